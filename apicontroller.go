@@ -0,0 +1,257 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// apiMaxBody is the largest request body the JSON API accepts.
+const apiMaxBody = 1 << 20
+
+// API list pages hold apiPerPage recipes unless per_page asks for up to
+// apiMaxPerPage.
+const (
+	apiPerPage    = 20
+	apiMaxPerPage = 100
+)
+
+// apiWriter marks a response to a JSON API request, so that errors are
+// rendered as JSON rather than as HTML pages.
+type apiWriter struct {
+	http.ResponseWriter
+}
+
+// Flush passes flushes through to the underlying writer, so that
+// streamed responses go out as they are written.
+func (w *apiWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// isAPI reports whether w is answering a JSON API request.
+func isAPI(w http.ResponseWriter) bool {
+	_, ok := w.(*apiWriter)
+	return ok
+}
+
+// APIAction is Action for the JSON API: errors, including those rendered
+// by Require, CheckCSRF and Throttle, are sent as {"error": message}.
+func (c *RBController) APIAction(a Action) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w = &apiWriter{w}
+		if err := a(w, r); err != nil {
+			c.renderActionError(w, err)
+		}
+	})
+}
+
+// MethodNotAllowed answers requests to a route with a method it doesn't
+// support, listing the ones it does.
+func (c *RBController) MethodNotAllowed(allow string) Action {
+	return Action(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Allow", allow)
+		c.RenderError(w, http.StatusMethodNotAllowed,
+			r.Method+" is not allowed here; use "+allow)
+		return nil
+	})
+}
+
+// apiRecipe gets the recipe named by the id route variable. If there is
+// no such recipe it answers 404, or 301 if it was merged into another,
+// and returns nil.
+func (c *RBController) apiRecipe(w http.ResponseWriter, r *http.Request) (*Recipe, error) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	recipe, err := c.GetRecipe(id)
+	if err == sql.ErrNoRows {
+		if moved, err := c.redirectMerged(w, r, id); moved || err != nil {
+			return nil, err
+		}
+		c.RenderError(w, http.StatusNotFound, "no recipe has id "+strconv.Itoa(id))
+		return nil, nil
+	}
+	return recipe, err
+}
+
+// decodeRecipe reads a JSON recipe from the request body into recipe,
+// leaving fields missing from the body as they were. Bodies that aren't
+// a JSON recipe get a 400 and decodeRecipe returns false.
+func (c *RBController) decodeRecipe(w http.ResponseWriter, r *http.Request, recipe *Recipe) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(recipe); err != nil {
+		c.RenderError(w, http.StatusBadRequest, "the body must be a JSON recipe: "+err.Error())
+		return false
+	}
+	recipe.Tags = ParseTags(strings.Join(recipe.Tags, ";"))
+	return true
+}
+
+// validRecipe answers 422 with the problems of an invalid recipe, and
+// reports whether the recipe was valid.
+func (c *RBController) validRecipe(w http.ResponseWriter, recipe *Recipe) bool {
+	problems := recipe.Validate()
+	if len(problems) == 0 {
+		return true
+	}
+	c.JSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+		"error":  "the recipe is invalid",
+		"fields": problems,
+	})
+	return false
+}
+
+// editableRecipe gets the recipe named by the id route variable, if the
+// current user may change it. Otherwise it answers 404 or 403 and
+// returns nil.
+func (c *RBController) editableRecipe(w http.ResponseWriter, r *http.Request) (*Recipe, *User, error) {
+	user, err := c.CurrentUser(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	recipe, err := c.apiRecipe(w, r)
+	if recipe == nil || err != nil {
+		return nil, nil, err
+	}
+	if !user.CanEdit(recipe) {
+		c.Forbidden(w)
+		return nil, nil, nil
+	}
+	return recipe, user, nil
+}
+
+// APIRecipes lists recipes page by page as JSON, filtered like the
+// /recipes/ page by q, cuisine, meal, season and tag. per_page sets the
+// page size, up to 100.
+func (c *RBController) APIRecipes(w http.ResponseWriter, r *http.Request) (err error) {
+	page, _ := strconv.Atoi(r.FormValue(`page`))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(r.FormValue(`per_page`))
+	if perPage < 1 {
+		perPage = apiPerPage
+	} else if perPage > apiMaxPerPage {
+		perPage = apiMaxPerPage
+	}
+
+	recipes, total, err := c.BrowseRecipes(parseBrowseFilter(r).search(),
+		perPage, (page-1)*perPage)
+	if err != nil {
+		return
+	}
+	c.JSON(w, http.StatusOK, map[string]interface{}{
+		"recipes":  recipes,
+		"total":    total,
+		"page":     page,
+		"per_page": perPage,
+	})
+	return nil
+}
+
+// APIRecipe renders one recipe as JSON.
+func (c *RBController) APIRecipe(w http.ResponseWriter, r *http.Request) (err error) {
+	recipe, err := c.apiRecipe(w, r)
+	if recipe != nil {
+		c.JSON(w, http.StatusOK, recipe)
+	}
+	return
+}
+
+// APICreateRecipe creates a recipe from a JSON body, answering 201 with
+// the new recipe and its URL in the Location header.
+func (c *RBController) APICreateRecipe(w http.ResponseWriter, r *http.Request) (err error) {
+	user, err := c.CurrentUser(r)
+	if err != nil {
+		return
+	}
+	recipe := new(Recipe)
+	if !c.decodeRecipe(w, r, recipe) || !c.validRecipe(w, recipe) {
+		return nil
+	}
+	return c.createRecipe(w, r, user, recipe)
+}
+
+// createRecipe saves a new recipe owned by user, answering 201 with the
+// saved recipe and its URL in the Location header.
+func (c *RBController) createRecipe(w http.ResponseWriter, r *http.Request,
+	user *User, recipe *Recipe) error {
+	recipe.Owner = user.ID
+	id, err := c.RecipeDB.NewRecipe(recipe, c.actor(r, user))
+	if err != nil {
+		return err
+	}
+	c.Stats.Invalidate()
+
+	created, err := c.GetRecipe(id)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Location", "/api/v1/recipes/"+strconv.Itoa(id))
+	c.JSON(w, http.StatusCreated, created)
+	return nil
+}
+
+// APIReplaceRecipe replaces a recipe with a JSON body. Fields missing
+// from the body are cleared.
+func (c *RBController) APIReplaceRecipe(w http.ResponseWriter, r *http.Request) (err error) {
+	return c.apiSaveRecipe(w, r, false)
+}
+
+// APIPatchRecipe changes only the fields of a recipe given in a JSON body.
+func (c *RBController) APIPatchRecipe(w http.ResponseWriter, r *http.Request) (err error) {
+	return c.apiSaveRecipe(w, r, true)
+}
+
+// apiSaveRecipe updates a recipe from a JSON body, on top of the saved
+// recipe when patching and from scratch otherwise.
+func (c *RBController) apiSaveRecipe(w http.ResponseWriter, r *http.Request, patch bool) error {
+	existing, user, err := c.editableRecipe(w, r)
+	if existing == nil || err != nil {
+		return err
+	}
+	recipe := new(Recipe)
+	if patch {
+		*recipe = *existing
+	}
+	if !c.decodeRecipe(w, r, recipe) || !c.validRecipe(w, recipe) {
+		return nil
+	}
+	// the id and owner can't be changed through the API
+	recipe.ID = existing.ID
+	recipe.Owner = existing.Owner
+	if err = c.RecipeDB.UpdateRecipe(recipe, c.actor(r, user)); err != nil {
+		return err
+	}
+	c.Stats.Invalidate()
+
+	updated, err := c.GetRecipe(recipe.ID)
+	if err != nil {
+		return err
+	}
+	c.JSON(w, http.StatusOK, updated)
+	return nil
+}
+
+// APIDeleteRecipe deletes a recipe, answering 204.
+func (c *RBController) APIDeleteRecipe(w http.ResponseWriter, r *http.Request) (err error) {
+	recipe, user, err := c.editableRecipe(w, r)
+	if recipe == nil || err != nil {
+		return
+	}
+	err = c.RecipeDB.DeleteRecipe(recipe.ID, c.actor(r, user))
+	if err == sql.ErrNoRows {
+		// deleted by someone else in the meantime
+		c.RenderError(w, http.StatusNotFound, "no recipe has id "+strconv.Itoa(recipe.ID))
+		return nil
+	} else if err != nil {
+		return
+	}
+	c.Stats.Invalidate()
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
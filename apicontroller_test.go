@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestRecipeValidate tests that recipes are checked field by field.
+func TestRecipeValidate(t *testing.T) {
+	recipe := &Recipe{Name: "Fufu", Description: "Pounded cassava",
+		Ingredientlist: "cassava; plantain", Instructions: "Pound.",
+		Mealtype: 4, Season: 9, Year: 1998}
+	if problems := recipe.Validate(); len(problems) != 0 {
+		t.Errorf("Validate() = %v, expected no problems", problems)
+	}
+
+	recipe.Name = " "
+	recipe.Mealtype = 8
+	recipe.Year = 1950
+	problems := recipe.Validate()
+	for _, field := range []string{"name", "mealtype", "year"} {
+		if problems[field] == "" {
+			t.Errorf("Validate() didn't complain about %s", field)
+		}
+	}
+	if len(problems) != 3 {
+		t.Errorf("Validate() = %v, expected 3 problems", problems)
+	}
+}
+
+// TestAPIErrors tests that API errors are JSON rather than HTML pages.
+func TestAPIErrors(t *testing.T) {
+	c := &RBController{Render: NewRenderer()}
+
+	req, _ := http.NewRequest("POST", "/api/v1/recipes", nil)
+	w := httptest.NewRecorder()
+	c.APIAction(c.Require(RoleContributor, c.MockAction(nil))).ServeHTTP(w, req)
+	var body map[string]string
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Require returned %v, expected %v", w.Code, http.StatusUnauthorized)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["error"] == "" {
+		t.Errorf("Require returned %q, expected a JSON error", w.Body.String())
+	}
+
+	req, _ = http.NewRequest("TRACE", "/api/v1/recipes", nil)
+	w = httptest.NewRecorder()
+	c.APIAction(c.MethodNotAllowed("GET, HEAD, POST")).ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD, POST" {
+		t.Errorf("MethodNotAllowed returned %v with Allow %q", w.Code,
+			w.Header().Get("Allow"))
+	}
+}
+
+// flushRecorder records what had been written at each flush.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed []string
+}
+
+func (w *flushRecorder) Flush() {
+	w.flushed = append(w.flushed, w.Body.String())
+}
+
+// TestAPIFlush tests that API responses can be flushed a batch at a time,
+// as streamRecipes does.
+func TestAPIFlush(t *testing.T) {
+	c := &RBController{Render: NewRenderer()}
+	batches := []string{"{\"id\":1}\n", "{\"id\":2}\n", "{\"id\":3}\n"}
+	stream := Action(func(w http.ResponseWriter, r *http.Request) error {
+		for _, batch := range batches {
+			w.Write([]byte(batch))
+			f, ok := w.(http.Flusher)
+			if !ok {
+				t.Fatalf("%T isn't an http.Flusher", w)
+			}
+			f.Flush()
+		}
+		return nil
+	})
+
+	req, _ := http.NewRequest("GET", "/recipes/jsonsearch/", nil)
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	c.APIAction(stream).ServeHTTP(w, req)
+	if len(w.flushed) != len(batches) {
+		t.Fatalf("flushed %d times, expected %d", len(w.flushed), len(batches))
+	}
+	sent := ""
+	for i, batch := range batches {
+		sent += batch
+		if w.flushed[i] != sent {
+			t.Errorf("flush %d sent %q, expected %q", i+1, w.flushed[i], sent)
+		}
+	}
+}
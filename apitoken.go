@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"github.com/gorilla/context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Token scopes. Read tokens may only make GET, HEAD and OPTIONS requests.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// apiTokenPrefix starts every API token, to make leaked tokens easy to spot.
+const apiTokenPrefix = "rbx_"
+
+// APIToken is a personal token for using the JSON API without a browser
+// login. Only a hash of the token is stored.
+type APIToken struct {
+	ID       int        `json:"id"`
+	UserID   int        `json:"user_id" db:"user_id"`
+	Name     string     `json:"name"`
+	Scope    string     `json:"scope"`
+	Hash     string     `json:"-"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"last_used" db:"last_used"`
+}
+
+// Allows reports whether the token's scope permits the request method.
+func (token *APIToken) Allows(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return token.Scope == ScopeWrite
+}
+
+// HashAPIToken returns the stored form of a token. Tokens are long and
+// random, so a plain SHA-256 is enough.
+func HashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewAPITokenSecret makes a fresh random token.
+func NewAPITokenSecret() (string, error) {
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + secret, nil
+}
+
+// bearerToken returns the token in the request's Authorization header,
+// and whether the request had a bearer Authorization header at all.
+func bearerToken(r *http.Request) (token string, ok bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
+}
+
+// authenticateToken finds the user owning the request's bearer token.
+func (c *RBController) authenticateToken(r *http.Request, secret string) (*User, error) {
+	token, err := c.GetAPITokenByHash(HashAPIToken(secret))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	user, err := c.GetUser(token.UserID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = c.TouchAPIToken(token.ID); err != nil {
+		return nil, err
+	}
+	context.Set(r, tokenKey, token)
+	return user, nil
+}
+
+// CurrentToken returns the API token the request was authenticated
+// with, or nil if it wasn't made with a token.
+func (c *RBController) CurrentToken(r *http.Request) (*APIToken, error) {
+	if _, err := c.CurrentUser(r); err != nil {
+		return nil, err
+	}
+	token, _ := context.Get(r, tokenKey).(*APIToken)
+	return token, nil
+}
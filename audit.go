@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Audit log actions
+const (
+	AuditRecipeCreate = "recipe.create"
+	AuditRecipeUpdate = "recipe.update"
+	AuditRecipeDelete = "recipe.delete"
+	AuditRecipeMerge  = "recipe.merge"
+	AuditUserRole     = "user.role"
+)
+
+// AuditEntry is one row of the append-only audit log, recording who
+// changed what and how.
+type AuditEntry struct {
+	ID        int       `json:"id"`
+	Actor     int       `json:"actor"`
+	ActorName string    `json:"actor_name" db:"actor_name"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	Before    string    `json:"before"`
+	After     string    `json:"after"`
+	IP        string    `json:"ip"`
+	Created   time.Time `json:"created"`
+}
+
+// Actor identifies who is making a change, for the audit log.
+type Actor struct {
+	UserID int
+	Name   string
+	IP     string
+}
+
+// actor returns the Actor for a request made by user.
+func (c *RBController) actor(r *http.Request, user *User) Actor {
+	actor := Actor{IP: c.ClientIP(r)}
+	if user != nil {
+		actor.UserID = user.ID
+		actor.Name = user.Email
+	}
+	return actor
+}
+
+// recipeTarget names a recipe as the target of an audit entry.
+func recipeTarget(id int) string {
+	return fmt.Sprintf("recipe:%d", id)
+}
+
+// userTarget names a user as the target of an audit entry.
+func userTarget(id int) string {
+	return fmt.Sprintf("user:%d", id)
+}
+
+// AuditFilter narrows down the audit log. Zero fields match everything.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	From   time.Time
+	To     time.Time
+}
+
+// auditSummaryLen is the longest a field gets in a before/after summary.
+const auditSummaryLen = 80
+
+// summarize shortens a value for an audit summary. It cuts by letter,
+// since Postgres refuses a string cut inside one.
+func summarize(value string) string {
+	value = strings.Join(strings.Fields(value), " ")
+	if runes := []rune(value); len(runes) > auditSummaryLen {
+		value = string(runes[:auditSummaryLen]) + "..."
+	}
+	return value
+}
+
+// recipeFields lists a recipe's fields in the order they are summarized.
+func recipeFields(recipe *Recipe) [][2]string {
+	return [][2]string{
+		{"name", recipe.Name},
+		{"description", recipe.Description},
+		{"cuisine", fmt.Sprint(recipe.Cuisine)},
+		{"mealtype", fmt.Sprint(recipe.Mealtype)},
+		{"season", fmt.Sprint(recipe.Season)},
+		{"ingredientlist", recipe.Ingredientlist},
+		{"instructions", recipe.Instructions},
+		{"yield", recipe.Yield},
+		{"contributor", recipe.Contributor},
+		{"country", recipe.Country},
+		{"community", recipe.Community},
+		{"year", fmt.Sprint(recipe.Year)},
+		{"story", recipe.Story},
+		{"tags", strings.Join(recipe.Tags, "; ")},
+	}
+}
+
+// DiffRecipes summarizes the fields that differ between two versions of
+// a recipe. A nil before summarizes every field of after.
+func DiffRecipes(before, after *Recipe) (beforeSummary, afterSummary string) {
+	var oldFields [][2]string
+	if before != nil {
+		oldFields = recipeFields(before)
+	}
+	var changedBefore, changedAfter []string
+	for i, field := range recipeFields(after) {
+		if oldFields != nil && oldFields[i][1] == field[1] {
+			continue
+		}
+		if oldFields != nil {
+			changedBefore = append(changedBefore,
+				field[0]+": "+summarize(oldFields[i][1]))
+		}
+		changedAfter = append(changedAfter, field[0]+": "+summarize(field[1]))
+	}
+	return strings.Join(changedBefore, "; "), strings.Join(changedAfter, "; ")
+}
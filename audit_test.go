@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// TestDiffRecipes tests that audit summaries only list changed fields.
+func TestDiffRecipes(t *testing.T) {
+	old := &Recipe{Name: "Toast", Cuisine: 1, Instructions: "Toast it"}
+	edited := *old
+	edited.Name = "Toasted Toast"
+	edited.Instructions = strings.Repeat("toast ", 50)
+
+	before, after := DiffRecipes(old, &edited)
+	if before != "name: Toast; instructions: Toast it" {
+		t.Errorf("before summary = %q", before)
+	}
+	if !strings.HasPrefix(after, "name: Toasted Toast; instructions: toast") ||
+		!strings.HasSuffix(after, "...") {
+		t.Errorf("after summary = %q", after)
+	}
+
+	before, after = DiffRecipes(nil, old)
+	if before != "" || !strings.Contains(after, "cuisine: 1") {
+		t.Errorf("new recipe summary = %q, %q", before, after)
+	}
+}
+
+// TestSummarizeUnicode tests that summaries are cut between letters, not
+// inside one.
+func TestSummarizeUnicode(t *testing.T) {
+	// the 80th letter is an é, which takes two bytes
+	value := strings.Repeat("a", 79) + "éñ and more"
+	got := summarize(value)
+	if !utf8.ValidString(got) {
+		t.Fatalf("summarize(%q) = %q, which isn't valid UTF-8", value, got)
+	}
+	if want := strings.Repeat("a", 79) + "é..."; got != want {
+		t.Errorf("summarize(%q) = %q, expected %q", value, got, want)
+	}
+	if short := "Crêpes Suzette"; summarize(short) != short {
+		t.Errorf("summarize(%q) = %q, expected it unchanged", short, summarize(short))
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// auditPageSize is the number of entries shown per page of the audit log.
+const auditPageSize = 50
+
+// auditDateFormat is the format of the from and to filters.
+const auditDateFormat = "2006-01-02"
+
+// parseAuditFilter reads an AuditFilter from a request's query string.
+// Dates that don't parse are ignored.
+func parseAuditFilter(r *http.Request) AuditFilter {
+	filter := AuditFilter{
+		Actor:  strings.TrimSpace(r.FormValue(`actor`)),
+		Action: strings.TrimSpace(r.FormValue(`action`)),
+		Target: strings.TrimSpace(r.FormValue(`target`)),
+	}
+	filter.From, _ = time.Parse(auditDateFormat, r.FormValue(`from`))
+	filter.To, _ = time.Parse(auditDateFormat, r.FormValue(`to`))
+	return filter
+}
+
+// query turns the filter back into a query string.
+func (filter AuditFilter) query() url.Values {
+	values := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	set("actor", filter.Actor)
+	set("action", filter.Action)
+	set("target", filter.Target)
+	if !filter.From.IsZero() {
+		set("from", filter.From.Format(auditDateFormat))
+	}
+	if !filter.To.IsZero() {
+		set("to", filter.To.Format(auditDateFormat))
+	}
+	return values
+}
+
+// AdminAudit shows a page of the audit log, filtered by the actor,
+// action, target, from and to query parameters.
+func (c *RBController) AdminAudit(w http.ResponseWriter, r *http.Request) (err error) {
+	filter := parseAuditFilter(r)
+	page, _ := strconv.Atoi(r.FormValue(`page`))
+	if page < 1 {
+		page = 1
+	}
+
+	// get one extra entry to see whether there is a next page
+	entries, err := c.GetAuditLog(filter, auditPageSize+1,
+		(page-1)*auditPageSize)
+	if err != nil {
+		return
+	}
+	more := len(entries) > auditPageSize
+	if more {
+		entries = entries[:auditPageSize]
+	}
+
+	pageURL := func(n int) string {
+		values := filter.query()
+		values.Set("page", strconv.Itoa(n))
+		return "/admin/audit/?" + values.Encode()
+	}
+	data := struct {
+		Entries []*AuditEntry
+		Filter  AuditFilter
+		Actions []string
+		Export  string
+		Prev    string
+		Next    string
+	}{
+		Entries: entries,
+		Filter:  filter,
+		Actions: []string{AuditRecipeCreate, AuditRecipeUpdate, AuditRecipeDelete,
+			AuditRecipeMerge, AuditUserRole},
+		Export: filter.query().Encode(),
+	}
+	if page > 1 {
+		data.Prev = pageURL(page - 1)
+	}
+	if more {
+		data.Next = pageURL(page + 1)
+	}
+	c.HTML(w, http.StatusOK, "admin/audit", data)
+	return nil
+}
+
+// AdminAuditExport downloads every audit log entry matching the filter
+// as CSV, or as JSON with format=json.
+func (c *RBController) AdminAuditExport(w http.ResponseWriter, r *http.Request) (err error) {
+	entries, err := c.GetAuditLog(parseAuditFilter(r), 0, 0)
+	if err != nil {
+		return
+	}
+	filename := "audit-" + time.Now().Format(auditDateFormat)
+
+	if r.FormValue(`format`) == "json" {
+		w.Header().Set("Content-Disposition",
+			`attachment; filename="`+filename+`.json"`)
+		if entries == nil {
+			entries = []*AuditEntry{}
+		}
+		c.JSON(w, http.StatusOK, entries)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=UTF-8")
+	w.Header().Set("Content-Disposition",
+		`attachment; filename="`+filename+`.csv"`)
+	out := csv.NewWriter(w)
+	out.Write([]string{"id", "created", "actor", "actor_name", "action",
+		"target", "before", "after", "ip"})
+	for _, entry := range entries {
+		out.Write([]string{strconv.Itoa(entry.ID),
+			entry.Created.Format(time.RFC3339), strconv.Itoa(entry.Actor),
+			entry.ActorName, entry.Action, entry.Target, entry.Before,
+			entry.After, entry.IP})
+	}
+	out.Flush()
+	return out.Error()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/jmoiron/sqlx"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// insertAudit appends an entry to the audit log, inside the transaction
+// making the change when there is one.
+func insertAudit(e sqlx.Execer, entry *AuditEntry) (err error) {
+	insert := `INSERT INTO audit_log ` +
+		`(actor, actor_name, action, target, before, after, ip) ` +
+		`VALUES ($1,$2,$3,$4,$5,$6,$7)`
+	_, err = e.Exec(insert, entry.Actor, entry.ActorName, entry.Action,
+		entry.Target, entry.Before, entry.After, entry.IP)
+	return
+}
+
+// GetAuditLog gets up to limit audit entries matching filter, newest
+// first, skipping the first offset. A limit of 0 gets every entry.
+func (recipeDB *RecipeDB) GetAuditLog(filter AuditFilter, limit,
+	offset int) (entries []*AuditEntry, err error) {
+	var args []interface{}
+	where := ""
+	add := func(clause string, arg interface{}) {
+		args = append(args, arg)
+		where += " AND " + clause + "$" + strconv.Itoa(len(args))
+	}
+
+	if filter.Actor != "" {
+		add("lower(actor_name) LIKE ", "%"+strings.ToLower(filter.Actor)+"%")
+	}
+	if filter.Action != "" {
+		add("action=", filter.Action)
+	}
+	if filter.Target != "" {
+		add("target=", filter.Target)
+	}
+	if !filter.From.IsZero() {
+		add("created >= ", filter.From)
+	}
+	if !filter.To.IsZero() {
+		// To is a day, so include all of it
+		add("created < ", filter.To.Add(24*time.Hour))
+	}
+
+	query := `SELECT * FROM audit_log WHERE true` + where +
+		` ORDER BY created DESC, id DESC`
+	if limit > 0 {
+		query += ` LIMIT ` + strconv.Itoa(limit) +
+			` OFFSET ` + strconv.Itoa(offset)
+	}
+	err = recipeDB.DB.Select(&entries, query, args...)
+	return
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/gorilla/context"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// context keys for per-request authentication state
+type authKey int
+
+const (
+	userKey authKey = iota
+	sessionKey
+	tokenKey
+)
+
+// sessionUserKey is the session value holding the logged in user's id.
+const sessionUserKey = "user"
+
+// CurrentUser returns the user making the request, or nil if the
+// request is anonymous. The user is looked up once per request.
+func (c *RBController) CurrentUser(r *http.Request) (user *User, err error) {
+	if cached, ok := context.GetOk(r, userKey); ok {
+		return cached.(*User), nil
+	}
+	if c.RecipeDB != nil {
+		user, err = c.authenticate(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	context.Set(r, userKey, user)
+	return
+}
+
+// authenticate finds the user owning the request's API token or, for
+// requests without one, the user logged in to the request's session,
+// falling back to HTTP basic auth credentials for scripts.
+func (c *RBController) authenticate(r *http.Request) (*User, error) {
+	if secret, ok := bearerToken(r); ok {
+		return c.authenticateToken(r, secret)
+	}
+
+	session, err := c.existingSession(r)
+	if err != nil {
+		return nil, err
+	}
+	if session != nil && session.Values[sessionUserKey] != "" {
+		id, _ := strconv.Atoi(session.Values[sessionUserKey])
+		user, err := c.GetUser(id)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return user, err
+	}
+
+	email, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	if err = c.throttleLogin(r, email); err != nil {
+		return nil, err
+	}
+	return c.checkLogin(email, password)
+}
+
+// checkLogin returns the user with the given email and password, or nil
+// if there is no such user.
+func (c *RBController) checkLogin(email, password string) (*User, error) {
+	user, err := c.GetUserByEmail(email)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	match, err := CheckPassword(user.Password, password)
+	if err != nil || !match {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Require wraps an action so that it only runs for users holding at
+// least the given role. Anonymous users are asked to log in, and users
+// without the role get a 403 page.
+// for example, use c.Action(c.Require(RoleAdmin, c.AdminUsers)).
+func (c *RBController) Require(role Role, a Action) Action {
+	return Action(func(w http.ResponseWriter, r *http.Request) error {
+		user, err := c.CurrentUser(r)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			c.Unauthorized(w, r)
+			return nil
+		}
+		if !user.Role.Includes(role) {
+			c.Forbidden(w)
+			return nil
+		}
+		if token, _ := context.Get(r, tokenKey).(*APIToken); token != nil &&
+			!token.Allows(r.Method) {
+			c.RenderError(w, http.StatusForbidden,
+				"Sorry, this API token may only read.")
+			return nil
+		}
+		return a(w, r)
+	})
+}
+
+// Unauthorized asks an anonymous user to log in, sending them to the
+// login page when sessions are enabled. Requests with a bad API token
+// and JSON API requests get a JSON error instead.
+func (c *RBController) Unauthorized(w http.ResponseWriter, r *http.Request) {
+	if _, ok := bearerToken(r); ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="RecipeBox"`)
+		c.JSON(w, http.StatusUnauthorized,
+			map[string]string{"error": "invalid or revoked API token"})
+		return
+	}
+	if isAPI(w) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="RecipeBox"`)
+		c.JSON(w, http.StatusUnauthorized,
+			map[string]string{"error": "an API token is required"})
+		return
+	}
+	if c.Sessions != nil {
+		next := url.Values{"next": {r.URL.RequestURI()}}
+		http.Redirect(w, r, "/login/?"+next.Encode(), http.StatusFound)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="RecipeBox"`)
+	c.RenderError(w, http.StatusUnauthorized,
+		"Please log in to see this page.")
+}
+
+// Forbidden renders a 403 page for users lacking permission.
+func (c *RBController) Forbidden(w http.ResponseWriter) {
+	c.RenderError(w, http.StatusForbidden,
+		"Sorry, you don't have permission to do that.")
+}
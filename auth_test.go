@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestCanEdit tests that contributors may only edit their own recipes
+// while editors and above may edit anything.
+func TestCanEdit(t *testing.T) {
+	recipe := &Recipe{ID: 1, Owner: 7}
+	cases := []struct {
+		user *User
+		want bool
+	}{
+		{nil, false},
+		{&User{ID: 7, Role: RoleViewer}, false},
+		{&User{ID: 7, Role: RoleContributor}, true},
+		{&User{ID: 8, Role: RoleContributor}, false},
+		{&User{ID: 8, Role: RoleEditor}, true},
+		{&User{ID: 8, Role: RoleAdmin}, true},
+	}
+	for _, tc := range cases {
+		if got := tc.user.CanEdit(recipe); got != tc.want {
+			t.Errorf("CanEdit(%+v) = %v, expected %v", tc.user, got, tc.want)
+		}
+	}
+}
+
+// TestPassword tests that hashed passwords can be checked.
+func TestPassword(t *testing.T) {
+	hash, err := HashPassword("hunter22")
+	if err != nil {
+		t.Fatalf("HashPassword failed: %v", err)
+	}
+	if ok, err := CheckPassword(hash, "hunter22"); !ok || err != nil {
+		t.Errorf("CheckPassword rejected the right password: %v", err)
+	}
+	if ok, _ := CheckPassword(hash, "hunter23"); ok {
+		t.Errorf("CheckPassword accepted the wrong password")
+	}
+	if _, err := CheckPassword("plaintext", "plaintext"); err == nil {
+		t.Errorf("CheckPassword accepted a malformed hash")
+	}
+}
+
+// TestRequire tests that Require turns away anonymous users.
+func TestRequire(t *testing.T) {
+	c := &RBController{Render: NewRenderer(), RecipeDB: nil}
+
+	req, _ := http.NewRequest("GET", "", nil)
+	w := httptest.NewRecorder()
+	handler := c.Action(c.Require(RoleViewer, c.MockAction(nil)))
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Require returned %v, expected %v", w.Code,
+			http.StatusUnauthorized)
+	}
+	if w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Require didn't ask for credentials")
+	}
+}
+
+// TestAPITokenScope tests that read tokens may only read.
+func TestAPITokenScope(t *testing.T) {
+	read := &APIToken{Scope: ScopeRead}
+	write := &APIToken{Scope: ScopeWrite}
+	if !read.Allows("GET") || read.Allows("POST") || read.Allows("DELETE") {
+		t.Errorf("read token allows the wrong methods")
+	}
+	if !write.Allows("GET") || !write.Allows("POST") {
+		t.Errorf("write token doesn't allow writing")
+	}
+}
+
+// TestBearerToken tests parsing of Authorization headers.
+func TestBearerToken(t *testing.T) {
+	req, _ := http.NewRequest("GET", "", nil)
+	if _, ok := bearerToken(req); ok {
+		t.Errorf("bearerToken found a token without a header")
+	}
+	req.Header.Set("Authorization", "bearer rbx_abc")
+	if token, ok := bearerToken(req); !ok || token != "rbx_abc" {
+		t.Errorf("bearerToken = %q, %v, expected rbx_abc", token, ok)
+	}
+
+	// a bad token gets a JSON error rather than a login page
+	c := &RBController{Render: NewRenderer(), RecipeDB: nil}
+	w := httptest.NewRecorder()
+	c.Action(c.Require(RoleViewer, c.MockAction(nil))).ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized ||
+		w.Header().Get("Content-Type") != "application/json; charset=UTF-8" {
+		t.Errorf("bad token got %v %q", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+// TestLocalRedirect tests that logins only redirect to paths on the site.
+func TestLocalRedirect(t *testing.T) {
+	cases := map[string]string{
+		"/recipes/3/":           "/recipes/3/",
+		"/recipes/?q=stew":      "/recipes/?q=stew",
+		"":                      "/",
+		"recipes/":              "/",
+		"//evil.example/":       "/",
+		"/\\evil.example/":      "/",
+		"/\t/evil.example/":     "/",
+		"https://evil.example/": "/",
+		"javascript:alert(1)":   "/",
+	}
+	for next, want := range cases {
+		if got := localRedirect(next); got != want {
+			t.Errorf("localRedirect(%q) = %q, expected %q", next, got, want)
+		}
+	}
+}
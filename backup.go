@@ -0,0 +1,493 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Backups are zip archives holding a JSON file for each recipe, under
+// recipes/, the recipes' pictures under media/, and a manifest.
+const (
+	backupFormat   = "recipebox-backup"
+	backupManifest = "manifest.json"
+	// backupSchemaVersion is bumped when what is backed up changes, so
+	// that older servers refuse backups they would misread.
+	backupSchemaVersion = 1
+)
+
+// BackupManifest describes a backup, with a checksum of every media file.
+type BackupManifest struct {
+	Format        string        `json:"format"`
+	SchemaVersion int           `json:"schema_version"`
+	Created       time.Time     `json:"created"`
+	Recipes       int           `json:"recipes"`
+	Media         []BackupMedia `json:"media"`
+}
+
+// BackupMedia is a media file of a backup.
+type BackupMedia struct {
+	Path   string `json:"path"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// BackupRecipe is a recipe as backed up: its picture is the path of a
+// media file, and its owner is also given by email, since user ids
+// differ between databases.
+type BackupRecipe struct {
+	*Recipe
+	Picture    string `json:"picture,omitempty"`
+	OwnerEmail string `json:"owner_email,omitempty"`
+}
+
+// BackupWriter writes a backup, a recipe at a time.
+type BackupWriter struct {
+	archive  *zip.Writer
+	manifest BackupManifest
+}
+
+// NewBackupWriter starts a backup written to w.
+func NewBackupWriter(w io.Writer) *BackupWriter {
+	return &BackupWriter{archive: zip.NewWriter(w), manifest: BackupManifest{
+		Format: backupFormat, SchemaVersion: backupSchemaVersion,
+		Created: time.Now().UTC(), Media: []BackupMedia{}}}
+}
+
+func (backup *BackupWriter) write(name string, data []byte) error {
+	w, err := backup.archive.Create(name)
+	if err == nil {
+		_, err = w.Write(data)
+	}
+	return err
+}
+
+// Add backs up a recipe, and its picture, owned by the user with the
+// given email.
+func (backup *BackupWriter) Add(recipe *Recipe, ownerEmail string) error {
+	record := &BackupRecipe{Recipe: recipe, OwnerEmail: ownerEmail}
+	if len(recipe.Picture) > 0 {
+		extension := "bin"
+		if _, format, err := image.DecodeConfig(bytes.NewReader(recipe.Picture)); err == nil {
+			extension = format
+		}
+		record.Picture = "media/recipe-" + strconv.Itoa(recipe.ID) + "." + extension
+		sum := sha256.Sum256(recipe.Picture)
+		backup.manifest.Media = append(backup.manifest.Media, BackupMedia{
+			Path: record.Picture, Size: len(recipe.Picture), SHA256: hex.EncodeToString(sum[:])})
+		if err := backup.write(record.Picture, recipe.Picture); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	backup.manifest.Recipes++
+	return backup.write("recipes/"+strconv.Itoa(recipe.ID)+".json", data)
+}
+
+// Close writes the manifest and finishes the backup.
+func (backup *BackupWriter) Close() error {
+	data, err := json.MarshalIndent(&backup.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = backup.write(backupManifest, data); err != nil {
+		return err
+	}
+	return backup.archive.Close()
+}
+
+// Backup is a backup read for restoring. Its recipes are checked, but
+// their pictures are only loaded by Picture, to keep memory down.
+type Backup struct {
+	Manifest BackupManifest
+	Recipes  []*BackupRecipe
+	files    map[string]*zip.File
+}
+
+// readZipFile reads a file of an archive.
+func readZipFile(file *zip.File) ([]byte, error) {
+	f, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// ReadBackup reads and checks a backup: its manifest must be one this
+// server understands, every recipe must be valid, and every media file
+// must match its checksum. Problems are returned along with the backup,
+// rather than as an error, so all of them can be reported.
+func ReadBackup(archive *zip.Reader) (backup *Backup, problems []string, err error) {
+	backup = &Backup{files: make(map[string]*zip.File)}
+	for _, file := range archive.File {
+		backup.files[file.Name] = file
+	}
+	manifest, ok := backup.files[backupManifest]
+	if !ok {
+		return nil, nil, fmt.Errorf("not a RecipeBox backup: there is no %s", backupManifest)
+	}
+	data, err := readZipFile(manifest)
+	if err == nil {
+		err = json.Unmarshal(data, &backup.Manifest)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading %s: %s", backupManifest, err)
+	}
+	if backup.Manifest.Format != backupFormat {
+		return nil, nil, fmt.Errorf("not a RecipeBox backup: the format is %q",
+			backup.Manifest.Format)
+	}
+	if backup.Manifest.SchemaVersion < 1 || backup.Manifest.SchemaVersion > backupSchemaVersion {
+		return nil, nil, fmt.Errorf("the backup has schema version %d, but this server "+
+			"reads versions 1 to %d", backup.Manifest.SchemaVersion, backupSchemaVersion)
+	}
+
+	media := make(map[string]BackupMedia)
+	for _, file := range backup.Manifest.Media {
+		media[file.Path] = file
+		zipped, ok := backup.files[file.Path]
+		if !ok {
+			problems = append(problems, file.Path+" is missing")
+			continue
+		}
+		f, err := zipped.Open()
+		if err != nil {
+			return nil, nil, err
+		}
+		hash := sha256.New()
+		size, err := io.Copy(hash, f)
+		f.Close()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s can't be read: %s", file.Path, err))
+		} else if int(size) != file.Size || hex.EncodeToString(hash.Sum(nil)) != file.SHA256 {
+			problems = append(problems, file.Path+" doesn't match its checksum")
+		}
+	}
+
+	ids := make(map[int]bool)
+	for _, file := range archive.File {
+		if !strings.HasPrefix(file.Name, "recipes/") || !strings.HasSuffix(file.Name, ".json") {
+			continue
+		}
+		data, err := readZipFile(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		recipe := &BackupRecipe{Recipe: new(Recipe)}
+		if err = json.Unmarshal(data, recipe); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", file.Name, err))
+			continue
+		}
+		if recipe.ID <= 0 || ids[recipe.ID] {
+			problems = append(problems, fmt.Sprintf("%s: the id %d is taken or bad",
+				file.Name, recipe.ID))
+		}
+		ids[recipe.ID] = true
+		if recipe.Tags == nil {
+			recipe.Tags = []string{}
+		}
+		invalid := recipe.Validate()
+		fields := make([]string, 0, len(invalid))
+		for field := range invalid {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			problems = append(problems, fmt.Sprintf("%s: %s %s", file.Name, field, invalid[field]))
+		}
+		if _, ok := media[recipe.Picture]; recipe.Picture != "" && !ok {
+			problems = append(problems, fmt.Sprintf("%s: the picture %s isn't in the manifest",
+				file.Name, recipe.Picture))
+		}
+		backup.Recipes = append(backup.Recipes, recipe)
+	}
+	if len(backup.Recipes) != backup.Manifest.Recipes {
+		problems = append(problems, fmt.Sprintf("the manifest lists %d recipes, but "+
+			"the backup holds %d", backup.Manifest.Recipes, len(backup.Recipes)))
+	}
+	sort.Slice(backup.Recipes, func(i, j int) bool {
+		return backup.Recipes[i].ID < backup.Recipes[j].ID
+	})
+	return backup, problems, nil
+}
+
+// Picture loads a backed up recipe's picture, if it has one.
+func (backup *Backup) Picture(recipe *BackupRecipe) ([]byte, error) {
+	if recipe.Picture == "" {
+		return nil, nil
+	}
+	return readZipFile(backup.files[recipe.Picture])
+}
+
+// --------------------------------------------
+//                   DATABASE
+// --------------------------------------------
+
+// BackupRecipes writes every recipe, with its tags and picture, to a
+// backup, and returns how many there were.
+func (recipeDB *RecipeDB) BackupRecipes(backup *BackupWriter) (count int, err error) {
+	users, err := recipeDB.GetUsers()
+	if err != nil {
+		return
+	}
+	emails := make(map[int]string)
+	for _, user := range users {
+		emails[user.ID] = user.Email
+	}
+	all := RecipeSearch{Cuisine: -1, Mealtype: -1, Season: -1}
+	err = recipeDB.StreamRecipes(all, 100, func(recipes []*Recipe) error {
+		for _, recipe := range recipes {
+			if err := backup.Add(recipe, emails[recipe.Owner]); err != nil {
+				return err
+			}
+		}
+		count += len(recipes)
+		return nil
+	})
+	return
+}
+
+// RestoreRecipes loads a checked backup in one transaction. Into an
+// empty recipes table, recipes keep their ids; otherwise they are given
+// new ones. Owners are found by email, and recipes whose owner isn't a
+// user here are owned by no one. It returns the new id of each backed
+// up id, and the emails of missing owners.
+func (recipeDB *RecipeDB) RestoreRecipes(backup *Backup, actor Actor) (ids map[int]int,
+	missing []string, err error) {
+	tx, err := recipeDB.DB.Beginx()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// nothing may add recipes while we decide whether to keep ids
+	if _, err = tx.Exec(`LOCK TABLE recipes IN EXCLUSIVE MODE`); err != nil {
+		return
+	}
+	var existing int
+	if err = tx.QueryRowx(`SELECT count(*) FROM recipes`).Scan(&existing); err != nil {
+		return
+	}
+	keepIDs := existing == 0
+
+	owners := make(map[string]int)
+	ids = make(map[int]int)
+	for _, recipe := range backup.Recipes {
+		owner, known := owners[recipe.OwnerEmail]
+		if !known && recipe.OwnerEmail != "" {
+			err = tx.QueryRowx(`SELECT id FROM users WHERE lower(email)=lower($1)`,
+				recipe.OwnerEmail).Scan(&owner)
+			if err == sql.ErrNoRows {
+				owner, err = 0, nil
+				missing = append(missing, recipe.OwnerEmail)
+			} else if err != nil {
+				return
+			}
+			owners[recipe.OwnerEmail] = owner
+		}
+		restored := *recipe.Recipe
+		restored.Owner = owner
+		if restored.Picture, err = backup.Picture(recipe); err != nil {
+			return
+		}
+
+		columns := `name, description, cuisine, mealtype, season, ingredientlist, ` +
+			`instructions, owner, contributor, country, community, year, story, ` +
+			`yield, picture`
+		args := []interface{}{restored.Name, restored.Description, restored.Cuisine,
+			restored.Mealtype, restored.Season, restored.Ingredientlist,
+			restored.Instructions, restored.Owner, restored.Contributor,
+			restored.Country, restored.Community, restored.Year, restored.Story,
+			restored.Yield, restored.Picture}
+		if keepIDs {
+			columns += `, id`
+			args = append(args, restored.ID)
+		}
+		marks := make([]string, len(args))
+		for i := range args {
+			marks[i] = "$" + strconv.Itoa(i+1)
+		}
+		var id int
+		err = tx.QueryRowx(`INSERT INTO recipes (`+columns+`) VALUES (`+
+			strings.Join(marks, ",")+`) RETURNING id`, args...).Scan(&id)
+		if err != nil {
+			return
+		}
+		ids[recipe.ID] = id
+		if err = setTags(tx, id, restored.Tags); err != nil {
+			return
+		}
+		restored.Picture = nil
+		_, afterSummary := DiffRecipes(nil, &restored)
+		err = insertAudit(tx, &AuditEntry{Actor: actor.UserID,
+			ActorName: actor.Name, Action: AuditRecipeCreate,
+			Target: recipeTarget(id), After: afterSummary, IP: actor.IP})
+		if err != nil {
+			return
+		}
+	}
+	if keepIDs {
+		_, err = tx.Exec(`SELECT setval(pg_get_serial_sequence('recipes', 'id'), ` +
+			`(SELECT coalesce(max(id), 0) + 1 FROM recipes), false)`)
+		if err != nil {
+			return
+		}
+	}
+	err = tx.Commit()
+	return
+}
+
+// --------------------------------------------
+//                   COMMANDS
+// --------------------------------------------
+
+// ExportCommand runs `recipebox-server export`, which backs up every
+// recipe to a file. It returns the exit status.
+func ExportCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	output := flags.String("o", "recipebox-backup-"+time.Now().Format("20060102")+".zip",
+		"the `file` to write")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	fail := func(err error) int {
+		fmt.Fprintf(stderr, "export: %s\n", err)
+		return 1
+	}
+
+	recipeDB := ConnectToDB()
+	f, err := os.Create(*output)
+	if err != nil {
+		return fail(err)
+	}
+	backup := NewBackupWriter(f)
+	count, err := recipeDB.BackupRecipes(backup)
+	if err == nil {
+		err = backup.Close()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*output)
+		return fail(err)
+	}
+	fmt.Fprintf(stdout, "%d recipes backed up to %s.\n", count, *output)
+	return 0
+}
+
+// RestoreCommand runs `recipebox-server restore`, which checks a backup
+// and loads it. It returns the exit status.
+func RestoreCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	check := flags.Bool("check", false, "check the backup without restoring anything")
+	idMap := flags.String("id-map", "",
+		"write the backed up and restored id of each recipe to this CSV `file`")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: recipebox-server restore [flags] <backup.zip>\n\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	fail := func(err error) int {
+		fmt.Fprintf(stderr, "restore: %s\n", err)
+		return 1
+	}
+
+	archive, err := zip.OpenReader(flags.Arg(0))
+	if err != nil {
+		return fail(err)
+	}
+	defer archive.Close()
+	backup, problems, err := ReadBackup(&archive.Reader)
+	if err != nil {
+		return fail(err)
+	}
+	for _, problem := range problems {
+		fmt.Fprintln(stderr, problem)
+	}
+	if *check || len(problems) > 0 {
+		fmt.Fprintf(stdout, "%d recipes and %d media files checked, %d problems; "+
+			"nothing restored.\n", len(backup.Recipes), len(backup.Manifest.Media),
+			len(problems))
+		if len(problems) > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	recipeDB := ConnectToDB()
+	ids, missing, err := recipeDB.RestoreRecipes(backup,
+		Actor{Name: "recipebox-server restore"})
+	if err != nil {
+		return fail(fmt.Errorf("nothing restored: %s", err))
+	}
+	for _, email := range missing {
+		fmt.Fprintf(stderr, "no user %s here; their recipes are owned by no one\n", email)
+	}
+	kept := true
+	for old, id := range ids {
+		kept = kept && old == id
+	}
+	if kept {
+		fmt.Fprintf(stdout, "%d recipes restored with their ids.\n", len(ids))
+	} else {
+		fmt.Fprintf(stdout, "%d recipes restored with new ids.\n", len(ids))
+	}
+	// the id map is still written if related recipes can't be found
+	status := 0
+	if _, err = recipeDB.RebuildRelated(); err != nil {
+		fmt.Fprintf(stderr, "restore: related recipes weren't found again: %s; "+
+			"run recipebox-server related\n", err)
+		status = 1
+	}
+
+	if *idMap != "" {
+		f, err := os.Create(*idMap)
+		if err != nil {
+			return fail(err)
+		}
+		w := csv.NewWriter(f)
+		w.Write([]string{"backup_id", "id"})
+		for _, recipe := range backup.Recipes {
+			w.Write([]string{strconv.Itoa(recipe.ID), strconv.Itoa(ids[recipe.ID])})
+		}
+		w.Flush()
+		if err = w.Error(); err == nil {
+			err = f.Close()
+		}
+		if err != nil {
+			return fail(err)
+		}
+	}
+	return status
+}
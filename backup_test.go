@@ -0,0 +1,89 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"image"
+	"image/png"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readTestBackup reads a backup written to buf.
+func readTestBackup(t *testing.T, buf []byte) (*Backup, []string) {
+	archive, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, problems, err := ReadBackup(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backup, problems
+}
+
+// TestBackup tests that recipes and their pictures come back from a
+// backup as they went in, and that damaged backups are caught.
+func TestBackup(t *testing.T) {
+	var picture bytes.Buffer
+	png.Encode(&picture, image.NewGray(image.Rect(0, 0, 2, 2)))
+	recipes := []*Recipe{
+		{ID: 12, Name: "Mafé", Description: "Peanut stew", Mealtype: 4,
+			Ingredientlist: "peanuts", Instructions: "Stew.", Owner: 3,
+			Country: "Senegal", Tags: []string{"stew"}, Picture: picture.Bytes()},
+		{ID: 7, Name: "Fufu", Description: "Pounded cassava",
+			Ingredientlist: "cassava", Instructions: "Pound.", Tags: []string{}},
+	}
+	var buf bytes.Buffer
+	writer := NewBackupWriter(&buf)
+	for _, recipe := range recipes {
+		if err := writer.Add(recipe, map[int]string{3: "ama@example.org"}[recipe.Owner]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	backup, problems := readTestBackup(t, buf.Bytes())
+	if len(problems) > 0 {
+		t.Fatalf("ReadBackup() found problems %v", problems)
+	}
+	if len(backup.Recipes) != 2 || backup.Recipes[0].ID != 7 ||
+		backup.Recipes[1].OwnerEmail != "ama@example.org" ||
+		backup.Recipes[1].Picture != "media/recipe-12.png" {
+		t.Fatalf("ReadBackup() = %+v", backup.Recipes)
+	}
+	loaded, err := backup.Picture(backup.Recipes[1])
+	if err != nil || !bytes.Equal(loaded, picture.Bytes()) {
+		t.Errorf("Picture() = %v, %v", loaded, err)
+	}
+	restored := *backup.Recipes[1].Recipe
+	restored.Picture = loaded
+	if !reflect.DeepEqual(&restored, recipes[0]) {
+		t.Errorf("the backed up recipe is %+v, expected %+v", restored, recipes[0])
+	}
+
+	// damage the picture and drop a recipe's description
+	var damaged bytes.Buffer
+	archive, _ := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	copied := zip.NewWriter(&damaged)
+	for _, file := range archive.File {
+		data, _ := readZipFile(file)
+		if strings.HasPrefix(file.Name, "media/") {
+			data[len(data)-1]++
+		} else if file.Name == "recipes/7.json" {
+			data = bytes.Replace(data, []byte("Pounded cassava"), nil, 1)
+		}
+		w, _ := copied.Create(file.Name)
+		w.Write(data)
+	}
+	copied.Close()
+	_, problems = readTestBackup(t, damaged.Bytes())
+	expected := []string{"media/recipe-12.png doesn't match its checksum",
+		"recipes/7.json: description is required"}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("ReadBackup() found problems %q, expected %q", problems, expected)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// browsePageSize is the number of recipes shown per page of /recipes/.
+const browsePageSize = 20
+
+// browseFilter is the set of filters chosen on the browse page. Meal and
+// Season are names such as "Dinner", Cuisine is -1 for any cuisine, and
+// recipes must have every one of Tags.
+type browseFilter struct {
+	Query   string
+	Cuisine int
+	Meal    string
+	Season  string
+	Tags    []string
+}
+
+// FacetValue is one choice in a facet of the browse page. URL applies
+// the choice on top of the current filters, or removes it if Selected.
+type FacetValue struct {
+	Label    string
+	Count    int
+	URL      string
+	Selected bool
+}
+
+// parseBrowseFilter reads a browseFilter from a request's query string
+// or form.
+func parseBrowseFilter(r *http.Request) browseFilter {
+	r.ParseForm()
+	return browseFilterOf(r.Form)
+}
+
+// browseFilterOf reads a browseFilter from query parameters. Unknown
+// meals and seasons are ignored.
+func browseFilterOf(values url.Values) browseFilter {
+	filter := browseFilter{Query: strings.TrimSpace(values.Get(`q`)), Cuisine: -1}
+	if cuisine, err := strconv.Atoi(values.Get(`cuisine`)); err == nil {
+		filter.Cuisine = cuisine
+	}
+	if _, ok := MealsToInt[values.Get(`meal`)]; ok {
+		filter.Meal = values.Get(`meal`)
+	}
+	if _, ok := SeasonsToInt[values.Get(`season`)]; ok {
+		filter.Season = values.Get(`season`)
+	}
+	filter.Tags = ParseTags(strings.Join(values[`tag`], ";"))
+	return filter
+}
+
+// search turns the filter into a loose RecipeSearch.
+func (filter browseFilter) search() RecipeSearch {
+	search := RecipeSearch{Name: filter.Query, Cuisine: filter.Cuisine,
+		Mealtype: -1, Season: -1, Tags: filter.Tags}
+	if filter.Meal != "" {
+		search.Mealtype = MealsToInt[filter.Meal]
+	}
+	if filter.Season != "" {
+		search.Season = SeasonsToInt[filter.Season]
+	}
+	return search
+}
+
+// url turns the filter back into a link to the browse page.
+func (filter browseFilter) url(page int) string {
+	values := url.Values{}
+	if filter.Query != "" {
+		values.Set("q", filter.Query)
+	}
+	if filter.Cuisine != -1 {
+		values.Set("cuisine", strconv.Itoa(filter.Cuisine))
+	}
+	if filter.Meal != "" {
+		values.Set("meal", filter.Meal)
+	}
+	if filter.Season != "" {
+		values.Set("season", filter.Season)
+	}
+	for _, tag := range filter.Tags {
+		values.Add("tag", tag)
+	}
+	if page > 1 {
+		values.Set("page", strconv.Itoa(page))
+	}
+	if len(values) == 0 {
+		return "/recipes/"
+	}
+	return "/recipes/?" + values.Encode()
+}
+
+// hidden lists the filters other than the query, as name and value
+// pairs for hidden fields of the search form.
+func (filter browseFilter) hidden() [][2]string {
+	filter.Query = ""
+	values, _ := url.ParseQuery(strings.TrimPrefix(filter.url(1), "/recipes/?"))
+	fields := [][2]string{}
+	for _, name := range []string{"cuisine", "meal", "season", "tag"} {
+		for _, value := range values[name] {
+			fields = append(fields, [2]string{name, value})
+		}
+	}
+	return fields
+}
+
+// withTag returns a copy of the filter with tag added, or removed if
+// it was already chosen.
+func (filter browseFilter) withTag(tag string) browseFilter {
+	tags := []string{}
+	found := false
+	for _, t := range filter.Tags {
+		if t == tag {
+			found = true
+		} else {
+			tags = append(tags, t)
+		}
+	}
+	if !found {
+		tags = append(tags, tag)
+		sort.Strings(tags)
+	}
+	filter.Tags = tags
+	return filter
+}
+
+// bitFacet lists the choices for a meal or season facet in bit order.
+// Values no matching recipe has are left out unless they are selected.
+func bitFacet(names map[int]string, counts map[int]int, selected string,
+	choose func(name string) browseFilter) []FacetValue {
+	bits := make([]int, 0, len(names))
+	for bit := range names {
+		bits = append(bits, bit)
+	}
+	sort.Ints(bits)
+
+	values := []FacetValue{}
+	for _, bit := range bits {
+		name := names[bit]
+		if counts[bit] == 0 && name != selected {
+			continue
+		}
+		if name == selected {
+			name = ""
+		}
+		values = append(values, FacetValue{Label: names[bit], Count: counts[bit],
+			URL: choose(name).url(1), Selected: names[bit] == selected})
+	}
+	return values
+}
+
+// browseFacets builds the facet choices shown beside the browse results.
+func browseFacets(filter browseFilter, facets *Facets) map[string][]FacetValue {
+	cuisines := make([]int, 0, len(facets.Cuisine))
+	for cuisine := range facets.Cuisine {
+		cuisines = append(cuisines, cuisine)
+	}
+	if _, ok := facets.Cuisine[filter.Cuisine]; !ok && filter.Cuisine != -1 {
+		cuisines = append(cuisines, filter.Cuisine)
+	}
+	sort.Ints(cuisines)
+	cuisineValues := []FacetValue{}
+	for _, cuisine := range cuisines {
+		choice := filter
+		choice.Cuisine = cuisine
+		if cuisine == filter.Cuisine {
+			choice.Cuisine = -1
+		}
+		cuisineValues = append(cuisineValues, FacetValue{
+			Label: "Cuisine " + strconv.Itoa(cuisine), Count: facets.Cuisine[cuisine],
+			URL: choice.url(1), Selected: cuisine == filter.Cuisine})
+	}
+
+	// most used tags first
+	tags := make([]string, 0, len(facets.Tags))
+	for tag := range facets.Tags {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if facets.Tags[tags[i]] != facets.Tags[tags[j]] {
+			return facets.Tags[tags[i]] > facets.Tags[tags[j]]
+		}
+		return tags[i] < tags[j]
+	})
+	chosen := make(map[string]bool)
+	for _, tag := range filter.Tags {
+		chosen[tag] = true
+	}
+	tagValues := []FacetValue{}
+	for _, tag := range tags {
+		tagValues = append(tagValues, FacetValue{Label: tag, Count: facets.Tags[tag],
+			URL: filter.withTag(tag).url(1), Selected: chosen[tag]})
+	}
+
+	return map[string][]FacetValue{
+		"Cuisine": cuisineValues,
+		"Meal": bitFacet(Meals, facets.Mealtype, filter.Meal,
+			func(name string) browseFilter { choice := filter; choice.Meal = name; return choice }),
+		"Season": bitFacet(Seasons, facets.Season, filter.Season,
+			func(name string) browseFilter { choice := filter; choice.Season = name; return choice }),
+		"Tags": tagValues,
+	}
+}
+
+// Recipes lists the recipes page by page, filtered by the q, cuisine,
+// meal, season and tag query parameters, with counts for each filter
+// choice within the current results.
+func (c *RBController) Recipes(w http.ResponseWriter, r *http.Request) (err error) {
+	filter := parseBrowseFilter(r)
+	page, _ := strconv.Atoi(r.FormValue(`page`))
+	if page < 1 {
+		page = 1
+	}
+
+	search := filter.search()
+	recipes, total, err := c.BrowseRecipes(search, browsePageSize,
+		(page-1)*browsePageSize)
+	if err != nil {
+		return
+	}
+	facets, err := c.GetFacets(search)
+	if err != nil {
+		return
+	}
+
+	data := struct {
+		Recipes  []*Recipe
+		Total    string
+		Query    string
+		Facets   map[string][]FacetValue
+		Hidden   [][2]string
+		Filtered bool
+		Page     int
+		Pages    int
+		Prev     string
+		Next     string
+	}{
+		Recipes:  recipes,
+		Total:    formatCount(total),
+		Query:    filter.Query,
+		Facets:   browseFacets(filter, facets),
+		Hidden:   filter.hidden(),
+		Filtered: filter.url(1) != "/recipes/",
+		Page:     page,
+		Pages:    (total + browsePageSize - 1) / browsePageSize,
+	}
+	if page > 1 {
+		data.Prev = filter.url(page - 1)
+	}
+	if page*browsePageSize < total {
+		data.Next = filter.url(page + 1)
+	}
+	c.HTML(w, http.StatusOK, "recipes/index", data)
+	return nil
+}
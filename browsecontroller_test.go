@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// TestParseTags tests that tags are trimmed, lowercased and deduplicated.
+func TestParseTags(t *testing.T) {
+	tags := ParseTags(" Street  Food;vegetarian;; street food ")
+	want := []string{"street food", "vegetarian"}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("ParseTags() = %q, expected %q", tags, want)
+	}
+}
+
+// TestBrowseFilter tests that browse filters survive a trip through
+// their URL, and that facet links add and remove choices.
+func TestBrowseFilter(t *testing.T) {
+	r := httptest.NewRequest("GET",
+		"/recipes/?q=stew&meal=Dinner&season=Monsoon&tag=spicy&tag=Vegan", nil)
+	filter := parseBrowseFilter(r)
+	want := browseFilter{Query: "stew", Cuisine: -1, Meal: "Dinner",
+		Tags: []string{"spicy", "vegan"}}
+	if !reflect.DeepEqual(filter, want) {
+		t.Fatalf("parseBrowseFilter() = %+v, expected %+v", filter, want)
+	}
+
+	url := filter.url(2)
+	wantURL := "/recipes/?meal=Dinner&page=2&q=stew&tag=spicy&tag=vegan"
+	if url != wantURL {
+		t.Errorf("url() = %q, expected %q", url, wantURL)
+	}
+	again := parseBrowseFilter(httptest.NewRequest("GET", url, nil))
+	if !reflect.DeepEqual(again, filter) {
+		t.Errorf("parseBrowseFilter(url()) = %+v, expected %+v", again, filter)
+	}
+
+	facets := browseFacets(filter, &Facets{
+		Cuisine:  map[int]int{3: 2},
+		Mealtype: map[int]int{1: 1, 4: 2},
+		Season:   map[int]int{},
+		Tags:     map[string]int{"spicy": 2, "vegan": 2, "soup": 1},
+	})
+	meals := facets["Meal"]
+	if len(meals) != 2 || meals[0].Label != "Breakfast" ||
+		meals[1].URL != "/recipes/?q=stew&tag=spicy&tag=vegan" || !meals[1].Selected {
+		t.Errorf("Meal facet = %+v", meals)
+	}
+	tags := facets["Tags"]
+	if len(tags) != 3 || tags[2].Label != "soup" ||
+		tags[2].URL != "/recipes/?meal=Dinner&q=stew&tag=soup&tag=spicy&tag=vegan" ||
+		tags[0].URL != "/recipes/?meal=Dinner&q=stew&tag=vegan" {
+		t.Errorf("Tags facet = %+v", tags)
+	}
+}
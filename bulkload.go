@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"github.com/lib/pq"
+	"strconv"
+	"strings"
+)
+
+// bulkBatch is how many rows are copied between progress reports.
+const bulkBatch = 1000
+
+// bulkColumns are the columns of the staging table recipes are copied
+// into. line is the row of the spreadsheet, tags are joined by ; (which
+// tags never hold) and after is the recipe's audit summary.
+var bulkColumns = []string{"line", "name", "description", "cuisine",
+	"mealtype", "season", "ingredientlist", "instructions", "yield", "owner",
+	"contributor", "country", "community", "year", "story", "tags", "after"}
+
+// bulkRecipeColumns are the staged columns merged into recipes.
+const bulkRecipeColumns = `name, description, cuisine, mealtype, season, ` +
+	`ingredientlist, instructions, yield, owner, contributor, country, ` +
+	`community, year, story`
+
+// BulkProgress is told how far a bulk load has got: done of total rows
+// through stage "copy", then once each for "check" and "merge".
+type BulkProgress func(stage string, done, total int)
+
+// bulkRow is the staging row of a recipe, in the order of bulkColumns.
+func bulkRow(line int, recipe *Recipe) []interface{} {
+	_, after := DiffRecipes(nil, recipe)
+	return []interface{}{line, recipe.Name, recipe.Description, recipe.Cuisine,
+		recipe.Mealtype, recipe.Season, recipe.Ingredientlist, recipe.Instructions,
+		recipe.Yield, recipe.Owner, recipe.Contributor, recipe.Country,
+		recipe.Community, recipe.Year, recipe.Story, strings.Join(recipe.Tags, ";"),
+		after}
+}
+
+// bulkChecks are the checks of Recipe.Validate, as conditions staged
+// rows fail. $1 and $2 are every meal and season bit; they are cast, as
+// Postgres can't tell which ~ is meant for a parameter of unknown type.
+var bulkChecks = [][2]string{
+	{"btrim(name) = ''", "name is required"},
+	{"btrim(description) = ''", "description is required"},
+	{"btrim(ingredientlist) = ''", "ingredientlist is required"},
+	{"btrim(instructions) = ''", "instructions is required"},
+	{"cuisine < 0", "cuisine must not be negative"},
+	{"mealtype < 0 OR mealtype & ~$1::integer <> 0", "mealtype has unknown bits"},
+	{"season < 0 OR season & ~$2::integer <> 0", "season has unknown bits"},
+	{"year <> 0 AND (year < 1961 OR year > extract(year FROM now()))",
+		"year must be between 1961 and this year"},
+}
+
+// bulkCheckQuery finds the first 20 problems of the staged rows, by the
+// line each is on, given every meal and season bit as $1 and $2.
+func bulkCheckQuery() string {
+	conditions := make([]string, len(bulkChecks))
+	for i, check := range bulkChecks {
+		conditions[i] = fmt.Sprintf("CASE WHEN %s THEN '%s' END", check[0], check[1])
+	}
+	return `SELECT line, problem FROM import_recipes, ` +
+		`unnest(ARRAY[` + strings.Join(conditions, ", ") + `]) AS problem ` +
+		`WHERE problem IS NOT NULL ORDER BY line LIMIT 20`
+}
+
+// BulkLoadRecipes adds many imported recipes at once, in one
+// transaction: they are copied into a staging table with COPY, checked
+// there, then merged into recipes with their tags and an audit entry
+// each, as made by actor. Either every recipe is added or none is.
+func (recipeDB *RecipeDB) BulkLoadRecipes(recipes []*ImportedRecipe, actor Actor,
+	progress BulkProgress) (err error) {
+	tx, err := recipeDB.DB.Beginx()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.Exec(`CREATE TEMP TABLE import_recipes (line integer, ` +
+		`name text, description text, cuisine integer, mealtype integer, ` +
+		`season integer, ingredientlist text, instructions text, yield text, ` +
+		`owner integer, contributor text, country text, community text, ` +
+		`year integer, story text, tags text, after text, id integer) ON COMMIT DROP`)
+	if err != nil {
+		return
+	}
+	stmt, err := tx.Prepare(pq.CopyIn("import_recipes", bulkColumns...))
+	if err != nil {
+		return
+	}
+	for i, recipe := range recipes {
+		if _, err = stmt.Exec(bulkRow(recipe.Line, recipe.Recipe)...); err != nil {
+			stmt.Close()
+			return
+		}
+		if (i+1)%bulkBatch == 0 || i+1 == len(recipes) {
+			progress("copy", i+1, len(recipes))
+		}
+	}
+	// an Exec without arguments ends the copy
+	if _, err = stmt.Exec(); err != nil {
+		stmt.Close()
+		return
+	}
+	if err = stmt.Close(); err != nil {
+		return
+	}
+
+	var problems []struct {
+		Line    int
+		Problem string
+	}
+	err = tx.Select(&problems, bulkCheckQuery(), allBits(Meals), allBits(Seasons))
+	if err != nil {
+		return
+	}
+	if len(problems) > 0 {
+		list := make([]string, len(problems))
+		for i, problem := range problems {
+			list[i] = "row " + strconv.Itoa(problem.Line) + ": " + problem.Problem
+		}
+		return fmt.Errorf("recipes failed checks in the database:\n%s",
+			strings.Join(list, "\n"))
+	}
+	progress("check", len(recipes), len(recipes))
+
+	// ids are taken up front, in the order of the rows, so tags and audit
+	// entries can refer to them
+	_, err = tx.Exec(`UPDATE import_recipes SET id = taken.id FROM ` +
+		`(SELECT line, nextval(pg_get_serial_sequence('recipes', 'id')) AS id ` +
+		`FROM (SELECT line FROM import_recipes ORDER BY line) AS ordered) AS taken ` +
+		`WHERE import_recipes.line = taken.line`)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec(`INSERT INTO recipes (id, ` + bulkRecipeColumns + `) ` +
+		`SELECT id, ` + bulkRecipeColumns + ` FROM import_recipes ORDER BY line`)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec(`INSERT INTO recipe_tags (recipe_id, tag) ` +
+		`SELECT DISTINCT id, tag FROM import_recipes, ` +
+		`unnest(string_to_array(tags, ';')) AS tag WHERE tag <> ''`)
+	if err != nil {
+		return
+	}
+	// targets are named as by recipeTarget
+	_, err = tx.Exec(`INSERT INTO audit_log `+
+		`(actor, actor_name, action, target, before, after, ip) `+
+		`SELECT $1, $2, $3, 'recipe:' || id, '', after, $4 `+
+		`FROM import_recipes ORDER BY line`,
+		actor.UserID, actor.Name, AuditRecipeCreate, actor.IP)
+	if err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	progress("merge", len(recipes), len(recipes))
+	return
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// TestBulkRow tests that staging rows line up with the staging columns,
+// and that checks can be quoted into SQL as they are.
+func TestBulkRow(t *testing.T) {
+	row := bulkRow(7, &Recipe{Name: "Mafé", Tags: []string{"peanut", "stew"}})
+	if len(row) != len(bulkColumns) {
+		t.Fatalf("bulkRow() has %d values for %d columns", len(row), len(bulkColumns))
+	}
+	values := make(map[string]interface{})
+	for i, column := range bulkColumns {
+		values[column] = row[i]
+	}
+	if values["line"] != 7 || values["name"] != "Mafé" || values["tags"] != "peanut;stew" ||
+		!strings.Contains(values["after"].(string), "Mafé") {
+		t.Errorf("bulkRow() = %v", values)
+	}
+	for _, check := range bulkChecks {
+		if strings.Contains(check[1], "'") {
+			t.Errorf("check message %q can't be quoted into SQL", check[1])
+		}
+	}
+}
+
+// TestBulkCheckQuery tests that the check query takes the meal and
+// season bits as its only parameters, typed so that Postgres can apply
+// ~ to them.
+func TestBulkCheckQuery(t *testing.T) {
+	query := bulkCheckQuery()
+	params := regexp.MustCompile(`\$\d+(::\w+)?`).FindAllString(query, -1)
+	if want := []string{"$1::integer", "$2::integer"}; !reflect.DeepEqual(params, want) {
+		t.Errorf("bulkCheckQuery() has parameters %v, expected %v", params, want)
+	}
+	if untyped := regexp.MustCompile(`~\s*\$\d+\b(?:[^:]|$)`); untyped.MatchString(query) {
+		t.Errorf("bulkCheckQuery() applies ~ to an untyped parameter: %s", query)
+	}
+	for _, check := range bulkChecks {
+		if !strings.Contains(query, "CASE WHEN "+check[0]+" THEN '"+check[1]+"' END") {
+			t.Errorf("bulkCheckQuery() is missing the check %q", check[0])
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Margins of printed pages, in points.
+const (
+	pageMargin   = 54.0
+	footerMargin = 30.0
+)
+
+// pdfFlow lays out text down the pages of a PDF, starting a new page
+// when the current one is full.
+type pdfFlow struct {
+	doc  *PDF
+	page *PDFPage
+	y    float64
+}
+
+// newPage starts the flow at the top of a new page.
+func (flow *pdfFlow) newPage() {
+	flow.page = flow.doc.AddPage()
+	flow.y = pageHeight - pageMargin
+}
+
+// room moves to a new page unless h points are left on this one.
+func (flow *pdfFlow) room(h float64) {
+	if flow.page == nil || flow.y-h < pageMargin {
+		flow.newPage()
+	}
+}
+
+// lines writes text wrapped to the width of the page, indented by indent
+// points, with leading points between baselines.
+func (flow *pdfFlow) lines(font pdfFont, size, leading, indent float64, text string) {
+	width := pageWidth - 2*pageMargin - indent
+	for _, line := range wrapText(font, size, text, width) {
+		flow.room(leading)
+		flow.y -= leading
+		flow.page.Text(pageMargin+indent, flow.y, font, size, line)
+	}
+}
+
+// space leaves h points of space, unless at the top of a page.
+func (flow *pdfFlow) space(h float64) {
+	if flow.y < pageHeight-pageMargin {
+		flow.y -= h
+	}
+}
+
+// heading writes a bold heading, keeping it on the same page as at least
+// a line of what follows.
+func (flow *pdfFlow) heading(size float64, text string) {
+	flow.space(size / 2)
+	flow.room(size*1.3 + 30)
+	flow.lines(fontBold, size, size*1.3, 0, text)
+	flow.y -= size / 4
+}
+
+// bullets writes a bulleted list.
+func (flow *pdfFlow) bullets(items []string) {
+	for _, item := range items {
+		flow.room(15)
+		flow.page.Text(pageMargin+4, flow.y-15, fontRegular, 11, "•")
+		flow.lines(fontRegular, 11, 15, 16, item)
+	}
+}
+
+// picture draws a picture centered on the page, scaled to fit within
+// maxHeight points. Pictures that can't be read are left out.
+func (flow *pdfFlow) picture(data []byte, maxHeight float64) {
+	if len(data) == 0 {
+		return
+	}
+	n, width, height, err := flow.doc.AddImage(data)
+	if err != nil || width == 0 || height == 0 {
+		return
+	}
+	maxWidth := pageWidth - 2*pageMargin
+	scale := maxWidth / float64(width)
+	if float64(height)*scale > maxHeight {
+		scale = maxHeight / float64(height)
+	}
+	w, h := float64(width)*scale, float64(height)*scale
+	flow.room(h)
+	flow.y -= h
+	flow.page.Image(n, (pageWidth-w)/2, flow.y, w, h)
+	flow.y -= 12
+}
+
+// bitNames lists the names of the bits set in bits, in bit order.
+func bitNames(names map[int]string, bits int) []string {
+	keys := []int{}
+	for bit := range names {
+		keys = append(keys, bit)
+	}
+	sort.Ints(keys)
+	list := []string{}
+	for _, bit := range keys {
+		if bits&bit != 0 {
+			list = append(list, names[bit])
+		}
+	}
+	return list
+}
+
+// writeRecipe lays out a recipe from the top of a new page: its picture,
+// name, categories, ingredients, instructions and where it comes from.
+func (flow *pdfFlow) writeRecipe(recipe *Recipe) {
+	flow.newPage()
+	flow.picture(recipe.Picture, 250)
+	flow.lines(fontBold, 22, 28, 0, recipe.Name)
+
+	flow.lines(fontRegular, 10, 16, 0, strings.Join(recipeAbout(recipe), "  |  "))
+	flow.space(6)
+	if recipe.Description != "" {
+		flow.lines(fontItalic, 11, 15, 0, recipe.Description)
+	}
+
+	flow.heading(14, "Ingredients")
+	flow.bullets(recipeIngredients(recipe))
+
+	flow.heading(14, "Instructions")
+	for _, paragraph := range recipeSteps(recipe) {
+		flow.lines(fontRegular, 11, 15, 0, paragraph)
+		flow.space(5)
+	}
+
+	if recipe.Contributor != "" || recipe.Country != "" || recipe.Story != "" {
+		flow.heading(14, "Where it comes from")
+		if source := recipeSource(recipe); source != "" {
+			flow.lines(fontRegular, 11, 15, 0, source)
+		}
+		if recipe.Story != "" {
+			flow.space(5)
+			flow.lines(fontItalic, 11, 15, 0, recipe.Story)
+		}
+	}
+	if len(recipe.Tags) > 0 {
+		flow.space(10)
+		flow.lines(fontRegular, 9, 13, 0, "Tags: "+strings.Join(recipe.Tags, ", "))
+	}
+}
+
+// recipeSource describes who contributed a recipe, and where and when,
+// as the recipe page does.
+func recipeSource(recipe *Recipe) string {
+	if recipe.Contributor == "" && recipe.Country == "" {
+		return ""
+	}
+	source := "Learned"
+	if recipe.Contributor != "" {
+		source = "Contributed by " + recipe.Contributor
+	}
+	if recipe.Country != "" {
+		source += " while serving in "
+		if recipe.Community != "" {
+			source += recipe.Community + ", "
+		}
+		source += recipe.Country
+	}
+	if recipe.Year != 0 {
+		source += ", " + strconv.Itoa(recipe.Year)
+	}
+	return source + "."
+}
+
+// footers numbers the pages from first on, with title beside the number.
+func footers(doc *PDF, first int, title string) {
+	for i := first; i < len(doc.Pages); i++ {
+		number := strconv.Itoa(i + 1)
+		doc.Pages[i].Text(pageMargin, footerMargin, fontRegular, 8, title)
+		doc.Pages[i].Text(pageWidth-pageMargin-textWidth(fontRegular, 8, number),
+			footerMargin, fontRegular, 8, number)
+	}
+}
+
+// RecipeCard renders one recipe as a printable PDF.
+func RecipeCard(recipe *Recipe) []byte {
+	doc := &PDF{Title: recipe.Name}
+	flow := &pdfFlow{doc: doc}
+	flow.writeRecipe(recipe)
+	footers(doc, 0, "RecipeBox")
+	return doc.Bytes()
+}
+
+// Cookbook groups, chosen for a cookbook's table of contents.
+const (
+	GroupByCuisine = "cuisine"
+	GroupBySeason  = "season"
+)
+
+// Cookbook is a printable collection of recipes, with a cover, a table
+// of contents grouped by cuisine or season, and a page for each recipe.
+type Cookbook struct {
+	Title   string
+	GroupBy string
+	Recipes []*Recipe
+}
+
+// cookbookGroup is a section of a cookbook's table of contents.
+type cookbookGroup struct {
+	Name    string
+	Recipes []*Recipe
+}
+
+// groups sorts the cookbook's recipes into sections, each sorted by
+// name. Grouped by season, a recipe is listed under each of its seasons,
+// and recipes for any season come last.
+func (book *Cookbook) groups() []cookbookGroup {
+	recipes := append([]*Recipe{}, book.Recipes...)
+	sort.SliceStable(recipes, func(i, j int) bool {
+		return strings.ToLower(recipes[i].Name) < strings.ToLower(recipes[j].Name)
+	})
+
+	groups := []cookbookGroup{}
+	if book.GroupBy == GroupBySeason {
+		bits := []int{}
+		for bit := range Seasons {
+			bits = append(bits, bit)
+		}
+		sort.Ints(bits)
+		for _, bit := range bits {
+			group := cookbookGroup{Name: Seasons[bit]}
+			for _, recipe := range recipes {
+				if recipe.Season&bit != 0 {
+					group.Recipes = append(group.Recipes, recipe)
+				}
+			}
+			groups = append(groups, group)
+		}
+		group := cookbookGroup{Name: "Any season"}
+		for _, recipe := range recipes {
+			if recipe.Season == 0 {
+				group.Recipes = append(group.Recipes, recipe)
+			}
+		}
+		groups = append(groups, group)
+	} else {
+		byCuisine := make(map[int][]*Recipe)
+		cuisines := []int{}
+		for _, recipe := range recipes {
+			if _, ok := byCuisine[recipe.Cuisine]; !ok {
+				cuisines = append(cuisines, recipe.Cuisine)
+			}
+			byCuisine[recipe.Cuisine] = append(byCuisine[recipe.Cuisine], recipe)
+		}
+		sort.Ints(cuisines)
+		for _, cuisine := range cuisines {
+			groups = append(groups, cookbookGroup{
+				Name: "Cuisine " + strconv.Itoa(cuisine), Recipes: byCuisine[cuisine]})
+		}
+	}
+
+	nonEmpty := groups[:0]
+	for _, group := range groups {
+		if len(group.Recipes) > 0 {
+			nonEmpty = append(nonEmpty, group)
+		}
+	}
+	return nonEmpty
+}
+
+// Heights of lines in the table of contents.
+const (
+	tocGroupLine = 30.0
+	tocLine      = 16.0
+)
+
+// tocPages counts the pages the table of contents will take.
+func tocPages(groups []cookbookGroup) int {
+	pages, y := 1, pageHeight-pageMargin-40
+	for _, group := range groups {
+		heights := []float64{tocGroupLine}
+		for range group.Recipes {
+			heights = append(heights, tocLine)
+		}
+		for i, h := range heights {
+			// a section's heading stays with its first recipe
+			need := h
+			if i == 0 {
+				need += tocLine
+			}
+			if y-need < pageMargin {
+				pages++
+				y = pageHeight - pageMargin
+			}
+			y -= h
+		}
+	}
+	return pages
+}
+
+// Render lays out the cookbook as a PDF.
+func (book *Cookbook) Render() []byte {
+	doc := &PDF{Title: book.Title}
+	groups := book.groups()
+
+	// the cover
+	cover := doc.AddPage()
+	y := pageHeight * 0.62
+	for _, line := range wrapText(fontBold, 32, book.Title, pageWidth-2*pageMargin) {
+		cover.Text((pageWidth-textWidth(fontBold, 32, line))/2, y, fontBold, 32, line)
+		y -= 40
+	}
+	subtitle := formatCount(len(book.Recipes)) + " recipes from the Peace Corps RecipeBox"
+	if len(book.Recipes) == 1 {
+		subtitle = "A recipe from the Peace Corps RecipeBox"
+	}
+	cover.Text((pageWidth-textWidth(fontRegular, 14, subtitle))/2, y-10,
+		fontRegular, 14, subtitle)
+	date := time.Now().Format("January 2006")
+	cover.Text((pageWidth-textWidth(fontItalic, 11, date))/2, y-34,
+		fontItalic, 11, date)
+
+	// leave room for the table of contents, which needs the recipes'
+	// page numbers
+	toc := len(doc.Pages)
+	for i := tocPages(groups); i > 0; i-- {
+		doc.AddPage()
+	}
+
+	// each recipe once, in the order of the table of contents
+	flow := &pdfFlow{doc: doc}
+	pages := make(map[*Recipe]int)
+	for _, group := range groups {
+		for _, recipe := range group.Recipes {
+			if _, ok := pages[recipe]; !ok {
+				pages[recipe] = len(doc.Pages)
+				flow.writeRecipe(recipe)
+			}
+		}
+	}
+
+	page := doc.Pages[toc]
+	y = pageHeight - pageMargin - 24
+	page.Text(pageMargin, y, fontBold, 24, "Contents")
+	y -= 16
+	for _, group := range groups {
+		for i := -1; i < len(group.Recipes); i++ {
+			h := tocLine
+			if i < 0 {
+				h = tocGroupLine
+			}
+			need := h
+			if i < 0 {
+				need += tocLine
+			}
+			if y-need < pageMargin {
+				toc++
+				page = doc.Pages[toc]
+				y = pageHeight - pageMargin
+			}
+			y -= h
+			if i < 0 {
+				page.Text(pageMargin, y, fontBold, 14, group.Name)
+				continue
+			}
+			recipe := group.Recipes[i]
+			number := strconv.Itoa(pages[recipe] + 1)
+			numberWidth := textWidth(fontRegular, 11, number)
+			name := recipe.Name
+			room := pageWidth - 2*pageMargin - 12 - numberWidth - 20
+			if lines := wrapText(fontRegular, 11, name, room); len(lines) > 1 {
+				name = strings.TrimSpace(lines[0]) + "…"
+			}
+			page.Text(pageMargin+12, y, fontRegular, 11, name)
+			page.Text(pageWidth-pageMargin-numberWidth, y, fontRegular, 11, number)
+			page.Link(pageMargin, y-4, pageWidth-2*pageMargin, tocLine, pages[recipe])
+		}
+	}
+
+	footers(doc, 1, book.Title)
+	return doc.Bytes()
+}
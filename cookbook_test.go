@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestWrapText tests that lines are broken between words, and within
+// words too long for a line.
+func TestWrapText(t *testing.T) {
+	if w := textWidth(fontRegular, 10, "Hi!"); w != 12.22 {
+		t.Errorf("textWidth(Hi!) = %v, expected 12.22", w)
+	}
+	lines := wrapText(fontRegular, 10, "Pound the cassava until smooth", 60)
+	if strings.Join(lines, "|") != "Pound the|cassava until|smooth" {
+		t.Errorf("wrapText() = %q", lines)
+	}
+	for _, line := range wrapText(fontBold, 10, strings.Repeat("m", 30), 60) {
+		if textWidth(fontBold, 10, line) > 60 {
+			t.Errorf("wrapText() made a line %q wider than 60 points", line)
+		}
+	}
+	if s := pdfString("Mafé (stew) – 1\\2 €"); s != "(Maf\xe9 \\(stew\\) \x96 1\\\\2 \x80)" {
+		t.Errorf("pdfString() = %q", s)
+	}
+}
+
+// checkPDF checks that every object is where the cross-reference table
+// says, and returns the number of pages.
+func checkPDF(t *testing.T, pdf []byte) int {
+	xref := regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`).FindSubmatch(pdf)
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")) || xref == nil {
+		t.Fatal("the PDF has no header or trailer")
+	}
+	start, _ := strconv.Atoi(string(xref[1]))
+	table := strings.Split(string(pdf[start:]), "\n")
+	count, _ := strconv.Atoi(strings.Fields(table[1])[1])
+	for n := 1; n < count; n++ {
+		offset, _ := strconv.Atoi(table[2+n][:10])
+		if !bytes.HasPrefix(pdf[offset:], []byte(strconv.Itoa(n)+" 0 obj\n")) {
+			t.Errorf("object %d isn't at offset %d", n, offset)
+		}
+	}
+	return bytes.Count(pdf, []byte("/Type /Page /Parent"))
+}
+
+// TestCookbook tests that a cookbook has a cover, a table of contents,
+// linked to each recipe, and a page for each recipe.
+func TestCookbook(t *testing.T) {
+	picture := image.NewNRGBA(image.Rect(0, 0, 4, 3))
+	picture.Set(1, 1, color.NRGBA{200, 50, 0, 128})
+	var buf bytes.Buffer
+	png.Encode(&buf, picture)
+
+	book := &Cookbook{Title: "Training packet", GroupBy: GroupBySeason, Recipes: []*Recipe{
+		{ID: 1, Name: "Mafé", Season: 3, Ingredientlist: "peanuts; tomato",
+			Instructions: "Stew.", Picture: buf.Bytes()},
+		{ID: 2, Name: "Fufu", Season: 0, Ingredientlist: "cassava",
+			Instructions: strings.Repeat("Pound the cassava. ", 400)},
+	}}
+	groups := book.groups()
+	names := []string{}
+	for _, group := range groups {
+		names = append(names, group.Name+":"+strconv.Itoa(len(group.Recipes)))
+	}
+	if strings.Join(names, " ") != "Spring:1 Summer:1 Any season:1" {
+		t.Errorf("groups() = %v", names)
+	}
+
+	pdf := book.Render()
+	// a cover, the contents, Mafé and two pages of Fufu
+	if pages := checkPDF(t, pdf); pages != 5 {
+		t.Errorf("the cookbook has %d pages, expected 5", pages)
+	}
+	if links := bytes.Count(pdf, []byte("/Subtype /Link")); links != 3 {
+		t.Errorf("the contents have %d links, expected 3", links)
+	}
+	if !bytes.Contains(pdf, []byte("/Subtype /Image /Width 4 /Height 3")) {
+		t.Error("the picture is missing")
+	}
+
+	if pages := checkPDF(t, RecipeCard(book.Recipes[0])); pages != 1 {
+		t.Errorf("the recipe card has %d pages, expected 1", pages)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/gorilla/mux"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// cookbookTitleLength is the longest title a cookbook may have.
+const cookbookTitleLength = 100
+
+// filenameUnsafe matches runs of characters left out of file names.
+var filenameUnsafe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// downloadName makes a file name such as "jollof-rice.pdf" from a title
+// and an extension.
+func downloadName(title, extension string) string {
+	name := strings.Trim(filenameUnsafe.ReplaceAllString(strings.ToLower(title), "-"), "-")
+	if name == "" {
+		name = "recipebox"
+	}
+	return name + "." + extension
+}
+
+// sendPDF answers with a PDF file, shown in the browser unless download.
+func sendPDF(w http.ResponseWriter, pdf []byte, filename string, download bool) {
+	disposition := "inline"
+	if download {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", disposition+`; filename="`+filename+`"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(pdf)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(pdf)
+}
+
+// RecipePDF renders a recipe as a printable PDF card.
+func (c *RBController) RecipePDF(w http.ResponseWriter, r *http.Request) (err error) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	recipe, err := c.GetRecipe(id)
+	if err == sql.ErrNoRows {
+		if moved, err := c.redirectMerged(w, r, id); moved || err != nil {
+			return err
+		}
+		c.RenderError(w, 404, "Sorry, your page wasn't found")
+		return nil
+	} else if err != nil {
+		return
+	}
+	sendPDF(w, RecipeCard(recipe), downloadName(recipe.Name, "pdf"), false)
+	return nil
+}
+
+// NewCookbook starts making a cookbook of the recipes matching the
+// search in the form's q, cuisine, meal, season and tag fields, and
+// sends the user to the page where it can be downloaded when ready.
+func (c *RBController) NewCookbook(w http.ResponseWriter, r *http.Request) (err error) {
+	user, err := c.CurrentUser(r)
+	if err != nil {
+		return
+	}
+	filter := parseBrowseFilter(r)
+	title := strings.Join(strings.Fields(r.PostFormValue(`title`)), " ")
+	if title == "" {
+		title = "RecipeBox Cookbook"
+	}
+	if len([]rune(title)) > cookbookTitleLength {
+		title = string([]rune(title)[:cookbookTitleLength])
+	}
+	groupBy := GroupByCuisine
+	if r.PostFormValue(`group`) == GroupBySeason {
+		groupBy = GroupBySeason
+	}
+
+	id, err := randomToken(16)
+	if err != nil {
+		return
+	}
+	job := &CookbookJob{ID: id, Owner: user.ID, Title: title,
+		Query:   strings.TrimPrefix(strings.TrimPrefix(filter.url(1), "/recipes/"), "?"),
+		GroupBy: groupBy}
+	if err = c.NewCookbookJob(job); err != nil {
+		return
+	}
+	if !c.Cookbooks.Add(id) {
+		err = c.FinishCookbookJob(id, nil, 0, errCookbooksBusy)
+		if err != nil {
+			return
+		}
+	}
+	http.Redirect(w, r, "/cookbooks/"+id+"/", http.StatusSeeOther)
+	return nil
+}
+
+var errCookbooksBusy = errors.New("Sorry, too many cookbooks are being " +
+	"made right now. Please try again in a few minutes.")
+
+// cookbookPage is the binding of a cookbook's page, which reloads itself
+// while the cookbook is being made.
+type cookbookPage struct {
+	*CookbookJob
+}
+
+// Head returns the tags added to the page's head.
+func (page cookbookPage) Head() template.HTML {
+	if page.Pending() {
+		return `<meta http-equiv="refresh" content="5">`
+	}
+	return ""
+}
+
+// cookbookJob gets the cookbook named by the id route variable, or
+// answers 404 and returns nil.
+func (c *RBController) cookbookJob(w http.ResponseWriter, r *http.Request) (*CookbookJob, error) {
+	job, err := c.GetCookbookJob(mux.Vars(r)["id"])
+	if err == sql.ErrNoRows {
+		c.RenderError(w, 404, "Sorry, that cookbook wasn't found. "+
+			"Cookbooks are kept for a week after they are made.")
+		return nil, nil
+	}
+	return job, err
+}
+
+// Cookbook shows whether a cookbook is ready, with a link to download it
+// when it is.
+func (c *RBController) Cookbook(w http.ResponseWriter, r *http.Request) (err error) {
+	job, err := c.cookbookJob(w, r)
+	if job != nil {
+		c.HTML(w, http.StatusOK, "cookbooks/cookbook", cookbookPage{job})
+	}
+	return
+}
+
+// CookbookPDF downloads a made cookbook.
+func (c *RBController) CookbookPDF(w http.ResponseWriter, r *http.Request) (err error) {
+	job, err := c.cookbookJob(w, r)
+	if job == nil {
+		return
+	}
+	pdf, err := c.GetCookbookPDF(job.ID)
+	if err == sql.ErrNoRows {
+		c.RenderError(w, 404, "Sorry, that cookbook isn't ready.")
+		return nil
+	} else if err != nil {
+		return
+	}
+	sendPDF(w, pdf, downloadName(job.Title, "pdf"), true)
+	return nil
+}
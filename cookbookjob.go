@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Cookbook job statuses.
+const (
+	CookbookPending = "pending"
+	CookbookDone    = "done"
+	CookbookFailed  = "failed"
+)
+
+// cookbookMaxRecipes is the most recipes a cookbook may hold.
+const cookbookMaxRecipes = 500
+
+// cookbookKeep is how long made cookbooks are kept for downloading.
+const cookbookKeep = 7 * 24 * time.Hour
+
+// cookbookTimeout is how long a cookbook may stay pending before it is
+// assumed lost, as when the server restarts while making it.
+const cookbookTimeout = time.Hour
+
+// CookbookJob is a cookbook made in the background from the recipes
+// matching a search of /recipes/. The PDF is kept in the cookbooks table
+// and only loaded for downloading.
+type CookbookJob struct {
+	ID      string
+	Owner   int
+	Title   string
+	Query   string // the search, as the query string of /recipes/
+	GroupBy string
+	Status  string
+	Error   string
+	Recipes int
+	Created time.Time
+	Updated time.Time
+}
+
+// Pending reports whether the cookbook is still being made.
+func (job *CookbookJob) Pending() bool {
+	return job.Status == CookbookPending
+}
+
+// SearchURL links to the search the cookbook was made from.
+func (job *CookbookJob) SearchURL() string {
+	if job.Query == "" {
+		return "/recipes/"
+	}
+	return "/recipes/?" + job.Query
+}
+
+// cookbookColumns are the columns of a CookbookJob, leaving out the PDF.
+const cookbookColumns = `id, owner, title, query, groupby, status, error, ` +
+	`recipes, created, updated`
+
+// NewCookbookJob adds a pending cookbook, and deletes cookbooks made
+// more than cookbookKeep ago.
+func (recipeDB *RecipeDB) NewCookbookJob(job *CookbookJob) (err error) {
+	_, err = recipeDB.DB.Exec(`DELETE FROM cookbooks WHERE created < $1`,
+		time.Now().Add(-cookbookKeep))
+	if err != nil {
+		return
+	}
+	insert := `INSERT INTO cookbooks (id, owner, title, query, groupby, status) ` +
+		`VALUES ($1,$2,$3,$4,$5,$6)`
+	_, err = recipeDB.DB.Exec(insert, job.ID, job.Owner, job.Title, job.Query,
+		job.GroupBy, CookbookPending)
+	return
+}
+
+// GetCookbookJob gets a cookbook by id. Cookbooks pending for longer
+// than cookbookTimeout are reported as failed.
+func (recipeDB *RecipeDB) GetCookbookJob(id string) (job *CookbookJob, err error) {
+	job = new(CookbookJob)
+	err = recipeDB.DB.QueryRowx(`SELECT `+cookbookColumns+
+		` FROM cookbooks WHERE id=$1`, id).StructScan(job)
+	if err == nil && job.Pending() && time.Since(job.Created) > cookbookTimeout {
+		job.Status = CookbookFailed
+		job.Error = "The cookbook took too long to make. Please try again."
+	}
+	return
+}
+
+// GetCookbookPDF gets a made cookbook's PDF.
+func (recipeDB *RecipeDB) GetCookbookPDF(id string) (pdf []byte, err error) {
+	err = recipeDB.DB.QueryRowx(`SELECT pdf FROM cookbooks WHERE id=$1 AND status=$2`,
+		id, CookbookDone).Scan(&pdf)
+	return
+}
+
+// FinishCookbookJob saves a made cookbook, or why it couldn't be made.
+func (recipeDB *RecipeDB) FinishCookbookJob(id string, pdf []byte, recipes int,
+	failure error) (err error) {
+	status, message := CookbookDone, ""
+	if failure != nil {
+		status, message, pdf = CookbookFailed, failure.Error(), nil
+	}
+	update := `UPDATE cookbooks SET status=$2, error=$3, pdf=$4, recipes=$5, ` +
+		`updated=now() WHERE id=$1`
+	_, err = recipeDB.DB.Exec(update, id, status, message, pdf, recipes)
+	return
+}
+
+// CookbookQueue makes cookbooks in the background, a few at a time, so
+// that big cookbooks can't starve the web server.
+type CookbookQueue struct {
+	RecipeDB *RecipeDB
+	jobs     chan string
+}
+
+// NewCookbookQueue starts workers making cookbooks, with room for 100
+// more waiting.
+func NewCookbookQueue(recipeDB *RecipeDB, workers int) *CookbookQueue {
+	queue := &CookbookQueue{RecipeDB: recipeDB, jobs: make(chan string, 100)}
+	for i := 0; i < workers; i++ {
+		go queue.work()
+	}
+	return queue
+}
+
+// Add queues a pending cookbook to be made. It reports false, rather
+// than waiting, when the queue is full.
+func (queue *CookbookQueue) Add(id string) bool {
+	select {
+	case queue.jobs <- id:
+		return true
+	default:
+		return false
+	}
+}
+
+func (queue *CookbookQueue) work() {
+	for id := range queue.jobs {
+		pdf, recipes, err := queue.make(id)
+		if err != nil {
+			fmt.Printf("[WARNING] making cookbook %s: %s\n", id, err.Error())
+		}
+		if err = queue.RecipeDB.FinishCookbookJob(id, pdf, recipes, err); err != nil {
+			fmt.Printf("[WARNING] saving cookbook %s: %s\n", id, err.Error())
+		}
+	}
+}
+
+// make renders a cookbook, turning any panic while laying it out into
+// an error so the worker carries on.
+func (queue *CookbookQueue) make(id string) (pdf []byte, recipes int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Sorry, something went wrong laying out the cookbook: %v", r)
+		}
+	}()
+	job, err := queue.RecipeDB.GetCookbookJob(id)
+	if err != nil {
+		return
+	}
+	values, err := url.ParseQuery(job.Query)
+	if err != nil {
+		return
+	}
+	found, total, err := queue.RecipeDB.BrowseRecipes(browseFilterOf(values).search(),
+		cookbookMaxRecipes, 0)
+	if err != nil {
+		return
+	}
+	if total == 0 {
+		return nil, 0, errors.New("No recipes match the search.")
+	}
+	if total > cookbookMaxRecipes {
+		return nil, 0, fmt.Errorf("%s recipes match the search, but a cookbook "+
+			"may hold at most %d. Please narrow the search.", formatCount(total),
+			cookbookMaxRecipes)
+	}
+	book := &Cookbook{Title: job.Title, GroupBy: job.GroupBy, Recipes: found}
+	return book.Render(), len(found), nil
+}
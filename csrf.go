@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"github.com/unrolled/render"
+	"html/template"
+	"net/http"
+	"regexp"
+)
+
+// CSRFField is the name of the hidden form field holding the CSRF token.
+// Scripts may send the token in the X-CSRF-Token header instead.
+const CSRFField = "csrf_token"
+
+// csrfKey is the session value holding the CSRF token.
+const csrfKey = "csrf"
+
+// postForm matches the opening tag of a form that posts.
+var postForm = regexp.MustCompile(`(?i)<form\b[^>]*\bmethod=["']?post["']?[^>]*>`)
+
+// formWriter carries the request alongside the response, so that HTML
+// can add the request's CSRF token to the forms it renders.
+type formWriter struct {
+	http.ResponseWriter
+	r *http.Request
+}
+
+// Flush passes flushes through to the underlying writer.
+func (fw *formWriter) Flush() {
+	if f, ok := fw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// bufferedResponse collects a rendered response so it can be rewritten.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header         { return b.header }
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
+func (b *bufferedResponse) WriteHeader(status int)      { b.status = status }
+
+// HTML renders a template like render.HTML, and adds a hidden CSRF token
+// field to every form in the page that posts.
+func (c *RBController) HTML(w http.ResponseWriter, status int, name string,
+	binding interface{}, htmlOpt ...render.HTMLOptions) {
+	fw, ok := w.(*formWriter)
+	if !ok {
+		c.Render.HTML(w, status, name, binding, htmlOpt...)
+		return
+	}
+
+	buf := &bufferedResponse{header: w.Header(), status: http.StatusOK}
+	c.Render.HTML(buf, status, name, binding, htmlOpt...)
+	body := buf.body.Bytes()
+
+	if postForm.Match(body) {
+		token, err := c.CSRFToken(w, fw.r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		field := []byte(`<input type="hidden" name="` + CSRFField +
+			`" value="` + template.HTMLEscapeString(token) + `">`)
+		body = postForm.ReplaceAllFunc(body, func(tag []byte) []byte {
+			return append(append([]byte{}, tag...), field...)
+		})
+	}
+	w.WriteHeader(buf.status)
+	w.Write(body)
+}
+
+// CSRFToken returns the CSRF token of the request's session, creating
+// the session and token if need be.
+func (c *RBController) CSRFToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	session, err := c.Session(w, r)
+	if err != nil {
+		return "", err
+	}
+	if token := session.Values[csrfKey]; token != "" {
+		return token, nil
+	}
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	session.Values[csrfKey] = token
+	return token, c.Sessions.Save(w, session)
+}
+
+// CheckCSRF wraps an action so that requests which change data must
+// carry the CSRF token of their session. Requests without a valid token
+// get a 403 page.
+// for example, use c.Action(c.CheckCSRF(c.SaveRecipe)).
+func (c *RBController) CheckCSRF(a Action) Action {
+	return Action(func(w http.ResponseWriter, r *http.Request) error {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			return a(w, r)
+		}
+		if c.Sessions == nil {
+			return a(w, r)
+		}
+
+		// requests made with an API token don't use cookies, so they
+		// can't be forged by another site
+		token, err := c.CurrentToken(r)
+		if err != nil {
+			return err
+		}
+		if token != nil {
+			return a(w, r)
+		}
+
+		session, err := c.existingSession(r)
+		if err != nil {
+			return err
+		}
+		sent := r.Header.Get("X-CSRF-Token")
+		if sent == "" {
+			sent = r.PostFormValue(CSRFField)
+		}
+		if session == nil || session.Values[csrfKey] == "" ||
+			subtle.ConstantTimeCompare([]byte(sent), []byte(session.Values[csrfKey])) != 1 {
+			c.RenderError(w, http.StatusForbidden,
+				"Sorry, this form has expired. Please go back, reload the page and try again.")
+			return nil
+		}
+		return a(w, r)
+	})
+}
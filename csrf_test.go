@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSessionController makes a controller with in-memory sessions.
+func newSessionController() *RBController {
+	return &RBController{Render: NewRenderer(), RecipeDB: nil,
+		Sessions: NewSessions(NewMemorySessionStore(), []byte("secret"))}
+}
+
+// TestSessionCookie tests that tampered session cookies are ignored.
+func TestSessionCookie(t *testing.T) {
+	sessions := NewSessions(NewMemorySessionStore(), []byte("secret"))
+	session, _ := sessions.New()
+	session.Values["hello"] = "world"
+	w := httptest.NewRecorder()
+	if err := sessions.Save(w, session); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	got, _ := sessions.Get(req)
+	if got == nil || got.Values["hello"] != "world" {
+		t.Errorf("Get didn't return the saved session, got %+v", got)
+	}
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	cookie.Value = "x" + cookie.Value
+	req.AddCookie(cookie)
+	if got, _ := sessions.Get(req); got != nil {
+		t.Errorf("Get accepted a tampered cookie")
+	}
+}
+
+// TestMemorySessionSweep tests that expired sessions are dropped even if
+// nobody asks for them again.
+func TestMemorySessionSweep(t *testing.T) {
+	store := NewMemorySessionStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	for _, id := range []string{"a", "b", "c"} {
+		store.Save(id, map[string]string{"csrf": id}, now.Add(time.Minute))
+	}
+	store.Save("d", nil, now.Add(time.Hour))
+
+	now = now.Add(2 * time.Minute)
+	store.Save("e", nil, now.Add(time.Hour))
+	if len(store.sessions) != 2 {
+		t.Errorf("the store holds %d sessions, expected d and e", len(store.sessions))
+	}
+	if values, _ := store.Load("d"); values == nil {
+		t.Errorf("Load dropped a session that hasn't expired")
+	}
+}
+
+// TestCSRF tests that rendered forms carry a CSRF token and that
+// CheckCSRF only lets through posts carrying it.
+func TestCSRF(t *testing.T) {
+	c := newSessionController()
+
+	// render a page with a form and pick out the token
+	req, _ := http.NewRequest("GET", "/register/", nil)
+	w := httptest.NewRecorder()
+	c.Action(c.Register).ServeHTTP(w, req)
+	match := regexp.MustCompile(`name="` + CSRFField + `" value="([^"]+)"`).
+		FindStringSubmatch(w.Body.String())
+	if match == nil {
+		t.Fatalf("Register form has no CSRF token")
+	}
+	cookies := w.Result().Cookies()
+
+	post := func(token string) int {
+		form := url.Values{"name": {"x"}}
+		if token != "" {
+			form.Set(CSRFField, token)
+		}
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		c.Action(c.CheckCSRF(c.MockAction(nil))).ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := post(""); code != http.StatusForbidden {
+		t.Errorf("post without token returned %v, expected %v", code,
+			http.StatusForbidden)
+	}
+	if code := post("wrong"); code != http.StatusForbidden {
+		t.Errorf("post with wrong token returned %v, expected %v", code,
+			http.StatusForbidden)
+	}
+	if code := post(match[1]); code != http.StatusOK {
+		t.Errorf("post with token returned %v, expected %v", code,
+			http.StatusOK)
+	}
+}
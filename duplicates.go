@@ -0,0 +1,484 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// duplicateThreshold is the similarity above which two recipes are
+// likely the same dish.
+const duplicateThreshold = 0.6
+
+// duplicateBlockLimit is the most recipes sharing a name prefix or an
+// ingredient that are compared with each other. Bigger groups, such as
+// every recipe with rice, say little about duplicates.
+const duplicateBlockLimit = 300
+
+// accentFolds maps accented letters to the letters they are compared as.
+var accentFolds = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ç': "c",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ì': "i", 'í': "i", 'î': "i",
+	'ï': "i", 'ñ': "n", 'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o",
+	'ø': "o", 'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ý': "y", 'ÿ': "y",
+	'æ': "ae", 'œ': "oe", 'ß': "ss",
+}
+
+// foldText lowercases text and folds its accents, so "Mafé" and "mafe"
+// compare equal.
+func foldText(text string) string {
+	var buf strings.Builder
+	for _, r := range strings.ToLower(text) {
+		if fold, ok := accentFolds[r]; ok {
+			buf.WriteString(fold)
+		} else {
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+// foldSQL returns an SQL expression folding column like foldText, for
+// the single letter folds; Postgres's unaccent needn't be installed.
+func foldSQL(column string) string {
+	letters := []string{}
+	for r, fold := range accentFolds {
+		if len(fold) == 1 {
+			letters = append(letters, string(r))
+		}
+	}
+	sort.Strings(letters)
+	from, to := "", ""
+	for _, letter := range letters {
+		from, to = from+letter, to+accentFolds[[]rune(letter)[0]]
+	}
+	return "translate(lower(" + column + "), '" + from + "', '" + to + "')"
+}
+
+// nameStopwords are words left out when comparing names.
+var nameStopwords = map[string]bool{
+	"a": true, "an": true, "the": true, "and": true, "with": true, "of": true,
+	"in": true, "on": true, "de": true, "du": true, "la": true, "le": true,
+	"les": true, "au": true, "aux": true, "et": true, "style": true,
+	"recipe": true, "my": true, "easy": true, "simple": true, "homemade": true,
+	"traditional": true, "s": true,
+}
+
+// ingredientFillers are words of ingredients that don't say what they are.
+var ingredientFillers = map[string]bool{
+	"cup": true, "tbsp": true, "tsp": true, "tablespoon": true, "teaspoon": true,
+	"g": true, "kg": true, "gram": true, "lb": true, "pound": true, "oz": true,
+	"ounce": true, "ml": true, "l": true, "liter": true, "litre": true,
+	"pinch": true, "dash": true, "can": true, "package": true, "clove": true,
+	"handful": true, "bunch": true, "slice": true, "piece": true, "each": true,
+	"of": true, "a": true, "an": true, "and": true, "or": true, "to": true,
+	"taste": true, "fresh": true, "large": true, "small": true, "medium": true,
+	"chopped": true, "diced": true, "sliced": true, "minced": true,
+	"ground": true, "whole": true, "about": true,
+}
+
+// singular makes English plurals singular, well enough to compare
+// ingredients: tomatoes, onions and berries become tomato, onion and berry.
+func singular(word string) string {
+	switch {
+	case len(word) > 4 && strings.HasSuffix(word, "ies"):
+		return word[:len(word)-3] + "y"
+	case len(word) > 4 && (strings.HasSuffix(word, "oes") || strings.HasSuffix(word, "ches") ||
+		strings.HasSuffix(word, "shes") || strings.HasSuffix(word, "xes")):
+		return word[:len(word)-2]
+	case len(word) > 3 && strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss"):
+		return word[:len(word)-1]
+	}
+	return word
+}
+
+// words splits folded text into words of letters and digits.
+func words(text string) []string {
+	return strings.FieldsFunc(foldText(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// nameTokens are the words of a name compared with other names.
+func nameTokens(name string) []string {
+	tokens := []string{}
+	for _, word := range words(name) {
+		if !nameStopwords[word] {
+			tokens = append(tokens, singular(word))
+		}
+	}
+	return tokens
+}
+
+// ingredientKey reduces an ingredient to what it is, e.g. "2 cups
+// peanut butter, smooth" to "peanut butter".
+func ingredientKey(ingredient string) string {
+	if cut := strings.IndexAny(ingredient, ",("); cut >= 0 {
+		ingredient = ingredient[:cut]
+	}
+	key := []string{}
+	for _, word := range words(ingredient) {
+		word = singular(word)
+		if !ingredientFillers[word] && strings.IndexFunc(word, unicode.IsDigit) < 0 {
+			key = append(key, word)
+		}
+	}
+	return strings.Join(key, " ")
+}
+
+// recipePrint is what is compared of a recipe.
+type recipePrint struct {
+	recipe      *Recipe
+	tokens      []string
+	trigrams    map[string]bool
+	ingredients map[string]bool
+}
+
+func fingerprint(recipe *Recipe) *recipePrint {
+	print := &recipePrint{recipe: recipe, tokens: nameTokens(recipe.Name),
+		trigrams: make(map[string]bool), ingredients: make(map[string]bool)}
+	padded := "  " + strings.Join(print.tokens, " ") + " "
+	runes := []rune(padded)
+	for i := 0; i+3 <= len(runes); i++ {
+		print.trigrams[string(runes[i:i+3])] = true
+	}
+	for _, ingredient := range ParseIngredients(recipe.Ingredientlist) {
+		if key := ingredientKey(ingredient); key != "" {
+			print.ingredients[key] = true
+		}
+	}
+	return print
+}
+
+// jaccard is the share of the union of two sets that they have in common.
+func jaccard(a, b map[string]bool) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 0
+	}
+	common := 0
+	for key := range a {
+		if b[key] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(a)+len(b)-common)
+}
+
+// oneEdit reports whether a and b, words of four letters or more, differ
+// by at most one letter added, dropped, changed or swapped with the next.
+func oneEdit(a, b string) bool {
+	if a == b {
+		return true
+	}
+	x, y := []rune(a), []rune(b)
+	if len(x) < 4 || len(y) < 4 {
+		return false
+	}
+	if len(x) > len(y) {
+		x, y = y, x
+	}
+	if len(y)-len(x) > 1 {
+		return false
+	}
+	i := 0
+	for i < len(x) && x[i] == y[i] {
+		i++
+	}
+	if len(x) < len(y) {
+		return string(x[i:]) == string(y[i+1:])
+	}
+	if string(x[i+1:]) == string(y[i+1:]) {
+		return true
+	}
+	return i+1 < len(x) && x[i] == y[i+1] && x[i+1] == y[i] && string(x[i+2:]) == string(y[i+2:])
+}
+
+// Similarity scores how alike two recipes are, from 0 to 1, by their
+// names and by their ingredients when both list some. Names are compared
+// word by word, allowing a typo in each word, and as letter trigrams;
+// a name made of another's words, like "Mafe" and "Mafe (Peanut stew)",
+// counts as half matched by its extra words.
+func (a *recipePrint) Similarity(b *recipePrint) float64 {
+	tokensA, tokensB := unique(a.tokens), unique(b.tokens)
+	name := 0.0
+	if len(tokensA) > 0 && len(tokensB) > 0 {
+		common := 0
+		for _, x := range tokensA {
+			for _, y := range tokensB {
+				if oneEdit(x, y) {
+					common++
+					break
+				}
+			}
+		}
+		fewest := len(tokensA)
+		if len(tokensB) < fewest {
+			fewest = len(tokensB)
+		}
+		if common > fewest {
+			common = fewest
+		}
+		name = (float64(common)/float64(len(tokensA)+len(tokensB)-common) +
+			float64(common)/float64(fewest)) / 2
+	}
+	common := 0
+	for trigram := range a.trigrams {
+		if b.trigrams[trigram] {
+			common++
+		}
+	}
+	if total := len(a.trigrams) + len(b.trigrams); total > 0 {
+		if dice := 2 * float64(common) / float64(total); dice > name {
+			name = dice
+		}
+	}
+	if len(a.ingredients) == 0 || len(b.ingredients) == 0 {
+		return name
+	}
+	return 0.55*name + 0.45*jaccard(a.ingredients, b.ingredients)
+}
+
+// unique returns words without repeats, in order.
+func unique(words []string) []string {
+	seen := make(map[string]bool)
+	kept := []string{}
+	for _, word := range words {
+		if !seen[word] {
+			seen[word] = true
+			kept = append(kept, word)
+		}
+	}
+	return kept
+}
+
+// nameBlocks are the name prefixes a recipe is compared by: the first
+// three letters of each of its name's words. Recipes must share one to
+// be compared.
+func nameBlocks(tokens []string) []string {
+	blocks := []string{}
+	seen := make(map[string]bool)
+	for _, token := range tokens {
+		if runes := []rune(token); len(runes) >= 3 && !seen[string(runes[:3])] {
+			seen[string(runes[:3])] = true
+			blocks = append(blocks, string(runes[:3]))
+		}
+	}
+	return blocks
+}
+
+// DuplicateMatch is a recipe likely to duplicate another, and how alike
+// they are.
+type DuplicateMatch struct {
+	Recipe *Recipe
+	Score  float64
+}
+
+// Percent is the match's score as a percentage, for pages.
+func (match DuplicateMatch) Percent() int {
+	return int(match.Score*100 + 0.5)
+}
+
+// Likely says whether the recipes are alike enough to be the same dish,
+// and so to be merged.
+func (match DuplicateMatch) Likely() bool {
+	return match.Score >= duplicateThreshold
+}
+
+// FindDuplicatesIn returns the candidates likely to duplicate recipe,
+// most alike first.
+func FindDuplicatesIn(recipe *Recipe, candidates []*Recipe) []DuplicateMatch {
+	print := fingerprint(recipe)
+	matches := []DuplicateMatch{}
+	for _, candidate := range candidates {
+		if candidate.ID == recipe.ID && recipe.ID != 0 {
+			continue
+		}
+		match := DuplicateMatch{Recipe: candidate, Score: print.Similarity(fingerprint(candidate))}
+		if match.Likely() {
+			matches = append(matches, match)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	return matches
+}
+
+// DuplicateCluster is a group of recipes likely to be the same dish.
+// Score is how alike its most alike pair is, and Scores how alike each
+// recipe is to the first, which the merge form keeps unless told not to.
+// Recipes joined to the group through another may be less alike to the
+// first than duplicateThreshold.
+type DuplicateCluster struct {
+	Recipes []*Recipe
+	Score   float64
+	Scores  []float64
+}
+
+// Percent is the cluster's score as a percentage, for pages.
+func (cluster DuplicateCluster) Percent() int {
+	return DuplicateMatch{Score: cluster.Score}.Percent()
+}
+
+// Alike is the i'th recipe and how alike it is to the first.
+func (cluster DuplicateCluster) Alike(i int) (match DuplicateMatch) {
+	if i < len(cluster.Scores) {
+		match = DuplicateMatch{Recipe: cluster.Recipes[i], Score: cluster.Scores[i]}
+	}
+	return match
+}
+
+// ClusterDuplicates groups recipes likely to be the same dish, most alike
+// groups first. Recipes are only compared when they share a name prefix
+// or an ingredient few other recipes have, so that big recipe boxes
+// don't need every pair compared.
+func ClusterDuplicates(recipes []*Recipe) []DuplicateCluster {
+	prints := make([]*recipePrint, len(recipes))
+	printOf := make(map[*Recipe]*recipePrint)
+	blocks := make(map[string][]int)
+	for i, recipe := range recipes {
+		prints[i] = fingerprint(recipe)
+		printOf[recipe] = prints[i]
+		for _, block := range nameBlocks(prints[i].tokens) {
+			blocks["name:"+block] = append(blocks["name:"+block], i)
+		}
+		for key := range prints[i].ingredients {
+			blocks["ingredient:"+key] = append(blocks["ingredient:"+key], i)
+		}
+	}
+
+	// recipes are joined into clusters by their likely duplicate pairs
+	parent := make([]int, len(recipes))
+	for i := range parent {
+		parent[i] = i
+	}
+	var root func(i int) int
+	root = func(i int) int {
+		if parent[i] != i {
+			parent[i] = root(parent[i])
+		}
+		return parent[i]
+	}
+	best := make(map[int]float64)
+	compared := make(map[[2]int]bool)
+	for _, members := range blocks {
+		if len(members) < 2 || len(members) > duplicateBlockLimit {
+			continue
+		}
+		for x := 0; x < len(members); x++ {
+			for y := x + 1; y < len(members); y++ {
+				pair := [2]int{members[x], members[y]}
+				if compared[pair] {
+					continue
+				}
+				compared[pair] = true
+				score := prints[pair[0]].Similarity(prints[pair[1]])
+				if score < duplicateThreshold {
+					continue
+				}
+				a, b := root(pair[0]), root(pair[1])
+				if a != b {
+					parent[b] = a
+					if best[b] > best[a] {
+						best[a] = best[b]
+					}
+				}
+				if score > best[a] {
+					best[a] = score
+				}
+			}
+		}
+	}
+
+	byRoot := make(map[int]*DuplicateCluster)
+	for i, recipe := range recipes {
+		cluster, ok := byRoot[root(i)]
+		if !ok {
+			cluster = &DuplicateCluster{Score: best[root(i)]}
+			byRoot[root(i)] = cluster
+		}
+		cluster.Recipes = append(cluster.Recipes, recipe)
+	}
+	clusters := []DuplicateCluster{}
+	for _, cluster := range byRoot {
+		if len(cluster.Recipes) > 1 {
+			sort.Slice(cluster.Recipes, func(i, j int) bool {
+				return cluster.Recipes[i].ID < cluster.Recipes[j].ID
+			})
+			first := printOf[cluster.Recipes[0]]
+			for _, recipe := range cluster.Recipes {
+				cluster.Scores = append(cluster.Scores, first.Similarity(printOf[recipe]))
+			}
+			clusters = append(clusters, *cluster)
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if clusters[i].Score != clusters[j].Score {
+			return clusters[i].Score > clusters[j].Score
+		}
+		return clusters[i].Recipes[0].ID < clusters[j].Recipes[0].ID
+	})
+	return clusters
+}
+
+// --------------------------------------------
+//                   DATABASE
+// --------------------------------------------
+
+// duplicateColumns are the columns loaded to look for duplicates, and to
+// list them, leaving out pictures.
+const duplicateColumns = `id, name, description, cuisine, country, contributor, ingredientlist`
+
+// FindDuplicates gets up to limit recipes likely to duplicate recipe.
+// Only recipes sharing a name prefix with it are compared.
+func (recipeDB *RecipeDB) FindDuplicates(recipe *Recipe, limit int) ([]DuplicateMatch, error) {
+	blocks := nameBlocks(nameTokens(recipe.Name))
+	if len(blocks) == 0 {
+		return nil, nil
+	}
+	patterns := make([]string, len(blocks))
+	for i, block := range blocks {
+		patterns[i] = "%" + block + "%"
+	}
+	marks, args := placeholders(1, patterns)
+	var candidates []*Recipe
+	err := recipeDB.DB.Select(&candidates, `SELECT `+duplicateColumns+` FROM recipes `+
+		`WHERE `+foldSQL("name")+` LIKE ANY (ARRAY[`+marks+`]) ORDER BY id DESC LIMIT 2000`,
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	matches := FindDuplicatesIn(recipe, candidates)
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, nil
+}
+
+// DuplicateClusters gets every group of recipes likely to be the same
+// dish.
+func (recipeDB *RecipeDB) DuplicateClusters() ([]DuplicateCluster, error) {
+	var recipes []*Recipe
+	err := recipeDB.DB.Select(&recipes, `SELECT `+duplicateColumns+` FROM recipes ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	return ClusterDuplicates(recipes), nil
+}
+
+// AdminDuplicates lists groups of recipes likely to be the same dish.
+func (c *RBController) AdminDuplicates(w http.ResponseWriter, r *http.Request) (err error) {
+	clusters, err := c.DuplicateClusters()
+	if err != nil {
+		return
+	}
+	recipes := 0
+	for _, cluster := range clusters {
+		recipes += len(cluster.Recipes)
+	}
+	c.HTML(w, http.StatusOK, "admin/duplicates", struct {
+		Clusters  []DuplicateCluster
+		Recipes   int
+		Threshold int
+	}{clusters, recipes, DuplicateMatch{Score: duplicateThreshold}.Percent()})
+	return nil
+}
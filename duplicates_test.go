@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestIngredientKey tests that amounts, units and preparation are left
+// out of ingredients, and plurals and accents folded.
+func TestIngredientKey(t *testing.T) {
+	tests := map[string]string{
+		"2 cups peanut butter, smooth": "peanut butter",
+		"3 Tomatoes (ripe)":            "tomato",
+		"1/2 tsp ground cumin":         "cumin",
+		"Piment d'Espelette":           "piment d espelette",
+		"salt, to taste":               "salt",
+		"4":                            "",
+	}
+	for ingredient, expected := range tests {
+		if key := ingredientKey(ingredient); key != expected {
+			t.Errorf("ingredientKey(%q) = %q, expected %q", ingredient, key, expected)
+		}
+	}
+}
+
+// TestFindDuplicatesIn tests that misspelled and accented names of the
+// same dish match, and that different dishes don't.
+func TestFindDuplicatesIn(t *testing.T) {
+	recipe := &Recipe{Name: "Mafé (Peanut Stew)",
+		Ingredientlist: "1 kg chicken; 2 cups peanut butter; 2 onions; salt"}
+	candidates := []*Recipe{
+		{ID: 1, Name: "Peanut stew", Ingredientlist: "chicken; peanut butter; onion; tomatoes"},
+		{ID: 2, Name: "Mafe", Ingredientlist: "500 g chicken, in pieces; peanut butter; onion"},
+		{ID: 3, Name: "Beef stew", Ingredientlist: "beef; carrots; potatoes"},
+		{ID: 4, Name: "Jollof rice", Ingredientlist: "rice; tomatoes; onions"},
+		{ID: 5, Name: "Peanut stwe"},
+	}
+	matches := FindDuplicatesIn(recipe, candidates)
+	ids := []int{}
+	for _, match := range matches {
+		ids = append(ids, match.Recipe.ID)
+	}
+	if !reflect.DeepEqual(ids, []int{5, 1, 2}) {
+		t.Errorf("FindDuplicatesIn() found %v", ids)
+	}
+	for _, match := range matches {
+		if match.Score < duplicateThreshold || match.Score > 1 {
+			t.Errorf("FindDuplicatesIn() scored %s %v", match.Recipe.Name, match.Score)
+		}
+	}
+}
+
+// TestClusterDuplicates tests that likely duplicates are grouped, even
+// through a recipe alike to both, and that lone recipes are left out.
+func TestClusterDuplicates(t *testing.T) {
+	recipes := []*Recipe{
+		{ID: 1, Name: "Chicken Yassa", Ingredientlist: "chicken; onions; lemon juice; mustard"},
+		{ID: 2, Name: "Jollof Rice", Ingredientlist: "rice; tomatoes; onions; pepper"},
+		{ID: 3, Name: "Senegalese chicken yassa",
+			Ingredientlist: "chicken; onions; lemons; mustard; olive oil"},
+		{ID: 4, Name: "Yassa", Ingredientlist: "poulet; onions; lemons; mustard; olive oil"},
+		{ID: 7, Name: "Poulet Yassa", Ingredientlist: "poulet; oignons; citron; moutarde"},
+		{ID: 5, Name: "Jollof rice (Ghana style)", Ingredientlist: "rice; tomato; onion; pepper"},
+		{ID: 6, Name: "Fufu", Ingredientlist: "cassava"},
+	}
+	clusters := ClusterDuplicates(recipes)
+	got := [][]int{}
+	for _, cluster := range clusters {
+		ids := []int{}
+		for _, recipe := range cluster.Recipes {
+			ids = append(ids, recipe.ID)
+		}
+		got = append(got, ids)
+	}
+	if !reflect.DeepEqual(got, [][]int{{2, 5}, {1, 3, 4}}) {
+		t.Errorf("ClusterDuplicates() = %v", got)
+	}
+	if len(clusters) > 0 && clusters[0].Percent() != 91 {
+		t.Errorf("ClusterDuplicates() scored the best cluster %d%%", clusters[0].Percent())
+	}
+	for _, cluster := range clusters {
+		if len(cluster.Scores) != len(cluster.Recipes) || cluster.Scores[0] != 1 ||
+			cluster.Alike(1).Score != cluster.Scores[1] {
+			t.Errorf("ClusterDuplicates() scored %v against the first", cluster.Scores)
+		}
+	}
+}
+
+// TestNewRecipeDuplicates tests that the new recipe form lists likely
+// duplicates, and asks for no more warnings when it is saved again.
+func TestNewRecipeDuplicates(t *testing.T) {
+	c := &RBController{Render: NewRenderer(), RecipeDB: nil}
+	w := httptest.NewRecorder()
+	c.HTML(w, http.StatusOK, "recipes/edit", struct {
+		*Recipe
+		NewRecipe  bool
+		Duplicates []DuplicateMatch
+	}{&Recipe{Name: "Mafe"}, true, []DuplicateMatch{
+		{Recipe: &Recipe{ID: 7, Name: "Mafé", Country: "Senegal"}, Score: 0.816}}})
+	page := w.Body.String()
+	if !strings.Contains(page, `<a href="/recipes/7/" target="_blank">Mafé</a>`) ||
+		!strings.Contains(page, "(Senegal), 82% alike") ||
+		!strings.Contains(page, `name="not_duplicate" value="1"`) {
+		t.Errorf("recipes/edit rendered:\n%s", page)
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"github.com/gorilla/mux"
+	"image"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// exportMaxRecipes is the most recipes an e-book may hold.
+const exportMaxRecipes = 500
+
+// textWidthColumns is the width plain text exports are wrapped to.
+const textWidthColumns = 72
+
+// recipeAbout summarizes a recipe's cuisine, meals, seasons and yield.
+func recipeAbout(recipe *Recipe) []string {
+	about := []string{"Cuisine " + strconv.Itoa(recipe.Cuisine)}
+	if meals := bitNames(Meals, recipe.Mealtype); len(meals) > 0 {
+		about = append(about, strings.Join(meals, ", "))
+	}
+	if seasons := bitNames(Seasons, recipe.Season); len(seasons) > 0 {
+		about = append(about, strings.Join(seasons, ", "))
+	}
+	if recipe.Yield != "" {
+		about = append(about, "Makes "+recipe.Yield)
+	}
+	return about
+}
+
+// recipeSteps splits a recipe's instructions into paragraphs.
+func recipeSteps(recipe *Recipe) []string {
+	steps := []string{}
+	for _, step := range strings.Split(recipe.Instructions, "\n") {
+		if step = strings.TrimSpace(step); step != "" {
+			steps = append(steps, step)
+		}
+	}
+	return steps
+}
+
+// recipeIngredients lists a recipe's ingredients, leaving out blanks.
+func recipeIngredients(recipe *Recipe) []string {
+	ingredients := []string{}
+	for _, ingredient := range ParseIngredients(recipe.Ingredientlist) {
+		if ingredient != "" {
+			ingredients = append(ingredients, ingredient)
+		}
+	}
+	return ingredients
+}
+
+// --------------------------------------------
+//               MARKDOWN AND TEXT
+// --------------------------------------------
+
+var (
+	// markdownSpecial matches characters Markdown would treat as markup
+	markdownSpecial = regexp.MustCompile("[\\\\`*_\\[\\]<>]")
+	// markdownBlock matches starts of lines Markdown would treat as blocks
+	markdownBlock = regexp.MustCompile(`^(#|>|[-+] )`)
+	// markdownNumber matches numbered list items, escaped after the number
+	markdownNumber = regexp.MustCompile(`^(\d+)([.)] )`)
+)
+
+// markdownEscape escapes text so Markdown shows it as it is.
+func markdownEscape(text string) string {
+	text = markdownSpecial.ReplaceAllString(text, `\$0`)
+	if markdownBlock.MatchString(text) {
+		text = `\` + text
+	}
+	return markdownNumber.ReplaceAllString(text, `$1\$2`)
+}
+
+// RecipeMarkdown writes a recipe as Markdown.
+func RecipeMarkdown(recipe *Recipe) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# %s\n\n", markdownEscape(recipe.Name))
+	fmt.Fprintf(&buf, "*%s*\n\n", markdownEscape(strings.Join(recipeAbout(recipe), " · ")))
+	if recipe.Description != "" {
+		fmt.Fprintf(&buf, "%s\n\n", markdownEscape(recipe.Description))
+	}
+	buf.WriteString("## Ingredients\n\n")
+	for _, ingredient := range recipeIngredients(recipe) {
+		fmt.Fprintf(&buf, "- %s\n", markdownEscape(ingredient))
+	}
+	buf.WriteString("\n## Instructions\n\n")
+	for i, step := range recipeSteps(recipe) {
+		fmt.Fprintf(&buf, "%d. %s\n", i+1, markdownEscape(step))
+	}
+	if source := recipeSource(recipe); source != "" || recipe.Story != "" {
+		buf.WriteString("\n## Where it comes from\n\n")
+		if source != "" {
+			fmt.Fprintf(&buf, "%s\n", markdownEscape(source))
+		}
+		if recipe.Story != "" {
+			buf.WriteString("\n")
+			for _, line := range strings.Split(strings.TrimSpace(recipe.Story), "\n") {
+				fmt.Fprintf(&buf, "> %s\n", markdownEscape(strings.TrimSpace(line)))
+			}
+		}
+	}
+	if len(recipe.Tags) > 0 {
+		fmt.Fprintf(&buf, "\nTags: %s\n", markdownEscape(strings.Join(recipe.Tags, ", ")))
+	}
+	return buf.String()
+}
+
+// wrapColumns wraps text to lines of at most width characters, the
+// first starting with first and the rest with rest.
+func wrapColumns(text string, width int, first, rest string) string {
+	lines := []string{}
+	line, prefix := "", first
+	for _, word := range strings.Fields(text) {
+		if line != "" && len([]rune(prefix+line+" "+word)) > width {
+			lines = append(lines, prefix+line)
+			line, prefix = "", rest
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		lines = append(lines, prefix+line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// RecipeText writes a recipe as plain text, wrapped for reading in any
+// text editor.
+func RecipeText(recipe *Recipe) string {
+	var buf bytes.Buffer
+	heading := func(title string) {
+		fmt.Fprintf(&buf, "\n%s\n%s\n\n", title, strings.Repeat("-", len([]rune(title))))
+	}
+	fmt.Fprintf(&buf, "%s\n%s\n\n", recipe.Name,
+		strings.Repeat("=", len([]rune(recipe.Name))))
+	fmt.Fprintf(&buf, "%s\n", wrapColumns(strings.Join(recipeAbout(recipe), " | "),
+		textWidthColumns, "", ""))
+	if recipe.Description != "" {
+		fmt.Fprintf(&buf, "\n%s\n", wrapColumns(recipe.Description, textWidthColumns, "", ""))
+	}
+	heading("Ingredients")
+	for _, ingredient := range recipeIngredients(recipe) {
+		fmt.Fprintf(&buf, "%s\n", wrapColumns(ingredient, textWidthColumns, "  * ", "    "))
+	}
+	heading("Instructions")
+	for i, step := range recipeSteps(recipe) {
+		number := fmt.Sprintf("%2d. ", i+1)
+		fmt.Fprintf(&buf, "%s\n", wrapColumns(step, textWidthColumns, number, "    "))
+	}
+	if source := recipeSource(recipe); source != "" || recipe.Story != "" {
+		heading("Where it comes from")
+		if source != "" {
+			fmt.Fprintf(&buf, "%s\n", wrapColumns(source, textWidthColumns, "", ""))
+		}
+		if recipe.Story != "" {
+			fmt.Fprintf(&buf, "\n%s\n", wrapColumns(recipe.Story, textWidthColumns, "", ""))
+		}
+	}
+	if len(recipe.Tags) > 0 {
+		fmt.Fprintf(&buf, "\nTags: %s\n", strings.Join(recipe.Tags, ", "))
+	}
+	return buf.String()
+}
+
+// --------------------------------------------
+//                     EPUB
+// --------------------------------------------
+
+// epubPictureTypes are the media types of pictures e-books may hold.
+var epubPictureTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+}
+
+// epubItem is a file of an e-book listed in its manifest.
+type epubItem struct {
+	ID        string
+	Href      string
+	MediaType string
+}
+
+// epubRecipe is a recipe's chapter of an e-book.
+type epubRecipe struct {
+	*Recipe
+	Href        string
+	Picture     string
+	About       string
+	Ingredients []string
+	Steps       []string
+	Source      string
+}
+
+// epubBook is the binding of an e-book's templates.
+type epubBook struct {
+	ID       string
+	Title    string
+	Modified string
+	Items    []epubItem
+	Chapters []*epubRecipe
+	Groups   []epubGroup
+}
+
+// epubGroup is a section of an e-book's navigation.
+type epubGroup struct {
+	Name     string
+	Chapters []*epubRecipe
+}
+
+// epubTemplates write the files of an e-book. html/template would escape
+// the XML declarations, so these are text templates escaping each value
+// with html. NCX numbers its navigation points from 1, hence inc.
+var epubTemplates = template.Must(template.New("epub").Funcs(template.FuncMap{
+	"inc": func(i int) int { return i + 1 },
+}).Parse(`
+{{define "container"}}<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+{{end}}
+{{define "opf"}}<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">{{html .ID}}</dc:identifier>
+    <dc:title>{{html .Title}}</dc:title>
+    <dc:language>en</dc:language>
+    <dc:publisher>Peace Corps RecipeBox</dc:publisher>
+    <meta property="dcterms:modified">{{html .Modified}}</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    {{range .Items}}<item id="{{html .ID}}" href="{{html .Href}}" media-type="{{html .MediaType}}"/>
+    {{end}}
+  </manifest>
+  <spine toc="ncx">
+    <itemref idref="nav"/>
+    {{range .Chapters}}<itemref idref="recipe-{{html .ID}}"/>
+    {{end}}
+  </spine>
+</package>
+{{end}}
+{{define "nav"}}<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" lang="en">
+<head><title>{{html .Title}}</title></head>
+<body>
+  <h1>{{html .Title}}</h1>
+  <nav epub:type="toc" id="toc">
+    <h2>Contents</h2>
+    <ol>
+      {{range .Groups}}<li><span>{{html .Name}}</span>
+        <ol>
+          {{range .Chapters}}<li><a href="{{html .Href}}">{{html .Name}}</a></li>
+          {{end}}
+        </ol>
+      </li>
+      {{end}}
+    </ol>
+  </nav>
+</body>
+</html>
+{{end}}
+{{define "ncx"}}<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+  <head><meta name="dtb:uid" content="{{html .ID}}"/></head>
+  <docTitle><text>{{html .Title}}</text></docTitle>
+  <navMap>
+    {{range $i, $chapter := .Chapters}}<navPoint id="nav-{{html $chapter.ID}}" playOrder="{{html (inc $i)}}">
+      <navLabel><text>{{html $chapter.Name}}</text></navLabel>
+      <content src="{{html $chapter.Href}}"/>
+    </navPoint>
+    {{end}}
+  </navMap>
+</ncx>
+{{end}}
+{{define "recipe"}}<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" lang="en">
+<head><title>{{html .Name}}</title></head>
+<body>
+  {{if .Picture}}<p><img src="{{html .Picture}}" alt="{{html .Name}}" style="max-width: 100%"/></p>{{end}}
+  <h1>{{html .Name}}</h1>
+  <p><small>{{html .About}}</small></p>
+  {{if .Description}}<p><em>{{html .Description}}</em></p>{{end}}
+  <h2>Ingredients</h2>
+  <ul>
+    {{range .Ingredients}}<li>{{html .}}</li>
+    {{end}}
+  </ul>
+  <h2>Instructions</h2>
+  <ol>
+    {{range .Steps}}<li>{{html .}}</li>
+    {{end}}
+  </ol>
+  {{if or .Source .Story}}<h2>Where it comes from</h2>
+  {{if .Source}}<p>{{html .Source}}</p>{{end}}
+  {{if .Story}}<blockquote><p>{{html .Story}}</p></blockquote>{{end}}{{end}}
+  {{if .Tags}}<p><small>Tags: {{range $i, $tag := .Tags}}{{if $i}}, {{end}}{{html $tag}}{{end}}</small></p>{{end}}
+</body>
+</html>
+{{end}}`))
+
+// RecipesEPUB packages recipes as an EPUB 3 e-book, with a chapter for
+// each recipe and contents grouped by cuisine. A table of contents in
+// the older NCX format is included for EPUB 2 readers.
+func RecipesEPUB(title string, recipes []*Recipe) ([]byte, error) {
+	id, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+	book := &epubBook{ID: "urn:recipebox:" + id, Title: title,
+		Modified: time.Now().UTC().Format("2006-01-02T15:04:05Z")}
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	write := func(name string, data []byte) error {
+		w, err := archive.Create(name)
+		if err == nil {
+			_, err = w.Write(data)
+		}
+		return err
+	}
+
+	// the mimetype must come first, uncompressed
+	w, err := archive.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return nil, err
+	}
+	w.Write([]byte("application/epub+zip"))
+
+	chapters := make(map[*Recipe]*epubRecipe)
+	for _, recipe := range recipes {
+		chapter := &epubRecipe{Recipe: recipe,
+			Href:        "recipe-" + strconv.Itoa(recipe.ID) + ".xhtml",
+			About:       strings.Join(recipeAbout(recipe), " · "),
+			Ingredients: recipeIngredients(recipe), Steps: recipeSteps(recipe),
+			Source: recipeSource(recipe)}
+		if _, format, err := image.DecodeConfig(bytes.NewReader(recipe.Picture)); err == nil &&
+			epubPictureTypes[format] != "" {
+			chapter.Picture = "images/recipe-" + strconv.Itoa(recipe.ID) + "." + format
+			book.Items = append(book.Items, epubItem{ID: "picture-" + strconv.Itoa(recipe.ID),
+				Href: chapter.Picture, MediaType: epubPictureTypes[format]})
+			if err = write("OEBPS/"+chapter.Picture, recipe.Picture); err != nil {
+				return nil, err
+			}
+		}
+		book.Items = append(book.Items, epubItem{ID: "recipe-" + strconv.Itoa(recipe.ID),
+			Href: chapter.Href, MediaType: "application/xhtml+xml"})
+		chapters[recipe] = chapter
+	}
+
+	// chapters follow the contents, which are ordered like a cookbook's
+	for _, group := range (&Cookbook{GroupBy: GroupByCuisine, Recipes: recipes}).groups() {
+		navGroup := epubGroup{Name: group.Name}
+		for _, recipe := range group.Recipes {
+			navGroup.Chapters = append(navGroup.Chapters, chapters[recipe])
+			book.Chapters = append(book.Chapters, chapters[recipe])
+		}
+		book.Groups = append(book.Groups, navGroup)
+	}
+
+	files := []struct{ name, template string }{
+		{"META-INF/container.xml", "container"},
+		{"OEBPS/content.opf", "opf"},
+		{"OEBPS/nav.xhtml", "nav"},
+		{"OEBPS/toc.ncx", "ncx"},
+	}
+	for _, file := range files {
+		var page bytes.Buffer
+		if err = epubTemplates.ExecuteTemplate(&page, file.template, book); err != nil {
+			return nil, err
+		}
+		if err = write(file.name, page.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	for _, chapter := range book.Chapters {
+		var page bytes.Buffer
+		if err = epubTemplates.ExecuteTemplate(&page, "recipe", chapter); err != nil {
+			return nil, err
+		}
+		if err = write("OEBPS/"+chapter.Href, page.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	if err = archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// --------------------------------------------
+//                   HANDLERS
+// --------------------------------------------
+
+// sendDownload answers with a file to save, of the given content type.
+func sendDownload(w http.ResponseWriter, data []byte, contentType, filename string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// RecipeExport downloads a recipe as Markdown or plain text, by the
+// format route variable.
+func (c *RBController) RecipeExport(w http.ResponseWriter, r *http.Request) (err error) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	recipe, err := c.GetRecipe(id)
+	if err == sql.ErrNoRows {
+		if moved, err := c.redirectMerged(w, r, id); moved || err != nil {
+			return err
+		}
+		c.RenderError(w, 404, "Sorry, your page wasn't found")
+		return nil
+	} else if err != nil {
+		return
+	}
+	if mux.Vars(r)["format"] == "md" {
+		sendDownload(w, []byte(RecipeMarkdown(recipe)), "text/markdown; charset=UTF-8",
+			downloadName(recipe.Name, "md"))
+	} else {
+		sendDownload(w, []byte(RecipeText(recipe)), "text/plain; charset=UTF-8",
+			downloadName(recipe.Name, "txt"))
+	}
+	return nil
+}
+
+// RecipesEPUBExport downloads the recipes matching a search of
+// /recipes/ as an e-book, titled by the title parameter.
+func (c *RBController) RecipesEPUBExport(w http.ResponseWriter, r *http.Request) (err error) {
+	filter := parseBrowseFilter(r)
+	recipes, total, err := c.BrowseRecipes(filter.search(), exportMaxRecipes, 0)
+	if err != nil {
+		return
+	}
+	if total == 0 {
+		c.RenderError(w, 404, "Sorry, no recipes match the search.")
+		return nil
+	}
+	if total > exportMaxRecipes {
+		c.RenderError(w, http.StatusBadRequest, fmt.Sprintf("Sorry, %s recipes "+
+			"match the search, but an e-book may hold at most %d. Please narrow "+
+			"the search.", formatCount(total), exportMaxRecipes))
+		return nil
+	}
+	title := strings.Join(strings.Fields(r.FormValue(`title`)), " ")
+	if title == "" {
+		title = "RecipeBox Recipes"
+	}
+	book, err := RecipesEPUB(title, recipes)
+	if err != nil {
+		return
+	}
+	sendDownload(w, book, "application/epub+zip", downloadName(title, "epub"))
+	return nil
+}
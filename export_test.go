@@ -0,0 +1,79 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// TestRecipeMarkdown tests that markup in a recipe is escaped and that
+// long lines of plain text are wrapped.
+func TestRecipeMarkdown(t *testing.T) {
+	recipe := &Recipe{Name: "Mafé *the* best", Cuisine: 3, Mealtype: 4,
+		Ingredientlist: "2 cups peanut_butter; # salt", Instructions: "1. Stew.\n\nServe.",
+		Tags: []string{"stew"}}
+	markdown := RecipeMarkdown(recipe)
+	for _, line := range []string{`# Mafé \*the\* best`, `- 2 cups peanut\_butter`,
+		`- \# salt`, `1. 1\. Stew.`, `2. Serve.`, `Tags: stew`} {
+		if !strings.Contains(markdown, line+"\n") {
+			t.Errorf("RecipeMarkdown() is missing %q:\n%s", line, markdown)
+		}
+	}
+
+	text := wrapColumns(strings.Repeat("pound ", 20), 30, " 1. ", "    ")
+	if text != " 1. pound pound pound pound\n    pound pound pound pound\n"+
+		"    pound pound pound pound\n    pound pound pound pound\n"+
+		"    pound pound pound pound" {
+		t.Errorf("wrapColumns() = %q", text)
+	}
+}
+
+// TestRecipesEPUB tests that an e-book starts with its stored mimetype
+// and that its files are well-formed XML.
+func TestRecipesEPUB(t *testing.T) {
+	book, err := RecipesEPUB("Mafé & friends", []*Recipe{
+		{ID: 1, Name: "Fufu <pounded>", Cuisine: 2, Ingredientlist: "cassava",
+			Instructions: "Pound."},
+		{ID: 2, Name: "Mafé", Cuisine: 1, Ingredientlist: "peanuts & tomato",
+			Instructions: "Stew.", Story: `From "Kédougou"`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(book), int64(len(book)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first := archive.File[0]; first.Name != "mimetype" || first.Method != zip.Store {
+		t.Errorf("the e-book starts with %s, expected a stored mimetype", first.Name)
+	}
+	names := []string{}
+	for _, file := range archive.File[1:] {
+		names = append(names, file.Name)
+		f, _ := file.Open()
+		data, _ := ioutil.ReadAll(f)
+		f.Close()
+		decoder := xml.NewDecoder(bytes.NewReader(data))
+		decoder.Strict, decoder.AutoClose = true, nil
+		for err == nil {
+			_, err = decoder.Token()
+		}
+		if err != io.EOF {
+			t.Errorf("%s isn't well-formed: %s", file.Name, err)
+		}
+		err = nil
+		// NCX navigation points are numbered from 1
+		if file.Name == "OEBPS/toc.ncx" && (!bytes.Contains(data, []byte(`playOrder="1"`)) ||
+			!bytes.Contains(data, []byte(`playOrder="2"`)) || bytes.Contains(data, []byte(`playOrder="0"`))) {
+			t.Errorf("toc.ncx numbers its navigation points wrongly:\n%s", data)
+		}
+	}
+	if strings.Join(names, " ") != "META-INF/container.xml OEBPS/content.opf "+
+		"OEBPS/nav.xhtml OEBPS/toc.ncx OEBPS/recipe-2.xhtml OEBPS/recipe-1.xhtml" {
+		t.Errorf("the e-book holds %v", names)
+	}
+}
@@ -0,0 +1,806 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// This file holds a small GraphQL implementation: enough of the query
+// language for /graphql, executed breadth first so that each field is
+// resolved for all of its parent objects at once. A field nested under a
+// list therefore costs one query rather than one per item. Fragments,
+// directives and introspection beyond __typename aren't supported.
+
+// graphMaxDepth is how deeply selection sets, values and types may nest
+// in a query.
+const graphMaxDepth = 15
+
+// graphMaxCost is the most fields a query may resolve, counting a field
+// once for each object it is resolved on. Nested lists multiply, so
+// this stops a small query from asking for millions of values.
+const graphMaxCost = 10000
+
+// --------------------------------------------
+//                    PARSING
+// --------------------------------------------
+
+// graphOperation is a query or mutation.
+type graphOperation struct {
+	Type       string
+	Name       string
+	Variables  []graphVariable
+	Selections []*graphSelection
+}
+
+// graphVariable is a variable declared by an operation.
+type graphVariable struct {
+	Name    string
+	Default interface{}
+	NonNull bool
+}
+
+// graphSelection is a field asked for in a selection set.
+type graphSelection struct {
+	Alias      string
+	Name       string
+	Args       map[string]interface{}
+	Selections []*graphSelection
+}
+
+// graphVar is a reference to a variable in an argument value.
+type graphVar string
+
+// graphEnum is an enum value in an argument, such as DINNER.
+type graphEnum string
+
+type graphToken struct {
+	kind  byte // 'n'ame, 'i'nt, 'f'loat, 's'tring, 'p'unctuator or 0 at the end
+	value string
+	pos   int
+}
+
+// lexGraphQL splits a GraphQL document into tokens. Commas are
+// insignificant in GraphQL, so they are dropped like whitespace.
+func lexGraphQL(src string) ([]graphToken, error) {
+	var tokens []graphToken
+	for i := 0; i < len(src); {
+		ch := src[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == ',':
+			i++
+		case ch == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.IndexByte("!$():=@[]{}|", ch) >= 0:
+			tokens = append(tokens, graphToken{'p', string(ch), i})
+			i++
+		case ch == '.':
+			if !strings.HasPrefix(src[i:], "...") {
+				return nil, fmt.Errorf("unexpected . at %d", i)
+			}
+			tokens = append(tokens, graphToken{'p', "...", i})
+			i += 3
+		case ch == '_' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z':
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] >= 'a' && src[i] <= 'z' ||
+				src[i] >= 'A' && src[i] <= 'Z' || src[i] >= '0' && src[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, graphToken{'n', src[start:i], start})
+		case ch == '-' || ch >= '0' && ch <= '9':
+			start := i
+			i++
+			kind := byte('i')
+			for i < len(src) && strings.IndexByte("0123456789.eE+-", src[i]) >= 0 {
+				if strings.IndexByte(".eE", src[i]) >= 0 {
+					kind = 'f'
+				}
+				i++
+			}
+			tokens = append(tokens, graphToken{kind, src[start:i], start})
+		case ch == '"':
+			start := i
+			if strings.HasPrefix(src[i:], `"""`) {
+				end := strings.Index(src[i+3:], `"""`)
+				if end < 0 {
+					return nil, fmt.Errorf("unterminated string at %d", start)
+				}
+				tokens = append(tokens, graphToken{'s', src[i+3 : i+3+end], start})
+				i += end + 6
+				continue
+			}
+			var b strings.Builder
+			for i++; ; i++ {
+				if i >= len(src) || src[i] == '\n' {
+					return nil, fmt.Errorf("unterminated string at %d", start)
+				}
+				if src[i] == '"' {
+					i++
+					break
+				}
+				if src[i] != '\\' {
+					b.WriteByte(src[i])
+					continue
+				}
+				i++
+				if i >= len(src) {
+					return nil, fmt.Errorf("unterminated string at %d", start)
+				}
+				switch src[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				case 'r':
+					b.WriteByte('\r')
+				case 'b':
+					b.WriteByte('\b')
+				case 'f':
+					b.WriteByte('\f')
+				case 'u':
+					if i+5 > len(src) {
+						return nil, fmt.Errorf("bad escape at %d", i)
+					}
+					code, err := strconv.ParseUint(src[i+1:i+5], 16, 32)
+					if err != nil {
+						return nil, fmt.Errorf("bad escape at %d", i)
+					}
+					b.WriteRune(rune(code))
+					i += 4
+				default:
+					b.WriteByte(src[i])
+				}
+			}
+			tokens = append(tokens, graphToken{'s', b.String(), start})
+		default:
+			r, _ := utf8.DecodeRuneInString(src[i:])
+			return nil, fmt.Errorf("unexpected %q at %d", r, i)
+		}
+	}
+	return append(tokens, graphToken{pos: len(src)}), nil
+}
+
+// graphParser parses a list of tokens by recursive descent.
+type graphParser struct {
+	tokens []graphToken
+	next   int
+	depth  int
+}
+
+func (p *graphParser) peek() graphToken { return p.tokens[p.next] }
+
+func (p *graphParser) take() graphToken {
+	token := p.tokens[p.next]
+	if token.kind != 0 {
+		p.next++
+	}
+	return token
+}
+
+// is reports whether the next token is the given punctuator or name.
+func (p *graphParser) is(value string) bool {
+	token := p.peek()
+	return (token.kind == 'p' || token.kind == 'n') && token.value == value
+}
+
+func (p *graphParser) expect(value string) error {
+	if !p.is(value) {
+		return p.unexpected("expected " + value)
+	}
+	p.take()
+	return nil
+}
+
+func (p *graphParser) name() (string, error) {
+	if p.peek().kind != 'n' {
+		return "", p.unexpected("expected a name")
+	}
+	return p.take().value, nil
+}
+
+// nest enters a nested selection set, value or type, failing if the
+// query nests too deeply. Callers leave it again with p.depth--.
+func (p *graphParser) nest() error {
+	if p.depth++; p.depth > graphMaxDepth {
+		return fmt.Errorf("the query nests more than %d levels deep", graphMaxDepth)
+	}
+	return nil
+}
+
+func (p *graphParser) unexpected(msg string) error {
+	token := p.peek()
+	if token.kind == 0 {
+		return fmt.Errorf("%s, found the end of the query", msg)
+	}
+	return fmt.Errorf("%s, found %q at %d", msg, token.value, token.pos)
+}
+
+// parseGraphQL parses a document of operations. A document may be a
+// bare selection set, which is short for a query.
+func parseGraphQL(src string) ([]*graphOperation, error) {
+	tokens, err := lexGraphQL(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &graphParser{tokens: tokens}
+	var operations []*graphOperation
+	for p.peek().kind != 0 {
+		op, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+		operations = append(operations, op)
+	}
+	if len(operations) == 0 {
+		return nil, errors.New("the query has no operations")
+	}
+	return operations, nil
+}
+
+func (p *graphParser) operation() (op *graphOperation, err error) {
+	op = &graphOperation{Type: "query"}
+	if !p.is("{") {
+		if op.Type, err = p.name(); err != nil {
+			return
+		}
+		if op.Type != "query" && op.Type != "mutation" {
+			return nil, fmt.Errorf("%s operations aren't supported", op.Type)
+		}
+		if p.peek().kind == 'n' {
+			op.Name = p.take().value
+		}
+		if p.is("(") {
+			if op.Variables, err = p.variables(); err != nil {
+				return
+			}
+		}
+	}
+	op.Selections, err = p.selectionSet()
+	return
+}
+
+func (p *graphParser) variables() (vars []graphVariable, err error) {
+	p.take()
+	for !p.is(")") {
+		var v graphVariable
+		if err = p.expect("$"); err != nil {
+			return
+		}
+		if v.Name, err = p.name(); err != nil {
+			return
+		}
+		if err = p.expect(":"); err != nil {
+			return
+		}
+		if v.NonNull, err = p.typeRef(); err != nil {
+			return
+		}
+		if p.is("=") {
+			p.take()
+			if v.Default, err = p.value(); err != nil {
+				return
+			}
+		}
+		vars = append(vars, v)
+	}
+	p.take()
+	return
+}
+
+// typeRef skips a type such as [String!]!, reporting whether it is
+// non-null. Variable types aren't otherwise checked.
+func (p *graphParser) typeRef() (nonNull bool, err error) {
+	if err = p.nest(); err != nil {
+		return
+	}
+	defer func() { p.depth-- }()
+	if p.is("[") {
+		p.take()
+		if _, err = p.typeRef(); err != nil {
+			return
+		}
+		if err = p.expect("]"); err != nil {
+			return
+		}
+	} else if _, err = p.name(); err != nil {
+		return
+	}
+	if p.is("!") {
+		p.take()
+		nonNull = true
+	}
+	return
+}
+
+func (p *graphParser) selectionSet() (selections []*graphSelection, err error) {
+	if err = p.nest(); err != nil {
+		return
+	}
+	defer func() { p.depth-- }()
+	if err = p.expect("{"); err != nil {
+		return
+	}
+	for !p.is("}") {
+		if p.is("...") {
+			return nil, errors.New("fragments aren't supported")
+		}
+		if p.is("@") {
+			return nil, errors.New("directives aren't supported")
+		}
+		sel := &graphSelection{}
+		if sel.Name, err = p.name(); err != nil {
+			return
+		}
+		sel.Alias = sel.Name
+		if p.is(":") {
+			p.take()
+			if sel.Name, err = p.name(); err != nil {
+				return
+			}
+		}
+		if p.is("(") {
+			if sel.Args, err = p.arguments(); err != nil {
+				return
+			}
+		}
+		if p.is("{") {
+			if sel.Selections, err = p.selectionSet(); err != nil {
+				return
+			}
+		}
+		selections = append(selections, sel)
+	}
+	p.take()
+	if len(selections) == 0 {
+		return nil, errors.New("selection sets may not be empty")
+	}
+	return
+}
+
+func (p *graphParser) arguments() (args map[string]interface{}, err error) {
+	p.take()
+	args = make(map[string]interface{})
+	for !p.is(")") {
+		var name string
+		if name, err = p.name(); err != nil {
+			return
+		}
+		if err = p.expect(":"); err != nil {
+			return
+		}
+		if args[name], err = p.value(); err != nil {
+			return
+		}
+	}
+	p.take()
+	return
+}
+
+// value parses an argument value into Go: ints, float64s, strings,
+// bools, nil, []interface{}, map[string]interface{}, graphEnum and
+// graphVar.
+func (p *graphParser) value() (interface{}, error) {
+	if err := p.nest(); err != nil {
+		return nil, err
+	}
+	defer func() { p.depth-- }()
+	token := p.peek()
+	switch {
+	case token.kind == 'p' && token.value == "$":
+		p.take()
+		name, err := p.name()
+		return graphVar(name), err
+	case token.kind == 'i':
+		p.take()
+		return strconv.Atoi(token.value)
+	case token.kind == 'f':
+		p.take()
+		return strconv.ParseFloat(token.value, 64)
+	case token.kind == 's':
+		p.take()
+		return token.value, nil
+	case token.kind == 'n':
+		p.take()
+		switch token.value {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return graphEnum(token.value), nil
+	case token.kind == 'p' && token.value == "[":
+		p.take()
+		list := []interface{}{}
+		for !p.is("]") {
+			if p.peek().kind == 0 {
+				return nil, p.unexpected("expected ]")
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		p.take()
+		return list, nil
+	case token.kind == 'p' && token.value == "{":
+		p.take()
+		object := make(map[string]interface{})
+		for !p.is("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect(":"); err != nil {
+				return nil, err
+			}
+			if object[name], err = p.value(); err != nil {
+				return nil, err
+			}
+		}
+		p.take()
+		return object, nil
+	}
+	return nil, p.unexpected("expected a value")
+}
+
+// --------------------------------------------
+//                   EXECUTION
+// --------------------------------------------
+
+// graphResolver resolves a field for every one of its parent objects at
+// once, returning one value per parent in the same order.
+type graphResolver func(ctx *graphContext, parents []interface{},
+	args map[string]interface{}) ([]interface{}, error)
+
+// graphField is a field of an object type. Type is written as in a
+// GraphQL schema, e.g. "[Recipe!]!"; types named in the schema are
+// objects, and anything else is a scalar.
+type graphField struct {
+	Type    string
+	Resolve graphResolver
+}
+
+// graphType is an object type.
+type graphType struct {
+	Name   string
+	Fields map[string]*graphField
+}
+
+// graphSchema is a set of object types, with Query and Mutation roots.
+type graphSchema map[string]*graphType
+
+// graphError is an error in a GraphQL response.
+type graphError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// graphContext is the state of one GraphQL request.
+type graphContext struct {
+	schema    graphSchema
+	variables map[string]interface{}
+	errors    []graphError
+	// cost counts the fields resolved so far, up to graphMaxCost
+	cost int
+}
+
+// graphObject is a result object, keeping its fields in the order they
+// were asked for.
+type graphObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newGraphObject() *graphObject {
+	return &graphObject{values: make(map[string]interface{})}
+}
+
+func (obj *graphObject) set(key string, value interface{}) {
+	if _, ok := obj.values[key]; !ok {
+		obj.keys = append(obj.keys, key)
+	}
+	obj.values[key] = value
+}
+
+// MarshalJSON writes the object's fields in order.
+func (obj *graphObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range obj.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		buf.Write(name)
+		buf.WriteByte(':')
+		value, err := json.Marshal(obj.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// perItem makes a graphResolver from a function resolving one parent.
+func perItem(resolve func(ctx *graphContext, parent interface{},
+	args map[string]interface{}) (interface{}, error)) graphResolver {
+	return func(ctx *graphContext, parents []interface{},
+		args map[string]interface{}) ([]interface{}, error) {
+		values := make([]interface{}, len(parents))
+		for i, parent := range parents {
+			value, err := resolve(ctx, parent, args)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return values, nil
+	}
+}
+
+// executeGraphQL runs an operation against a schema.
+func executeGraphQL(schema graphSchema, op *graphOperation, root interface{},
+	variables map[string]interface{}) (*graphObject, []graphError) {
+	ctx := &graphContext{schema: schema, variables: make(map[string]interface{})}
+	for _, v := range op.Variables {
+		value, ok := variables[v.Name]
+		if !ok {
+			value = v.Default
+		}
+		if value == nil && v.NonNull {
+			return nil, []graphError{{Message: "variable $" + v.Name + " is required"}}
+		}
+		ctx.variables[v.Name] = value
+	}
+
+	rootType := schema["Query"]
+	if op.Type == "mutation" {
+		rootType = schema["Mutation"]
+	}
+	if rootType == nil {
+		return nil, []graphError{{Message: op.Type + "s aren't supported"}}
+	}
+	objects, err := ctx.execute(rootType, []interface{}{root}, op.Selections, nil)
+	if err != nil {
+		return nil, append(ctx.errors, graphError{Message: err.Error()})
+	}
+	return objects[0], ctx.errors
+}
+
+// argValues substitutes variables into a field's arguments.
+func (ctx *graphContext) argValues(args map[string]interface{}) (map[string]interface{}, error) {
+	var substitute func(v interface{}) (interface{}, error)
+	substitute = func(v interface{}) (interface{}, error) {
+		switch v := v.(type) {
+		case graphVar:
+			value, ok := ctx.variables[string(v)]
+			if !ok {
+				return nil, errors.New("variable $" + string(v) + " isn't declared")
+			}
+			return value, nil
+		case []interface{}:
+			list := make([]interface{}, len(v))
+			for i, item := range v {
+				var err error
+				if list[i], err = substitute(item); err != nil {
+					return nil, err
+				}
+			}
+			return list, nil
+		case map[string]interface{}:
+			object := make(map[string]interface{}, len(v))
+			for key, item := range v {
+				var err error
+				if object[key], err = substitute(item); err != nil {
+					return nil, err
+				}
+			}
+			return object, nil
+		}
+		return v, nil
+	}
+	values := make(map[string]interface{}, len(args))
+	for name, arg := range args {
+		value, err := substitute(arg)
+		if err != nil {
+			return nil, err
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// isNil reports whether a resolved value is null.
+func isNil(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+// execute resolves a selection set on every one of parents, which are
+// all of type typ. Errors in resolvers null the field and are recorded;
+// errors in the query itself abort the request.
+func (ctx *graphContext) execute(typ *graphType, parents []interface{},
+	selections []*graphSelection, path []interface{}) ([]*graphObject, error) {
+	objects := make([]*graphObject, len(parents))
+	for i := range objects {
+		objects[i] = newGraphObject()
+	}
+
+	for _, sel := range selections {
+		fieldPath := append(append([]interface{}{}, path...), sel.Alias)
+		if sel.Name == "__typename" {
+			for _, obj := range objects {
+				obj.set(sel.Alias, typ.Name)
+			}
+			continue
+		}
+		field, ok := typ.Fields[sel.Name]
+		if !ok {
+			return nil, fmt.Errorf("%s has no field %s", typ.Name, sel.Name)
+		}
+		typeName := strings.Trim(field.Type, "[]!")
+		list := strings.HasPrefix(field.Type, "[")
+		child, isObject := ctx.schema[typeName]
+		if isObject && sel.Selections == nil {
+			return nil, fmt.Errorf("%s of type %s needs a selection of subfields",
+				sel.Name, field.Type)
+		} else if !isObject && sel.Selections != nil {
+			return nil, fmt.Errorf("%s of type %s has no subfields", sel.Name, field.Type)
+		}
+
+		if ctx.cost += len(parents); ctx.cost > graphMaxCost {
+			return nil, fmt.Errorf("the query is too big: it asks for more than %d fields",
+				graphMaxCost)
+		}
+		args, err := ctx.argValues(sel.Args)
+		if err != nil {
+			return nil, err
+		}
+		values, err := field.Resolve(ctx, parents, args)
+		if err != nil {
+			ctx.errors = append(ctx.errors, graphError{Message: err.Error(), Path: fieldPath})
+			for _, obj := range objects {
+				obj.set(sel.Alias, nil)
+			}
+			continue
+		}
+
+		if !isObject {
+			for i, obj := range objects {
+				obj.set(sel.Alias, values[i])
+			}
+			continue
+		}
+
+		// gather every child object below this field, to resolve them
+		// all together
+		var children []interface{}
+		for _, value := range values {
+			if isNil(value) {
+				continue
+			}
+			if list {
+				v := reflect.ValueOf(value)
+				for j := 0; j < v.Len(); j++ {
+					if item := v.Index(j).Interface(); !isNil(item) {
+						children = append(children, item)
+					}
+				}
+			} else {
+				children = append(children, value)
+			}
+		}
+		results, err := ctx.execute(child, children, sel.Selections, fieldPath)
+		if err != nil {
+			return nil, err
+		}
+
+		// and hand them back out to their parents
+		next := 0
+		for i, value := range values {
+			switch {
+			case isNil(value):
+				objects[i].set(sel.Alias, nil)
+			case list:
+				v := reflect.ValueOf(value)
+				items := make([]interface{}, v.Len())
+				for j := range items {
+					if !isNil(v.Index(j).Interface()) {
+						items[j] = results[next]
+						next++
+					}
+				}
+				objects[i].set(sel.Alias, items)
+			default:
+				objects[i].set(sel.Alias, results[next])
+				next++
+			}
+		}
+	}
+	return objects, nil
+}
+
+// --------------------------------------------
+//                   ARGUMENTS
+// --------------------------------------------
+
+// argInt reads an Int argument, which may have come from JSON variables
+// as a float64.
+func argInt(args map[string]interface{}, name string, def int) (int, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return def, nil
+	case int:
+		return v, nil
+	case float64:
+		if v == float64(int(v)) {
+			return int(v), nil
+		}
+	}
+	return 0, fmt.Errorf("%s must be an Int", name)
+}
+
+// argString reads a String or enum argument.
+func argString(args map[string]interface{}, name string) (string, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case graphEnum:
+		return string(v), nil
+	}
+	return "", fmt.Errorf("%s must be a String", name)
+}
+
+// argStrings reads a [String] argument. A single string counts as a
+// list of one, as GraphQL allows.
+func argStrings(args map[string]interface{}, name string) ([]string, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		list := make([]string, len(v))
+		for i, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a list of Strings", name)
+			}
+			list[i] = s
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("%s must be a list of Strings", name)
+}
+
+// argObject reads an input object argument.
+func argObject(args map[string]interface{}, name string) (map[string]interface{}, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return map[string]interface{}{}, nil
+	case map[string]interface{}:
+		return v, nil
+	}
+	return nil, fmt.Errorf("%s must be an input object", name)
+}
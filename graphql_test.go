@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestParseGraphQL tests parsing of operations, arguments and errors.
+func TestParseGraphQL(t *testing.T) {
+	ops, err := parseGraphQL(`
+		# find dinners
+		query Dinners($first: Int = 5, $tags: [String!]) {
+			dinners: recipes(filter: {meal: DINNER, tags: $tags}, first: $first) {
+				total nodes { id name }
+			}
+		}
+		mutation { createRecipe(input: {name: "Fufu!", year: 1998}) { id } }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 2 || ops[0].Name != "Dinners" || ops[1].Type != "mutation" {
+		t.Fatalf("parseGraphQL() = %+v", ops)
+	}
+	if v := ops[0].Variables[0]; v.Name != "first" || v.Default != 5 || v.NonNull {
+		t.Errorf("variable = %+v", v)
+	}
+	sel := ops[0].Selections[0]
+	filter := sel.Args["filter"].(map[string]interface{})
+	if sel.Alias != "dinners" || sel.Name != "recipes" ||
+		filter["meal"] != graphEnum("DINNER") || filter["tags"] != graphVar("tags") {
+		t.Errorf("selection = %+v", sel)
+	}
+	input := ops[1].Selections[0].Args["input"].(map[string]interface{})
+	if input["name"] != "Fufu!" || input["year"] != 1998 {
+		t.Errorf("input = %v", input)
+	}
+
+	for _, bad := range []string{"", "{", "{ recipes(first: ) { id } }",
+		"subscription { a }", "{ ...frag }", `{ a(b: "c) }`} {
+		if _, err := parseGraphQL(bad); err == nil {
+			t.Errorf("parseGraphQL(%q) didn't fail", bad)
+		}
+	}
+}
+
+// TestGraphQLBatching tests that a field nested under a list is resolved
+// once for all of its parents.
+func TestGraphQLBatching(t *testing.T) {
+	calls := 0
+	schema := graphSchema{
+		"Query": {Name: "Query", Fields: map[string]*graphField{
+			"numbers": {"[Number]", get(func(interface{}) interface{} {
+				return []int{1, 2, 3}
+			})},
+		}},
+		"Number": {Name: "Number", Fields: map[string]*graphField{
+			"double": {"Int", func(ctx *graphContext, parents []interface{},
+				args map[string]interface{}) ([]interface{}, error) {
+				calls++
+				values := make([]interface{}, len(parents))
+				for i, parent := range parents {
+					values[i] = parent.(int) * 2
+				}
+				return values, nil
+			}},
+		}},
+	}
+	ops, _ := parseGraphQL(`{ numbers { __typename twice: double } }`)
+	data, errs := executeGraphQL(schema, ops[0], nil, nil)
+	out, _ := json.Marshal(data)
+	want := `{"numbers":[{"__typename":"Number","twice":2},` +
+		`{"__typename":"Number","twice":4},{"__typename":"Number","twice":6}]}`
+	if string(out) != want || errs != nil {
+		t.Errorf("executeGraphQL() = %s %v, expected %s", out, errs, want)
+	}
+	if calls != 1 {
+		t.Errorf("double was resolved %d times, expected once", calls)
+	}
+}
+
+// TestGraphQL tests the /graphql handler with fields that don't need
+// the database.
+func TestGraphQL(t *testing.T) {
+	c := &RBController{Render: NewRenderer()}
+	handler := c.APIAction(c.GraphQL)
+	post := func(body string) (int, graphResponse, string) {
+		req := httptest.NewRequest("POST", "/graphql", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var resp struct {
+			graphResponse
+			Data map[string]interface{} `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp.graphResponse, w.Body.String()
+	}
+
+	code, _, body := post(`{"query": "query($x: Boolean) { meals { bit name } }"}`)
+	want := `{"data":{"meals":[{"bit":1,"name":"Breakfast"},{"bit":2,"name":"Lunch"},` +
+		`{"bit":4,"name":"Dinner"}]}}`
+	if code != http.StatusOK || strings.TrimSpace(body) != want {
+		t.Errorf("meals query = %d %s, expected %s", code, body, want)
+	}
+
+	code, resp, _ := post(`{"query": "{ meals { colour } }"}`)
+	if code != http.StatusOK || len(resp.Errors) != 1 {
+		t.Errorf("unknown field = %d %+v, expected an error", code, resp)
+	}
+
+	code, resp, _ = post(`{"query": "{ meals "}`)
+	if code != http.StatusBadRequest || len(resp.Errors) != 1 {
+		t.Errorf("bad query = %d %+v, expected a 400", code, resp)
+	}
+
+	// mutations need a login
+	code, resp, body = post(`{"query": "mutation M($name: String!) { ` +
+		`createRecipe(input: {name: $name}) { id } }", "variables": {"name": "Fufu"}}`)
+	if code != http.StatusOK || len(resp.Errors) != 1 ||
+		!strings.Contains(resp.Errors[0].Message, "log in") ||
+		!strings.Contains(body, `"createRecipe":null`) {
+		t.Errorf("anonymous mutation = %d %s, expected a login error", code, body)
+	}
+}
+
+// TestGraphQLLimits tests that deeply nested and very big queries fail
+// rather than run.
+func TestGraphQLLimits(t *testing.T) {
+	deep := strings.Repeat("{ a ", graphMaxDepth+1) + strings.Repeat("}", graphMaxDepth+1)
+	if _, err := parseGraphQL(deep); err == nil {
+		t.Errorf("parseGraphQL() accepted %d nested selection sets", graphMaxDepth+1)
+	}
+	value := "{ a(b: " + strings.Repeat("[", graphMaxDepth) + strings.Repeat("]", graphMaxDepth) + ") }"
+	if _, err := parseGraphQL(value); err == nil {
+		t.Errorf("parseGraphQL() accepted %d nested lists", graphMaxDepth)
+	}
+	if _, err := parseGraphQL(strings.Repeat("{ a ", 5) + strings.Repeat("}", 5)); err != nil {
+		t.Errorf("parseGraphQL() rejected 5 nested selection sets: %v", err)
+	}
+
+	// every item has 100 items, so each level costs 100 times the last
+	resolved := 0
+	schema := graphSchema{
+		"Query": {Name: "Query", Fields: map[string]*graphField{
+			"items": {"[Item!]!", get(func(interface{}) interface{} { return make([]int, 100) })},
+		}},
+		"Item": {Name: "Item", Fields: map[string]*graphField{
+			"items": {"[Item!]!", func(ctx *graphContext, parents []interface{},
+				args map[string]interface{}) ([]interface{}, error) {
+				resolved += len(parents)
+				values := make([]interface{}, len(parents))
+				for i := range values {
+					values[i] = make([]int, 100)
+				}
+				return values, nil
+			}},
+			"id": {"Int", get(func(interface{}) interface{} { return 1 })},
+		}},
+	}
+	ops, _ := parseGraphQL(`{ items { id items { __typename } } }`)
+	if _, errs := executeGraphQL(schema, ops[0], nil, nil); errs != nil {
+		t.Errorf("executeGraphQL() of 10,000 items = %v, expected no errors", errs)
+	}
+	resolved = 0
+	ops, _ = parseGraphQL(`{ items { items { items { id } } } }`)
+	data, errs := executeGraphQL(schema, ops[0], nil, nil)
+	if data != nil || len(errs) != 1 || !strings.Contains(errs[0].Message, "too big") {
+		t.Errorf("executeGraphQL() of a million values = %v, expected it to be too big", errs)
+	}
+	if resolved > graphMaxCost {
+		t.Errorf("resolved items on %d parents, expected the query to stop first", resolved)
+	}
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// graphMaxFirst is the most items a GraphQL list field returns at once.
+const graphMaxFirst = 100
+
+// GraphQL values that aren't Recipes or Contributors.
+type (
+	graphPage struct {
+		Total   int
+		HasMore bool
+		Recipes []*Recipe
+	}
+	graphCuisine    struct{ ID int }
+	graphTag        struct{ Name string }
+	graphIngredient struct{ Text string }
+	graphCategory   struct {
+		Bit  int
+		Name string
+	}
+)
+
+// graphLoader loads and caches what the GraphQL resolvers of one request
+// share, so that each is fetched at most once.
+type graphLoader struct {
+	c      *RBController
+	r      *http.Request
+	facets *Facets
+}
+
+// counts returns the number of recipes by cuisine and tag.
+func (loader *graphLoader) counts() (*Facets, error) {
+	if loader.facets == nil {
+		facets, err := loader.c.GetFacets(RecipeSearch{Cuisine: -1, Mealtype: -1, Season: -1})
+		if err != nil {
+			return nil, err
+		}
+		loader.facets = facets
+	}
+	return loader.facets, nil
+}
+
+// editor returns the current user if they may change recipes.
+func (loader *graphLoader) editor() (*User, error) {
+	user, err := loader.c.CurrentUser(loader.r)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, errors.New("log in or send an API token to change recipes")
+	}
+	if !user.Role.Includes(RoleContributor) {
+		return nil, errors.New("you don't have permission to change recipes")
+	}
+	if token, _ := loader.c.CurrentToken(loader.r); token != nil && !token.Allows("POST") {
+		return nil, errors.New("this API token may only read")
+	}
+	return user, nil
+}
+
+// graphFirst reads the first argument of a list field.
+func graphFirst(args map[string]interface{}) (int, error) {
+	first, err := argInt(args, "first", 20)
+	if err == nil && (first < 0 || first > graphMaxFirst) {
+		err = errors.New("first must be between 0 and 100")
+	}
+	return first, err
+}
+
+// get makes a resolver that reads a value from each parent.
+func get(read func(parent interface{}) interface{}) graphResolver {
+	return perItem(func(ctx *graphContext, parent interface{},
+		args map[string]interface{}) (interface{}, error) {
+		return read(parent), nil
+	})
+}
+
+// graphCategories lists the names of a bit map as GraphQL values.
+func graphCategories(bits map[int]string) []graphCategory {
+	categories := []graphCategory{}
+	for bit, name := range bits {
+		categories = append(categories, graphCategory{bit, name})
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		return categories[i].Bit < categories[j].Bit
+	})
+	return categories
+}
+
+// graphBitNames lists the names of the bits set in value.
+func graphBitNames(bits map[int]string, value int) []string {
+	names := []string{}
+	for _, category := range graphCategories(bits) {
+		if value&category.Bit > 0 {
+			names = append(names, category.Name)
+		}
+	}
+	return names
+}
+
+// graphBit reads a meal or season name, which may be given as a GraphQL
+// enum such as DINNER.
+func graphBit(toInt map[string]int, name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	name = strings.Title(strings.ToLower(name))
+	bit, ok := toInt[name]
+	if !ok {
+		return 0, errors.New("there is no " + name)
+	}
+	return bit, nil
+}
+
+// graphSearch reads the filter argument of the recipes field.
+func graphSearch(args map[string]interface{}) (search RecipeSearch, err error) {
+	filter, err := argObject(args, "filter")
+	if err != nil {
+		return
+	}
+	search = RecipeSearch{Cuisine: -1}
+	if search.Name, err = argString(filter, "name"); err != nil {
+		return
+	}
+	if search.Cuisine, err = argInt(filter, "cuisine", -1); err != nil {
+		return
+	}
+	var meal, season string
+	if meal, err = argString(filter, "meal"); err != nil {
+		return
+	}
+	if search.Mealtype, err = graphBit(MealsToInt, meal); err != nil {
+		return
+	}
+	if season, err = argString(filter, "season"); err != nil {
+		return
+	}
+	if search.Season, err = graphBit(SeasonsToInt, season); err != nil {
+		return
+	}
+	var tags []string
+	if tags, err = argStrings(filter, "tags"); err != nil {
+		return
+	}
+	search.Tags = ParseTags(strings.Join(tags, ";"))
+	if search.Contributor, err = argString(filter, "contributor"); err != nil {
+		return
+	}
+	if search.Country, err = argString(filter, "country"); err != nil {
+		return
+	}
+	search.Year, err = argInt(filter, "year", 0)
+	return
+}
+
+// graphRecipeInput applies the input argument of a mutation on top of
+// recipe, using the fields' JSON names.
+func graphRecipeInput(args map[string]interface{}, recipe *Recipe) error {
+	input, err := argObject(args, "input")
+	if err != nil {
+		return err
+	}
+	for _, field := range []string{"id", "owner", "picture"} {
+		if _, ok := input[field]; ok {
+			return errors.New(field + " can't be set")
+		}
+	}
+	data, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(recipe); err != nil {
+		return errors.New("bad input: " + err.Error())
+	}
+	recipe.Tags = ParseTags(strings.Join(recipe.Tags, ";"))
+
+	if problems := recipe.Validate(); len(problems) > 0 {
+		list := []string{}
+		for field, problem := range problems {
+			list = append(list, field+" "+problem)
+		}
+		sort.Strings(list)
+		return errors.New("invalid recipe: " + strings.Join(list, "; "))
+	}
+	return nil
+}
+
+// graphSchema builds the GraphQL schema for a request.
+func (c *RBController) graphSchema(r *http.Request) graphSchema {
+	loader := &graphLoader{c: c, r: r}
+
+	// recipesOf resolves a recipes(first) field of tags or contributors,
+	// getting the recipes of every parent in one query
+	recipesOf := func(key func(parent interface{}) string,
+		load func(keys []string, limit int) (map[string][]*Recipe, error)) graphResolver {
+		return func(ctx *graphContext, parents []interface{},
+			args map[string]interface{}) ([]interface{}, error) {
+			first, err := graphFirst(args)
+			if err != nil {
+				return nil, err
+			}
+			keys := make([]string, len(parents))
+			for i, parent := range parents {
+				keys[i] = key(parent)
+			}
+			groups, err := load(keys, first)
+			if err != nil {
+				return nil, err
+			}
+			values := make([]interface{}, len(parents))
+			for i := range parents {
+				recipes := groups[keys[i]]
+				if recipes == nil {
+					recipes = []*Recipe{}
+				}
+				values[i] = recipes
+			}
+			return values, nil
+		}
+	}
+
+	recipe := func(parent interface{}) *Recipe { return parent.(*Recipe) }
+	return graphSchema{
+		"Query": {Name: "Query", Fields: map[string]*graphField{
+			"recipe": {"Recipe", perItem(func(ctx *graphContext, parent interface{},
+				args map[string]interface{}) (interface{}, error) {
+				id, err := argInt(args, "id", 0)
+				if err != nil {
+					return nil, err
+				}
+				recipe, err := c.GetRecipe(id)
+				if err == sql.ErrNoRows {
+					return nil, nil
+				}
+				return recipe, err
+			})},
+			"recipes": {"RecipePage!", perItem(func(ctx *graphContext, parent interface{},
+				args map[string]interface{}) (interface{}, error) {
+				search, err := graphSearch(args)
+				if err != nil {
+					return nil, err
+				}
+				first, err := graphFirst(args)
+				if err != nil {
+					return nil, err
+				}
+				offset, err := argInt(args, "offset", 0)
+				if err != nil || offset < 0 {
+					return nil, errors.New("offset must be a positive Int")
+				}
+				recipes, total, err := c.BrowseRecipes(search, first, offset)
+				if err != nil {
+					return nil, err
+				}
+				return &graphPage{Total: total, HasMore: offset+len(recipes) < total,
+					Recipes: recipes}, nil
+			})},
+			"cuisines": {"[Cuisine!]!", perItem(func(ctx *graphContext, parent interface{},
+				args map[string]interface{}) (interface{}, error) {
+				counts, err := loader.counts()
+				if err != nil {
+					return nil, err
+				}
+				cuisines := []graphCuisine{}
+				for id := range counts.Cuisine {
+					cuisines = append(cuisines, graphCuisine{id})
+				}
+				sort.Slice(cuisines, func(i, j int) bool { return cuisines[i].ID < cuisines[j].ID })
+				return cuisines, nil
+			})},
+			"tags": {"[Tag!]!", perItem(func(ctx *graphContext, parent interface{},
+				args map[string]interface{}) (interface{}, error) {
+				counts, err := loader.counts()
+				if err != nil {
+					return nil, err
+				}
+				tags := []graphTag{}
+				for name := range counts.Tags {
+					tags = append(tags, graphTag{name})
+				}
+				sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+				return tags, nil
+			})},
+			"contributors": {"[Contributor!]!", perItem(func(ctx *graphContext, parent interface{},
+				args map[string]interface{}) (interface{}, error) {
+				first, err := graphFirst(args)
+				if err != nil {
+					return nil, err
+				}
+				offset, err := argInt(args, "offset", 0)
+				if err != nil || offset < 0 {
+					return nil, errors.New("offset must be a positive Int")
+				}
+				contributors, err := c.ListContributors(first, offset)
+				if contributors == nil {
+					contributors = []*Contributor{}
+				}
+				return contributors, err
+			})},
+			"meals": {"[Category!]!", get(func(interface{}) interface{} {
+				return graphCategories(Meals)
+			})},
+			"seasons": {"[Category!]!", get(func(interface{}) interface{} {
+				return graphCategories(Seasons)
+			})},
+		}},
+
+		"Mutation": {Name: "Mutation", Fields: map[string]*graphField{
+			"createRecipe": {"Recipe", perItem(func(ctx *graphContext, parent interface{},
+				args map[string]interface{}) (interface{}, error) {
+				user, err := loader.editor()
+				if err != nil {
+					return nil, err
+				}
+				recipe := new(Recipe)
+				if err = graphRecipeInput(args, recipe); err != nil {
+					return nil, err
+				}
+				recipe.Owner = user.ID
+				id, err := c.RecipeDB.NewRecipe(recipe, c.actor(r, user))
+				if err != nil {
+					return nil, err
+				}
+				c.Stats.Invalidate()
+				return c.GetRecipe(id)
+			})},
+			"updateRecipe": {"Recipe", perItem(func(ctx *graphContext, parent interface{},
+				args map[string]interface{}) (interface{}, error) {
+				user, err := loader.editor()
+				if err != nil {
+					return nil, err
+				}
+				id, err := argInt(args, "id", 0)
+				if err != nil {
+					return nil, err
+				}
+				existing, err := c.GetRecipe(id)
+				if err == sql.ErrNoRows {
+					return nil, errors.New("no recipe has that id")
+				} else if err != nil {
+					return nil, err
+				}
+				if !user.CanEdit(existing) {
+					return nil, errors.New("you may only change your own recipes")
+				}
+				recipe := *existing
+				if err = graphRecipeInput(args, &recipe); err != nil {
+					return nil, err
+				}
+				if err = c.RecipeDB.UpdateRecipe(&recipe, c.actor(r, user)); err != nil {
+					return nil, err
+				}
+				c.Stats.Invalidate()
+				return c.GetRecipe(id)
+			})},
+		}},
+
+		"RecipePage": {Name: "RecipePage", Fields: map[string]*graphField{
+			"total":   {"Int!", get(func(p interface{}) interface{} { return p.(*graphPage).Total })},
+			"hasMore": {"Boolean!", get(func(p interface{}) interface{} { return p.(*graphPage).HasMore })},
+			"nodes":   {"[Recipe!]!", get(func(p interface{}) interface{} { return p.(*graphPage).Recipes })},
+		}},
+
+		"Recipe": {Name: "Recipe", Fields: map[string]*graphField{
+			"id":           {"Int!", get(func(p interface{}) interface{} { return recipe(p).ID })},
+			"name":         {"String!", get(func(p interface{}) interface{} { return recipe(p).Name })},
+			"description":  {"String!", get(func(p interface{}) interface{} { return recipe(p).Description })},
+			"instructions": {"String!", get(func(p interface{}) interface{} { return recipe(p).Instructions })},
+			"yield":        {"String!", get(func(p interface{}) interface{} { return recipe(p).Yield })},
+			"mealtype":     {"Int!", get(func(p interface{}) interface{} { return recipe(p).Mealtype })},
+			"season":       {"Int!", get(func(p interface{}) interface{} { return recipe(p).Season })},
+			"country":      {"String!", get(func(p interface{}) interface{} { return recipe(p).Country })},
+			"community":    {"String!", get(func(p interface{}) interface{} { return recipe(p).Community })},
+			"year":         {"Int!", get(func(p interface{}) interface{} { return recipe(p).Year })},
+			"story":        {"String!", get(func(p interface{}) interface{} { return recipe(p).Story })},
+			"owner":        {"Int!", get(func(p interface{}) interface{} { return recipe(p).Owner })},
+			"cuisine": {"Cuisine!", get(func(p interface{}) interface{} {
+				return graphCuisine{recipe(p).Cuisine}
+			})},
+			"meals": {"[String!]!", get(func(p interface{}) interface{} {
+				return graphBitNames(Meals, recipe(p).Mealtype)
+			})},
+			"seasons": {"[String!]!", get(func(p interface{}) interface{} {
+				return graphBitNames(Seasons, recipe(p).Season)
+			})},
+			"ingredients": {"[Ingredient!]!", get(func(p interface{}) interface{} {
+				ingredients := []graphIngredient{}
+				for _, text := range ParseIngredients(recipe(p).Ingredientlist) {
+					if text = strings.TrimSpace(text); text != "" {
+						ingredients = append(ingredients, graphIngredient{text})
+					}
+				}
+				return ingredients
+			})},
+			"tags": {"[Tag!]!", get(func(p interface{}) interface{} {
+				tags := []graphTag{}
+				for _, name := range recipe(p).Tags {
+					tags = append(tags, graphTag{name})
+				}
+				return tags
+			})},
+			"contributor": {"Contributor", func(ctx *graphContext, parents []interface{},
+				args map[string]interface{}) ([]interface{}, error) {
+				// one query for the contributors of every recipe
+				names := []string{}
+				for _, parent := range parents {
+					if name := recipe(parent).Contributor; name != "" {
+						names = append(names, name)
+					}
+				}
+				contributors, err := c.GetContributors(names)
+				if err != nil {
+					return nil, err
+				}
+				byName := make(map[string]*Contributor)
+				for _, contributor := range contributors {
+					byName[contributor.Name] = contributor
+				}
+				values := make([]interface{}, len(parents))
+				for i, parent := range parents {
+					values[i] = byName[recipe(parent).Contributor]
+				}
+				return values, nil
+			}},
+		}},
+
+		"Ingredient": {Name: "Ingredient", Fields: map[string]*graphField{
+			"text": {"String!", get(func(p interface{}) interface{} { return p.(graphIngredient).Text })},
+		}},
+
+		"Cuisine": {Name: "Cuisine", Fields: map[string]*graphField{
+			"id": {"Int!", get(func(p interface{}) interface{} { return p.(graphCuisine).ID })},
+			"recipeCount": {"Int!", perItem(func(ctx *graphContext, parent interface{},
+				args map[string]interface{}) (interface{}, error) {
+				counts, err := loader.counts()
+				if err != nil {
+					return nil, err
+				}
+				return counts.Cuisine[parent.(graphCuisine).ID], nil
+			})},
+		}},
+
+		"Tag": {Name: "Tag", Fields: map[string]*graphField{
+			"name": {"String!", get(func(p interface{}) interface{} { return p.(graphTag).Name })},
+			"recipeCount": {"Int!", perItem(func(ctx *graphContext, parent interface{},
+				args map[string]interface{}) (interface{}, error) {
+				counts, err := loader.counts()
+				if err != nil {
+					return nil, err
+				}
+				return counts.Tags[parent.(graphTag).Name], nil
+			})},
+			"recipes": {"[Recipe!]!", recipesOf(
+				func(p interface{}) string { return p.(graphTag).Name },
+				c.RecipesByTags)},
+		}},
+
+		"Contributor": {Name: "Contributor", Fields: map[string]*graphField{
+			"name": {"String!", get(func(p interface{}) interface{} { return p.(*Contributor).Name })},
+			"recipeCount": {"Int!", get(func(p interface{}) interface{} {
+				return p.(*Contributor).Recipes
+			})},
+			"countries": {"[String!]!", get(func(p interface{}) interface{} {
+				return p.(*Contributor).Countries
+			})},
+			"recipes": {"[Recipe!]!", recipesOf(
+				func(p interface{}) string { return p.(*Contributor).Name },
+				c.RecipesByContributors)},
+		}},
+
+		"Category": {Name: "Category", Fields: map[string]*graphField{
+			"bit":  {"Int!", get(func(p interface{}) interface{} { return p.(graphCategory).Bit })},
+			"name": {"String!", get(func(p interface{}) interface{} { return p.(graphCategory).Name })},
+		}},
+	}
+}
+
+// graphResponse is the body of a GraphQL response.
+type graphResponse struct {
+	Data   *graphObject `json:"data,omitempty"`
+	Errors []graphError `json:"errors,omitempty"`
+}
+
+// GraphQL answers GraphQL queries and mutations, sent as a JSON body of
+// {"query", "variables", "operationName"}, as an application/graphql
+// body, or as the query, variables and operationName parameters of a
+// GET. Mutations must be POSTed, and need the same login as the recipe
+// forms.
+func (c *RBController) GraphQL(w http.ResponseWriter, r *http.Request) (err error) {
+	var request struct {
+		Query         string                 `json:"query"`
+		Variables     map[string]interface{} `json:"variables"`
+		OperationName string                 `json:"operationName"`
+	}
+	fail := func(status int, msg string) error {
+		c.JSON(w, status, graphResponse{Errors: []graphError{{Message: msg}}})
+		return nil
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case r.Method == "POST" && contentType == "application/json":
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBody))
+		if err = decoder.Decode(&request); err != nil {
+			return fail(http.StatusBadRequest, "the body must be a JSON GraphQL request: "+err.Error())
+		}
+	case r.Method == "POST" && contentType == "application/graphql":
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, apiMaxBody))
+		if err != nil {
+			return fail(http.StatusBadRequest, err.Error())
+		}
+		request.Query = string(body)
+	default:
+		request.Query = r.FormValue("query")
+		request.OperationName = r.FormValue("operationName")
+		if variables := r.FormValue("variables"); variables != "" {
+			if err = json.Unmarshal([]byte(variables), &request.Variables); err != nil {
+				return fail(http.StatusBadRequest, "variables must be a JSON object")
+			}
+		}
+	}
+
+	operations, err := parseGraphQL(request.Query)
+	if err != nil {
+		return fail(http.StatusBadRequest, err.Error())
+	}
+	var op *graphOperation
+	for _, candidate := range operations {
+		if candidate.Name == request.OperationName ||
+			request.OperationName == "" && len(operations) == 1 {
+			op = candidate
+		}
+	}
+	if op == nil {
+		return fail(http.StatusBadRequest, "choose an operation with operationName")
+	}
+
+	run := func(w http.ResponseWriter, r *http.Request) error {
+		data, errs := executeGraphQL(c.graphSchema(r), op, nil, request.Variables)
+		c.JSON(w, http.StatusOK, graphResponse{Data: data, Errors: errs})
+		return nil
+	}
+	if op.Type == "mutation" {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			return fail(http.StatusMethodNotAllowed, "mutations must be POSTed")
+		}
+		return c.CheckCSRF(run)(w, r)
+	}
+	return run(w, r)
+}
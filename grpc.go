@@ -0,0 +1,435 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/context"
+)
+
+// This file serves the RecipeBox gRPC service described in
+// proto/recipebox.proto, over plain-text HTTP/2 using net/http. The
+// protobuf messages are few and small, so they are encoded by hand
+// rather than with generated code.
+
+// grpcService is the full name of the service, which prefixes its paths.
+const grpcService = "/recipebox.v1.RecipeBox/"
+
+// grpcMaxMessage is the largest request message accepted.
+const grpcMaxMessage = 4 << 20
+
+// gRPC status codes
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcNotFound          = 5
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnauthenticated   = 16
+)
+
+// grpcError is an error carrying a gRPC status code.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string { return e.msg }
+
+func grpcErrorf(code int, format string, args ...interface{}) error {
+	return &grpcError{code, fmt.Sprintf(format, args...)}
+}
+
+// --------------------------------------------
+//                   PROTOBUF
+// --------------------------------------------
+
+// protoWriter encodes a protobuf message. Like proto3, it leaves out
+// fields holding their zero value.
+type protoWriter struct {
+	buf []byte
+}
+
+func (p *protoWriter) tag(field, wire int) {
+	p.buf = binary.AppendUvarint(p.buf, uint64(field<<3|wire))
+}
+
+func (p *protoWriter) int32(field int, v int) {
+	if v != 0 {
+		p.tag(field, 0)
+		// negative numbers are sign extended to 64 bits
+		p.buf = binary.AppendUvarint(p.buf, uint64(int64(int32(v))))
+	}
+}
+
+func (p *protoWriter) bytes(field int, b []byte) {
+	p.tag(field, 2)
+	p.buf = binary.AppendUvarint(p.buf, uint64(len(b)))
+	p.buf = append(p.buf, b...)
+}
+
+func (p *protoWriter) string(field int, s string) {
+	if s != "" {
+		p.bytes(field, []byte(s))
+	}
+}
+
+var errBadProto = errors.New("malformed protobuf message")
+
+// readProto calls fn with each field of a protobuf message: varints
+// in v, and length delimited fields in b. Fixed width fields are
+// skipped, since no message here uses them.
+func readProto(data []byte, fn func(field int, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errBadProto
+		}
+		data = data[n:]
+		field, wire := int(key>>3), int(key&7)
+		var v uint64
+		var b []byte
+		switch wire {
+		case 0:
+			if v, n = binary.Uvarint(data); n <= 0 {
+				return errBadProto
+			}
+			data = data[n:]
+		case 1, 5:
+			size := 8
+			if wire == 5 {
+				size = 4
+			}
+			if len(data) < size {
+				return errBadProto
+			}
+			data = data[size:]
+			continue
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errBadProto
+			}
+			b = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			return errBadProto
+		}
+		if err := fn(field, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// marshalRecipe encodes a Recipe message.
+func marshalRecipe(recipe *Recipe) []byte {
+	p := &protoWriter{}
+	p.int32(1, recipe.ID)
+	p.string(2, recipe.Name)
+	p.string(3, recipe.Description)
+	p.int32(4, recipe.Cuisine)
+	p.int32(5, recipe.Mealtype)
+	p.int32(6, recipe.Season)
+	p.string(7, recipe.Ingredientlist)
+	p.string(8, recipe.Instructions)
+	p.int32(9, recipe.Owner)
+	p.string(10, recipe.Contributor)
+	p.string(11, recipe.Country)
+	p.string(12, recipe.Community)
+	p.int32(13, recipe.Year)
+	p.string(14, recipe.Story)
+	for _, tag := range recipe.Tags {
+		p.bytes(15, []byte(tag))
+	}
+	p.string(16, recipe.Yield)
+	return p.buf
+}
+
+// unmarshalRecipe decodes a Recipe message.
+func unmarshalRecipe(data []byte) (*Recipe, error) {
+	recipe := &Recipe{Tags: []string{}}
+	ints := map[int]*int{1: &recipe.ID, 4: &recipe.Cuisine, 5: &recipe.Mealtype,
+		6: &recipe.Season, 9: &recipe.Owner, 13: &recipe.Year}
+	strs := map[int]*string{2: &recipe.Name, 3: &recipe.Description,
+		7: &recipe.Ingredientlist, 8: &recipe.Instructions, 10: &recipe.Contributor,
+		11: &recipe.Country, 12: &recipe.Community, 14: &recipe.Story,
+		16: &recipe.Yield}
+	err := readProto(data, func(field int, v uint64, b []byte) error {
+		if p, ok := ints[field]; ok {
+			*p = int(int32(v))
+		} else if p, ok := strs[field]; ok {
+			*p = string(b)
+		} else if field == 15 {
+			recipe.Tags = append(recipe.Tags, string(b))
+		}
+		return nil
+	})
+	return recipe, err
+}
+
+// unmarshalSearch decodes a SearchRecipesRequest message.
+func unmarshalSearch(data []byte) (search RecipeSearch, err error) {
+	search = RecipeSearch{Cuisine: -1, Mealtype: -1, Season: -1}
+	err = readProto(data, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			search.Strict = v != 0
+		case 2:
+			search.Name = string(b)
+		case 3:
+			search.Cuisine = int(int32(v))
+		case 4:
+			search.Mealtype = int(int32(v))
+		case 5:
+			search.Season = int(int32(v))
+		case 6:
+			search.Contributor = string(b)
+		case 7:
+			search.Country = string(b)
+		case 8:
+			search.Year = int(int32(v))
+		case 9:
+			search.Tags = append(search.Tags, string(b))
+		}
+		return nil
+	})
+	search.Tags = ParseTags(strings.Join(search.Tags, ";"))
+	return
+}
+
+// --------------------------------------------
+//                    SERVICE
+// --------------------------------------------
+
+// grpcStream sends the response messages of one call.
+type grpcStream struct {
+	w    http.ResponseWriter
+	sent bool
+}
+
+// Send writes one length-prefixed message and flushes it to the client.
+func (s *grpcStream) Send(message []byte) error {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	if _, err := s.w.Write(append(frame, message...)); err != nil {
+		return err
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	s.sent = true
+	return nil
+}
+
+// grpcMethod handles one method of the service, reading its request
+// message and sending response messages to the stream.
+type grpcMethod func(r *http.Request, request []byte, stream *grpcStream) error
+
+// grpcThrottle wraps a method so each client may only call it as often as
+// the named group's rate limit allows, like Throttle does for actions.
+// Clients over the limit get RESOURCE_EXHAUSTED.
+func (c *RBController) grpcThrottle(group string, method grpcMethod) grpcMethod {
+	return func(r *http.Request, request []byte, stream *grpcStream) error {
+		allowed, retryAfter, err := c.take(group, r)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return grpcErrorf(grpcResourceExhausted,
+				"too many requests; try again in %d seconds", retrySeconds(retryAfter))
+		}
+		return method(r, request, stream)
+	}
+}
+
+// GRPCHandler serves the RecipeBox gRPC service.
+func (c *RBController) GRPCHandler() http.Handler {
+	// methods are limited by the same groups as their JSON API routes
+	methods := map[string]grpcMethod{
+		"GetRecipe":     c.grpcThrottle("api", c.grpcGetRecipe),
+		"SearchRecipes": c.grpcThrottle("search", c.grpcSearchRecipes),
+		"UpsertRecipe":  c.grpcThrottle("api", c.grpcUpsertRecipe),
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// mux isn't in front of this handler to clear the request context
+		defer context.Clear(r)
+		if r.Method != "POST" || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(w, "this port only serves gRPC", http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Add("Trailer", "Grpc-Status")
+		w.Header().Add("Trailer", "Grpc-Message")
+
+		stream := &grpcStream{w: w}
+		err := func() error {
+			method, ok := methods[strings.TrimPrefix(r.URL.Path, grpcService)]
+			if !ok || !strings.HasPrefix(r.URL.Path, grpcService) {
+				return grpcErrorf(grpcUnimplemented, "unknown method %s", r.URL.Path)
+			}
+			request, err := readGRPCMessage(r)
+			if err != nil {
+				return err
+			}
+			return method(r, request, stream)
+		}()
+
+		code, msg := grpcOK, ""
+		if err != nil {
+			code, msg = grpcInternal, err.Error()
+			if e, ok := err.(*grpcError); ok {
+				code = e.code
+			} else if _, ok := err.(*loginThrottled); ok {
+				code = grpcResourceExhausted
+			} else {
+				fmt.Printf("[WARNING] in gRPC %s: %s\n", r.URL.Path, msg)
+			}
+		}
+		if !stream.sent {
+			w.WriteHeader(http.StatusOK)
+		}
+		w.Header().Set("Grpc-Status", strconv.Itoa(code))
+		// grpc-message is percent encoded
+		w.Header().Set("Grpc-Message", strings.Replace(url.QueryEscape(msg), "+", "%20", -1))
+	})
+}
+
+// readGRPCMessage reads the single length-prefixed message of a request.
+func readGRPCMessage(r *http.Request) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r.Body, header); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "missing request message")
+	}
+	if header[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed messages aren't supported")
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > grpcMaxMessage {
+		return nil, grpcErrorf(grpcInvalidArgument, "request message is too large")
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(r.Body, message); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "truncated request message")
+	}
+	io.Copy(ioutil.Discard, r.Body)
+	return message, nil
+}
+
+// grpcGetRecipe implements GetRecipe.
+func (c *RBController) grpcGetRecipe(r *http.Request, request []byte, stream *grpcStream) error {
+	id := 0
+	err := readProto(request, func(field int, v uint64, b []byte) error {
+		if field == 1 {
+			id = int(int32(v))
+		}
+		return nil
+	})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+	recipe, err := c.GetRecipe(id)
+	if err == sql.ErrNoRows {
+		return grpcErrorf(grpcNotFound, "no recipe has id %d", id)
+	} else if err != nil {
+		return err
+	}
+	return stream.Send(marshalRecipe(recipe))
+}
+
+// grpcSearchRecipes implements SearchRecipes, streaming the recipes as
+// they are read from the database.
+func (c *RBController) grpcSearchRecipes(r *http.Request, request []byte, stream *grpcStream) error {
+	search, err := unmarshalSearch(request)
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+	return c.StreamRecipes(search, searchBatch, func(recipes []*Recipe) error {
+		for _, recipe := range recipes {
+			if err := stream.Send(marshalRecipe(recipe)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// grpcUpsertRecipe implements UpsertRecipe, with the same permissions
+// as the JSON API.
+func (c *RBController) grpcUpsertRecipe(r *http.Request, request []byte, stream *grpcStream) error {
+	user, err := c.CurrentUser(r)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return grpcErrorf(grpcUnauthenticated, "send a write API token as authorization: Bearer <token>")
+	}
+	token, err := c.CurrentToken(r)
+	if err != nil {
+		return err
+	}
+	if !user.Role.Includes(RoleContributor) || token != nil && !token.Allows("POST") {
+		return grpcErrorf(grpcPermissionDenied, "you may not change recipes")
+	}
+
+	var recipe *Recipe
+	err = readProto(request, func(field int, v uint64, b []byte) (err error) {
+		if field == 1 {
+			recipe, err = unmarshalRecipe(b)
+		}
+		return
+	})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+	if recipe == nil {
+		return grpcErrorf(grpcInvalidArgument, "recipe is required")
+	}
+	recipe.Tags = ParseTags(strings.Join(recipe.Tags, ";"))
+	if problems := recipe.Validate(); len(problems) > 0 {
+		list := []string{}
+		for field, problem := range problems {
+			list = append(list, field+" "+problem)
+		}
+		return grpcErrorf(grpcInvalidArgument, "invalid recipe: %s", strings.Join(list, "; "))
+	}
+
+	id := recipe.ID
+	if id == 0 {
+		recipe.Owner = user.ID
+		if id, err = c.RecipeDB.NewRecipe(recipe, c.actor(r, user)); err != nil {
+			return err
+		}
+	} else {
+		existing, err := c.GetRecipe(id)
+		if err == sql.ErrNoRows {
+			return grpcErrorf(grpcNotFound, "no recipe has id %d", id)
+		} else if err != nil {
+			return err
+		}
+		if !user.CanEdit(existing) {
+			return grpcErrorf(grpcPermissionDenied, "you may only change your own recipes")
+		}
+		recipe.Owner = existing.Owner
+		if err = c.RecipeDB.UpdateRecipe(recipe, c.actor(r, user)); err != nil {
+			return err
+		}
+	}
+	c.Stats.Invalidate()
+
+	saved, err := c.GetRecipe(id)
+	if err != nil {
+		return err
+	}
+	return stream.Send(marshalRecipe(saved))
+}
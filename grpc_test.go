@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// TestRecipeProto tests that recipes survive a round trip through the
+// protobuf codec, negative numbers included.
+func TestRecipeProto(t *testing.T) {
+	recipe := &Recipe{ID: 7, Name: "Jollof rice", Description: "Party rice",
+		Cuisine: 3, Mealtype: 4, Season: -1, Ingredientlist: "rice; tomato",
+		Instructions: "Cook.", Yield: "6 servings", Owner: 2, Contributor: "Ama", Country: "Ghana",
+		Year: 2001, Tags: []string{"party", "rice"}}
+	decoded, err := unmarshalRecipe(marshalRecipe(recipe))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, recipe) {
+		t.Errorf("decoded %+v, expected %+v", decoded, recipe)
+	}
+
+	if _, err := unmarshalRecipe([]byte{0x12, 0x05, 'a'}); err == nil {
+		t.Error("a truncated message decoded without error")
+	}
+
+	p := &protoWriter{}
+	p.int32(4, 2)
+	p.string(9, "Spicy ")
+	search, err := unmarshalSearch(p.buf)
+	if err != nil || search.Mealtype != 2 || search.Cuisine != -1 ||
+		!reflect.DeepEqual(search.Tags, []string{"spicy"}) {
+		t.Errorf("unmarshalSearch() = %+v, %v", search, err)
+	}
+}
+
+// TestGRPCStatus tests that calls over HTTP/2 get their status in
+// trailers, and that calls are rate limited.
+func TestGRPCStatus(t *testing.T) {
+	c := &RBController{Render: NewRenderer(),
+		Limiter: &RateLimiter{Store: NewMemoryRateStore(),
+			Groups: map[string]RateLimit{"api": {Rate: 0.1, Burst: 1}}}}
+	server := httptest.NewUnstartedServer(c.GRPCHandler())
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{Protocols: new(http.Protocols)}}
+	client.Transport.(*http.Transport).Protocols.SetUnencryptedHTTP2(true)
+
+	tests := []struct {
+		method string
+		status string
+	}{
+		{"Nonexistent", "12"},
+		{"UpsertRecipe", "16"},
+		{"UpsertRecipe", "8"},
+	}
+	for _, test := range tests {
+		body := bytes.NewReader([]byte{0, 0, 0, 0, 0})
+		req, _ := http.NewRequest("POST", server.URL+grpcService+test.method, body)
+		req.Header.Set("Content-Type", "application/grpc")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// trailers arrive after the body
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.ProtoMajor != 2 {
+			t.Errorf("%s was served over %s, expected HTTP/2", test.method, resp.Proto)
+		}
+		if status := resp.Trailer.Get("Grpc-Status"); status != test.status {
+			t.Errorf("%s returned status %q (%s), expected %q", test.method, status,
+				resp.Trailer.Get("Grpc-Message"), test.status)
+		}
+	}
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// importFields are the recipe fields a spreadsheet may fill, named as in
+// the JSON API. Each is read from the column of the same name, ignoring
+// case, unless -columns maps it to another.
+var importFields = []string{"name", "description", "cuisine", "mealtype",
+	"season", "ingredientlist", "instructions", "yield", "contributor",
+	"country", "community", "year", "story", "tags"}
+
+// importRow is a row of a spreadsheet, with the line it starts on.
+type importRow struct {
+	Line  int
+	Cells []string
+}
+
+// ImportedRecipe is a recipe read from a row of a spreadsheet, with
+// what is wrong with it.
+type ImportedRecipe struct {
+	Line     int
+	Recipe   *Recipe
+	Problems []string
+}
+
+// parseColumnMap parses a mapping such as "name=Recipe,mealtype=Meal"
+// from recipe fields to column names.
+func parseColumnMap(spec string) (map[string]string, error) {
+	known := make(map[string]bool)
+	for _, field := range importFields {
+		known[field] = true
+	}
+	columns := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		field := strings.ToLower(strings.TrimSpace(parts[0]))
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("column mapping %q isn't field=column", pair)
+		}
+		if !known[field] {
+			return nil, fmt.Errorf("unknown field %q, expected one of %s", field,
+				strings.Join(importFields, ", "))
+		}
+		columns[field] = strings.TrimSpace(parts[1])
+	}
+	return columns, nil
+}
+
+// findColumns finds each field's column in a header row. Mapped columns
+// must be there, as must one for the name; other fields may be left out.
+func findColumns(header []string, mapped map[string]string) (map[string]int, error) {
+	positions := make(map[string]int)
+	for i, title := range header {
+		title = strings.ToLower(strings.TrimSpace(title))
+		if _, seen := positions[title]; !seen {
+			positions[title] = i
+		}
+	}
+	columns := make(map[string]int)
+	for _, field := range importFields {
+		title, ok := mapped[field]
+		if !ok {
+			title = field
+		}
+		if i, found := positions[strings.ToLower(title)]; found {
+			columns[field] = i
+		} else if ok {
+			return nil, fmt.Errorf("there is no %q column for %s", title, field)
+		}
+	}
+	if _, ok := columns["name"]; !ok {
+		return nil, errors.New("there is no name column; map one with -columns name=<column>")
+	}
+	return columns, nil
+}
+
+// parseBitCell reads meals or seasons given by name, separated by commas
+// or semicolons, or as a number adding up their bits.
+func parseBitCell(cell string, bits map[string]int, names map[int]string) (int, error) {
+	if n, err := strconv.Atoi(cell); err == nil {
+		if n < 0 || n&^allBits(names) != 0 {
+			return 0, fmt.Errorf("must add up bits of %s", describeBits(names))
+		}
+		return n, nil
+	}
+	total := 0
+	for _, name := range strings.FieldsFunc(cell, func(r rune) bool {
+		return r == ',' || r == ';'
+	}) {
+		name = strings.TrimSpace(name)
+		bit := 0
+		for known, b := range bits {
+			if strings.EqualFold(known, name) {
+				bit = b
+			}
+		}
+		if bit == 0 {
+			return 0, fmt.Errorf("%q isn't one of %s", name, describeBits(names))
+		}
+		total |= bit
+	}
+	return total, nil
+}
+
+// parseNumberCell reads a whole number, which spreadsheets may write as
+// e.g. 1998.0.
+func parseNumberCell(cell string) (int, error) {
+	if n, err := strconv.Atoi(cell); err == nil {
+		return n, nil
+	}
+	f, err := strconv.ParseFloat(cell, 64)
+	if err != nil || f != float64(int(f)) {
+		return 0, errors.New("must be a whole number")
+	}
+	return int(f), nil
+}
+
+// importRecipe reads a recipe from a row, checking it like a recipe
+// saved from the site.
+func importRecipe(row importRow, columns map[string]int) *ImportedRecipe {
+	imported := &ImportedRecipe{Line: row.Line, Recipe: &Recipe{}}
+	reported := make(map[string]bool)
+	problem := func(field, message string) {
+		imported.Problems = append(imported.Problems, field+" "+message)
+		reported[field] = true
+	}
+	cell := func(field string) string {
+		if i, ok := columns[field]; ok && i < len(row.Cells) {
+			return strings.TrimSpace(row.Cells[i])
+		}
+		return ""
+	}
+	number := func(field string, into *int) {
+		if value := cell(field); value != "" {
+			n, err := parseNumberCell(value)
+			if err != nil {
+				problem(field, err.Error())
+			}
+			*into = n
+		}
+	}
+	bits := func(field string, toInt map[string]int, names map[int]string, into *int) {
+		n, err := parseBitCell(cell(field), toInt, names)
+		if err != nil {
+			problem(field, err.Error())
+		}
+		*into = n
+	}
+
+	recipe := imported.Recipe
+	recipe.Name = cell("name")
+	recipe.Description = cell("description")
+	number("cuisine", &recipe.Cuisine)
+	bits("mealtype", MealsToInt, Meals, &recipe.Mealtype)
+	bits("season", SeasonsToInt, Seasons, &recipe.Season)
+	// spreadsheets often list ingredients a line each
+	recipe.Ingredientlist = strings.Join(strings.FieldsFunc(cell("ingredientlist"),
+		func(r rune) bool { return r == '\n' || r == '\r' }), "; ")
+	recipe.Instructions = cell("instructions")
+	recipe.Yield = cell("yield")
+	recipe.Contributor = cell("contributor")
+	recipe.Country = cell("country")
+	recipe.Community = cell("community")
+	number("year", &recipe.Year)
+	recipe.Story = cell("story")
+	recipe.Tags = ParseTags(cell("tags"))
+
+	// fields that didn't parse are already reported
+	imported.Problems = append(imported.Problems, recipeProblems(recipe, reported)...)
+	return imported
+}
+
+// ImportRecipes reads recipes from the rows of a spreadsheet, the first
+// being its header. Blank rows are skipped.
+func ImportRecipes(rows []importRow, mapped map[string]string) ([]*ImportedRecipe, error) {
+	if len(rows) == 0 {
+		return nil, errors.New("the spreadsheet is empty")
+	}
+	columns, err := findColumns(rows[0].Cells, mapped)
+	if err != nil {
+		return nil, err
+	}
+	imported := []*ImportedRecipe{}
+	for _, row := range rows[1:] {
+		if strings.TrimSpace(strings.Join(row.Cells, "")) != "" {
+			imported = append(imported, importRecipe(row, columns))
+		}
+	}
+	return imported, nil
+}
+
+// --------------------------------------------
+//                 SPREADSHEETS
+// --------------------------------------------
+
+// readCSV reads the rows of a CSV file, which may start with the byte
+// order mark Excel writes.
+func readCSV(data []byte, delimiter rune) ([]importRow, error) {
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	reader.Comma = delimiter
+	reader.FieldsPerRecord = -1
+	rows := []importRow{}
+	for {
+		cells, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		} else if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		rows = append(rows, importRow{Line: line, Cells: cells})
+	}
+}
+
+// xlsxText is a string of a workbook, which may be split into runs of
+// differently styled text.
+type xlsxText struct {
+	Text string `xml:"t"`
+	Runs []struct {
+		Text string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (text xlsxText) String() string {
+	s := text.Text
+	for _, run := range text.Runs {
+		s += run.Text
+	}
+	return s
+}
+
+// xlsxWorkbook is xl/workbook.xml, listing the sheets.
+type xlsxWorkbook struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		ID   string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+// xlsxRelationships is xl/_rels/workbook.xml.rels, giving the files of
+// the sheets.
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+// xlsxSheet is a worksheet. Empty rows and cells are left out, so each
+// says where it is.
+type xlsxSheet struct {
+	Rows []struct {
+		Ref   int `xml:"r,attr"`
+		Cells []struct {
+			Ref    string   `xml:"r,attr"`
+			Type   string   `xml:"t,attr"`
+			Value  string   `xml:"v"`
+			Inline xlsxText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// readXLSXFile decodes an XML file of a workbook, reporting false if
+// there is no such file.
+func readXLSXFile(archive *zip.Reader, name string, into interface{}) (bool, error) {
+	for _, file := range archive.File {
+		if file.Name == name {
+			f, err := file.Open()
+			if err != nil {
+				return true, err
+			}
+			defer f.Close()
+			return true, xml.NewDecoder(f).Decode(into)
+		}
+	}
+	return false, nil
+}
+
+// xlsxMaxColumns is how many columns a sheet may have, up to XFD.
+const xlsxMaxColumns = 16384
+
+// xlsxColumn turns a cell reference such as "AB12" into a column index.
+// It returns -1 for a reference without a column or past XFD.
+func xlsxColumn(ref string) int {
+	column := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		if column = column*26 + int(r-'A'+1); column > xlsxMaxColumns {
+			return -1
+		}
+	}
+	return column - 1
+}
+
+// readXLSX reads the rows of a sheet of an Excel workbook, the first
+// sheet if sheet is empty.
+func readXLSX(data []byte, sheet string) ([]importRow, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("not an Excel workbook: %s", err)
+	}
+	var workbook xlsxWorkbook
+	var relationships xlsxRelationships
+	for name, into := range map[string]interface{}{"xl/workbook.xml": &workbook,
+		"xl/_rels/workbook.xml.rels": &relationships} {
+		if found, err := readXLSXFile(archive, name, into); !found || err != nil {
+			return nil, fmt.Errorf("not an Excel workbook: reading %s: %v", name, err)
+		}
+	}
+	id := ""
+	for _, s := range workbook.Sheets {
+		if (sheet == "" && id == "") || s.Name == sheet {
+			id = s.ID
+		}
+	}
+	target := ""
+	for _, relationship := range relationships.Relationships {
+		if relationship.ID == id && id != "" {
+			target = relationship.Target
+		}
+	}
+	if target == "" {
+		return nil, fmt.Errorf("the workbook has no sheet %q", sheet)
+	}
+	if strings.HasPrefix(target, "/") {
+		target = strings.TrimPrefix(target, "/")
+	} else {
+		target = path.Join("xl", target)
+	}
+
+	// workbooks without text have no shared strings
+	var shared struct {
+		Items []xlsxText `xml:"si"`
+	}
+	if _, err = readXLSXFile(archive, "xl/sharedStrings.xml", &shared); err != nil {
+		return nil, err
+	}
+	var worksheet xlsxSheet
+	if found, err := readXLSXFile(archive, target, &worksheet); !found || err != nil {
+		return nil, fmt.Errorf("reading sheet %s: %v", target, err)
+	}
+
+	rows := []importRow{}
+	for _, row := range worksheet.Rows {
+		line := row.Ref
+		if line == 0 {
+			line = len(rows) + 1
+		}
+		cells := []string{}
+		for i, cell := range row.Cells {
+			column := i
+			if cell.Ref != "" {
+				column = xlsxColumn(cell.Ref)
+			}
+			if column < 0 || column >= xlsxMaxColumns {
+				return nil, fmt.Errorf("cell %q has a bad cell reference", cell.Ref)
+			}
+			for len(cells) <= column {
+				cells = append(cells, "")
+			}
+			switch cell.Type {
+			case "s":
+				n, err := strconv.Atoi(cell.Value)
+				if err != nil || n < 0 || n >= len(shared.Items) {
+					return nil, fmt.Errorf("cell %s has a bad shared string", cell.Ref)
+				}
+				cells[column] = shared.Items[n].String()
+			case "inlineStr":
+				cells[column] = cell.Inline.String()
+			case "b":
+				cells[column] = map[string]string{"0": "FALSE", "1": "TRUE"}[cell.Value]
+			default:
+				cells[column] = cell.Value
+			}
+		}
+		rows = append(rows, importRow{Line: line, Cells: cells})
+	}
+	return rows, nil
+}
+
+// --------------------------------------------
+//                   COMMAND
+// --------------------------------------------
+
+// ImportCommand runs `recipebox-server import`, which adds the recipes
+// in a CSV file or Excel workbook, a row each, or in a MealMaster,
+// RecipeML or Cooklang file, as owned by a user. Nothing is imported
+// unless every recipe is good; good recipes are loaded together by
+// BulkLoadRecipes. It returns the exit status.
+func ImportCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	columnSpec := flags.String("columns", "",
+		"`field=column,...` pairs reading fields from other columns, e.g. name=Recipe")
+	sheet := flags.String("sheet", "", "the sheet of an Excel workbook to read (default the first)")
+	delimiter := flags.String("delimiter", ",", "the delimiter of a CSV file")
+	owner := flags.String("owner", "", "the email of the contributor the recipes are from")
+	dryRun := flags.Bool("dry-run", false, "check the recipes without importing anything")
+	format := flags.String("format", "", "the file's `format`: csv, xlsx, "+
+		FormatMealMaster+", "+FormatRecipeML+" or "+FormatCooklang+" (default by the file)")
+	description := flags.String("description", "",
+		"the description of recipes from MealMaster, RecipeML or Cooklang files without one")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: recipebox-server import [flags] <file>\n\n"+
+			"Spreadsheet columns are read by field name: %s.\n"+
+			"Meals and seasons may be given by name, e.g. \"Lunch, Dinner\".\n\n",
+			strings.Join(importFields, ", "))
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || (*owner == "" && !*dryRun) {
+		flags.Usage()
+		return 2
+	}
+	fail := func(err error) int {
+		fmt.Fprintf(stderr, "import: %s\n", err)
+		return 1
+	}
+
+	mapped, err := parseColumnMap(*columnSpec)
+	if err != nil {
+		return fail(err)
+	}
+	comma, size := utf8.DecodeRuneInString(*delimiter)
+	if size == 0 || size != len(*delimiter) {
+		return fail(errors.New("the delimiter must be one character"))
+	}
+	filename := flags.Arg(0)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fail(err)
+	}
+	if *format == "" {
+		*format = DetectRecipeFormat(filename, data)
+	}
+	if *format == "" && strings.EqualFold(path.Ext(filename), ".xlsx") {
+		*format = "xlsx"
+	}
+
+	// recipes are found by row in spreadsheets, and by line in other files
+	where := "row"
+	var imported []*ImportedRecipe
+	var rows []importRow
+	switch *format {
+	case "xlsx":
+		rows, err = readXLSX(data, *sheet)
+	case "", "csv":
+		rows, err = readCSV(data, comma)
+	default:
+		where = "line"
+		imported, err = ParseRecipeFile(filename, *format, data, *description)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if rows != nil {
+		if imported, err = ImportRecipes(rows, mapped); err != nil {
+			return fail(err)
+		}
+	}
+
+	bad := 0
+	for _, recipe := range imported {
+		if len(recipe.Problems) > 0 {
+			bad++
+			sort.Strings(recipe.Problems)
+			fmt.Fprintf(stderr, "%s %d: %s\n", where, recipe.Line,
+				strings.Join(recipe.Problems, "; "))
+		}
+	}
+	if *dryRun || bad > 0 {
+		fmt.Fprintf(stdout, "%d recipes checked, %d with problems; nothing imported.\n",
+			len(imported), bad)
+		if bad > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	recipeDB := ConnectToDB()
+	user, err := recipeDB.GetUserByEmail(*owner)
+	if err != nil {
+		return fail(fmt.Errorf("no user %s: %s", *owner, err))
+	}
+	if !user.Role.Includes(RoleContributor) {
+		return fail(fmt.Errorf("%s is a %s and can't add recipes", user.Email, user.Role))
+	}
+	actor := Actor{UserID: user.ID, Name: user.Email}
+	for _, recipe := range imported {
+		recipe.Recipe.Owner = user.ID
+	}
+	err = recipeDB.BulkLoadRecipes(imported, actor, func(stage string, done, total int) {
+		switch stage {
+		case "copy":
+			fmt.Fprintf(stdout, "copied %d of %d recipes\n", done, total)
+		case "check":
+			fmt.Fprintf(stdout, "checked %d recipes\n", total)
+		case "merge":
+			fmt.Fprintf(stdout, "added %d recipes with their tags\n", total)
+		}
+	})
+	if err != nil {
+		return fail(fmt.Errorf("nothing imported: %s", err))
+	}
+	fmt.Fprintf(stdout, "%d recipes imported.\n", len(imported))
+	if _, err = recipeDB.RebuildRelated(); err != nil {
+		return fail(fmt.Errorf("related recipes weren't found again: %s; "+
+			"run recipebox-server related", err))
+	}
+	return 0
+}
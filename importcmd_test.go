@@ -0,0 +1,110 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestImportRecipes tests that mapped columns are read, meals and
+// seasons are read by name, and bad rows are reported by line.
+func TestImportRecipes(t *testing.T) {
+	csv := "\xef\xbb\xbfRecipe;Description;Meal;season;Ingredients;instructions;Year;Tags\n" +
+		"Mafé;Peanut stew;lunch, Dinner;8;\"peanuts\ntomato\";Stew.;1998.0;\"Stew; Peanut\"\n" +
+		";;;;;;;\n" +
+		"Fufu;;Brunch;Fall;cassava;Pound.;1950;\n"
+	rows, err := readCSV([]byte(csv), ';')
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped, err := parseColumnMap("name=Recipe, ingredientlist=ingredients,mealtype=Meal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportRecipes(rows, mapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 2 {
+		t.Fatalf("ImportRecipes() read %d recipes, expected 2", len(imported))
+	}
+	expected := &Recipe{Name: "Mafé", Description: "Peanut stew", Mealtype: 6,
+		Season: 8, Ingredientlist: "peanuts; tomato", Instructions: "Stew.",
+		Year: 1998, Tags: []string{"peanut", "stew"}}
+	if !reflect.DeepEqual(imported[0].Recipe, expected) || imported[0].Problems != nil {
+		t.Errorf("ImportRecipes() = %+v %v, expected %+v", imported[0].Recipe,
+			imported[0].Problems, expected)
+	}
+	problems := imported[1].Problems
+	if imported[1].Line != 5 || len(problems) != 3 ||
+		!strings.HasPrefix(problems[0], `mealtype "Brunch" isn't one of`) ||
+		problems[1] != "description is required" || !strings.HasPrefix(problems[2], "year") {
+		t.Errorf("ImportRecipes() found problems %v on line %d", imported[1].Problems,
+			imported[1].Line)
+	}
+
+	if _, err = ImportRecipes(rows, map[string]string{"story": "Memories"}); err == nil {
+		t.Error("ImportRecipes() accepted a mapping to a missing column")
+	}
+	if _, err = parseColumnMap("picture=Photo"); err == nil {
+		t.Error("parseColumnMap() accepted an unknown field")
+	}
+}
+
+// TestReadXLSX tests that shared, rich and inline strings are read into
+// the columns and rows their references give.
+func TestReadXLSX(t *testing.T) {
+	files := map[string]string{
+		"xl/workbook.xml": `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"
+			xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+			<sheets><sheet name="Notes" sheetId="1" r:id="rId1"/>
+			<sheet name="Recipes" sheetId="2" r:id="rId2"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+			<Relationship Id="rId1" Target="worksheets/sheet1.xml"/>
+			<Relationship Id="rId2" Target="/xl/worksheets/sheet2.xml"/></Relationships>`,
+		"xl/sharedStrings.xml": `<sst><si><t>name</t></si><si><r><t>Ma</t></r><r><t>fé</t></r></si></sst>`,
+		"xl/worksheets/sheet2.xml": `<worksheet><sheetData>
+			<row r="1"><c r="A1" t="s"><v>0</v></c><c r="C1" t="inlineStr"><is><t>year</t></is></c></row>
+			<row r="3"><c r="A3" t="s"><v>1</v></c><c r="C3"><v>1998</v></c></row>
+			</sheetData></worksheet>`,
+	}
+	workbook := func() []byte {
+		var buf bytes.Buffer
+		archive := zip.NewWriter(&buf)
+		for name, data := range files {
+			w, _ := archive.Create(name)
+			w.Write([]byte(data))
+		}
+		archive.Close()
+		return buf.Bytes()
+	}
+
+	rows, err := readXLSX(workbook(), "Recipes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []importRow{{1, []string{"name", "", "year"}}, {3, []string{"Mafé", "", "1998"}}}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("readXLSX() = %v, expected %v", rows, expected)
+	}
+	if _, err = readXLSX(workbook(), ""); err == nil {
+		t.Error("readXLSX() read the first sheet, which is missing")
+	}
+
+	// columns past XFD, the last Excel has, are refused
+	for _, ref := range []string{"XFE1", "ZZZZZZZZ1", "ZZZZZZZZZZZZZZZ1", "1"} {
+		files["xl/worksheets/sheet2.xml"] = `<worksheet><sheetData><row r="1">` +
+			`<c r="` + ref + `"><v>1</v></c></row></sheetData></worksheet>`
+		if _, err = readXLSX(workbook(), "Recipes"); err == nil ||
+			!strings.Contains(err.Error(), "bad cell reference") {
+			t.Errorf("readXLSX() of cell %s = %v, expected a bad cell reference", ref, err)
+		}
+	}
+	files["xl/worksheets/sheet2.xml"] = `<worksheet><sheetData><row r="1">` +
+		`<c r="XFD1"><v>1</v></c></row></sheetData></worksheet>`
+	if rows, err = readXLSX(workbook(), "Recipes"); err != nil || len(rows[0].Cells) != xlsxMaxColumns {
+		t.Errorf("readXLSX() of cell XFD1 = %v, expected %d columns", err, xlsxMaxColumns)
+	}
+}
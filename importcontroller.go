@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// importMaxUpload is the largest recipe file the upload form takes.
+const importMaxUpload = 5 << 20
+
+// importMaxRecipes is the most recipes the upload form imports at once;
+// bigger collections are imported with `recipebox-server import`.
+const importMaxRecipes = 200
+
+// importPage is the binding of the upload form, its preview of the
+// recipes read from a file, and the list of recipes imported.
+type importPage struct {
+	Formats     []string
+	Format      string
+	Description string
+	Filename    string
+	Error       string
+	Recipes     []*ImportedRecipe
+	Good        int
+	// Data holds the good recipes as JSON, sent back to be saved.
+	Data  string
+	Saved []*Recipe
+}
+
+func newImportPage() *importPage {
+	return &importPage{Formats: []string{FormatMealMaster, FormatRecipeML, FormatCooklang}}
+}
+
+// ImportRecipesForm serves the form for uploading a MealMaster, RecipeML
+// or Cooklang file.
+func (c *RBController) ImportRecipesForm(w http.ResponseWriter, r *http.Request) (err error) {
+	c.HTML(w, http.StatusOK, "recipes/import", newImportPage())
+	return nil
+}
+
+// PreviewImport reads the recipes of an uploaded file and shows them,
+// with what is wrong with each, before they are imported.
+func (c *RBController) PreviewImport(w http.ResponseWriter, r *http.Request) (err error) {
+	page := newImportPage()
+	page.Format = r.PostFormValue(`format`)
+	page.Description = strings.TrimSpace(r.PostFormValue(`description`))
+	showError := func(message string) error {
+		page.Error = message
+		c.HTML(w, http.StatusBadRequest, "recipes/import", page)
+		return nil
+	}
+
+	file, header, err := r.FormFile(`file`)
+	if err != nil {
+		return showError("Please choose a file to upload.")
+	}
+	defer file.Close()
+	page.Filename = header.Filename
+	if header.Size > importMaxUpload {
+		return showError(fmt.Sprintf("Sorry, files may be at most %d MB.", importMaxUpload>>20))
+	}
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return
+	}
+	format := page.Format
+	if format == "" {
+		if format = DetectRecipeFormat(header.Filename, data); format == "" {
+			return showError("Sorry, that file doesn't look like MealMaster or RecipeML. " +
+				"Please choose its format.")
+		}
+	}
+	if page.Recipes, err = ParseRecipeFile(header.Filename, format, data,
+		page.Description); err != nil {
+		return showError(err.Error())
+	}
+	if len(page.Recipes) > importMaxRecipes {
+		return showError(fmt.Sprintf("Sorry, the file holds %d recipes, but at most %d "+
+			"may be uploaded at once. Please split it, or ask an admin to import it.",
+			len(page.Recipes), importMaxRecipes))
+	}
+
+	good := []*Recipe{}
+	for _, recipe := range page.Recipes {
+		if len(recipe.Problems) == 0 {
+			good = append(good, recipe.Recipe)
+		}
+	}
+	encoded, err := json.Marshal(good)
+	if err != nil {
+		return
+	}
+	page.Good, page.Data = len(good), string(encoded)
+	c.HTML(w, http.StatusOK, "recipes/import", page)
+	return nil
+}
+
+// SaveImport adds the recipes shown by PreviewImport, owned by the user.
+// They are checked again, since they come back from the browser.
+func (c *RBController) SaveImport(w http.ResponseWriter, r *http.Request) (err error) {
+	user, err := c.CurrentUser(r)
+	if err != nil {
+		return
+	}
+	var recipes []*Recipe
+	if json.Unmarshal([]byte(r.PostFormValue(`recipes`)), &recipes) != nil ||
+		len(recipes) == 0 || len(recipes) > importMaxRecipes {
+		c.RenderError(w, http.StatusBadRequest, "Sorry, those recipes can't be imported. "+
+			"Please upload the file again.")
+		return nil
+	}
+	for _, recipe := range recipes {
+		if len(recipe.Validate()) > 0 {
+			c.RenderError(w, http.StatusBadRequest, "Sorry, "+recipe.Name+
+				" can't be imported. Please upload the file again.")
+			return nil
+		}
+	}
+
+	for _, recipe := range recipes {
+		recipe.ID, recipe.Owner, recipe.Picture = 0, user.ID, nil
+		recipe.Tags = ParseTags(strings.Join(recipe.Tags, ";"))
+	}
+	// all or nothing, so a failure can be retried without duplicates
+	if err = c.RecipeDB.NewRecipes(recipes, c.actor(r, user)); err != nil {
+		return
+	}
+	c.Stats.Invalidate()
+	page := newImportPage()
+	page.Saved = recipes
+	c.HTML(w, http.StatusOK, "recipes/import", page)
+	return nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"html"
+	"html/template"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ldType is the content type of JSON-LD documents.
+const ldType = "application/ld+json"
+
+// RecipeLD is a recipe as a schema.org Recipe, for search engines and
+// other sites.
+type RecipeLD struct {
+	Context            string      `json:"@context"`
+	Type               string      `json:"@type"`
+	URL                string      `json:"url,omitempty"`
+	Name               string      `json:"name"`
+	Description        string      `json:"description,omitempty"`
+	RecipeIngredient   []string    `json:"recipeIngredient"`
+	RecipeInstructions []HowToStep `json:"recipeInstructions,omitempty"`
+	RecipeYield        string      `json:"recipeYield,omitempty"`
+	RecipeCategory     []string    `json:"recipeCategory,omitempty"`
+	Keywords           string      `json:"keywords,omitempty"`
+	Author             *Person     `json:"author,omitempty"`
+}
+
+// HowToStep is one step of a schema.org Recipe's instructions.
+type HowToStep struct {
+	Type string `json:"@type"`
+	Text string `json:"text"`
+}
+
+// Person is a schema.org Person.
+type Person struct {
+	Type string `json:"@type"`
+	Name string `json:"name"`
+}
+
+// NewRecipeLD describes recipe as a schema.org Recipe found at url.
+// Each line of the instructions becomes a step.
+func NewRecipeLD(recipe *Recipe, url string) *RecipeLD {
+	ld := &RecipeLD{Context: "https://schema.org", Type: "Recipe", URL: url,
+		Name: recipe.Name, Description: recipe.Description,
+		RecipeIngredient: recipeIngredients(recipe), RecipeYield: recipe.Yield,
+		RecipeCategory: bitNames(Meals, recipe.Mealtype),
+		Keywords:       strings.Join(recipe.Tags, ", ")}
+	for _, step := range recipeSteps(recipe) {
+		ld.RecipeInstructions = append(ld.RecipeInstructions, HowToStep{"HowToStep", step})
+	}
+	if recipe.Contributor != "" {
+		ld.Author = &Person{"Person", recipe.Contributor}
+	}
+	return ld
+}
+
+// recipeHead is the part of a recipe page's head that describes it to
+// search engines and to sites it is shared on.
+var recipeHead = template.Must(template.New("head").Parse(`
+    <link rel="canonical" href="{{.LD.URL}}">
+    <link rel="alternate" type="application/ld+json" href="{{.JSONLD}}">
+    <meta property="og:type" content="article">
+    <meta property="og:site_name" content="RecipeBox">
+    <meta property="og:title" content="{{.LD.Name}}">
+    <meta property="og:description" content="{{.LD.Description}}">
+    <meta property="og:url" content="{{.LD.URL}}">
+    <script type="application/ld+json">{{.LD}}</script>
+`))
+
+// RecipeHead renders the JSON-LD and Open Graph tags of a recipe page.
+func RecipeHead(recipe *Recipe, base string) (template.HTML, error) {
+	path := "/recipes/" + strconv.Itoa(recipe.ID) + "/"
+	var buf bytes.Buffer
+	err := recipeHead.Execute(&buf, map[string]interface{}{
+		"LD":     NewRecipeLD(recipe, base+path),
+		"JSONLD": path + "jsonld/",
+	})
+	return template.HTML(buf.String()), err
+}
+
+// ldScript finds the JSON-LD blocks of an HTML page.
+var ldScript = regexp.MustCompile(`(?is)<script[^>]*type=["']?application/ld\+json["']?[^>]*>(.*?)</script>`)
+
+// ldTag matches the HTML tags some sites leave in their JSON-LD text.
+var ldTag = regexp.MustCompile(`<[^>]*>`)
+
+var errNoRecipeLD = errors.New("the document has no schema.org Recipe")
+
+// ParseRecipeLD reads the first schema.org Recipe from a JSON-LD
+// document, or from the JSON-LD blocks of an HTML page, into the fields
+// of a new recipe. Fields without a counterpart are left out.
+func ParseRecipeLD(document []byte) (*Recipe, error) {
+	blocks := [][]byte{document}
+	if trimmed := bytes.TrimSpace(document); len(trimmed) > 0 && trimmed[0] == '<' {
+		blocks = nil
+		for _, match := range ldScript.FindAllSubmatch(document, -1) {
+			blocks = append(blocks, match[1])
+		}
+	}
+	for _, block := range blocks {
+		var doc interface{}
+		if err := json.Unmarshal(block, &doc); err != nil {
+			if len(blocks) == 1 {
+				return nil, errors.New("the document isn't JSON-LD: " + err.Error())
+			}
+			continue
+		}
+		if node := findRecipeLD(doc); node != nil {
+			return recipeFromLD(node), nil
+		}
+	}
+	return nil, errNoRecipeLD
+}
+
+// findRecipeLD searches a JSON-LD document, including any @graph or
+// nested nodes, for a node whose @type is Recipe.
+func findRecipeLD(doc interface{}) map[string]interface{} {
+	switch doc := doc.(type) {
+	case []interface{}:
+		for _, item := range doc {
+			if node := findRecipeLD(item); node != nil {
+				return node
+			}
+		}
+	case map[string]interface{}:
+		for _, t := range ldStrings(doc["@type"]) {
+			if t == "Recipe" || strings.HasSuffix(t, "/Recipe") || t == "schema:Recipe" {
+				return doc
+			}
+		}
+		keys := []string{}
+		for key := range doc {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if node := findRecipeLD(doc[key]); node != nil {
+				return node
+			}
+		}
+	}
+	return nil
+}
+
+// recipeFromLD maps a schema.org Recipe node to a recipe.
+func recipeFromLD(node map[string]interface{}) *Recipe {
+	recipe := &Recipe{Name: ldText(node["name"]),
+		Description: ldText(node["description"])}
+
+	ingredients := node["recipeIngredient"]
+	if ingredients == nil {
+		// the older name of recipeIngredient
+		ingredients = node["ingredients"]
+	}
+	list := []string{}
+	for _, ingredient := range ldStrings(ingredients) {
+		// semicolons separate our ingredients
+		list = append(list, strings.Replace(ingredient, ";", ",", -1))
+	}
+	recipe.Ingredientlist = strings.Join(list, "; ")
+	recipe.Instructions = strings.Join(ldSteps(node["recipeInstructions"]), "\n")
+
+	// yields are often given twice, as in ["4", "4 servings"]; keep the
+	// most descriptive
+	for _, yield := range ldStrings(node["recipeYield"]) {
+		if len(yield) > len(recipe.Yield) {
+			recipe.Yield = yield
+		}
+	}
+
+	keywords := []string{}
+	for _, keyword := range ldStrings(node["keywords"]) {
+		keywords = append(keywords, strings.Split(keyword, ",")...)
+	}
+	recipe.Tags = ParseTags(strings.Join(keywords, ";"))
+	for _, category := range ldStrings(node["recipeCategory"]) {
+		for bit, meal := range Meals {
+			if strings.EqualFold(category, meal) {
+				recipe.Mealtype |= bit
+			}
+		}
+	}
+	return recipe
+}
+
+// ldText is the plain text of a JSON-LD string, number or text node.
+func ldText(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		text := html.UnescapeString(ldTag.ReplaceAllString(value, " "))
+		return strings.Join(strings.Fields(text), " ")
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case map[string]interface{}:
+		if text, ok := value["text"]; ok {
+			return ldText(text)
+		}
+		return ldText(value["name"])
+	}
+	return ""
+}
+
+// ldStrings is the non-empty texts of a JSON-LD value or list of values.
+func ldStrings(value interface{}) []string {
+	values, ok := value.([]interface{})
+	if !ok {
+		values = []interface{}{value}
+	}
+	texts := []string{}
+	for _, value := range values {
+		if text := ldText(value); text != "" {
+			texts = append(texts, text)
+		}
+	}
+	return texts
+}
+
+// ldSteps flattens recipeInstructions, which may be text, a list of
+// texts or HowToSteps, or HowToSections of steps, into lines.
+func ldSteps(value interface{}) []string {
+	switch value := value.(type) {
+	case string:
+		lines := []string{}
+		for _, line := range strings.Split(ldTag.ReplaceAllString(value, "\n"), "\n") {
+			if line = ldText(line); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		return lines
+	case []interface{}:
+		lines := []string{}
+		for _, item := range value {
+			lines = append(lines, ldSteps(item)...)
+		}
+		return lines
+	case map[string]interface{}:
+		if items, ok := value["itemListElement"]; ok {
+			return ldSteps(items)
+		}
+		if text := ldText(value); text != "" {
+			return []string{text}
+		}
+	}
+	return nil
+}
+
+// RecipeJSONLD renders a recipe as a schema.org Recipe.
+func (c *RBController) RecipeJSONLD(w http.ResponseWriter, r *http.Request) (err error) {
+	recipe, err := c.apiRecipe(w, r)
+	if recipe == nil {
+		return
+	}
+	url := c.BaseURL + "/recipes/" + strconv.Itoa(recipe.ID) + "/"
+	data, err := json.Marshal(NewRecipeLD(recipe, url))
+	if err != nil {
+		return
+	}
+	w.Header().Set("Content-Type", ldType+"; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return nil
+}
+
+// APIImportRecipe creates a recipe from a schema.org Recipe, sent as a
+// JSON-LD document or as an HTML page with JSON-LD in it.
+func (c *RBController) APIImportRecipe(w http.ResponseWriter, r *http.Request) (err error) {
+	user, err := c.CurrentUser(r)
+	if err != nil {
+		return
+	}
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != ldType && contentType != "application/json" && contentType != "text/html" {
+		c.RenderError(w, http.StatusUnsupportedMediaType,
+			"send a JSON-LD document as "+ldType+" or an HTML page as text/html")
+		return nil
+	}
+	document, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, apiMaxBody))
+	if err != nil {
+		c.RenderError(w, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	recipe, err := ParseRecipeLD(document)
+	if err != nil {
+		c.RenderError(w, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	if !c.validRecipe(w, recipe) {
+		return nil
+	}
+	return c.createRecipe(w, r, user, recipe)
+}
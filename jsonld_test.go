@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// TestParseRecipeLD tests that recipes are found and mapped from the
+// shapes of JSON-LD other sites publish.
+func TestParseRecipeLD(t *testing.T) {
+	document := `{"@context": "https://schema.org", "@graph": [
+		{"@type": "WebPage", "name": "Not a recipe"},
+		{"@type": ["Recipe", "NewsArticle"], "name": "Mafé",
+		 "description": "Peanut &amp; tomato <b>stew</b>",
+		 "recipeIngredient": ["2 cups peanut butter", "salt; pepper"],
+		 "recipeInstructions": [
+			{"@type": "HowToSection", "name": "Stew", "itemListElement": [
+				{"@type": "HowToStep", "text": "Brown the meat."},
+				{"@type": "HowToStep", "text": "Add the sauce."}]},
+			"Serve over rice."],
+		 "recipeYield": [6, "6 servings"],
+		 "recipeCategory": "dinner",
+		 "keywords": "Stew, peanut"}]}`
+	recipe, err := ParseRecipeLD([]byte(document))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Recipe{Name: "Mafé", Description: "Peanut & tomato stew",
+		Ingredientlist: "2 cups peanut butter; salt, pepper",
+		Instructions:   "Brown the meat.\nAdd the sauce.\nServe over rice.",
+		Yield:          "6 servings", Mealtype: 4, Tags: []string{"peanut", "stew"}}
+	if !reflect.DeepEqual(recipe, expected) {
+		t.Errorf("ParseRecipeLD() = %+v, expected %+v", recipe, expected)
+	}
+
+	page := `<html><head>
+		<script type="application/ld+json">{"@type": "Organization"}</script>
+		<script type='application/ld+json'>{"@type": "Recipe", "name": "Fufu",
+			"recipeInstructions": "Boil.<br>Pound."}</script>
+		</head></html>`
+	recipe, err = ParseRecipeLD([]byte(page))
+	if err != nil || recipe.Name != "Fufu" || recipe.Instructions != "Boil.\nPound." {
+		t.Errorf("ParseRecipeLD(page) = %+v, %v", recipe, err)
+	}
+
+	if _, err = ParseRecipeLD([]byte(`{"@type": "Person"}`)); err != errNoRecipeLD {
+		t.Errorf("ParseRecipeLD(person) returned %v, expected %v", err, errNoRecipeLD)
+	}
+}
+
+// TestRecipeHead tests that a recipe page's JSON-LD is valid JSON, and
+// that a recipe can't end the script it's in.
+func TestRecipeHead(t *testing.T) {
+	recipe := &Recipe{ID: 3, Name: "</script><b>Jollof</b>", Mealtype: 5,
+		Ingredientlist: "rice; tomato", Instructions: "Fry.\n\nSimmer.",
+		Tags: []string{"party", "rice"}}
+	head, err := RecipeHead(recipe, "https://example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(head), "</script>") != 1 {
+		t.Errorf("the recipe's name escaped its script: %s", head)
+	}
+	script := regexp.MustCompile(`(?s)<script[^>]*>(.*)</script>`).FindStringSubmatch(string(head))
+	var ld RecipeLD
+	if script == nil || json.Unmarshal([]byte(script[1]), &ld) != nil {
+		t.Fatalf("no JSON-LD in %s", head)
+	}
+	if ld.Name != recipe.Name || ld.URL != "https://example.org/recipes/3/" ||
+		len(ld.RecipeInstructions) != 2 || ld.Keywords != "party, rice" ||
+		!reflect.DeepEqual(ld.RecipeCategory, []string{"Breakfast", "Dinner"}) {
+		t.Errorf("the JSON-LD is %+v", ld)
+	}
+}
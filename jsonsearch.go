@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ndjsonType is the content type of newline delimited JSON, one recipe
+// per line, used for streaming large search results.
+const ndjsonType = "application/x-ndjson"
+
+// searchBatch is the number of recipes streamed between flushes.
+const searchBatch = 100
+
+// JSONSearch is a search of /recipes/jsonsearch/, read from query or
+// form parameters or from a JSON body. Cuisine, Mealtype and Season are
+// -1 when not given.
+type JSONSearch struct {
+	Strict      bool     `json:"strict"`
+	Name        string   `json:"name"`
+	Cuisine     int      `json:"cuisine"`
+	Mealtype    int      `json:"mealtype"`
+	Season      int      `json:"season"`
+	Contributor string   `json:"contributor"`
+	Country     string   `json:"country"`
+	Year        int      `json:"year"`
+	Tags        []string `json:"tags"`
+	Facets      bool     `json:"facets"`
+	Format      string   `json:"format"`
+}
+
+// SearchResults is the JSON envelope of a search's results.
+type SearchResults struct {
+	Results []*Recipe  `json:"results"`
+	Meta    SearchMeta `json:"meta"`
+}
+
+// SearchMeta describes the search that found a set of results.
+type SearchMeta struct {
+	Count  int        `json:"count"`
+	Query  JSONSearch `json:"query"`
+	Facets *Facets    `json:"facets,omitempty"`
+}
+
+// parseJSONSearch reads a search from a JSON body, or else from the
+// request's query string and form. Parameters that don't parse are
+// reported as errors rather than ignored.
+func parseJSONSearch(r *http.Request) (search JSONSearch, err error) {
+	search = JSONSearch{Cuisine: -1, Mealtype: -1, Season: -1}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType == "application/json" {
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err = decoder.Decode(&search); err != nil {
+			return search, errors.New("the body must be a JSON search: " + err.Error())
+		}
+	} else {
+		if err = r.ParseForm(); err != nil {
+			return
+		}
+		search.Name = r.Form.Get("name")
+		search.Contributor = r.Form.Get("contributor")
+		search.Country = r.Form.Get("country")
+		search.Tags = r.Form["tag"]
+		search.Format = r.Form.Get("format")
+
+		bools := map[string]*bool{"strict": &search.Strict, "facets": &search.Facets}
+		for name, field := range bools {
+			if value := r.Form.Get(name); value != "" {
+				if *field, err = strconv.ParseBool(value); err != nil {
+					return search, errors.New(name + " must be 0 or 1")
+				}
+			}
+		}
+		ints := map[string]*int{"cuisine": &search.Cuisine,
+			"mealtype": &search.Mealtype, "season": &search.Season,
+			"year": &search.Year}
+		for name, field := range ints {
+			if value := r.Form.Get(name); value != "" {
+				if *field, err = strconv.Atoi(value); err != nil {
+					return search, errors.New(name + " must be a whole number")
+				}
+			}
+		}
+	}
+
+	search.Tags = ParseTags(strings.Join(search.Tags, ";"))
+	if search.Format == "" && strings.Contains(r.Header.Get("Accept"), ndjsonType) {
+		search.Format = "ndjson"
+	}
+	if search.Format != "" && search.Format != "json" && search.Format != "ndjson" {
+		return search, errors.New("format must be json or ndjson")
+	}
+	return search, nil
+}
+
+// recipeSearch turns the search into a RecipeSearch.
+func (search JSONSearch) recipeSearch() RecipeSearch {
+	return RecipeSearch{Strict: search.Strict, Name: search.Name,
+		Cuisine: search.Cuisine, Mealtype: search.Mealtype, Season: search.Season,
+		Contributor: search.Contributor, Country: search.Country,
+		Year: search.Year, Tags: search.Tags}
+}
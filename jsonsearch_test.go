@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestParseJSONSearch tests that searches read the same from a query
+// string, a form and a JSON body, and that bad parameters are errors.
+func TestParseJSONSearch(t *testing.T) {
+	want := JSONSearch{Strict: true, Name: "stew", Cuisine: -1, Mealtype: 4,
+		Season: -1, Tags: []string{"spicy"}, Facets: true}
+
+	get := httptest.NewRequest("GET",
+		"/recipes/jsonsearch/?strict=1&name=stew&mealtype=4&tag=Spicy&facets=1", nil)
+	form := httptest.NewRequest("POST", "/recipes/jsonsearch/",
+		strings.NewReader("strict=1&name=stew&mealtype=4&tag=Spicy&facets=1"))
+	form.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	body := httptest.NewRequest("POST", "/recipes/jsonsearch/",
+		strings.NewReader(`{"strict": true, "name": "stew", "mealtype": 4, `+
+			`"tags": ["Spicy"], "facets": true}`))
+	body.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	for name, r := range map[string]*http.Request{"GET": get, "form": form, "JSON": body} {
+		search, err := parseJSONSearch(r)
+		if err != nil {
+			t.Errorf("%s: parseJSONSearch() failed: %v", name, err)
+		} else if !reflect.DeepEqual(search, want) {
+			t.Errorf("%s: parseJSONSearch() = %+v, expected %+v", name, search, want)
+		}
+	}
+
+	for _, query := range []string{"strict=maybe", "cuisine=thai", "format=xml"} {
+		r := httptest.NewRequest("GET", "/recipes/jsonsearch/?"+query, nil)
+		if _, err := parseJSONSearch(r); err == nil {
+			t.Errorf("parseJSONSearch(%q) didn't fail", query)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/recipes/jsonsearch/", nil)
+	r.Header.Set("Accept", ndjsonType)
+	if search, _ := parseJSONSearch(r); search.Format != "ndjson" {
+		t.Errorf("parseJSONSearch() format = %q, expected ndjson", search.Format)
+	}
+}
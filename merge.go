@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MergeRecipes merges the recipes in merged into survivor, which keeps
+// their tags, and the first of their pictures if it has none. The merged
+// recipes are deleted, and their ids, and any ids merged into them
+// before, redirect to survivor. Each merged recipe is recorded in the
+// audit log, as is what survivor gained. It returns sql.ErrNoRows if any
+// of the recipes doesn't exist, and a *notDuplicate if any isn't alike
+// enough to survivor to be the same dish.
+func (recipeDB *RecipeDB) MergeRecipes(survivor int, merged []int, actor Actor) (err error) {
+	tx, err := recipeDB.DB.Beginx()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	ids := make([]string, len(merged))
+	for i, id := range merged {
+		ids[i] = strconv.Itoa(id)
+	}
+	marks, args := placeholders(2, ids)
+	args = append([]interface{}{survivor}, args...)
+
+	var recipes []*Recipe
+	err = tx.Select(&recipes, `SELECT * FROM recipes WHERE id=$1 OR id IN (`+marks+`) `+
+		`ORDER BY id FOR UPDATE`, args...)
+	if err != nil {
+		return
+	}
+	if len(recipes) != len(merged)+1 {
+		return sql.ErrNoRows
+	}
+	var before *Recipe
+	for _, recipe := range recipes {
+		err = tx.Select(&recipe.Tags,
+			"SELECT tag FROM recipe_tags WHERE recipe_id=$1 ORDER BY tag", recipe.ID)
+		if err != nil {
+			return
+		}
+		if recipe.ID == survivor {
+			before = recipe
+		}
+	}
+	if err = checkMerge(before, recipes); err != nil {
+		return
+	}
+
+	_, err = tx.Exec(`INSERT INTO recipe_tags (recipe_id, tag) `+
+		`SELECT DISTINCT $1::integer, tag FROM recipe_tags WHERE recipe_id IN (`+marks+`) `+
+		`ON CONFLICT DO NOTHING`, args...)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec(`UPDATE recipes SET picture=(SELECT picture FROM recipes `+
+		`WHERE id IN (`+marks+`) AND picture IS NOT NULL ORDER BY id LIMIT 1) `+
+		`WHERE id=$1 AND picture IS NULL`, args...)
+	if err != nil {
+		return
+	}
+
+	// point old redirects at the survivor too, so that there are no chains
+	_, err = tx.Exec(`UPDATE recipe_redirects SET recipe_id=$1 `+
+		`WHERE recipe_id IN (`+marks+`)`, args...)
+	if err != nil {
+		return
+	}
+	for _, id := range merged {
+		_, err = tx.Exec(`INSERT INTO recipe_redirects (old_id, recipe_id) VALUES ($1, $2)`,
+			id, survivor)
+		if err != nil {
+			return
+		}
+	}
+	_, err = tx.Exec(`DELETE FROM recipes WHERE id IN (`+marks+`) AND id<>$1`, args...)
+	if err != nil {
+		return
+	}
+
+	after := new(Recipe)
+	err = tx.QueryRowx("SELECT * FROM recipes WHERE id=$1", survivor).StructScan(after)
+	if err != nil {
+		return
+	}
+	err = tx.Select(&after.Tags,
+		"SELECT tag FROM recipe_tags WHERE recipe_id=$1 ORDER BY tag", survivor)
+	if err != nil {
+		return
+	}
+	targets := make([]string, len(merged))
+	for i, id := range merged {
+		targets[i] = recipeTarget(id)
+	}
+	for _, recipe := range recipes {
+		entry := &AuditEntry{Actor: actor.UserID, ActorName: actor.Name,
+			Action: AuditRecipeMerge, Target: recipeTarget(recipe.ID), IP: actor.IP}
+		if recipe.ID == survivor {
+			entry.Before, entry.After = DiffRecipes(before, after)
+			if entry.After != "" {
+				entry.After += "; "
+			}
+			entry.After += "merged " + strings.Join(targets, ", ")
+			if before.Picture == nil && after.Picture != nil {
+				entry.After += "; picture from a merged recipe"
+			}
+		} else {
+			_, entry.Before = DiffRecipes(nil, recipe)
+			entry.After = "merged into " + recipeTarget(survivor)
+		}
+		if err = insertAudit(tx, entry); err != nil {
+			return
+		}
+	}
+	err = tx.Commit()
+	return
+}
+
+// notDuplicate is the error of a merge refused because a recipe isn't
+// alike enough to the one it would be merged into.
+type notDuplicate struct {
+	match    DuplicateMatch
+	survivor *Recipe
+}
+
+func (e *notDuplicate) Error() string {
+	return fmt.Sprintf("Sorry, %s is only %d%% alike to %s, too little to be the same dish.",
+		e.match.Recipe.Name, e.match.Percent(), e.survivor.Name)
+}
+
+// checkMerge checks that every recipe but survivor is likely to
+// duplicate it. Recipes are grouped on the duplicates report through any
+// alike pair, so a group may hold recipes that aren't alike to the one
+// chosen to keep.
+func checkMerge(survivor *Recipe, recipes []*Recipe) error {
+	print := fingerprint(survivor)
+	for _, recipe := range recipes {
+		if recipe.ID == survivor.ID {
+			continue
+		}
+		match := DuplicateMatch{Recipe: recipe, Score: print.Similarity(fingerprint(recipe))}
+		if !match.Likely() {
+			return &notDuplicate{match, survivor}
+		}
+	}
+	return nil
+}
+
+// MergedInto gets the recipe that the recipe with id was merged into, or
+// sql.ErrNoRows if it wasn't merged.
+func (recipeDB *RecipeDB) MergedInto(id int) (survivor int, err error) {
+	err = recipeDB.DB.Get(&survivor, `SELECT recipe_id FROM recipe_redirects WHERE old_id=$1`, id)
+	return
+}
+
+// mergedPath is path, a recipe's page or one of its routes, with the
+// recipe's id replaced by survivor's.
+func mergedPath(path string, id, survivor int) string {
+	parts := strings.Split(path, "/")
+	for i := 1; i < len(parts); i++ {
+		if parts[i-1] == "recipes" && parts[i] == strconv.Itoa(id) {
+			parts[i] = strconv.Itoa(survivor)
+			break
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// redirectMerged answers a request for a recipe that was merged into
+// another with a permanent redirect to the same route of the other,
+// and reports whether it did. Only GET and HEAD are redirected, since
+// clients may not repeat other methods at the new URL.
+func (c *RBController) redirectMerged(w http.ResponseWriter, r *http.Request, id int) (bool, error) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false, nil
+	}
+	survivor, err := c.MergedInto(id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	target := mergedPath(r.URL.Path, id, survivor)
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+	return true, nil
+}
+
+// parseMerge reads the survivor and the recipes to merge into it from a
+// merge form. The survivor is left out of the recipes to merge, in case
+// its box was ticked too.
+func parseMerge(r *http.Request) (survivor int, merged []int, ok bool) {
+	survivor, err := strconv.Atoi(r.PostFormValue(`survivor`))
+	if err != nil {
+		return 0, nil, false
+	}
+	seen := map[int]bool{survivor: true}
+	for _, value := range r.PostForm[`merge`] {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, nil, false
+		}
+		if !seen[id] {
+			seen[id] = true
+			merged = append(merged, id)
+		}
+	}
+	return survivor, merged, len(merged) > 0
+}
+
+// MergeRecipes merges the recipes ticked on the duplicates report into
+// the one chosen to survive, and shows it.
+func (c *RBController) MergeRecipes(w http.ResponseWriter, r *http.Request) (err error) {
+	survivor, merged, ok := parseMerge(r)
+	if !ok {
+		c.RenderError(w, http.StatusBadRequest,
+			"Please choose a recipe to keep, and at least one other to merge into it.")
+		return nil
+	}
+	user, err := c.CurrentUser(r)
+	if err != nil {
+		return
+	}
+	err = c.RecipeDB.MergeRecipes(survivor, merged, c.actor(r, user))
+	if err == sql.ErrNoRows {
+		c.RenderError(w, http.StatusNotFound,
+			"Sorry, one of those recipes no longer exists. It may have been merged already.")
+		return nil
+	} else if refused, ok := err.(*notDuplicate); ok {
+		c.RenderError(w, http.StatusBadRequest, refused.Error())
+		return nil
+	} else if err != nil {
+		return
+	}
+	c.Stats.Invalidate()
+	http.Redirect(w, r, "/recipes/"+strconv.Itoa(survivor)+"/", http.StatusFound)
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestMergedPath tests that only the recipe's id is replaced in the
+// routes of a merged recipe.
+func TestMergedPath(t *testing.T) {
+	tests := map[string]string{
+		"/recipes/12/":       "/recipes/7/",
+		"/recipes/12/json/":  "/recipes/7/json/",
+		"/api/v1/recipes/12": "/api/v1/recipes/7",
+		"/recipes/120/":      "/recipes/120/",
+		"/cookbooks/12/pdf/": "/cookbooks/12/pdf/",
+	}
+	for path, expected := range tests {
+		if merged := mergedPath(path, 12, 7); merged != expected {
+			t.Errorf("mergedPath(%q) = %q, expected %q", path, merged, expected)
+		}
+	}
+}
+
+// TestParseMerge tests that the survivor is left out of the recipes
+// merged into it, and that forms missing either are refused.
+func TestParseMerge(t *testing.T) {
+	parse := func(form url.Values) (int, []int, bool) {
+		req, _ := http.NewRequest("POST", "/admin/duplicates/merge/",
+			strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return parseMerge(req)
+	}
+	survivor, merged, ok := parse(url.Values{"survivor": {"3"}, "merge": {"5", "3", "9", "5"}})
+	if survivor != 3 || !reflect.DeepEqual(merged, []int{5, 9}) || !ok {
+		t.Errorf("parseMerge() = %d, %v, %v", survivor, merged, ok)
+	}
+	for _, form := range []url.Values{
+		{"survivor": {"3"}, "merge": {"3"}},
+		{"merge": {"5"}},
+		{"survivor": {"3"}, "merge": {"five"}},
+	} {
+		if _, _, ok := parse(form); ok {
+			t.Errorf("parseMerge(%v) accepted the form", form)
+		}
+	}
+}
+
+// TestAdminDuplicatesForm tests that each group of duplicates gets a
+// merge form keeping its first recipe, with nothing ticked to merge, and
+// shows how alike the others are to it.
+func TestAdminDuplicatesForm(t *testing.T) {
+	c := &RBController{Render: NewRenderer(), RecipeDB: nil}
+	w := httptest.NewRecorder()
+	c.HTML(w, http.StatusOK, "admin/duplicates", struct {
+		Clusters  []DuplicateCluster
+		Recipes   int
+		Threshold int
+	}{[]DuplicateCluster{{Recipes: []*Recipe{{ID: 2, Name: "Jollof Rice"},
+		{ID: 5, Name: "Jollof rice (Ghana style)"}, {ID: 8, Name: "Jollof"}},
+		Score: 0.91, Scores: []float64{1, 0.91, 0.42}}}, 3, 60})
+	page := w.Body.String()
+	if !strings.Contains(page, `<form action="/admin/duplicates/merge/" method="POST">`) ||
+		!strings.Contains(page, `name="survivor" value="2" checked`) ||
+		!strings.Contains(page, `name="merge" value="5">`) ||
+		strings.Contains(page, `name="merge" value="5" checked`) ||
+		!strings.Contains(page, `<td>91%</td>`) ||
+		!strings.Contains(page, `<td><em>42%</em></td>`) ||
+		!strings.Contains(page, `less than 60% alike`) {
+		t.Errorf("admin/duplicates rendered:\n%s", page)
+	}
+}
+
+// TestCheckMerge tests that recipes are only merged into one they are
+// likely to duplicate, even when grouped with it through another.
+func TestCheckMerge(t *testing.T) {
+	yassa := &Recipe{ID: 1, Name: "Chicken Yassa",
+		Ingredientlist: "chicken; onions; lemon juice; mustard"}
+	senegalese := &Recipe{ID: 3, Name: "Senegalese chicken yassa",
+		Ingredientlist: "chicken; onions; lemons; mustard; olive oil"}
+	jollof := &Recipe{ID: 2, Name: "Jollof Rice", Ingredientlist: "rice; tomatoes; onions; pepper"}
+
+	if err := checkMerge(yassa, []*Recipe{yassa, senegalese}); err != nil {
+		t.Errorf("checkMerge() refused a duplicate: %v", err)
+	}
+	err := checkMerge(yassa, []*Recipe{yassa, senegalese, jollof})
+	if refused, ok := err.(*notDuplicate); !ok || refused.match.Recipe != jollof {
+		t.Errorf("checkMerge() = %v, expected Jollof Rice refused", err)
+	}
+}
+
+// TestMergeRole tests that editors, and not contributors, may see the
+// duplicates report and merge recipes.
+func TestMergeRole(t *testing.T) {
+	c := &RBController{Render: NewRenderer(), RecipeDB: nil}
+	router := c.Router()
+	serve := func(role Role, method, path string) (code int) {
+		req, _ := http.NewRequest(method, path, strings.NewReader(""))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		context.Set(req, userKey, &User{ID: 1, Role: role})
+		defer context.Clear(req)
+		// past Require, the report reads the database, which isn't there
+		defer func() {
+			if recover() != nil {
+				code = http.StatusOK
+			}
+		}()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	for _, route := range [][2]string{{"GET", "/admin/duplicates/"},
+		{"POST", "/admin/duplicates/merge/"}} {
+		if code := serve(RoleContributor, route[0], route[1]); code != http.StatusForbidden {
+			t.Errorf("%s %s by a contributor returned %d, expected %d", route[0], route[1],
+				code, http.StatusForbidden)
+		}
+		if code := serve(RoleEditor, route[0], route[1]); code == http.StatusForbidden {
+			t.Errorf("%s %s by an editor was forbidden", route[0], route[1])
+		}
+	}
+	// an empty merge form gets as far as being refused
+	if code := serve(RoleEditor, "POST", "/admin/duplicates/merge/"); code != http.StatusBadRequest {
+		t.Errorf("an editor's empty merge returned %d, expected %d", code, http.StatusBadRequest)
+	}
+}
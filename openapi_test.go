@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// routeVar matches a mux route variable with a pattern, e.g. {id:[0-9]+}.
+var routeVar = regexp.MustCompile(`\{(\w+):[^}]+\}`)
+
+// openAPI is the part of an OpenAPI document the tests look at.
+type openAPI struct {
+	Paths      map[string]map[string]json.RawMessage
+	Components struct {
+		Schemas map[string]struct {
+			Properties map[string]json.RawMessage
+		}
+	}
+}
+
+func loadOpenAPI(t *testing.T) *openAPI {
+	data, err := ioutil.ReadFile("webroot/api/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := new(openAPI)
+	if err = json.Unmarshal(data, spec); err != nil {
+		t.Fatalf("openapi.json doesn't parse: %v", err)
+	}
+	return spec
+}
+
+// TestOpenAPIRoutes tests that webroot/api/openapi.json describes
+// exactly the routes and methods of c.APIRoutes, and that c.Router
+// serves them.
+func TestOpenAPIRoutes(t *testing.T) {
+	spec := loadOpenAPI(t)
+	c := &RBController{Render: NewRenderer()}
+
+	routes := make(map[string][]string)
+	for _, route := range c.APIRoutes() {
+		path := routeVar.ReplaceAllString(route.Path, "{$1}")
+		for method := range route.Actions {
+			routes[path] = append(routes[path], strings.ToLower(method))
+		}
+		sort.Strings(routes[path])
+	}
+
+	documented := make(map[string][]string)
+	for path, item := range spec.Paths {
+		for key := range item {
+			if key != "parameters" {
+				documented[path] = append(documented[path], key)
+			}
+		}
+		sort.Strings(documented[path])
+	}
+
+	for path, methods := range routes {
+		if !reflect.DeepEqual(documented[path], methods) {
+			t.Errorf("%s allows %v but openapi.json documents %v", path, methods,
+				documented[path])
+		}
+	}
+	for path := range documented {
+		if _, ok := routes[path]; !ok {
+			t.Errorf("openapi.json documents %s, which isn't an API route", path)
+		}
+	}
+
+	// the router sends every documented path to the API, which lists the
+	// methods it allows when asked for another
+	router := c.Router()
+	for path, methods := range documented {
+		req, _ := http.NewRequest("TRACE", strings.Replace(path, "{id}", "1", -1), nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var allowed []string
+		for _, method := range strings.Split(w.Header().Get("Allow"), ", ") {
+			if method != "HEAD" {
+				allowed = append(allowed, strings.ToLower(method))
+			}
+		}
+		sort.Strings(allowed)
+		if w.Code != http.StatusMethodNotAllowed || !reflect.DeepEqual(allowed, methods) ||
+			w.Header().Get("Content-Type") != "application/json; charset=UTF-8" {
+			t.Errorf("router answered TRACE %s with %v %q, Allow %v", path, w.Code,
+				w.Header().Get("Content-Type"), allowed)
+		}
+	}
+}
+
+// TestPageRoutes tests that the router registers nothing besides the API
+// and the page routes, and that no page route takes a path of the API,
+// since every route that answers JSON belongs in c.APIRoutes.
+func TestPageRoutes(t *testing.T) {
+	spec := loadOpenAPI(t)
+	c := &RBController{Render: NewRenderer()}
+
+	api := make(map[string]bool)
+	for _, route := range c.APIRoutes() {
+		api[route.Path] = true
+	}
+	for _, route := range c.PageRoutes() {
+		path := routeVar.ReplaceAllString(route.Path, "{$1}")
+		if api[route.Path] || spec.Paths[path] != nil {
+			t.Errorf("%s is both a page and an API route", route.Path)
+		}
+		if strings.Contains(route.Path, "json") {
+			t.Errorf("%s looks like JSON but is a page route", route.Path)
+		}
+	}
+
+}
+
+// TestOpenAPISchemas tests that the documented schemas have the same
+// fields as the types they describe.
+func TestOpenAPISchemas(t *testing.T) {
+	spec := loadOpenAPI(t)
+	types := map[string]interface{}{
+		"Recipe":         Recipe{},
+		"SearchRequest":  JSONSearch{},
+		"SearchResults":  SearchResults{},
+		"SearchMeta":     SearchMeta{},
+		"Facets":         Facets{},
+		"Stats":          Stats{},
+		"RecipeLD":       RecipeLD{},
+		"RelatedRecipes": RelatedRecipes{},
+		"RelatedRecipe":  RelatedRecipe{},
+		"PantryResults":  PantryResults{},
+		"PantryMatch":    PantryMatch{},
+		"AuditEntry":     AuditEntry{},
+	}
+	for name, value := range types {
+		var fields []string
+		typ := reflect.TypeOf(value)
+		for i := 0; i < typ.NumField(); i++ {
+			if tag := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]; tag != "-" {
+				fields = append(fields, tag)
+			}
+		}
+		var documented []string
+		for field := range spec.Components.Schemas[name].Properties {
+			documented = append(documented, field)
+		}
+		sort.Strings(fields)
+		sort.Strings(documented)
+		if !reflect.DeepEqual(fields, documented) {
+			t.Errorf("%s has fields %v but openapi.json documents %v", name,
+				fields, documented)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pantryMaxItems is the most ingredients a pantry search takes.
+const pantryMaxItems = 50
+
+// pantryMaxResults is the most recipes a pantry search returns.
+const pantryMaxResults = 50
+
+// pantryStaples are ingredients most kitchens have, taken as at hand
+// unless the search says otherwise. They cover only ingredients that
+// are exactly them, so that salt doesn't stand in for salt fish.
+var pantryStaples = []string{"water", "salt", "pepper", "oil", "vegetable oil"}
+
+// PantrySearch is a search for recipes that can be made with the
+// ingredients at hand. Recipes must match Search too; Have holds the
+// ingredientKey of each ingredient at hand. MaxMissing limits how many
+// ingredients a recipe may lack, when not -1.
+type PantrySearch struct {
+	Search     RecipeSearch
+	Have       []string
+	Staples    bool
+	MaxMissing int
+}
+
+// parsePantry reads the ingredients at hand from have parameters, each
+// holding ingredients separated by commas, semicolons or lines. The
+// first of those with the same ingredientKey is kept.
+func parsePantry(values []string) (have []string) {
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, item := range strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == ';' || r == '\n'
+		}) {
+			if key := ingredientKey(item); key != "" && !seen[key] && len(have) < pantryMaxItems {
+				seen[key] = true
+				have = append(have, key)
+			}
+		}
+	}
+	return
+}
+
+// pantrySearchOf reads a pantry search from query parameters: have, the
+// ingredients at hand; staples=0 to not count staples as at hand;
+// missing, the most ingredients a recipe may lack; and the filters of
+// the browse page.
+func pantrySearchOf(values url.Values) PantrySearch {
+	pantry := PantrySearch{Search: browseFilterOf(values).search(),
+		Have: parsePantry(values[`have`]), Staples: values.Get(`staples`) != "0",
+		MaxMissing: -1}
+	if missing, err := strconv.Atoi(values.Get(`missing`)); err == nil && missing >= 0 {
+		pantry.MaxMissing = missing
+	}
+	for _, key := range pantry.Have {
+		// recipes must mention the first word of an ingredient at hand;
+		// plurals like berries don't contain their singular
+		word := strings.Fields(key)[0]
+		if strings.HasSuffix(word, "y") && len(word) > 3 {
+			word = word[:len(word)-1]
+		}
+		pantry.Search.Ingredients = append(pantry.Search.Ingredients, word)
+	}
+	return pantry
+}
+
+// PantryMatch is a recipe found by a pantry search, with its ingredients
+// split into those at hand and those missing.
+type PantryMatch struct {
+	Recipe *Recipe `json:"recipe"`
+	// Coverage is the share of the recipe's ingredients at hand.
+	Coverage float64  `json:"coverage"`
+	Have     []string `json:"have"`
+	Missing  []string `json:"missing"`
+}
+
+// Percent is the match's coverage as a percentage, for pages.
+func (match PantryMatch) Percent() int {
+	return int(match.Coverage*100 + 0.5)
+}
+
+// Ingredients is how many ingredients the recipe has, for pages.
+func (match PantryMatch) Ingredients() int {
+	return len(match.Have) + len(match.Missing)
+}
+
+// PantryResults is the JSON of a pantry search.
+type PantryResults struct {
+	Have    []string      `json:"have"`
+	Results []PantryMatch `json:"results"`
+}
+
+// wordsWithin reports whether every word of part is among the words of
+// whole.
+func wordsWithin(part, whole string) bool {
+	words := strings.Fields(whole)
+	for _, word := range strings.Fields(part) {
+		found := false
+		for _, other := range words {
+			if word == other {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// isStaple reports whether an ingredient, by its ingredientKey, is a
+// staple taken as at hand.
+func (pantry PantrySearch) isStaple(key string) bool {
+	if pantry.Staples {
+		for _, staple := range pantryStaples {
+			if key == staple {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// inPantry reports whether an ingredient, by its ingredientKey, is one of
+// those at hand, or a kind of one: chicken at hand covers chicken thighs.
+func (pantry PantrySearch) inPantry(key string) bool {
+	for _, have := range pantry.Have {
+		if wordsWithin(have, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match splits the recipe's ingredients into those at hand and those
+// missing. Recipes with nothing but staples at hand don't match, nor
+// do recipes missing more than MaxMissing.
+func (pantry PantrySearch) Match(recipe *Recipe) (match PantryMatch, ok bool) {
+	match = PantryMatch{Recipe: recipe, Have: []string{}, Missing: []string{}}
+	fromPantry := false
+	for _, ingredient := range ParseIngredients(recipe.Ingredientlist) {
+		key := ingredientKey(ingredient)
+		if key == "" {
+			continue
+		}
+		if pantry.inPantry(key) {
+			fromPantry = true
+			match.Have = append(match.Have, strings.TrimSpace(ingredient))
+		} else if pantry.isStaple(key) {
+			match.Have = append(match.Have, strings.TrimSpace(ingredient))
+		} else {
+			match.Missing = append(match.Missing, strings.TrimSpace(ingredient))
+		}
+	}
+	if !fromPantry || (pantry.MaxMissing >= 0 && len(match.Missing) > pantry.MaxMissing) {
+		return match, false
+	}
+	match.Coverage = float64(len(match.Have)) / float64(len(match.Have)+len(match.Missing))
+	return match, true
+}
+
+// sortPantry sorts matches most covered first, then fewest missing, then
+// by name.
+func sortPantry(matches []PantryMatch) {
+	sort.SliceStable(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.Coverage != b.Coverage {
+			return a.Coverage > b.Coverage
+		}
+		if len(a.Missing) != len(b.Missing) {
+			return len(a.Missing) < len(b.Missing)
+		}
+		return strings.ToLower(a.Recipe.Name) < strings.ToLower(b.Recipe.Name)
+	})
+}
+
+// RankPantry matches recipes against the pantry, best first.
+func RankPantry(pantry PantrySearch, recipes []*Recipe) []PantryMatch {
+	matches := []PantryMatch{}
+	for _, recipe := range recipes {
+		if match, ok := pantry.Match(recipe); ok {
+			matches = append(matches, match)
+		}
+	}
+	sortPantry(matches)
+	return matches
+}
+
+// PantryRecipes gets the recipes that can best be made with the pantry,
+// up to limit of them. Only recipes mentioning something at hand are
+// read from the database, a batch at a time, and without their pictures,
+// which aren't shown.
+func (recipeDB *RecipeDB) PantryRecipes(pantry PantrySearch, limit int) ([]PantryMatch, error) {
+	matches := []PantryMatch{}
+	if len(pantry.Have) == 0 {
+		return matches, nil
+	}
+	err := recipeDB.StreamRecipeColumns(textColumns, pantry.Search, 500,
+		func(recipes []*Recipe) error {
+			for _, recipe := range recipes {
+				if match, ok := pantry.Match(recipe); ok {
+					matches = append(matches, match)
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	sortPantry(matches)
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, nil
+}
+
+// Pantry serves the "What can I cook?" page, where the user lists the
+// ingredients at hand and gets the recipes that can best be made with
+// them, with what each is missing.
+func (c *RBController) Pantry(w http.ResponseWriter, r *http.Request) (err error) {
+	r.ParseForm()
+	pantry := pantrySearchOf(r.Form)
+	matches, err := c.PantryRecipes(pantry, pantryMaxResults)
+	if err != nil {
+		return
+	}
+	c.HTML(w, http.StatusOK, "recipes/pantry", struct {
+		Have       string
+		Staples    bool
+		Missing    string
+		Searched   bool
+		Matches    []PantryMatch
+		Hidden     [][2]string
+		MaxResults int
+	}{
+		Have:       strings.Join(pantry.Have, "\n"),
+		Staples:    pantry.Staples,
+		Missing:    r.Form.Get(`missing`),
+		Searched:   len(pantry.Have) > 0,
+		Matches:    matches,
+		Hidden:     browseFilterOf(r.Form).hidden(),
+		MaxResults: pantryMaxResults,
+	})
+	return nil
+}
+
+// PantryJSON renders a pantry search as JSON. It needs at least one
+// ingredient at hand.
+func (c *RBController) PantryJSON(w http.ResponseWriter, r *http.Request) (err error) {
+	r.ParseForm()
+	pantry := pantrySearchOf(r.Form)
+	if len(pantry.Have) == 0 {
+		c.RenderError(w, http.StatusBadRequest, "give the ingredients at hand as have")
+		return nil
+	}
+	matches, err := c.PantryRecipes(pantry, pantryMaxResults)
+	if err == nil {
+		c.JSON(w, http.StatusOK, PantryResults{Have: pantry.Have, Results: matches})
+	}
+	return
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestPantrySearchOf tests that the ingredients at hand are read without
+// amounts or repeats, and that the search only reads recipes mentioning
+// one of them.
+func TestPantrySearchOf(t *testing.T) {
+	pantry := pantrySearchOf(url.Values{
+		"have":    {"2 cups rice, Tomatoes\nonion; tomato", "berries"},
+		"missing": {"2"}, "cuisine": {"3"}, "staples": {"0"},
+	})
+	if !reflect.DeepEqual(pantry.Have, []string{"rice", "tomato", "onion", "berry"}) ||
+		pantry.MaxMissing != 2 || pantry.Staples || pantry.Search.Cuisine != 3 {
+		t.Errorf("pantrySearchOf() = %+v", pantry)
+	}
+	clause, args := pantry.Search.where()
+	if !strings.HasSuffix(clause, ` LIKE ANY (ARRAY[$3,$4,$5,$6]) `) ||
+		!reflect.DeepEqual(args[2:], []interface{}{"%rice%", "%tomato%", "%onion%", "%berr%"}) {
+		t.Errorf("where() = %q with %v", clause, args)
+	}
+	if pantry = pantrySearchOf(url.Values{}); !pantry.Staples || pantry.MaxMissing != -1 {
+		t.Errorf("pantrySearchOf() = %+v", pantry)
+	}
+}
+
+// TestRankPantry tests that recipes are ranked by the share of their
+// ingredients at hand, that staples count but don't match on their own,
+// and that what is missing is listed.
+func TestRankPantry(t *testing.T) {
+	recipes := []*Recipe{
+		{ID: 1, Name: "Jollof rice", Ingredientlist: "2 cups rice; 3 tomatoes; 1 onion; salt; thyme"},
+		{ID: 2, Name: "Fried rice", Ingredientlist: "rice; eggs; oil"},
+		{ID: 3, Name: "Mafe", Ingredientlist: "chicken thighs; peanut butter; onions; tomato paste"},
+		{ID: 4, Name: "Brine", Ingredientlist: "water; salt"},
+		{ID: 5, Name: "Pancakes", Ingredientlist: "flour; milk; eggs"},
+	}
+	pantry := PantrySearch{Have: []string{"rice", "tomato", "onion", "chicken"},
+		Staples: true, MaxMissing: -1}
+	matches := RankPantry(pantry, recipes)
+	ids := []int{}
+	for _, match := range matches {
+		ids = append(ids, match.Recipe.ID)
+	}
+	if !reflect.DeepEqual(ids, []int{1, 3, 2}) {
+		t.Fatalf("RankPantry() found %v", ids)
+	}
+	jollof := matches[0]
+	if jollof.Percent() != 80 || jollof.Ingredients() != 5 ||
+		!reflect.DeepEqual(jollof.Missing, []string{"thyme"}) {
+		t.Errorf("RankPantry() matched %+v", jollof)
+	}
+	if mafe := matches[1]; !reflect.DeepEqual(mafe.Have,
+		[]string{"chicken thighs", "onions", "tomato paste"}) {
+		t.Errorf("RankPantry() matched %+v", mafe)
+	}
+
+	pantry.Staples, pantry.MaxMissing = false, 1
+	if matches = RankPantry(pantry, recipes); len(matches) != 1 || matches[0].Recipe.ID != 3 {
+		t.Errorf("RankPantry() without staples found %+v", matches)
+	}
+}
+
+// TestPantryForms tests that the page asks for ingredients before
+// searching, and that the JSON route needs them.
+func TestPantryForms(t *testing.T) {
+	c := &RBController{Render: NewRenderer(), RecipeDB: nil}
+	req, _ := http.NewRequest("GET", "/recipes/pantry/?cuisine=3", nil)
+	w := httptest.NewRecorder()
+	c.Action(c.Pantry).ServeHTTP(w, req)
+	page := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(page, `<textarea name="have"`) ||
+		!strings.Contains(page, `<input type="hidden" name="cuisine" value="3">`) ||
+		strings.Contains(page, "No recipes use") {
+		t.Errorf("Pantry() answered %d:\n%s", w.Code, page)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/recipes/pantry?have=,", nil)
+	w = httptest.NewRecorder()
+	c.Action(c.PantryJSON).ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("PantryJSON() answered %d", w.Code)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"  // pictures may be GIFs
+	_ "image/jpeg" // or JPEGs
+	_ "image/png"  // or PNGs
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file is a small PDF writer, enough for printable recipes: pages
+// of text in the standard Helvetica fonts, which every PDF reader has,
+// pictures, and links between pages. Text is encoded as WinAnsi, so
+// characters outside Western European languages print as "?".
+
+// Letter paper, in points.
+const (
+	pageWidth  = 612.0
+	pageHeight = 792.0
+)
+
+// pdfFont is one of the standard fonts used by PDF documents.
+type pdfFont int
+
+// The fonts, named /F1, /F2 and /F3 in page resources.
+const (
+	fontRegular pdfFont = iota
+	fontBold
+	fontItalic
+)
+
+var pdfFontNames = []string{"Helvetica", "Helvetica-Bold", "Helvetica-Oblique"}
+
+// Glyph widths of the printable ASCII characters, in thousandths of the
+// font size, from the fonts' Adobe metrics. The oblique font has the
+// same widths as the regular one.
+var (
+	helveticaWidths = []int{
+		278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+		556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+		1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+		667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+		333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+		556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+	}
+	helveticaBoldWidths = []int{
+		278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+		556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+		975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+		667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+		333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+		611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584,
+	}
+)
+
+// winAnsi maps the characters WinAnsi places in 0x80-0x9F to their codes.
+// Latin-1 characters, 0xA0-0xFF, have the same codes in both.
+var winAnsi = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87,
+	'ˆ': 0x88, '‰': 0x89, 'Š': 0x8A, '‹': 0x8B, 'Œ': 0x8C, 'Ž': 0x8E,
+	'‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97,
+	'˜': 0x98, '™': 0x99, 'š': 0x9A, '›': 0x9B, 'œ': 0x9C, 'ž': 0x9E, 'Ÿ': 0x9F,
+}
+
+// wideChars are the widths of WinAnsi characters above ASCII that aren't
+// about as wide as a digit.
+var wideChars = map[byte]int{
+	0x85: 1000, 0x89: 1000, 0x91: 222, 0x92: 222, 0x93: 333, 0x94: 333,
+	0x95: 350, 0x97: 1000, 0x99: 1000, 0xA0: 278, 0xB0: 400, 0xB7: 278,
+	0xBC: 834, 0xBD: 834, 0xBE: 834, 0xC6: 1000, 0xE6: 889,
+}
+
+// encodeWinAnsi encodes text for the standard fonts.
+func encodeWinAnsi(text string) []byte {
+	encoded := make([]byte, 0, len(text))
+	for _, r := range text {
+		switch {
+		case r == '\t':
+			encoded = append(encoded, ' ')
+		case r >= 0x20 && r < 0x7F, r >= 0xA0 && r <= 0xFF:
+			encoded = append(encoded, byte(r))
+		case winAnsi[r] != 0:
+			encoded = append(encoded, winAnsi[r])
+		case r >= 0x20:
+			encoded = append(encoded, '?')
+		}
+	}
+	return encoded
+}
+
+// textWidth measures text set in font at size points.
+func textWidth(font pdfFont, size float64, text string) float64 {
+	widths := helveticaWidths
+	if font == fontBold {
+		widths = helveticaBoldWidths
+	}
+	total := 0
+	for _, c := range encodeWinAnsi(text) {
+		switch {
+		case c < 0x7F:
+			total += widths[c-0x20]
+		case wideChars[c] != 0:
+			total += wideChars[c]
+		default:
+			total += 556
+		}
+	}
+	return float64(total) * size / 1000
+}
+
+// wrapText breaks text into lines no wider than width, between words
+// where it can and within words that are too long by themselves.
+func wrapText(font pdfFont, size float64, text string, width float64) []string {
+	lines := []string{}
+	line := ""
+	for _, word := range strings.Fields(text) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if textWidth(font, size, candidate) <= width {
+			line = candidate
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+		// break words wider than the line
+		line = ""
+		for _, r := range word {
+			if line != "" && textWidth(font, size, line+string(r)) > width {
+				lines = append(lines, line)
+				line = ""
+			}
+			line += string(r)
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// pdfString writes text as a PDF string literal.
+func pdfString(text string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('(')
+	for _, c := range encodeWinAnsi(text) {
+		if c == '(' || c == ')' || c == '\\' {
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(c)
+	}
+	buf.WriteByte(')')
+	return buf.String()
+}
+
+// pdfImage is a picture, stored as a JPEG or as compressed pixels.
+type pdfImage struct {
+	width, height int
+	colorSpace    string
+	filter        string
+	data          []byte
+}
+
+// pdfLink makes a rectangle of a page go to another page.
+type pdfLink struct {
+	x, y, w, h float64
+	target     int
+}
+
+// PDFPage is a page of a PDF, drawn with coordinates in points from the
+// bottom left corner.
+type PDFPage struct {
+	content bytes.Buffer
+	images  map[int]bool
+	links   []pdfLink
+}
+
+// Text draws a line of text with its baseline starting at x, y.
+func (page *PDFPage) Text(x, y float64, font pdfFont, size float64, text string) {
+	fmt.Fprintf(&page.content, "BT /F%d %.1f Tf %.2f %.2f Td %s Tj ET\n",
+		font+1, size, x, y, pdfString(text))
+}
+
+// Line draws a line width points thick.
+func (page *PDFPage) Line(x1, y1, x2, y2, width float64) {
+	fmt.Fprintf(&page.content, "%.2f w %.2f %.2f m %.2f %.2f l S\n",
+		width, x1, y1, x2, y2)
+}
+
+// Image draws a picture added with AddImage into a box whose bottom left
+// corner is at x, y.
+func (page *PDFPage) Image(image int, x, y, w, h float64) {
+	page.images[image] = true
+	fmt.Fprintf(&page.content, "q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q\n",
+		w, h, x, y, image)
+}
+
+// Link makes a box whose bottom left corner is at x, y go to the page
+// with the given index when clicked.
+func (page *PDFPage) Link(x, y, w, h float64, target int) {
+	page.links = append(page.links, pdfLink{x, y, w, h, target})
+}
+
+// PDF is a PDF document being built.
+type PDF struct {
+	Title  string
+	Pages  []*PDFPage
+	images []*pdfImage
+}
+
+// AddPage adds a blank page at the end of the document.
+func (doc *PDF) AddPage() *PDFPage {
+	page := &PDFPage{images: make(map[int]bool)}
+	doc.Pages = append(doc.Pages, page)
+	return page
+}
+
+// AddImage adds a JPEG, PNG or GIF picture to the document, returning
+// its number and its size in pixels. JPEGs are embedded as they are;
+// other pictures are flattened onto white.
+func (doc *PDF) AddImage(data []byte) (n, width, height int, err error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	img := &pdfImage{width: config.Width, height: config.Height}
+	switch {
+	case format == "jpeg" && config.ColorModel == color.GrayModel:
+		img.colorSpace, img.filter, img.data = "DeviceGray", "DCTDecode", data
+	case format == "jpeg" && config.ColorModel == color.YCbCrModel:
+		img.colorSpace, img.filter, img.data = "DeviceRGB", "DCTDecode", data
+	default:
+		decoded, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		bounds := decoded.Bounds()
+		pixels := make([]byte, 0, bounds.Dx()*bounds.Dy()*3)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				r, g, b, a := decoded.At(x, y).RGBA()
+				// the colors are premultiplied, so add white for the
+				// transparent part
+				white := 0xFFFF - a
+				pixels = append(pixels, byte((r+white)>>8), byte((g+white)>>8),
+					byte((b+white)>>8))
+			}
+		}
+		img.colorSpace, img.filter = "DeviceRGB", "FlateDecode"
+		img.data = deflate(pixels)
+	}
+	doc.images = append(doc.images, img)
+	return len(doc.images) - 1, img.width, img.height, nil
+}
+
+// deflate compresses data for a FlateDecode stream.
+func deflate(data []byte) []byte {
+	var buf bytes.Buffer
+	z := zlib.NewWriter(&buf)
+	z.Write(data)
+	z.Close()
+	return buf.Bytes()
+}
+
+// pdfWriter writes numbered objects, remembering where each starts for
+// the cross-reference table.
+type pdfWriter struct {
+	buf     bytes.Buffer
+	offsets []int
+}
+
+func (pw *pdfWriter) object(n int, format string, args ...interface{}) {
+	pw.offsets[n] = pw.buf.Len()
+	fmt.Fprintf(&pw.buf, "%d 0 obj\n", n)
+	fmt.Fprintf(&pw.buf, format, args...)
+	pw.buf.WriteString("\nendobj\n")
+}
+
+func (pw *pdfWriter) stream(n int, dict string, data []byte) {
+	pw.offsets[n] = pw.buf.Len()
+	fmt.Fprintf(&pw.buf, "%d 0 obj\n<< %s /Length %d >>\nstream\n", n, dict, len(data))
+	pw.buf.Write(data)
+	pw.buf.WriteString("\nendstream\nendobj\n")
+}
+
+// WriteTo writes the document as a PDF file.
+func (doc *PDF) WriteTo(w io.Writer) (int64, error) {
+	// objects: 1 catalog, 2 page tree, 3 info, fonts, images, then a
+	// page and its content for each page
+	fonts := 4
+	images := fonts + len(pdfFontNames)
+	pages := images + len(doc.images)
+	pw := &pdfWriter{offsets: make([]int, pages+2*len(doc.Pages))}
+	pageRef := func(i int) string { return strconv.Itoa(pages+2*i) + " 0 R" }
+
+	pw.buf.WriteString("%PDF-1.4\n%\xE2\xE3\xCF\xD3\n")
+	pw.object(1, "<< /Type /Catalog /Pages 2 0 R >>")
+	kids := []string{}
+	for i := range doc.Pages {
+		kids = append(kids, pageRef(i))
+	}
+	pw.object(2, "<< /Type /Pages /Kids [%s] /Count %d /MediaBox [0 0 %g %g] >>",
+		strings.Join(kids, " "), len(doc.Pages), pageWidth, pageHeight)
+	pw.object(3, "<< /Title %s /Producer (RecipeBox) /CreationDate (D:%s) >>",
+		pdfString(doc.Title), time.Now().UTC().Format("20060102150405Z"))
+
+	fontResources := []string{}
+	for i, name := range pdfFontNames {
+		pw.object(fonts+i, "<< /Type /Font /Subtype /Type1 /BaseFont /%s "+
+			"/Encoding /WinAnsiEncoding >>", name)
+		fontResources = append(fontResources, fmt.Sprintf("/F%d %d 0 R", i+1, fonts+i))
+	}
+	for i, img := range doc.images {
+		pw.stream(images+i, fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d "+
+			"/Height %d /ColorSpace /%s /BitsPerComponent 8 /Filter /%s",
+			img.width, img.height, img.colorSpace, img.filter), img.data)
+	}
+
+	for i, page := range doc.Pages {
+		imageResources := ""
+		for n := range doc.images {
+			if page.images[n] {
+				imageResources += fmt.Sprintf(" /Im%d %d 0 R", n, images+n)
+			}
+		}
+		annots := ""
+		for _, link := range page.links {
+			annots += fmt.Sprintf("<< /Type /Annot /Subtype /Link /Border [0 0 0] "+
+				"/Rect [%.2f %.2f %.2f %.2f] /Dest [%s /Fit] >> ",
+				link.x, link.y, link.x+link.w, link.y+link.h, pageRef(link.target))
+		}
+		pw.object(pages+2*i, "<< /Type /Page /Parent 2 0 R /Contents %d 0 R "+
+			"/Resources << /Font << %s >> /XObject <<%s >> >> /Annots [%s] >>",
+			pages+2*i+1, strings.Join(fontResources, " "), imageResources, annots)
+		pw.stream(pages+2*i+1, "/Filter /FlateDecode", deflate(page.content.Bytes()))
+	}
+
+	xref := pw.buf.Len()
+	fmt.Fprintf(&pw.buf, "xref\n0 %d\n0000000000 65535 f \n", len(pw.offsets))
+	for _, offset := range pw.offsets[1:] {
+		fmt.Fprintf(&pw.buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&pw.buf, "trailer\n<< /Size %d /Root 1 0 R /Info 3 0 R >>\n"+
+		"startxref\n%d\n%%%%EOF\n", len(pw.offsets), xref)
+	return pw.buf.WriteTo(w)
+}
+
+// Bytes returns the document as a PDF file.
+func (doc *PDF) Bytes() []byte {
+	var buf bytes.Buffer
+	doc.WriteTo(&buf)
+	return buf.Bytes()
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit describes a token bucket: a client may make Burst requests
+// at once, and the bucket refills at Rate requests per second.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+var errBadRateLimit = errors.New(`rate limits look like "60/m" or "60/m,10"`)
+
+// rateUnits maps the units accepted by ParseRateLimit to seconds.
+var rateUnits = map[string]float64{
+	"s": 1,
+	"m": 60,
+	"h": 3600,
+}
+
+// ParseRateLimit parses a limit of the form count/unit[,burst], where
+// unit is s, m or h. The burst defaults to count. For example "60/m"
+// allows an average of one request per second, up to 60 at once.
+func ParseRateLimit(s string) (limit RateLimit, err error) {
+	spec, burst := s, ""
+	if i := strings.Index(s, ","); i >= 0 {
+		spec, burst = s[:i], s[i+1:]
+	}
+	parts := strings.Split(spec, "/")
+	if len(parts) != 2 {
+		return limit, errBadRateLimit
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	seconds, ok := rateUnits[strings.TrimSpace(parts[1])]
+	if err != nil || !ok || count < 1 {
+		return limit, errBadRateLimit
+	}
+	limit = RateLimit{Rate: float64(count) / seconds, Burst: count}
+	if burst != "" {
+		limit.Burst, err = strconv.Atoi(strings.TrimSpace(burst))
+		if err != nil || limit.Burst < 1 {
+			return limit, errBadRateLimit
+		}
+	}
+	return limit, nil
+}
+
+// RateStore keeps token buckets. Take removes a token from the bucket
+// named key, refilling it first. If the bucket is empty it reports how
+// long until a token will be available.
+type RateStore interface {
+	Take(key string, limit RateLimit) (ok bool, retryAfter time.Duration, err error)
+}
+
+// RateLimiter limits how often each client may call each group of routes.
+type RateLimiter struct {
+	Store  RateStore
+	Groups map[string]RateLimit
+}
+
+// retrySeconds rounds a wait up to whole seconds for Retry-After.
+func retrySeconds(d time.Duration) int {
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// Throttle wraps an action so each client may only call it as often as
+// the named group's rate limit allows. Clients over the limit get a 429
+// page with a Retry-After header. Groups without a limit aren't limited.
+// for example, use c.Action(c.Throttle("search", c.RecipeJSONAdvanced)).
+func (c *RBController) Throttle(group string, a Action) Action {
+	return Action(func(w http.ResponseWriter, r *http.Request) error {
+		allowed, retryAfter, err := c.take(group, r)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(retrySeconds(retryAfter)))
+			c.RenderError(w, http.StatusTooManyRequests,
+				"Sorry, you're making requests too quickly. Please slow down.")
+			return nil
+		}
+		return a(w, r)
+	})
+}
+
+// take takes a token from the client's bucket of the named group, and
+// says whether the client may go ahead or else how long it should wait.
+func (c *RBController) take(group string, r *http.Request) (bool, time.Duration, error) {
+	if c.Limiter == nil {
+		return true, 0, nil
+	}
+	limit, ok := c.Limiter.Groups[group]
+	if !ok {
+		return true, 0, nil
+	}
+
+	// clients are told apart by API token when they have one. Other
+	// clients aren't authenticated first, since checking a password
+	// is what a limit should spare the server.
+	key := group + ":ip:" + c.ClientIP(r)
+	var token *APIToken
+	if _, ok := bearerToken(r); ok {
+		var err error
+		if token, err = c.CurrentToken(r); err != nil {
+			return false, 0, err
+		}
+	}
+	if token != nil {
+		key = group + ":token:" + strconv.Itoa(token.ID)
+	}
+	allowed, retryAfter, err := c.Limiter.Store.Take(key, limit)
+	if err != nil {
+		// a broken store shouldn't take the site down with it
+		fmt.Printf("[WARNING] in Throttle: %s\n", err.Error())
+		return true, 0, nil
+	}
+	return allowed, retryAfter, nil
+}
+
+// loginThrottled is the error of a password check refused because the
+// client or the account has run out of login attempts.
+type loginThrottled struct {
+	retryAfter time.Duration
+}
+
+func (e *loginThrottled) Error() string {
+	return "Sorry, there have been too many login attempts. Please wait a minute and try again."
+}
+
+// throttleLogin takes a token of the login group for the client's IP,
+// the same bucket the login form uses, and one for email, before a
+// password sent with basic auth is checked. Passwords can then be
+// guessed no faster there than through the form, whichever route they
+// are sent to.
+func (c *RBController) throttleLogin(r *http.Request, email string) error {
+	if c.Limiter == nil {
+		return nil
+	}
+	limit, ok := c.Limiter.Groups["login"]
+	if !ok {
+		return nil
+	}
+	for _, key := range []string{"login:ip:" + c.ClientIP(r),
+		"login:email:" + strings.ToLower(strings.TrimSpace(email))} {
+		allowed, retryAfter, err := c.Limiter.Store.Take(key, limit)
+		if err != nil {
+			fmt.Printf("[WARNING] in throttleLogin: %s\n", err.Error())
+			return nil
+		}
+		if !allowed {
+			return &loginThrottled{retryAfter}
+		}
+	}
+	return nil
+}
+
+// renderActionError renders the error an action returned: a 429 page
+// for too many login attempts, and a 500 page for anything else.
+func (c *RBController) renderActionError(w http.ResponseWriter, err error) {
+	if throttled, ok := err.(*loginThrottled); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(retrySeconds(throttled.retryAfter)))
+		c.RenderError(w, http.StatusTooManyRequests, throttled.Error())
+		return
+	}
+	c.RenderError(w, http.StatusInternalServerError, "Internal server error\n"+err.Error())
+}
+
+// --------------------------------------------
+//                  RATE STORES
+// --------------------------------------------
+
+// MemoryRateStore keeps token buckets in memory. Each server instance
+// counts separately, so use PostgresRateStore when running several.
+type MemoryRateStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+// NewMemoryRateStore makes an empty MemoryRateStore.
+func NewMemoryRateStore() *MemoryRateStore {
+	return &MemoryRateStore{buckets: make(map[string]*bucket), now: time.Now}
+}
+
+// Take implements RateStore.
+func (store *MemoryRateStore) Take(key string, limit RateLimit) (bool, time.Duration, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	now := store.now()
+	store.sweep(now)
+
+	b, ok := store.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		store.buckets[key] = b
+	}
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed*limit.Rate)
+		b.updated = now
+	}
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	missing := float64(limit.Burst) - b.tokens
+	b.full = now.Add(time.Duration(missing / limit.Rate * float64(time.Second)))
+	if allowed {
+		return true, 0, nil
+	}
+	return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second)), nil
+}
+
+// sweep drops buckets which have refilled, about once a minute, so
+// memory use doesn't grow with every client ever seen.
+func (store *MemoryRateStore) sweep(now time.Time) {
+	if now.Sub(store.swept) < time.Minute {
+		return
+	}
+	for key, b := range store.buckets {
+		if now.After(b.full) {
+			delete(store.buckets, key)
+		}
+	}
+	store.swept = now
+}
+
+// PostgresRateStore keeps token buckets in the rate_limits table, so
+// that every server instance shares the same limits. Buckets are
+// updated in a single statement, timed by the database's clock.
+type PostgresRateStore struct {
+	DB *sqlx.DB
+
+	mu    sync.Mutex
+	swept time.Time
+}
+
+// Take implements RateStore.
+func (store *PostgresRateStore) Take(key string, limit RateLimit) (bool, time.Duration, error) {
+	// $2 is the burst and $3 the rate. The refilled bucket is
+	//   least(burst, tokens + seconds since updated * rate)
+	// and a token is only taken if at least one is left.
+	refilled := `least($2, rl.tokens + ` +
+		`greatest(0, extract(epoch FROM now() - rl.updated)) * $3)`
+	upsert := `INSERT INTO rate_limits AS rl (key, tokens, allowed, updated) ` +
+		`VALUES ($1, $2 - 1, true, now()) ` +
+		`ON CONFLICT (key) DO UPDATE SET ` +
+		`tokens = CASE WHEN ` + refilled + ` >= 1 ` +
+		`THEN ` + refilled + ` - 1 ELSE ` + refilled + ` END, ` +
+		`allowed = ` + refilled + ` >= 1, ` +
+		`updated = now() ` +
+		`RETURNING tokens, allowed`
+
+	var tokens float64
+	var allowed bool
+	err := store.DB.QueryRowx(upsert, key, float64(limit.Burst), limit.Rate).
+		Scan(&tokens, &allowed)
+	if err != nil {
+		return false, 0, err
+	}
+	if err = store.sweep(); err != nil {
+		return false, 0, err
+	}
+	if allowed {
+		return true, 0, nil
+	}
+	return false, time.Duration((1 - tokens) / limit.Rate * float64(time.Second)), nil
+}
+
+// sweep deletes buckets that haven't been touched for an hour, about
+// every ten minutes. Limits are assumed to refill within the hour.
+func (store *PostgresRateStore) sweep() error {
+	store.mu.Lock()
+	due := time.Since(store.swept) > 10*time.Minute
+	if due {
+		store.swept = time.Now()
+	}
+	store.mu.Unlock()
+	if !due {
+		return nil
+	}
+	_, err := store.DB.Exec(
+		"DELETE FROM rate_limits WHERE updated < now() - interval '1 hour'")
+	return err
+}
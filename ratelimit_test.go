@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestParseRateLimit tests parsing of rate limit settings.
+func TestParseRateLimit(t *testing.T) {
+	cases := []struct {
+		spec string
+		want RateLimit
+	}{
+		{"60/m", RateLimit{Rate: 1, Burst: 60}},
+		{"2/s,10", RateLimit{Rate: 2, Burst: 10}},
+		{"3600/h", RateLimit{Rate: 1, Burst: 3600}},
+	}
+	for _, tc := range cases {
+		got, err := ParseRateLimit(tc.spec)
+		if err != nil || got != tc.want {
+			t.Errorf("ParseRateLimit(%q) = %+v, %v, expected %+v", tc.spec,
+				got, err, tc.want)
+		}
+	}
+	for _, spec := range []string{"", "60", "60/d", "0/m", "60/m,0"} {
+		if _, err := ParseRateLimit(spec); err == nil {
+			t.Errorf("ParseRateLimit(%q) didn't fail", spec)
+		}
+	}
+}
+
+// TestMemoryRateStore tests that buckets empty and refill.
+func TestMemoryRateStore(t *testing.T) {
+	now := time.Unix(0, 0)
+	store := NewMemoryRateStore()
+	store.now = func() time.Time { return now }
+	limit := RateLimit{Rate: 1, Burst: 2}
+
+	for i := 0; i < 2; i++ {
+		if ok, _, _ := store.Take("a", limit); !ok {
+			t.Fatalf("request %v was limited", i)
+		}
+	}
+	ok, retry, _ := store.Take("a", limit)
+	if ok || retry != time.Second {
+		t.Errorf("third request got %v, %v, expected false, 1s", ok, retry)
+	}
+	if ok, _, _ := store.Take("b", limit); !ok {
+		t.Errorf("other client was limited")
+	}
+
+	now = now.Add(time.Second)
+	if ok, _, _ := store.Take("a", limit); !ok {
+		t.Errorf("bucket didn't refill")
+	}
+}
+
+// TestThrottle tests that clients over the limit get a 429.
+func TestThrottle(t *testing.T) {
+	c := &RBController{Render: NewRenderer(), RecipeDB: nil,
+		Limiter: &RateLimiter{Store: NewMemoryRateStore(),
+			Groups: map[string]RateLimit{"test": {Rate: 0.1, Burst: 1}}}}
+	handler := c.Action(c.Throttle("test", c.MockAction(nil)))
+
+	req, _ := http.NewRequest("GET", "", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("first request returned %v", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "10" {
+		t.Errorf("second request returned %v, Retry-After %q", w.Code,
+			w.Header().Get("Retry-After"))
+	}
+}
+
+// TestThrottleLogin tests that basic auth credentials count against the
+// login limit, and that other limits don't check them.
+func TestThrottleLogin(t *testing.T) {
+	c := &RBController{Render: NewRenderer(), RecipeDB: &RecipeDB{},
+		Limiter: &RateLimiter{Store: NewMemoryRateStore(),
+			Groups: map[string]RateLimit{
+				"login":  {Rate: 0.1, Burst: 2},
+				"search": {Rate: 1, Burst: 10},
+			}}}
+	req, _ := http.NewRequest("GET", "/recipes/new/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.SetBasicAuth("Cook@example.com", "guess")
+
+	// a limit that isn't for logins leaves the password alone; checking
+	// it here would need the database
+	w := httptest.NewRecorder()
+	c.Action(c.Throttle("search", c.MockAction(nil))).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("throttled request returned %v", w.Code)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := c.throttleLogin(req, " cook@example.com"); err != nil {
+			t.Fatalf("attempt %d: %v", i+1, err)
+		}
+	}
+	if _, ok := c.throttleLogin(req, "other@example.com").(*loginThrottled); !ok {
+		t.Errorf("another email from the same IP wasn't throttled")
+	}
+
+	w = httptest.NewRecorder()
+	c.Router().ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "10" {
+		t.Errorf("basic auth returned %v, Retry-After %q", w.Code,
+			w.Header().Get("Retry-After"))
+	}
+
+	// the email is throttled from any address
+	other, _ := http.NewRequest("GET", "/recipes/new/", nil)
+	other.RemoteAddr = "10.0.0.2:1234"
+	if _, ok := c.throttleLogin(other, "COOK@example.com").(*loginThrottled); !ok {
+		t.Errorf("the email wasn't throttled from another IP")
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
-	"container/list"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/unrolled/render"
+	"html/template"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
@@ -19,6 +21,21 @@ type RBController struct {
 	AppController
 	*RecipeDB
 	*render.Render
+	Sessions *Sessions
+	Limiter  *RateLimiter
+	Stats    *StatsCache
+
+	// Cookbooks makes printable cookbooks in the background.
+	Cookbooks *CookbookQueue
+
+	// TrustProxy takes the client's IP from the last X-Forwarded-For
+	// address, for running behind a proxy such as Heroku's router.
+	TrustProxy bool
+
+	// BaseURL is the scheme and host the site is served at, for links
+	// that must be absolute. It is configured rather than taken from
+	// requests, whose Host header the client chooses.
+	BaseURL string
 }
 
 // --------------------------------------------
@@ -33,9 +50,28 @@ func PathExists(filename string) bool {
 	}
 }
 
+// ClientIP returns the IP address of the client making a request.
+func (c *RBController) ClientIP(r *http.Request) string {
+	if c.TrustProxy {
+		forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if ip := strings.TrimSpace(forwarded[len(forwarded)-1]); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 // RenderError uses RBController's renderer to create an error
-// based off of a template.
+// based off of a template.  JSON API requests get {"error": msg}.
 func (c *RBController) RenderError(w http.ResponseWriter, errorCode int, msg string) {
+	if isAPI(w) {
+		c.JSON(w, errorCode, map[string]string{"error": msg})
+		return
+	}
 	m := make(map[string]string)
 	m["error_code"] = fmt.Sprintf("%v", errorCode)
 	m["error_msg"] = msg
@@ -56,9 +92,11 @@ func (c *RBController) About(w http.ResponseWriter, r *http.Request) (err error)
 // Overriding the AppController errors to make use of the renderer
 func (c *RBController) Action(a Action) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.Sessions != nil {
+			w = &formWriter{ResponseWriter: w, r: r}
+		}
 		if err := a(w, r); err != nil {
-			c.RenderError(w, http.StatusInternalServerError,
-				"Internal server error\n"+err.Error())
+			c.renderActionError(w, err)
 		}
 	})
 }
@@ -75,13 +113,25 @@ func (c *RBController) EditRecipe(w http.ResponseWriter, r *http.Request) (err e
 	recipe, err := c.GetRecipe(id)
 
 	if err == nil {
+		// contributors may only edit their own recipes
+		user, err := c.CurrentUser(r)
+		if err != nil {
+			return err
+		}
+		if !user.CanEdit(recipe) {
+			c.Forbidden(w)
+			return nil
+		}
+
 		// pass data to render
 		data := struct {
 			*Recipe
-			NewRecipe bool
+			NewRecipe  bool
+			Duplicates []DuplicateMatch
 		}{
 			recipe,
 			false,
+			nil,
 		}
 
 		c.HTML(w, http.StatusOK, "recipes/edit", data)
@@ -95,11 +145,17 @@ func (c *RBController) EditRecipe(w http.ResponseWriter, r *http.Request) (err e
 
 // Home creates the homepage
 func (c *RBController) Home(w http.ResponseWriter, r *http.Request) (err error) {
+	totals := new(Stats)
+	if c.Stats != nil {
+		if totals, err = c.Stats.Get(); err != nil {
+			return
+		}
+	}
 	stats := map[string]string{
-		"nRecipes":    "891",
-		"nVolunteers": "200,000",
-		"nCountries":  "100+",
-		"nYears":      "54",
+		"nRecipes":    formatCount(totals.Recipes),
+		"nVolunteers": formatCount(totals.Volunteers),
+		"nCountries":  formatCount(totals.Countries),
+		"nYears":      formatCount(totals.Years),
 	}
 	c.HTML(w, http.StatusOK, "home", stats)
 	return nil
@@ -111,10 +167,12 @@ func (c *RBController) NewRecipe(w http.ResponseWriter, r *http.Request) (err er
 	// build data with anonymous struct
 	data := struct {
 		*Recipe
-		NewRecipe bool
+		NewRecipe  bool
+		Duplicates []DuplicateMatch
 	}{
 		new(Recipe),
 		true,
+		nil,
 	}
 
 	// pass data to render
@@ -128,8 +186,18 @@ func (c *RBController) Recipe(w http.ResponseWriter, r *http.Request) (err error
 	id, _ := strconv.Atoi(vars["id"])
 	recipe, err := c.GetRecipe(id)
 	if err == nil {
-		c.HTML(w, http.StatusOK, "recipes/recipe", recipe)
+		page := &recipePage{Recipe: recipe}
+		if page.head, err = RecipeHead(recipe, c.BaseURL); err != nil {
+			return
+		}
+		if page.Related, err = c.GetRelated(id); err != nil {
+			return
+		}
+		c.HTML(w, http.StatusOK, "recipes/recipe", page)
 	} else if err == sql.ErrNoRows {
+		if moved, err := c.redirectMerged(w, r, id); moved || err != nil {
+			return err
+		}
 		// this means that the recipe wasn't found, so we should return a 404 error
 		c.RenderError(w, 404, "Sorry, your page wasn't found")
 		err = nil
@@ -137,6 +205,17 @@ func (c *RBController) Recipe(w http.ResponseWriter, r *http.Request) (err error
 	return
 }
 
+// recipePage is the binding of a recipe's page, which adds the recipe's
+// description for search engines to the layout's head.
+type recipePage struct {
+	*Recipe
+	Related []RelatedRecipe
+	head    template.HTML
+}
+
+// Head returns the tags added to the page's head.
+func (page *recipePage) Head() template.HTML { return page.head }
+
 // RecipeJSON renders a raw JSON string of a recipe selected by id
 func (c *RBController) RecipeJSON(w http.ResponseWriter, r *http.Request) (err error) {
 	vars := mux.Vars(r)
@@ -145,6 +224,9 @@ func (c *RBController) RecipeJSON(w http.ResponseWriter, r *http.Request) (err e
 	if err == nil {
 		c.JSON(w, http.StatusOK, recipe)
 	} else if err == sql.ErrNoRows {
+		if moved, err := c.redirectMerged(w, r, id); moved || err != nil {
+			return err
+		}
 		c.RenderError(w, 404, "Sorry, your page wasn't found")
 		err = nil
 	}
@@ -153,40 +235,76 @@ func (c *RBController) RecipeJSON(w http.ResponseWriter, r *http.Request) (err e
 
 // RecipeJSONAdvanced handles advanced JSON searches.
 // Searches are either strict or loose (by name)
-// and are done by season, mealtype, and cuisine.
-// TODO: use MUX.  this function currently doesn't work.
+// and are done by season, mealtype, cuisine, provenance and tags,
+// given as GET or POST parameters or as a JSON body.
+// Results come back in a JSON envelope, with counts by mealtype bit,
+// season bit, cuisine and tag when facets is set, or streamed one
+// recipe per line with format=ndjson.
 func (c *RBController) RecipeJSONAdvanced(w http.ResponseWriter, r *http.Request) (err error) {
-	r.ParseForm()
-	strict, err := strconv.Atoi(r.PostFormValue("strict"))
-	name := r.PostFormValue("name")
-	cuisine, _ := strconv.Atoi(r.PostFormValue("cuisine"))
-	season, _ := strconv.Atoi(r.PostFormValue("season"))
-	mealtype, _ := strconv.Atoi(r.PostFormValue("mealtype"))
-
-	// get all the recipes that match
-	var recipes *list.List
-	if strict == 0 {
-		recipes, err = c.GetRecipesLoose(name, cuisine, mealtype, season)
-	} else {
-		recipes, err = c.GetRecipesStrict(name, cuisine, mealtype, season)
+	search, err := parseJSONSearch(r)
+	if err != nil {
+		c.RenderError(w, http.StatusBadRequest, err.Error())
+		return nil
 	}
 
-	// slice of jsons
-	jsons := make([]string, recipes.Len())
+	if search.Format == "ndjson" {
+		return c.streamRecipes(w, search)
+	}
 
-	if err == nil {
-		index := 0
-		for e := recipes.Front(); e != nil; e = e.Next() {
-			rec := e.Value.(*Recipe)
-			jsons[index] = rec.ToJSON()
-			index++
+	results := SearchResults{Results: []*Recipe{}, Meta: SearchMeta{Query: search}}
+	err = c.StreamRecipes(search.recipeSearch(), searchBatch,
+		func(recipes []*Recipe) error {
+			results.Results = append(results.Results, recipes...)
+			return nil
+		})
+	if err != nil {
+		return
+	}
+	results.Meta.Count = len(results.Results)
+	if search.Facets {
+		if results.Meta.Facets, err = c.GetFacets(search.recipeSearch()); err != nil {
+			return
 		}
-		request := strings.Join(jsons, "\n")
-		fmt.Fprintf(w, request)
-	} else {
-		fmt.Fprintf(w, "%v", err.Error())
 	}
-	return
+	c.JSON(w, http.StatusOK, results)
+	return nil
+}
+
+// streamRecipes writes the results of a search as newline delimited
+// JSON, flushing after every batch. Errors after the first batch can't
+// change the status, so they are sent as a final {"error": ...} line.
+func (c *RBController) streamRecipes(w http.ResponseWriter, search JSONSearch) error {
+	started := false
+	encoder := json.NewEncoder(w)
+	err := c.StreamRecipes(search.recipeSearch(), searchBatch,
+		func(recipes []*Recipe) error {
+			if !started {
+				w.Header().Set("Content-Type", ndjsonType)
+				started = true
+			}
+			for _, recipe := range recipes {
+				if err := encoder.Encode(recipe); err != nil {
+					return err
+				}
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			return nil
+		})
+	if err != nil && started {
+		fmt.Printf("[WARNING] in streamRecipes: %s\n", err.Error())
+		encoder.Encode(map[string]string{"error": err.Error()})
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !started {
+		// no results
+		w.Header().Set("Content-Type", ndjsonType)
+		w.WriteHeader(http.StatusOK)
+	}
+	return nil
 }
 
 // SaveRecipe takes a POST request from the /recipes/id/edit/ form
@@ -204,6 +322,18 @@ func (c *RBController) SaveRecipe(w http.ResponseWriter, r *http.Request) (err e
 	description := r.PostFormValue(`description`)
 	ingredients := r.PostFormValue(`ingredients`)
 	instructions := r.PostFormValue(`instructions`)
+	yield := strings.TrimSpace(r.PostFormValue(`yield`))
+
+	// provenance, all optional
+	contributor := strings.TrimSpace(r.PostFormValue(`contributor`))
+	country := strings.TrimSpace(r.PostFormValue(`country`))
+	community := strings.TrimSpace(r.PostFormValue(`community`))
+	story := r.PostFormValue(`story`)
+	tags := ParseTags(r.PostFormValue(`tags`))
+	year := 0
+	if yearStr := strings.TrimSpace(r.PostFormValue(`year`)); yearStr != "" && err == nil {
+		year, err = strconv.Atoi(yearStr)
+	}
 
 	// TODO better error handling
 	if err != nil {
@@ -215,7 +345,13 @@ func (c *RBController) SaveRecipe(w http.ResponseWriter, r *http.Request) (err e
 	// everything OK: build the recipe, and send it to the database
 	recipe := Recipe{ID: 0, Name: name, Cuisine: cuisine, Mealtype: mealtype,
 		Season: season, Description: description, Ingredientlist: ingredients,
-		Instructions: instructions}
+		Instructions: instructions, Yield: yield, Contributor: contributor, Country: country,
+		Community: community, Year: year, Story: story, Tags: tags}
+
+	user, err := c.CurrentUser(r)
+	if err != nil {
+		return
+	}
 
 	// if we don't have the id string, then this is a new request.
 	vars := mux.Vars(r)
@@ -224,18 +360,62 @@ func (c *RBController) SaveRecipe(w http.ResponseWriter, r *http.Request) (err e
 
 	if idStr != "" {
 		id, _ = strconv.Atoi(idStr)
+
+		// contributors may only edit their own recipes
+		var existing *Recipe
+		existing, err = c.GetRecipe(id)
+		if err == sql.ErrNoRows {
+			c.RenderError(w, 404, "Sorry, your page wasn't found")
+			return nil
+		} else if err != nil {
+			return
+		}
+		if !user.CanEdit(existing) {
+			c.Forbidden(w)
+			return nil
+		}
+
 		recipe.ID = id
-		err = c.RecipeDB.UpdateRecipe(&recipe)
+		recipe.Owner = existing.Owner
+		err = c.RecipeDB.UpdateRecipe(&recipe, c.actor(r, user))
 	} else {
-		id, err = c.RecipeDB.NewRecipe(&recipe)
+		// warn about recipes already in the box before adding another,
+		// unless the user has seen the warning and says it isn't one
+		if r.PostFormValue(`not_duplicate`) != "1" {
+			var duplicates []DuplicateMatch
+			if duplicates, err = c.FindDuplicates(&recipe, 5); err != nil {
+				return
+			}
+			if len(duplicates) > 0 {
+				c.HTML(w, http.StatusOK, "recipes/edit", struct {
+					*Recipe
+					NewRecipe  bool
+					Duplicates []DuplicateMatch
+				}{&recipe, true, duplicates})
+				return nil
+			}
+		}
+		recipe.Owner = user.ID
+		id, err = c.RecipeDB.NewRecipe(&recipe, c.actor(r, user))
 	}
 
 	if err == nil {
+		c.Stats.Invalidate()
 		http.Redirect(w, r, "/recipes/"+fmt.Sprintf("%v", id)+"/", http.StatusFound)
 	}
 	return
 }
 
+// StatsJSON renders the recipe box statistics, broken down by cuisine,
+// country and season, as JSON
+func (c *RBController) StatsJSON(w http.ResponseWriter, r *http.Request) (err error) {
+	stats, err := c.Stats.Get()
+	if err == nil {
+		c.JSON(w, http.StatusOK, stats)
+	}
+	return
+}
+
 // Static serves static pages
 func (c *RBController) Static(w http.ResponseWriter, r *http.Request) (err error) {
 	vars := mux.Vars(r)
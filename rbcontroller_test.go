@@ -3,7 +3,6 @@ package main
 import (
 	"errors"
 	"fmt"
-	"github.com/unrolled/render"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -23,9 +22,7 @@ func (c *RBController) MockAction(err error) Action {
 // for producing a http.HandlerFunc based on the action
 func TestAction(t *testing.T) {
 	// setup controller and renderer
-	renderer := render.New(render.Options{
-		Layout: "layout",
-	})
+	renderer := NewRenderer()
 	c := &RBController{Render: renderer, RecipeDB: nil}
 
 	// setup request, aboutHandler
@@ -54,9 +51,7 @@ func TestAction(t *testing.T) {
 // About webpage.
 func TestAbout(t *testing.T) {
 	// setup controller
-	renderer := render.New(render.Options{
-		Layout: "layout",
-	})
+	renderer := NewRenderer()
 	c := &RBController{Render: renderer, RecipeDB: nil}
 
 	// setup request, aboutHandler
@@ -69,3 +64,48 @@ func TestAbout(t *testing.T) {
 		t.Errorf("About page didn't return %v", http.StatusOK)
 	}
 }
+
+// TestHome tests the Home action, which should display the
+// homepage even before any stats are available.
+func TestHome(t *testing.T) {
+	c := &RBController{Render: NewRenderer(), RecipeDB: nil}
+
+	req, _ := http.NewRequest("GET", "", nil)
+	w := httptest.NewRecorder()
+	c.Action(c.Home).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Home page didn't return %v", http.StatusOK)
+	}
+
+	for n, want := range map[int]string{0: "0", 891: "891",
+		200000: "200,000", 1234567: "1,234,567"} {
+		if got := formatCount(n); got != want {
+			t.Errorf("formatCount(%v) = %q, expected %q", n, got, want)
+		}
+	}
+}
+
+// TestGetBaseURL tests that absolute links use the configured site
+// rather than a host the client sends.
+func TestGetBaseURL(t *testing.T) {
+	t.Setenv("PORT", "5000")
+	t.Setenv("BASE_URL", "https://recipes.example.org/")
+	if got := GetBaseURL(); got != "https://recipes.example.org" {
+		t.Errorf("GetBaseURL() = %q, expected https://recipes.example.org", got)
+	}
+	t.Setenv("BASE_URL", "")
+	if got := GetBaseURL(); got != "http://localhost:5000" {
+		t.Errorf("GetBaseURL() = %q, expected http://localhost:5000", got)
+	}
+	for _, bad := range []string{"recipes.example.org", "https://recipes.example.org/box"} {
+		t.Setenv("BASE_URL", bad)
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("GetBaseURL() accepted BASE_URL=%q", bad)
+				}
+			}()
+			GetBaseURL()
+		}()
+	}
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // constants in map form
@@ -41,7 +44,28 @@ type Recipe struct {
 	Season         int    `json:"season"`
 	Ingredientlist string `json:"ingredientlist"`
 	Instructions   string `json:"instructions"`
+	Yield          string `json:"yield"`
 	Picture        []byte `json:"picture"`
+	Owner          int    `json:"owner"`
+
+	// Provenance: who contributed the recipe, and where and when
+	// they learned it.
+	Contributor string `json:"contributor"`
+	Country     string `json:"country"`
+	Community   string `json:"community"`
+	Year        int    `json:"year"`
+	Story       string `json:"story"`
+
+	// Tags are kept in the recipe_tags table.
+	Tags []string `json:"tags" db:"-"`
+}
+
+// Contributor is a volunteer who contributed recipes, known by the name
+// given on them.
+type Contributor struct {
+	Name      string   `json:"name"`
+	Recipes   int      `json:"recipes"`
+	Countries []string `json:"countries"`
 }
 
 // ToJSON turns a Recipe into a JSON string
@@ -65,6 +89,75 @@ func ParseIngredients(ingredients string) []string {
 	return things
 }
 
+// Validate checks a recipe before it is saved, returning what is wrong
+// with each bad field. An empty map means the recipe may be saved.
+func (recipe *Recipe) Validate() map[string]string {
+	problems := make(map[string]string)
+	required := map[string]string{
+		"name":           recipe.Name,
+		"description":    recipe.Description,
+		"ingredientlist": recipe.Ingredientlist,
+		"instructions":   recipe.Instructions,
+	}
+	for field, value := range required {
+		if strings.TrimSpace(value) == "" {
+			problems[field] = "is required"
+		}
+	}
+	if recipe.Cuisine < 0 {
+		problems["cuisine"] = "must not be negative"
+	}
+	if recipe.Mealtype < 0 || recipe.Mealtype&^allBits(Meals) != 0 {
+		problems["mealtype"] = "must add up bits of " + describeBits(Meals)
+	}
+	if recipe.Season < 0 || recipe.Season&^allBits(Seasons) != 0 {
+		problems["season"] = "must add up bits of " + describeBits(Seasons)
+	}
+	// the Peace Corps sent its first volunteers in 1961
+	if recipe.Year != 0 && (recipe.Year < 1961 || recipe.Year > time.Now().Year()) {
+		problems["year"] = "must be between 1961 and this year, or 0 if unknown"
+	}
+	return problems
+}
+
+// allBits returns every bit of a bit map set.
+func allBits(bits map[int]string) (all int) {
+	for bit := range bits {
+		all |= bit
+	}
+	return
+}
+
+// describeBits lists the bits of a bit map, e.g. "1 (Breakfast), 2 (Lunch)".
+func describeBits(bits map[int]string) string {
+	keys := make([]int, 0, len(bits))
+	for bit := range bits {
+		keys = append(keys, bit)
+	}
+	sort.Ints(keys)
+	list := make([]string, len(keys))
+	for i, bit := range keys {
+		list[i] = strconv.Itoa(bit) + " (" + bits[bit] + ")"
+	}
+	return strings.Join(list, ", ")
+}
+
+// ParseTags returns a sorted list of distinct, lowercase tags from a
+// string with delimiter ;
+func ParseTags(tags string) []string {
+	seen := make(map[string]bool)
+	result := []string{}
+	for _, tag := range strings.Split(tags, ";") {
+		tag = strings.ToLower(strings.Join(strings.Fields(tag), " "))
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			result = append(result, tag)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
 // ParseMealtype returns a map of whether or not the number
 // represents a particular mealtype.
 // This map is a map from meal to bool (t/f)
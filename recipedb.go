@@ -4,6 +4,10 @@ import (
 	"container/list"
 	"fmt"
 	"github.com/jmoiron/sqlx"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // RecipeDB represents a recipe database. Wraps a sqlx.DB.
@@ -15,98 +19,629 @@ type RecipeDB struct {
 func (recipeDB *RecipeDB) GetRecipe(id int) (recipe *Recipe, err error) {
 	row := recipeDB.DB.QueryRowx("SELECT * FROM recipes WHERE id=$1", id)
 	recipe = new(Recipe)
-	err = row.StructScan(recipe)
+	if err = row.StructScan(recipe); err != nil {
+		return
+	}
+	err = recipeDB.loadTags([]*Recipe{recipe})
 	return
 }
 
-// UpdateRecipe takes an edited recipe and inserts in into the database
-func (recipeDB *RecipeDB) UpdateRecipe(recipe *Recipe) (err error) {
-	// 8 things, TODO insert picture
+// DeleteRecipe deletes a recipe and its tags, recording the deleted
+// fields in the audit log. It returns sql.ErrNoRows if there is no such
+// recipe.
+func (recipeDB *RecipeDB) DeleteRecipe(id int, actor Actor) (err error) {
+	tx, err := recipeDB.DB.Beginx()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	before := new(Recipe)
+	err = tx.QueryRowx("SELECT * FROM recipes WHERE id=$1 FOR UPDATE",
+		id).StructScan(before)
+	if err != nil {
+		return
+	}
+	err = tx.Select(&before.Tags,
+		"SELECT tag FROM recipe_tags WHERE recipe_id=$1 ORDER BY tag", id)
+	if err != nil {
+		return
+	}
+	if _, err = tx.Exec("DELETE FROM recipes WHERE id=$1", id); err != nil {
+		return
+	}
+
+	_, beforeSummary := DiffRecipes(nil, before)
+	err = insertAudit(tx, &AuditEntry{Actor: actor.UserID,
+		ActorName: actor.Name, Action: AuditRecipeDelete,
+		Target: recipeTarget(id), Before: beforeSummary, IP: actor.IP})
+	if err != nil {
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// GetTags gets the tags of each of the given recipes, in one query.
+func (recipeDB *RecipeDB) GetTags(ids []int) (tags map[int][]string, err error) {
+	tags = make(map[int][]string)
+	if len(ids) == 0 {
+		return
+	}
+	list := make([]string, len(ids))
+	for i, id := range ids {
+		list[i] = strconv.Itoa(id)
+	}
+	rows, err := recipeDB.DB.Queryx(`SELECT recipe_id, tag FROM recipe_tags ` +
+		`WHERE recipe_id IN (` + strings.Join(list, ",") + `) ORDER BY tag`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var tag string
+		if err = rows.Scan(&id, &tag); err != nil {
+			return
+		}
+		tags[id] = append(tags[id], tag)
+	}
+	err = rows.Err()
+	return
+}
+
+// loadTags fills in the Tags of each recipe.
+func (recipeDB *RecipeDB) loadTags(recipes []*Recipe) error {
+	ids := make([]int, len(recipes))
+	for i, recipe := range recipes {
+		ids[i] = recipe.ID
+	}
+	tags, err := recipeDB.GetTags(ids)
+	if err != nil {
+		return err
+	}
+	for _, recipe := range recipes {
+		recipe.Tags = tags[recipe.ID]
+		if recipe.Tags == nil {
+			recipe.Tags = []string{}
+		}
+	}
+	return nil
+}
+
+// setTags replaces a recipe's tags inside a transaction.
+func setTags(tx *sqlx.Tx, id int, tags []string) (err error) {
+	if _, err = tx.Exec("DELETE FROM recipe_tags WHERE recipe_id=$1", id); err != nil {
+		return
+	}
+	for _, tag := range tags {
+		_, err = tx.Exec("INSERT INTO recipe_tags (recipe_id, tag) VALUES ($1,$2)",
+			id, tag)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// UpdateRecipe takes an edited recipe and inserts in into the database.
+// The change is recorded in the audit log as made by actor.
+func (recipeDB *RecipeDB) UpdateRecipe(recipe *Recipe, actor Actor) (err error) {
+	tx, err := recipeDB.DB.Beginx()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// keep the old version for the audit log
+	before := new(Recipe)
+	err = tx.QueryRowx("SELECT * FROM recipes WHERE id=$1 FOR UPDATE",
+		recipe.ID).StructScan(before)
+	if err != nil {
+		return
+	}
+	err = tx.Select(&before.Tags,
+		"SELECT tag FROM recipe_tags WHERE recipe_id=$1 ORDER BY tag", recipe.ID)
+	if err != nil {
+		return
+	}
+
+	// 14 things, TODO insert picture
 	update := `UPDATE recipes SET ` +
 		`name=$2,description=$3,cuisine=$4,mealtype=$5,` +
-		`season=$6, ingredientlist=$7, instructions=$8 WHERE id=$1`
-	_, err = recipeDB.DB.Exec(update, recipe.ID, recipe.Name,
+		`season=$6, ingredientlist=$7, instructions=$8, ` +
+		`contributor=$9, country=$10, community=$11, year=$12, ` +
+		`story=$13, yield=$14 WHERE id=$1`
+	_, err = tx.Exec(update, recipe.ID, recipe.Name,
 		recipe.Description, recipe.Cuisine, recipe.Mealtype, recipe.Season,
-		recipe.Ingredientlist, recipe.Instructions)
-	return err
+		recipe.Ingredientlist, recipe.Instructions, recipe.Contributor,
+		recipe.Country, recipe.Community, recipe.Year, recipe.Story,
+		recipe.Yield)
+	if err != nil {
+		return
+	}
+	if err = setTags(tx, recipe.ID, recipe.Tags); err != nil {
+		return
+	}
+	if err = refreshRelated(tx, recipe.ID); err != nil {
+		return
+	}
+
+	beforeSummary, afterSummary := DiffRecipes(before, recipe)
+	err = insertAudit(tx, &AuditEntry{Actor: actor.UserID,
+		ActorName: actor.Name, Action: AuditRecipeUpdate,
+		Target: recipeTarget(recipe.ID), Before: beforeSummary,
+		After: afterSummary, IP: actor.IP})
+	if err != nil {
+		return
+	}
+	return tx.Commit()
 }
 
-// NewRecipe makes a new recipe and inserts it into the database
-func (recipeDB *RecipeDB) NewRecipe(recipe *Recipe) (newID int, err error) {
-	// 8 things, TODO insert picture
+// NewRecipe makes a new recipe and inserts it into the database.
+// The change is recorded in the audit log as made by actor.
+func (recipeDB *RecipeDB) NewRecipe(recipe *Recipe, actor Actor) (newID int, err error) {
+	tx, err := recipeDB.DB.Beginx()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if newID, err = insertRecipe(tx, recipe, actor); err != nil {
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// NewRecipes inserts several new recipes at once, setting their ids.
+// Either every recipe is added or none is.
+func (recipeDB *RecipeDB) NewRecipes(recipes []*Recipe, actor Actor) (err error) {
+	tx, err := recipeDB.DB.Beginx()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	for _, recipe := range recipes {
+		if recipe.ID, err = insertRecipe(tx, recipe, actor); err != nil {
+			return
+		}
+	}
+	err = tx.Commit()
+	return
+}
+
+// insertRecipe inserts a new recipe with its tags and related recipes,
+// and records it in the audit log as made by actor.
+func insertRecipe(tx *sqlx.Tx, recipe *Recipe, actor Actor) (newID int, err error) {
+	// 14 things, TODO insert picture
 	insert := `INSERT INTO recipes ` +
 		`(name, description, cuisine, mealtype, season,` +
-		` ingredientlist, instructions) ` +
-		`VALUES ($1,$2,$3,$4,$5,$6,$7)` +
+		` ingredientlist, instructions, owner, contributor, country,` +
+		` community, year, story, yield) ` +
+		`VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14)` +
 		`RETURNING id`
 
-	// returns an primary key
-	rows, err := recipeDB.DB.Queryx(insert, recipe.Name,
+	// returns the primary key
+	err = tx.QueryRowx(insert, recipe.Name,
 		recipe.Description, recipe.Cuisine, recipe.Mealtype, recipe.Season,
-		recipe.Ingredientlist, recipe.Instructions)
-
-	// return the primary key as well
-	if err == nil {
-		// only has one row
-		rows.Next()
-		someID := 0
-		err = rows.Scan(&someID)
-		if err == nil {
-			newID = someID
-		}
+		recipe.Ingredientlist, recipe.Instructions, recipe.Owner,
+		recipe.Contributor, recipe.Country, recipe.Community, recipe.Year,
+		recipe.Story, recipe.Yield).Scan(&newID)
+	if err != nil {
+		return
+	}
+	if err = setTags(tx, newID, recipe.Tags); err != nil {
+		return
+	}
+	if err = refreshRelated(tx, newID); err != nil {
+		return
 	}
+
+	_, afterSummary := DiffRecipes(nil, recipe)
+	err = insertAudit(tx, &AuditEntry{Actor: actor.UserID,
+		ActorName: actor.Name, Action: AuditRecipeCreate,
+		Target: recipeTarget(newID), After: afterSummary, IP: actor.IP})
 	return
 }
 
-// getRecipes is a helper function that
-// gets a Recipe based on a search
-func (recipeDB *RecipeDB) getRecipes(strict bool, name string, cuisine,
-	mealtype, season int) (recipes *list.List, err error) {
+// RecipeSearch describes a recipe search. Cuisine, Mealtype and Season
+// match everything when -1, Year when 0, and the strings when empty.
+// Strict searches must match Mealtype and Season exactly; loose searches
+// match recipes sharing any meal or season bit. Recipes must have every
+// one of Tags, and mention at least one of Ingredients, which are
+// lowercase words without accents, in their ingredient list.
+type RecipeSearch struct {
+	Strict      bool
+	Name        string
+	Cuisine     int
+	Mealtype    int
+	Season      int
+	Contributor string
+	Country     string
+	Year        int
+	Tags        []string
+	Ingredients []string
+}
 
-	fmt.Printf("Getting %v %v %v %v", name, cuisine, mealtype, season)
+// where builds the WHERE clause and arguments for a search.
+func (search RecipeSearch) where() (clause string, args []interface{}) {
+	add := func(format string, arg interface{}) {
+		args = append(args, arg)
+		clause += fmt.Sprintf(format, len(args))
+	}
 
-	searchSQL := `SELECT * FROM recipes WHERE lower(name) LIKE lower($1) `
+	clause = `lower(name) LIKE lower($1) `
+	args = []interface{}{"%" + search.Name + "%"}
 
 	// cuisine match
-	if cuisine != -1 {
-		searchSQL += `AND cuisine=$2 `
+	if search.Cuisine != -1 {
+		add(`AND cuisine=$%d `, search.Cuisine)
 	}
 
 	// mealtype match
-	if mealtype != -1 {
-		if strict {
-			searchSQL += `AND mealtype=$3 `
+	if search.Mealtype != -1 {
+		if search.Strict {
+			add(`AND mealtype=$%d `, search.Mealtype)
 		} else {
-			searchSQL += `AND (mealtype&$3 > 0) `
+			add(`AND (mealtype&$%d > 0) `, search.Mealtype)
 		}
 	}
 
 	// season match
-	if season != -1 {
-		if strict {
-			searchSQL += `AND season=$4 `
+	if search.Season != -1 {
+		if search.Strict {
+			add(`AND season=$%d `, search.Season)
 		} else {
-			searchSQL += `AND (season&$4 > 0) `
+			add(`AND (season&$%d > 0) `, search.Season)
 		}
 	}
 
-	rows, err := recipeDB.DB.Queryx(searchSQL, name, cuisine, mealtype, season)
+	// provenance match
+	if search.Contributor != "" {
+		add(`AND lower(contributor) LIKE lower($%d) `, "%"+search.Contributor+"%")
+	}
+	if search.Country != "" {
+		add(`AND lower(country)=lower($%d) `, search.Country)
+	}
+	if search.Year != 0 {
+		add(`AND year=$%d `, search.Year)
+	}
+
+	// tag match
+	for _, tag := range search.Tags {
+		add(`AND id IN (SELECT recipe_id FROM recipe_tags WHERE tag=$%d) `, tag)
+	}
+
+	// ingredient match, on any of them
+	if len(search.Ingredients) > 0 {
+		patterns := make([]string, len(search.Ingredients))
+		for i, ingredient := range search.Ingredients {
+			patterns[i] = "%" + ingredient + "%"
+		}
+		marks, patternArgs := placeholders(len(args)+1, patterns)
+		clause += `AND ` + foldSQL("ingredientlist") + ` LIKE ANY (ARRAY[` + marks + `]) `
+		args = append(args, patternArgs...)
+	}
+	return
+}
 
+// SearchRecipes gets the recipes matching a search.
+func (recipeDB *RecipeDB) SearchRecipes(search RecipeSearch) (recipes *list.List, err error) {
+	clause, args := search.where()
+	rows, err := recipeDB.DB.Queryx(`SELECT * FROM recipes WHERE `+clause, args...)
 	if err != nil {
-		fmt.Printf("[WARNING] in GetRecipesStrict: %s", err.Error())
+		fmt.Printf("[WARNING] in SearchRecipes: %s\n", err.Error())
+		return
 	}
+	defer rows.Close()
 
 	// build the return list
 	recipes = list.New()
+	matches := []*Recipe{}
 	for rows.Next() {
 		recipe := new(Recipe)
 		err = rows.StructScan(recipe)
 		if err == nil {
 			recipes.PushBack(recipe)
+			matches = append(matches, recipe)
 		} else {
-			fmt.Printf("[WARNING] StructScan: %s", err.Error())
+			fmt.Printf("[WARNING] StructScan: %s\n", err.Error())
 		}
 	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	err = recipeDB.loadTags(matches)
+	return
+}
+
+// textColumns are every column of recipes but the picture, for reading
+// many recipes where pictures aren't shown.
+const textColumns = `id, name, description, cuisine, mealtype, season, ingredientlist, ` +
+	`instructions, yield, owner, contributor, country, community, year, story`
+
+// StreamRecipes calls fn with the recipes matching a search, ordered by
+// id, batch at a time, so that large results needn't be held in memory.
+// It stops at the first error fn returns.
+func (recipeDB *RecipeDB) StreamRecipes(search RecipeSearch, batch int,
+	fn func(recipes []*Recipe) error) error {
+	return recipeDB.StreamRecipeColumns(`*`, search, batch, fn)
+}
+
+// StreamRecipeColumns is StreamRecipes reading only the given columns,
+// such as textColumns.
+func (recipeDB *RecipeDB) StreamRecipeColumns(columns string, search RecipeSearch,
+	batch int, fn func(recipes []*Recipe) error) (err error) {
+	clause, args := search.where()
+	rows, err := recipeDB.DB.Queryx(`SELECT `+columns+` FROM recipes WHERE `+clause+
+		`ORDER BY id`, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	recipes := make([]*Recipe, 0, batch)
+	send := func() error {
+		if err := recipeDB.loadTags(recipes); err != nil {
+			return err
+		}
+		err := fn(recipes)
+		recipes = recipes[:0]
+		return err
+	}
+	for rows.Next() {
+		recipe := new(Recipe)
+		if err = rows.StructScan(recipe); err != nil {
+			return
+		}
+		if recipes = append(recipes, recipe); len(recipes) == batch {
+			if err = send(); err != nil {
+				return
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	if len(recipes) > 0 {
+		err = send()
+	}
+	return
+}
+
+// BrowseRecipes gets one page of the recipes matching a search, ordered
+// by name, along with the total number of matches.
+func (recipeDB *RecipeDB) BrowseRecipes(search RecipeSearch, limit,
+	offset int) (recipes []*Recipe, total int, err error) {
+	clause, args := search.where()
+	query := `SELECT *, count(*) OVER () AS total FROM recipes WHERE ` +
+		clause + `ORDER BY lower(name), id ` +
+		fmt.Sprintf(`LIMIT %d OFFSET %d`, limit, offset)
+	var rows []struct {
+		Recipe
+		Total int
+	}
+	if err = recipeDB.DB.Select(&rows, query, args...); err != nil {
+		return
+	}
+
+	recipes = make([]*Recipe, len(rows))
+	for i := range rows {
+		recipes[i] = &rows[i].Recipe
+		total = rows[i].Total
+	}
+	if len(rows) == 0 && offset > 0 {
+		// past the last page, so count separately
+		err = recipeDB.DB.QueryRowx(`SELECT count(*) FROM recipes WHERE `+clause,
+			args...).Scan(&total)
+		if err != nil {
+			return
+		}
+	}
+	err = recipeDB.loadTags(recipes)
+	return
+}
+
+// placeholders returns n query placeholders numbered from $first, e.g.
+// "$1,$2,$3", and the keys as query arguments.
+func placeholders(first int, keys []string) (string, []interface{}) {
+	marks := make([]string, len(keys))
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		marks[i] = "$" + strconv.Itoa(first+i)
+		args[i] = key
+	}
+	return strings.Join(marks, ","), args
+}
+
+// recipesByGroup gets up to limit recipes, ordered by name, for each of
+// keys, in one query. group is the SQL expression matched against the
+// keys, and from the tables to search.
+func (recipeDB *RecipeDB) recipesByGroup(from, group string, keys []string,
+	limit int) (groups map[string][]*Recipe, err error) {
+	groups = make(map[string][]*Recipe)
+	if len(keys) == 0 {
+		return
+	}
+	marks, args := placeholders(1, keys)
+	query := `SELECT * FROM (SELECT recipes.*, ` + group + ` AS groupkey, ` +
+		`row_number() OVER (PARTITION BY ` + group +
+		` ORDER BY lower(recipes.name), recipes.id) AS rank ` +
+		`FROM ` + from + ` WHERE ` + group + ` IN (` + marks + `)) ranked ` +
+		`WHERE rank <= ` + strconv.Itoa(limit) + ` ORDER BY rank`
+	var rows []struct {
+		Recipe
+		Groupkey string
+		Rank     int
+	}
+	if err = recipeDB.DB.Select(&rows, query, args...); err != nil {
+		return
+	}
+	recipes := make([]*Recipe, len(rows))
+	for i := range rows {
+		recipes[i] = &rows[i].Recipe
+		groups[rows[i].Groupkey] = append(groups[rows[i].Groupkey], recipes[i])
+	}
+	err = recipeDB.loadTags(recipes)
+	return
+}
+
+// RecipesByTags gets up to limit recipes with each of the tags.
+func (recipeDB *RecipeDB) RecipesByTags(tags []string, limit int) (map[string][]*Recipe, error) {
+	return recipeDB.recipesByGroup(
+		`recipes JOIN recipe_tags ON recipe_tags.recipe_id = recipes.id`,
+		`recipe_tags.tag`, tags, limit)
+}
+
+// RecipesByContributors gets up to limit recipes by each of the
+// contributors.
+func (recipeDB *RecipeDB) RecipesByContributors(names []string, limit int) (map[string][]*Recipe, error) {
+	return recipeDB.recipesByGroup(`recipes`, `recipes.contributor`, names, limit)
+}
+
+// contributorsQuery selects contributors, their recipe counts and their
+// countries from the recipes matching the conditions that follow it.
+const contributorsQuery = `SELECT contributor, count(*), ` +
+	`coalesce(string_agg(DISTINCT country, ';') FILTER (WHERE country <> ''), '') ` +
+	`FROM recipes WHERE contributor <> '' `
+
+// contributorsOrder groups and orders contributorsQuery, most prolific
+// first.
+const contributorsOrder = `GROUP BY contributor ORDER BY count(*) DESC, contributor`
+
+// GetContributors gets the named contributors, or every contributor
+// when names is nil, most prolific first.
+func (recipeDB *RecipeDB) GetContributors(names []string) (contributors []*Contributor, err error) {
+	query := contributorsQuery
+	var args []interface{}
+	if names != nil {
+		if len(names) == 0 {
+			return
+		}
+		var marks string
+		marks, args = placeholders(1, names)
+		query += `AND contributor IN (` + marks + `) `
+	}
+	return recipeDB.queryContributors(query+contributorsOrder, args...)
+}
+
+// ListContributors gets up to limit contributors, most prolific first,
+// skipping the first offset of them.
+func (recipeDB *RecipeDB) ListContributors(limit, offset int) ([]*Contributor, error) {
+	return recipeDB.queryContributors(contributorsQuery+contributorsOrder+` LIMIT $1 OFFSET $2`,
+		limit, offset)
+}
+
+// queryContributors runs a contributorsQuery.
+func (recipeDB *RecipeDB) queryContributors(query string, args ...interface{}) (contributors []*Contributor, err error) {
+	rows, err := recipeDB.DB.Queryx(query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		contributor := new(Contributor)
+		var countries string
+		if err = rows.Scan(&contributor.Name, &contributor.Recipes, &countries); err != nil {
+			return
+		}
+		contributor.Countries = []string{}
+		if countries != "" {
+			contributor.Countries = strings.Split(countries, ";")
+		}
+		contributors = append(contributors, contributor)
+	}
+	err = rows.Err()
+	return
+}
+
+// Facets count the recipes matching a search by each cuisine, meal,
+// season and tag. A recipe made for several meals or seasons counts
+// towards each of them.
+type Facets struct {
+	Cuisine  map[int]int    `json:"cuisine"`
+	Mealtype map[int]int    `json:"mealtype"`
+	Season   map[int]int    `json:"season"`
+	Tags     map[string]int `json:"tags"`
+}
+
+// bitArray formats the keys of a bit map as a SQL array literal.
+func bitArray(bits map[int]string) string {
+	list := make([]string, 0, len(bits))
+	for bit := range bits {
+		list = append(list, strconv.Itoa(bit))
+	}
+	sort.Strings(list)
+	return `ARRAY[` + strings.Join(list, ",") + `]`
+}
+
+// GetFacets counts the recipes matching a search by cuisine, meal,
+// season and tag, in a single query. The counts are used both by the
+// browse page and by the jsonsearch API.
+func (recipeDB *RecipeDB) GetFacets(search RecipeSearch) (facets *Facets, err error) {
+	clause, args := search.where()
+	query := `WITH matched AS (` +
+		`SELECT id, cuisine, mealtype, season FROM recipes WHERE ` + clause + `) ` +
+		`SELECT 'cuisine', cuisine::text, count(*) FROM matched GROUP BY cuisine ` +
+		`UNION ALL ` +
+		`SELECT 'mealtype', bit::text, count(*) FROM matched, ` +
+		`unnest(` + bitArray(Meals) + `) bit WHERE mealtype&bit > 0 GROUP BY bit ` +
+		`UNION ALL ` +
+		`SELECT 'season', bit::text, count(*) FROM matched, ` +
+		`unnest(` + bitArray(Seasons) + `) bit WHERE season&bit > 0 GROUP BY bit ` +
+		`UNION ALL ` +
+		`SELECT 'tag', tag, count(*) FROM matched ` +
+		`JOIN recipe_tags ON recipe_id = matched.id GROUP BY tag`
+
+	rows, err := recipeDB.DB.Queryx(query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	facets = &Facets{
+		Cuisine:  make(map[int]int),
+		Mealtype: make(map[int]int),
+		Season:   make(map[int]int),
+		Tags:     make(map[string]int),
+	}
+	for rows.Next() {
+		var facet, value string
+		var n int
+		if err = rows.Scan(&facet, &value, &n); err != nil {
+			return
+		}
+		key, _ := strconv.Atoi(value)
+		switch facet {
+		case "cuisine":
+			facets.Cuisine[key] = n
+		case "mealtype":
+			facets.Mealtype[key] = n
+		case "season":
+			facets.Season[key] = n
+		case "tag":
+			facets.Tags[value] = n
+		}
+	}
+	err = rows.Err()
 	return
 }
 
@@ -114,8 +649,8 @@ func (recipeDB *RecipeDB) getRecipes(strict bool, name string, cuisine,
 func (recipeDB *RecipeDB) GetRecipesStrict(name string, cuisine,
 	mealtype, season int) (recipes *list.List, err error) {
 
-	recipes, err = recipeDB.getRecipes(true, "%"+name+"%", cuisine,
-		mealtype, season)
+	recipes, err = recipeDB.SearchRecipes(RecipeSearch{Strict: true,
+		Name: name, Cuisine: cuisine, Mealtype: mealtype, Season: season})
 	return
 }
 
@@ -123,7 +658,92 @@ func (recipeDB *RecipeDB) GetRecipesStrict(name string, cuisine,
 func (recipeDB *RecipeDB) GetRecipesLoose(name string, cuisine,
 	mealtype, season int) (recipes *list.List, err error) {
 
-	recipes, err = recipeDB.getRecipes(false, "%"+name+"%", cuisine,
-		mealtype, season)
+	recipes, err = recipeDB.SearchRecipes(RecipeSearch{Strict: false,
+		Name: name, Cuisine: cuisine, Mealtype: mealtype, Season: season})
+	return
+}
+
+// GetStats computes Stats from the recipes table. Volunteers and
+// countries are counted case-insensitively, and years is the span of
+// years recipes were collected in.
+func (recipeDB *RecipeDB) GetStats() (stats *Stats, err error) {
+	stats = &Stats{
+		ByCuisine: make(map[int]int),
+		ByCountry: make(map[string]int),
+		BySeason:  make(map[string]int),
+	}
+
+	totals := `SELECT count(*), ` +
+		`count(DISTINCT lower(contributor)) FILTER (WHERE contributor <> ''), ` +
+		`count(DISTINCT lower(country)) FILTER (WHERE country <> ''), ` +
+		`coalesce(max(year) FILTER (WHERE year > 0) - ` +
+		`min(year) FILTER (WHERE year > 0) + 1, 0) ` +
+		`FROM recipes`
+	err = recipeDB.DB.QueryRowx(totals).Scan(&stats.Recipes,
+		&stats.Volunteers, &stats.Countries, &stats.Years)
+	if err != nil {
+		return
+	}
+
+	// counts per cuisine and per country
+	rows, err := recipeDB.DB.Queryx(
+		`SELECT cuisine, count(*) FROM recipes GROUP BY cuisine`)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var cuisine, n int
+		if err = rows.Scan(&cuisine, &n); err != nil {
+			rows.Close()
+			return
+		}
+		stats.ByCuisine[cuisine] = n
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	rows, err = recipeDB.DB.Queryx(`SELECT min(country), count(*) FROM recipes ` +
+		`WHERE country <> '' GROUP BY lower(country)`)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var country string
+		var n int
+		if err = rows.Scan(&country, &n); err != nil {
+			rows.Close()
+			return
+		}
+		stats.ByCountry[country] = n
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	// a recipe counts towards every season it is made in
+	bits := make([]int, 0, len(Seasons))
+	for bit := range Seasons {
+		bits = append(bits, bit)
+	}
+	sort.Ints(bits)
+	seasons := `SELECT `
+	counts := make([]int, len(bits))
+	dest := make([]interface{}, len(bits))
+	for i, bit := range bits {
+		if i > 0 {
+			seasons += `, `
+		}
+		seasons += fmt.Sprintf(`count(*) FILTER (WHERE season&%d > 0)`, bit)
+		dest[i] = &counts[i]
+	}
+	if err = recipeDB.DB.QueryRowx(seasons + ` FROM recipes`).Scan(dest...); err != nil {
+		return
+	}
+	for i, bit := range bits {
+		stats.BySeason[Seasons[bit]] = counts[i]
+	}
+
+	stats.Updated = time.Now()
 	return
 }
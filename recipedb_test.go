@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestRecipeSearchWhere tests that search clauses are numbered to match
+// their arguments, whichever fields are set.
+func TestRecipeSearchWhere(t *testing.T) {
+	search := RecipeSearch{Name: "stew", Cuisine: -1, Mealtype: 4,
+		Season: -1, Country: "Ghana", Year: 1998}
+	clause, args := search.where()
+
+	wantClause := `lower(name) LIKE lower($1) AND (mealtype&$2 > 0) ` +
+		`AND lower(country)=lower($3) AND year=$4 `
+	if clause != wantClause {
+		t.Errorf("where() clause = %q, expected %q", clause, wantClause)
+	}
+	wantArgs := []interface{}{"%stew%", 4, "Ghana", 1998}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("where() args = %v, expected %v", args, wantArgs)
+	}
+
+	search.Strict = true
+	if clause, _ = search.where(); clause != `lower(name) LIKE lower($1) `+
+		`AND mealtype=$2 AND lower(country)=lower($3) AND year=$4 ` {
+		t.Errorf("strict where() clause = %q", clause)
+	}
+}
+
+// TestTextColumns tests that textColumns reads every field of a recipe
+// kept in the recipes table but its picture.
+func TestTextColumns(t *testing.T) {
+	var fields []string
+	typ := reflect.TypeOf(Recipe{})
+	for i := 0; i < typ.NumField(); i++ {
+		if field := typ.Field(i); field.Tag.Get("db") != "-" && field.Name != "Picture" {
+			fields = append(fields, strings.ToLower(field.Name))
+		}
+	}
+	columns := strings.Split(textColumns, ", ")
+	sort.Strings(fields)
+	sort.Strings(columns)
+	if !reflect.DeepEqual(fields, columns) {
+		t.Errorf("textColumns are %v, expected %v", columns, fields)
+	}
+}
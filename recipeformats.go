@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Formats recipes may be imported from besides spreadsheets, by the
+// -format flag of the import command and the upload form.
+const (
+	FormatMealMaster = "mealmaster"
+	FormatRecipeML   = "recipeml"
+	FormatCooklang   = "cooklang"
+)
+
+// recipeParsers parse files of each format into recipes, each with the
+// line it starts on. name is the file's name.
+var recipeParsers = map[string]func(name, text string) ([]*ImportedRecipe, error){
+	FormatMealMaster: ParseMealMaster,
+	FormatRecipeML:   ParseRecipeML,
+	FormatCooklang:   ParseCooklang,
+}
+
+// DetectRecipeFormat guesses the format of a recipe file from its name
+// and contents, returning "" for anything else.
+func DetectRecipeFormat(name string, data []byte) string {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".mmf", ".mm":
+		return FormatMealMaster
+	case ".rml", ".recipeml":
+		return FormatRecipeML
+	case ".cook":
+		return FormatCooklang
+	}
+	head := data
+	if len(head) > 4096 {
+		head = head[:4096]
+	}
+	switch {
+	case bytes.Contains(head, []byte("Meal-Master")) || bytes.HasPrefix(head, []byte("MMMMM")):
+		return FormatMealMaster
+	case bytes.Contains(head, []byte("<recipeml")):
+		return FormatRecipeML
+	}
+	return ""
+}
+
+// decodeLegacyText reads text as UTF-8, or else as Windows-1252, which
+// most old recipe programs wrote.
+func decodeLegacyText(data []byte) string {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	high := make(map[byte]rune)
+	for r, b := range winAnsi {
+		high[b] = r
+	}
+	var buf strings.Builder
+	for _, b := range data {
+		if r, ok := high[b]; ok {
+			buf.WriteRune(r)
+		} else {
+			buf.WriteRune(rune(b))
+		}
+	}
+	return buf.String()
+}
+
+// ParseRecipeFile reads the recipes of a file in one of recipeParsers'
+// formats, checking each as if saved from the site. Recipes without a
+// description are given description, since most old formats have none.
+func ParseRecipeFile(name, format string, data []byte,
+	description string) ([]*ImportedRecipe, error) {
+	parse, ok := recipeParsers[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown recipe format %q", format)
+	}
+	imported, err := parse(name, decodeLegacyText(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(imported) == 0 {
+		return nil, fmt.Errorf("no %s recipes were found in %s", format, name)
+	}
+	for _, recipe := range imported {
+		if strings.TrimSpace(recipe.Recipe.Description) == "" {
+			recipe.Recipe.Description = description
+		}
+		if recipe.Recipe.Tags == nil {
+			recipe.Recipe.Tags = []string{}
+		}
+		recipe.Problems = recipeProblems(recipe.Recipe, nil)
+	}
+	return imported, nil
+}
+
+// recipeProblems lists what is wrong with a recipe, in the order of
+// importFields, leaving out fields already reported.
+func recipeProblems(recipe *Recipe, reported map[string]bool) (problems []string) {
+	invalid := recipe.Validate()
+	for _, field := range importFields {
+		if message, ok := invalid[field]; ok && !reported[field] {
+			problems = append(problems, field+" "+message)
+		}
+	}
+	return
+}
+
+// ingredientText joins the parts of an ingredient, leaving out blanks.
+// Semicolons separate ingredients, so become commas.
+func ingredientText(parts ...string) string {
+	words := []string{}
+	for _, part := range parts {
+		if part = strings.Join(strings.Fields(part), " "); part != "" {
+			words = append(words, part)
+		}
+	}
+	return strings.Replace(strings.Join(words, " "), ";", ",", -1)
+}
+
+// mealsOf sets the meal bits of names such as "Dinner" and returns the
+// rest, for use as tags.
+func mealsOf(recipe *Recipe, names []string) (rest []string) {
+	for _, name := range names {
+		found := false
+		for meal, bit := range MealsToInt {
+			if strings.EqualFold(strings.TrimSpace(name), meal) {
+				recipe.Mealtype |= bit
+				found = true
+			}
+		}
+		if !found {
+			rest = append(rest, name)
+		}
+	}
+	return
+}
+
+// paragraphs joins lines into paragraphs separated by blank lines, one
+// per line as recipe instructions are.
+func paragraphs(lines []string) string {
+	result := []string{}
+	current := []string{}
+	flush := func() {
+		if len(current) > 0 {
+			result = append(result, strings.Join(current, " "))
+			current = current[:0]
+		}
+	}
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line == "" {
+			flush()
+		} else {
+			current = append(current, line)
+		}
+	}
+	flush()
+	return strings.Join(result, "\n")
+}
+
+// --------------------------------------------
+//                  MEALMASTER
+// --------------------------------------------
+
+var (
+	// mealMasterStart matches the first line of a MealMaster recipe
+	mealMasterStart = regexp.MustCompile(`^(MMMMM|-----).*Meal-Master`)
+	// mealMasterDivider matches the last line of a recipe, or a heading
+	// such as MMMMM-----SAUCE----- within one
+	mealMasterDivider = regexp.MustCompile(`^(MMMMM|-----)-*(.*?)-*\s*$`)
+	// mealMasterAmount matches the amount column of an ingredient line
+	mealMasterAmount = regexp.MustCompile(`^[0-9 /.-]*$`)
+)
+
+// mealMasterUnits are MealMaster's two-letter unit codes.
+var mealMasterUnits = map[string]string{
+	"": "", "x": "", "sm": "small", "md": "medium", "lg": "large",
+	"cn": "can", "pk": "package", "pn": "pinch", "dr": "drop", "ds": "dash",
+	"ct": "carton", "bn": "bunch", "sl": "slice", "ea": "each", "t": "tsp",
+	"ts": "tsp", "T": "tbsp", "tb": "tbsp", "fl": "fl oz", "c": "cup",
+	"pt": "pint", "qt": "quart", "ga": "gallon", "oz": "oz", "lb": "lb",
+	"ml": "ml", "cb": "cubic cm", "cl": "cl", "dl": "dl", "l": "liter",
+	"mg": "mg", "cg": "cg", "dg": "dg", "g": "g", "kg": "kg",
+}
+
+// mealMasterIngredient reads an ingredient in MealMaster's columns: an
+// amount in 7, a unit code in 2 and the rest, e.g. "  1 1/2 c  Rice".
+func mealMasterIngredient(line string) (amount, unit, text string, ok bool) {
+	columns := []rune(line)
+	if len(columns) < 12 || columns[7] != ' ' || columns[10] != ' ' ||
+		!mealMasterAmount.MatchString(string(columns[:7])) {
+		return
+	}
+	unit, ok = mealMasterUnits[strings.TrimSpace(string(columns[8:10]))]
+	text = strings.TrimSpace(string(columns[11:]))
+	return strings.TrimSpace(string(columns[:7])), unit, text, ok && text != ""
+}
+
+// ParseMealMaster reads the recipes of a MealMaster file. Ingredients
+// may be in one or two columns, and continued on the next line after a
+// "-". Categories that are meals set the meal; the others become tags.
+func ParseMealMaster(name, text string) ([]*ImportedRecipe, error) {
+	recipes := []*ImportedRecipe{}
+	var recipe *Recipe
+	var ingredients, instructions []string
+	state := ""
+	finish := func() {
+		recipe.Ingredientlist = strings.Join(ingredients, "; ")
+		recipe.Instructions = paragraphs(instructions)
+		recipe = nil
+		state = ""
+	}
+	addIngredient := func(line string) bool {
+		amount, unit, text, ok := mealMasterIngredient(line)
+		if !ok {
+			return false
+		}
+		if strings.HasPrefix(text, "-") && amount == "" && unit == "" && len(ingredients) > 0 {
+			last := len(ingredients) - 1
+			ingredients[last] = ingredientText(ingredients[last], strings.TrimLeft(text, "-"))
+		} else {
+			ingredients = append(ingredients, ingredientText(amount, unit, text))
+		}
+		return true
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(nil, 1<<20)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimRight(strings.Replace(scanner.Text(), "\t", "        ", -1), " \r")
+		if mealMasterStart.MatchString(line) {
+			if recipe != nil {
+				finish()
+			}
+			recipe = new(Recipe)
+			ingredients, instructions = nil, nil
+			recipes = append(recipes, &ImportedRecipe{Line: number, Recipe: recipe})
+			state = "header"
+			continue
+		}
+		if recipe == nil {
+			continue
+		}
+		if divider := mealMasterDivider.FindStringSubmatch(line); divider != nil {
+			if strings.TrimSpace(divider[2]) == "" {
+				finish()
+			} else if state == "instructions" {
+				// a heading among the instructions starts a paragraph
+				instructions = append(instructions, "", strings.TrimSpace(divider[2])+":", "")
+			}
+			continue
+		}
+
+		if state == "header" {
+			trimmed := strings.TrimSpace(line)
+			field := strings.SplitN(trimmed, ":", 2)
+			if len(field) == 2 {
+				value := strings.TrimSpace(field[1])
+				switch strings.ToLower(field[0]) {
+				case "title":
+					recipe.Name = value
+					continue
+				case "categories":
+					rest := mealsOf(recipe, strings.Split(value, ","))
+					recipe.Tags = ParseTags(strings.Join(rest, ";"))
+					continue
+				case "yield", "servings":
+					recipe.Yield = value
+					continue
+				}
+			}
+			if trimmed == "" {
+				continue
+			}
+			state = "ingredients"
+		}
+		if state == "ingredients" {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			// two columns of ingredients are split at column 41, counted
+			// in letters rather than bytes
+			if columns := []rune(line); len(columns) > 41 {
+				left, right := string(columns[:41]), string(columns[41:])
+				_, _, _, leftOK := mealMasterIngredient(left)
+				_, _, _, rightOK := mealMasterIngredient(right)
+				if leftOK && rightOK {
+					addIngredient(left)
+					addIngredient(right)
+					continue
+				}
+			}
+			if addIngredient(line) {
+				continue
+			}
+			state = "instructions"
+		}
+		instructions = append(instructions, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if recipe != nil {
+		finish()
+	}
+	return recipes, nil
+}
+
+// --------------------------------------------
+//                   RECIPEML
+// --------------------------------------------
+
+// recipeMLIngredient is an <ing> of a RecipeML recipe.
+type recipeMLIngredient struct {
+	Quantity string `xml:"amt>qty"`
+	Unit     string `xml:"amt>unit"`
+	Item     string `xml:"item"`
+	Prep     string `xml:"prep"`
+}
+
+// recipeML is a <recipe> of a RecipeML document. Yields and directions
+// may be plain text or marked up.
+type recipeML struct {
+	Title      string   `xml:"head>title"`
+	Categories []string `xml:"head>categories>cat"`
+	Yield      struct {
+		Text     string `xml:",chardata"`
+		Quantity string `xml:"qty"`
+		Unit     string `xml:"unit"`
+	} `xml:"head>yield"`
+	Description string               `xml:"description"`
+	Ingredients []recipeMLIngredient `xml:"ingredients>ing"`
+	Divisions   []struct {
+		Title       string               `xml:"title"`
+		Ingredients []recipeMLIngredient `xml:"ing"`
+	} `xml:"ingredients>ing-div"`
+	Directions struct {
+		Text  string   `xml:",chardata"`
+		Steps []string `xml:"step"`
+	} `xml:"directions"`
+}
+
+// ParseRecipeML reads the recipes of a RecipeML document, which may be a
+// single <recipe> or a <menu> of them.
+func ParseRecipeML(name, text string) ([]*ImportedRecipe, error) {
+	recipes := []*ImportedRecipe{}
+	decoder := xml.NewDecoder(strings.NewReader(text))
+	decoder.Strict = false
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		// the text is already decoded
+		return input, nil
+	}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return recipes, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%s isn't well-formed RecipeML: %s", name, err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "recipe" {
+			continue
+		}
+		line, _ := decoder.InputPos()
+		var parsed recipeML
+		if err = decoder.DecodeElement(&parsed, &start); err != nil {
+			return nil, fmt.Errorf("%s isn't well-formed RecipeML: %s", name, err)
+		}
+
+		recipe := &Recipe{Name: strings.TrimSpace(parsed.Title),
+			Description: strings.Join(strings.Fields(parsed.Description), " ")}
+		rest := mealsOf(recipe, parsed.Categories)
+		recipe.Tags = ParseTags(strings.Join(rest, ";"))
+		recipe.Yield = ingredientText(parsed.Yield.Quantity, parsed.Yield.Unit)
+		if recipe.Yield == "" {
+			recipe.Yield = ingredientText(parsed.Yield.Text)
+		}
+		ingredients := []string{}
+		for _, ing := range parsed.Ingredients {
+			ingredients = append(ingredients, ingredientText(ing.Quantity, ing.Unit, ing.Item, ing.Prep))
+		}
+		for _, division := range parsed.Divisions {
+			for _, ing := range division.Ingredients {
+				ingredients = append(ingredients, ingredientText(ing.Quantity, ing.Unit, ing.Item, ing.Prep))
+			}
+		}
+		recipe.Ingredientlist = strings.Join(ingredients, "; ")
+		if len(parsed.Directions.Steps) > 0 {
+			steps := make([]string, len(parsed.Directions.Steps))
+			for i, step := range parsed.Directions.Steps {
+				steps[i] = strings.Join(strings.Fields(step), " ")
+			}
+			recipe.Instructions = strings.Join(steps, "\n")
+		} else {
+			recipe.Instructions = paragraphs(strings.Split(parsed.Directions.Text, "\n"))
+		}
+		recipes = append(recipes, &ImportedRecipe{Line: line, Recipe: recipe})
+	}
+}
+
+// --------------------------------------------
+//                   COOKLANG
+// --------------------------------------------
+
+var (
+	// cooklangIngredient matches @name{quantity%unit}(preparation), where
+	// one-word names may leave out the braces
+	cooklangIngredient = regexp.MustCompile(
+		`@(?:([^@#~{}\n]+?)\{([^}]*)\}|([\p{L}\p{N}_-]+))(?:\(([^)\n]*)\))?`)
+	// cooklangCookware matches #name{} or #name
+	cooklangCookware = regexp.MustCompile(`#(?:([^@#~{}\n]+?)\{[^}]*\}|([\p{L}\p{N}_-]+))`)
+	// cooklangTimer matches ~name{quantity%unit} or ~{quantity%unit}
+	cooklangTimer = regexp.MustCompile(`~([^@#~{}\n]*)\{([^}]*)\}`)
+	// cooklangComment matches -- comments and [- block comments -]
+	cooklangComment = regexp.MustCompile(`(?s)\[-.*?-\]|--[^\n]*`)
+)
+
+// cooklangQuantity turns "1%kg" into "1 kg".
+func cooklangQuantity(quantity string) string {
+	return ingredientText(strings.Replace(quantity, "%", " ", 1))
+}
+
+// ParseCooklang reads a Cooklang recipe. Its name is the title in its
+// metadata, or else the file's name. Metadata are given as ">> key:
+// value" lines or in front matter between "---" lines.
+func ParseCooklang(name, text string) ([]*ImportedRecipe, error) {
+	recipe := &Recipe{}
+	metadata := make(map[string]string)
+	lines := strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	if len(lines) > 0 && strings.TrimSpace(lines[0]) == "---" {
+		for i := 1; i < len(lines); i++ {
+			if strings.TrimSpace(lines[i]) == "---" {
+				for _, line := range lines[1:i] {
+					if field := strings.SplitN(line, ":", 2); len(field) == 2 {
+						metadata[strings.ToLower(strings.TrimSpace(field[0]))] = strings.TrimSpace(field[1])
+					}
+				}
+				lines = lines[i+1:]
+				break
+			}
+		}
+	}
+
+	body := []string{}
+	notes := []string{}
+	for _, line := range strings.Split(cooklangComment.ReplaceAllString(
+		strings.Join(lines, "\n"), ""), "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, ">>"):
+			if field := strings.SplitN(strings.TrimPrefix(trimmed, ">>"), ":", 2); len(field) == 2 {
+				metadata[strings.ToLower(strings.TrimSpace(field[0]))] = strings.TrimSpace(field[1])
+			}
+		case strings.HasPrefix(trimmed, ">"):
+			notes = append(notes, strings.TrimSpace(strings.TrimPrefix(trimmed, ">")))
+		case strings.HasPrefix(trimmed, "="):
+			// section headings start new steps
+			body = append(body, "", strings.Trim(trimmed, "= ")+":", "")
+		default:
+			body = append(body, line)
+		}
+	}
+
+	ingredients := []string{}
+	steps := paragraphs(body)
+	steps = cooklangIngredient.ReplaceAllStringFunc(steps, func(match string) string {
+		parts := cooklangIngredient.FindStringSubmatch(match)
+		name := parts[1] + parts[3]
+		preparation := ""
+		if parts[4] != "" {
+			preparation = ", " + parts[4]
+		}
+		ingredients = append(ingredients, ingredientText(cooklangQuantity(parts[2]), name)+
+			strings.Replace(preparation, ";", ",", -1))
+		return strings.TrimSpace(name)
+	})
+	steps = cooklangCookware.ReplaceAllStringFunc(steps, func(match string) string {
+		parts := cooklangCookware.FindStringSubmatch(match)
+		return strings.TrimSpace(parts[1] + parts[2])
+	})
+	steps = cooklangTimer.ReplaceAllStringFunc(steps, func(match string) string {
+		parts := cooklangTimer.FindStringSubmatch(match)
+		if quantity := cooklangQuantity(parts[2]); quantity != "" {
+			return quantity
+		}
+		return strings.TrimSpace(parts[1])
+	})
+	recipe.Instructions = steps
+	recipe.Ingredientlist = strings.Join(ingredients, "; ")
+
+	recipe.Name = metadata["title"]
+	if recipe.Name == "" {
+		base := path.Base(strings.Replace(name, `\`, "/", -1))
+		recipe.Name = strings.Join(strings.FieldsFunc(strings.TrimSuffix(base, path.Ext(base)),
+			func(r rune) bool { return r == '-' || r == '_' || r == ' ' }), " ")
+	}
+	recipe.Description = metadata["description"]
+	if recipe.Description == "" {
+		recipe.Description = metadata["introduction"]
+	}
+	if recipe.Description == "" {
+		recipe.Description = strings.Join(notes, " ")
+	}
+	for _, key := range []string{"servings", "yield", "serves"} {
+		if recipe.Yield == "" {
+			recipe.Yield = metadata[key]
+		}
+	}
+	recipe.Contributor = metadata["author"]
+	if year, err := strconv.Atoi(metadata["year"]); err == nil {
+		recipe.Year = year
+	}
+	tags := strings.Split(strings.Trim(metadata["tags"], "[]"), ",")
+	for _, key := range []string{"course", "meal"} {
+		if metadata[key] != "" {
+			tags = append(tags, strings.Split(metadata[key], ",")...)
+		}
+	}
+	rest := mealsOf(recipe, tags)
+	recipe.Tags = ParseTags(strings.Join(rest, ";"))
+	return []*ImportedRecipe{{Line: 1, Recipe: recipe}}, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestParseMealMaster tests that one- and two-column ingredients,
+// continued ingredients and headings are read, and that old Windows
+// text is decoded, with columns counted in letters.
+func TestParseMealMaster(t *testing.T) {
+	text := "Saved from the 1994 newsletter\r\n" +
+		"MMMMM----- Recipe via Meal-Master (tm) v8.05\r\n" +
+		"\r\n" +
+		"      Title: Chicken Yassa\r\n" +
+		" Categories: Dinner, Poultry, Senegalese\r\n" +
+		"      Yield: 4 servings\r\n" +
+		"\r\n" +
+		"      2 lb Chicken pieces                      3    Onions; sliced\r\n" +
+		"      1 c  Cr\xe8me fra\xeeche                       2    Limes\r\n" +
+		"    1/4 c  Lemon juice\r\n" +
+		"           -freshly squeezed\r\n" +
+		"\r\n" +
+		"MMMMM---------------------------SAUCE-----------------------------\r\n" +
+		"      1 T  Mustard\r\n" +
+		"\r\n" +
+		"  Marinate the chicken overnight in the lemon juice\r\n" +
+		"  and onions.\r\n" +
+		"\r\n" +
+		"  Grill, then simmer in the marinade. Serve with rice \x96 it's caf\xe9 food.\r\n" +
+		"\r\n" +
+		"MMMMM\r\n" +
+		"---------- Recipe via Meal-Master (tm) v8.02\r\n" +
+		"      Title: Fufu\r\n" +
+		"      1 lg Cassava\r\n" +
+		"  Pound.\r\n" +
+		"-----\r\n"
+	imported, err := ParseRecipeFile("yassa.txt", DetectRecipeFormat("yassa.txt", []byte(text)),
+		[]byte(text), "From the archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 2 {
+		t.Fatalf("ParseMealMaster() read %d recipes, expected 2", len(imported))
+	}
+	expected := &Recipe{Name: "Chicken Yassa", Description: "From the archive",
+		Mealtype: 4, Yield: "4 servings", Tags: []string{"poultry", "senegalese"},
+		Ingredientlist: "2 lb Chicken pieces; 3 Onions, sliced; 1 cup Crème fraîche; 2 Limes; " +
+			"1/4 cup Lemon juice freshly squeezed; 1 tbsp Mustard",
+		Instructions: "Marinate the chicken overnight in the lemon juice and onions.\n" +
+			"Grill, then simmer in the marinade. Serve with rice – it's café food."}
+	if !reflect.DeepEqual(imported[0].Recipe, expected) || imported[0].Line != 2 {
+		t.Errorf("ParseMealMaster() = %+v on line %d, expected %+v", imported[0].Recipe,
+			imported[0].Line, expected)
+	}
+	fufu := imported[1].Recipe
+	if fufu.Name != "Fufu" || fufu.Ingredientlist != "1 large Cassava" ||
+		fufu.Instructions != "Pound." || imported[1].Line != 22 || imported[1].Problems != nil {
+		t.Errorf("ParseMealMaster() = %+v on line %d, with problems %v", fufu,
+			imported[1].Line, imported[1].Problems)
+	}
+}
+
+// TestParseRecipeML tests that ingredients, divisions and steps of a
+// RecipeML menu are read.
+func TestParseRecipeML(t *testing.T) {
+	text := `<?xml version="1.0" encoding="ISO-8859-1"?>
+<recipeml version="0.5">
+<menu><head><title>Menu</title></head>
+<recipe>
+  <head>
+    <title>Jollof Rice</title>
+    <categories><cat>Lunch</cat><cat>Rice</cat></categories>
+    <yield><qty>6</qty><unit>servings</unit></yield>
+  </head>
+  <description>A one-pot rice dish.</description>
+  <ingredients>
+    <ing><amt><qty>2</qty><unit>cups</unit></amt><item>rice</item><prep>washed</prep></ing>
+    <ing-div><title>Base</title>
+      <ing><amt><qty>3</qty></amt><item>tomatoes</item></ing>
+    </ing-div>
+  </ingredients>
+  <directions><step>Fry the base.</step><step>Add the
+    rice and simmer.</step></directions>
+</recipe>
+<recipe><head><title>Ginger beer</title><yield>2 liters</yield></head>
+  <ingredients><ing><item>ginger</item></ing></ingredients>
+  <directions>Grate the ginger.
+
+Steep overnight.</directions>
+</recipe>
+</menu>
+</recipeml>`
+	if format := DetectRecipeFormat("menu.xml", []byte(text)); format != FormatRecipeML {
+		t.Errorf("DetectRecipeFormat() = %q", format)
+	}
+	imported, err := ParseRecipeFile("menu.xml", FormatRecipeML, []byte(text), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Recipe{Name: "Jollof Rice", Description: "A one-pot rice dish.",
+		Mealtype: 2, Yield: "6 servings", Tags: []string{"rice"},
+		Ingredientlist: "2 cups rice washed; 3 tomatoes",
+		Instructions:   "Fry the base.\nAdd the rice and simmer."}
+	if len(imported) != 2 || !reflect.DeepEqual(imported[0].Recipe, expected) {
+		t.Fatalf("ParseRecipeML() = %+v, expected %+v", imported[0].Recipe, expected)
+	}
+	beer := imported[1]
+	if beer.Recipe.Yield != "2 liters" || beer.Recipe.Instructions !=
+		"Grate the ginger.\nSteep overnight." || len(beer.Problems) != 1 {
+		t.Errorf("ParseRecipeML() = %+v, with problems %v", beer.Recipe, beer.Problems)
+	}
+}
+
+// TestParseCooklang tests that ingredients, cookware and timers are
+// taken out of a Cooklang recipe's steps, and its metadata read.
+func TestParseCooklang(t *testing.T) {
+	text := "---\ntitle: Peanut Stew\ntags: [stew, peanut]\n---\n" +
+		">> servings: 4\n" +
+		">> course: dinner\n" +
+		"> Mafé, as made in Kédougou.\n" +
+		"-- a comment\n" +
+		"Brown @chicken{1%kg} in a #large pot{} with @salt. [- not this -]\n" +
+		"Add @peanut butter{2%cups}(smooth) and @onions{2}.\n\n" +
+		"Simmer for ~{45%minutes}.\n"
+	imported, err := ParseRecipeFile("mafe.cook", DetectRecipeFormat("mafe.cook", nil),
+		[]byte(text), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Recipe{Name: "Peanut Stew", Description: "Mafé, as made in Kédougou.",
+		Mealtype: 4, Yield: "4", Tags: []string{"peanut", "stew"},
+		Ingredientlist: "1 kg chicken; salt; 2 cups peanut butter, smooth; 2 onions",
+		Instructions: "Brown chicken in a large pot with salt. " +
+			"Add peanut butter and onions.\nSimmer for 45 minutes."}
+	if len(imported) != 1 || !reflect.DeepEqual(imported[0].Recipe, expected) {
+		t.Errorf("ParseCooklang() = %+v, expected %+v", imported[0].Recipe, expected)
+	}
+
+	imported, _ = ParseRecipeFile("dir/ginger_beer.cook", FormatCooklang,
+		[]byte("Grate @ginger."), "Imported")
+	if imported[0].Recipe.Name != "ginger beer" {
+		t.Errorf("ParseCooklang() named the recipe %q", imported[0].Recipe.Name)
+	}
+}
+
+// TestPreviewImport tests that uploaded recipes are shown, and that only
+// the good ones are sent back to be saved.
+func TestPreviewImport(t *testing.T) {
+	c := &RBController{Render: NewRenderer(), RecipeDB: nil}
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("description", "From the archive")
+	file, _ := form.CreateFormFile("file", "menu.xml")
+	file.Write([]byte(`<recipeml><menu>
+		<recipe><head><title>Fufu</title></head>
+		<ingredients><ing><item>cassava</item></ing></ingredients>
+		<directions>Pound.</directions></recipe>
+		<recipe><head><title>Water</title></head></recipe>
+		</menu></recipeml>`))
+	form.Close()
+
+	req, _ := http.NewRequest("POST", "/recipes/import/preview/", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	c.Action(c.PreviewImport).ServeHTTP(w, req)
+	page := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(page, "Import 1 recipes") ||
+		!strings.Contains(page, "Not imported: ingredientlist is required") ||
+		!strings.Contains(page, `&#34;name&#34;:&#34;Fufu&#34;`) ||
+		strings.Contains(page, `&#34;name&#34;:&#34;Water&#34;`) {
+		t.Errorf("PreviewImport() answered %d:\n%s", w.Code, page)
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// relatedLimit is how many related recipes are kept for each recipe.
+const relatedLimit = 6
+
+// relatedMinScore is the least score of a related recipe. Recipes that
+// share neither an ingredient nor a cuisine score at most 0.25, so they
+// are never related.
+const relatedMinScore = 0.3
+
+// relatedPrint is what is compared of recipes to relate them.
+type relatedPrint struct {
+	id       int
+	cuisine  int
+	mealtype int
+	season   int
+	// ingredients holds the ingredientKey of each ingredient, once
+	ingredients []string
+}
+
+func newRelatedPrint(recipe *Recipe) *relatedPrint {
+	print := &relatedPrint{id: recipe.ID, cuisine: recipe.Cuisine,
+		mealtype: recipe.Mealtype, season: recipe.Season}
+	seen := make(map[string]bool)
+	for _, ingredient := range ParseIngredients(recipe.Ingredientlist) {
+		if key := ingredientKey(ingredient); key != "" && !seen[key] {
+			seen[key] = true
+			print.ingredients = append(print.ingredients, key)
+		}
+	}
+	return print
+}
+
+// bitOverlap is the share of the bits set in a or b that are set in both.
+func bitOverlap(a, b int) float64 {
+	if a|b == 0 {
+		return 0
+	}
+	return float64(bits.OnesCount(uint(a&b))) / float64(bits.OnesCount(uint(a|b)))
+}
+
+// relatedScore scores how related two recipes are, from 0 to 1: mostly
+// by the ingredients they share, then by cuisine, meals and seasons.
+func relatedScore(a, b *relatedPrint) float64 {
+	common := 0
+	for _, x := range a.ingredients {
+		for _, y := range b.ingredients {
+			if x == y {
+				common++
+				break
+			}
+		}
+	}
+	score := 0.0
+	if common > 0 {
+		score = 0.55 * float64(common) / float64(len(a.ingredients)+len(b.ingredients)-common)
+	}
+	if a.cuisine == b.cuisine {
+		score += 0.2
+	}
+	return score + 0.15*bitOverlap(a.mealtype, b.mealtype) + 0.1*bitOverlap(a.season, b.season)
+}
+
+// RelatedScore is a related recipe's id and how related it is.
+type RelatedScore struct {
+	ID    int
+	Score float64
+}
+
+// sortRelated sorts related recipes most related first, then by id.
+func sortRelated(related []RelatedScore) {
+	sort.Slice(related, func(i, j int) bool {
+		if related[i].Score != related[j].Score {
+			return related[i].Score > related[j].Score
+		}
+		return related[i].ID < related[j].ID
+	})
+}
+
+// relatedIndex finds the recipes sharing an ingredient or a cuisine with
+// a recipe, which are the only ones that may be related to it.
+type relatedIndex struct {
+	prints []*relatedPrint
+	keys   map[string][]int
+}
+
+func newRelatedIndex(prints []*relatedPrint) *relatedIndex {
+	index := &relatedIndex{prints: prints, keys: make(map[string][]int)}
+	for i, print := range prints {
+		for _, key := range print.ingredients {
+			index.keys["ingredient:"+key] = append(index.keys["ingredient:"+key], i)
+		}
+		cuisine := "cuisine:" + strconv.Itoa(print.cuisine)
+		index.keys[cuisine] = append(index.keys[cuisine], i)
+	}
+	return index
+}
+
+// Related scores every recipe related to print, most related first.
+func (index *relatedIndex) Related(print *relatedPrint) []RelatedScore {
+	keys := []string{"cuisine:" + strconv.Itoa(print.cuisine)}
+	for _, key := range print.ingredients {
+		keys = append(keys, "ingredient:"+key)
+	}
+	seen := make(map[int]bool)
+	related := []RelatedScore{}
+	for _, key := range keys {
+		for _, i := range index.keys[key] {
+			other := index.prints[i]
+			if seen[i] || other.id == print.id {
+				continue
+			}
+			seen[i] = true
+			if score := relatedScore(print, other); score >= relatedMinScore {
+				related = append(related, RelatedScore{ID: other.id, Score: score})
+			}
+		}
+	}
+	sortRelated(related)
+	return related
+}
+
+// BuildRelated finds the related recipes of each of recipes, up to
+// relatedLimit each.
+func BuildRelated(recipes []*Recipe) map[int][]RelatedScore {
+	prints := make([]*relatedPrint, len(recipes))
+	for i, recipe := range recipes {
+		prints[i] = newRelatedPrint(recipe)
+	}
+	index := newRelatedIndex(prints)
+	related := make(map[int][]RelatedScore)
+	for _, print := range prints {
+		if scores := index.Related(print); len(scores) > 0 {
+			if len(scores) > relatedLimit {
+				scores = scores[:relatedLimit]
+			}
+			related[print.id] = scores
+		}
+	}
+	return related
+}
+
+// --------------------------------------------
+//                   DATABASE
+// --------------------------------------------
+
+// relatedColumns are the columns of recipes compared to relate them.
+const relatedColumns = `id, cuisine, mealtype, season, ingredientlist`
+
+// insertRelated adds rows of (recipe_id, related_id, score) to
+// related_recipes, a thousand to a statement. Rows already there, added
+// by a save of a related recipe at the same time, get the new score.
+func insertRelated(tx *sqlx.Tx, rows [][]interface{}) error {
+	for len(rows) > 0 {
+		batch := rows
+		if len(batch) > 1000 {
+			batch = batch[:1000]
+		}
+		rows = rows[len(batch):]
+		values := make([]string, len(batch))
+		args := make([]interface{}, 0, 3*len(batch))
+		for i, row := range batch {
+			values[i] = fmt.Sprintf("($%d,$%d,$%d)", 3*i+1, 3*i+2, 3*i+3)
+			args = append(args, row...)
+		}
+		_, err := tx.Exec(`INSERT INTO related_recipes (recipe_id, related_id, score) VALUES `+
+			strings.Join(values, ",")+` ON CONFLICT (recipe_id, related_id) `+
+			`DO UPDATE SET score=EXCLUDED.score`, args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relatedCandidates builds the query for the recipes that may be related
+// to print: those of its cuisine, and those whose ingredient list
+// mentions one of its ingredients. Ingredients are matched by their
+// first word, less a final y so that berry finds berries.
+func relatedCandidates(print *relatedPrint) (query string, args []interface{}) {
+	query = `SELECT ` + relatedColumns + ` FROM recipes WHERE id<>$1 AND (cuisine=$2`
+	args = []interface{}{print.id, print.cuisine}
+	words := []string{}
+	seen := make(map[string]bool)
+	for _, key := range print.ingredients {
+		word := strings.Fields(key)[0]
+		if strings.HasSuffix(word, "y") && len(word) > 3 {
+			word = word[:len(word)-1]
+		}
+		if !seen[word] {
+			seen[word] = true
+			words = append(words, "%"+word+"%")
+		}
+	}
+	if len(words) > 0 {
+		marks, patterns := placeholders(3, words)
+		query += ` OR ` + foldSQL("ingredientlist") + ` LIKE ANY (ARRAY[` + marks + `])`
+		args = append(args, patterns...)
+	}
+	return query + `)`, args
+}
+
+// refreshRelated finds the related recipes of the recipe with id again,
+// after it was added or changed, and puts it among the related recipes
+// of the recipes it is now more related to than their least related.
+// Recipes it is less related to than before keep what they have, minus
+// it, until RebuildRelated. Only recipes that may be related to it are
+// read.
+func refreshRelated(tx *sqlx.Tx, id int) (err error) {
+	recipe := new(Recipe)
+	err = tx.QueryRowx(`SELECT `+relatedColumns+` FROM recipes WHERE id=$1`, id).StructScan(recipe)
+	if err != nil {
+		return
+	}
+	print := newRelatedPrint(recipe)
+	var recipes []*Recipe
+	query, args := relatedCandidates(print)
+	if err = tx.Select(&recipes, query, args...); err != nil {
+		return
+	}
+	prints := make([]*relatedPrint, len(recipes))
+	for i, recipe := range recipes {
+		prints[i] = newRelatedPrint(recipe)
+	}
+	related := newRelatedIndex(prints).Related(print)
+
+	_, err = tx.Exec(`DELETE FROM related_recipes WHERE recipe_id=$1 OR related_id=$1`, id)
+	if err != nil {
+		return
+	}
+	if len(related) == 0 {
+		return
+	}
+	ids := make([]string, len(related))
+	for i, other := range related {
+		ids[i] = strconv.Itoa(other.ID)
+	}
+	var kept []struct {
+		RecipeID int `db:"recipe_id"`
+		Count    int
+		Weakest  float64
+	}
+	marks, args := placeholders(1, ids)
+	err = tx.Select(&kept, `SELECT recipe_id, count(*) AS count, min(score) AS weakest `+
+		`FROM related_recipes WHERE recipe_id IN (`+marks+`) GROUP BY recipe_id`, args...)
+	if err != nil {
+		return
+	}
+	weakest := make(map[int]float64)
+	for _, row := range kept {
+		if row.Count >= relatedLimit {
+			weakest[row.RecipeID] = row.Weakest
+		}
+	}
+	rows := [][]interface{}{}
+	for i, other := range related {
+		if i < relatedLimit {
+			rows = append(rows, []interface{}{id, other.ID, other.Score})
+		}
+		if other.Score > weakest[other.ID] {
+			rows = append(rows, []interface{}{other.ID, id, other.Score})
+		}
+	}
+	if err = insertRelated(tx, rows); err != nil {
+		return
+	}
+
+	// recipes that now relate to it may have one too many
+	_, err = tx.Exec(`DELETE FROM related_recipes r USING (SELECT recipe_id, related_id, `+
+		`row_number() OVER (PARTITION BY recipe_id ORDER BY score DESC, related_id) AS rank `+
+		`FROM related_recipes WHERE recipe_id IN `+
+		`(SELECT recipe_id FROM related_recipes WHERE related_id=$1)) ranked `+
+		`WHERE r.recipe_id=ranked.recipe_id AND r.related_id=ranked.related_id `+
+		`AND ranked.rank>$2`, id, relatedLimit)
+	return
+}
+
+// RebuildRelated finds the related recipes of every recipe again. It
+// returns how many recipes have related recipes.
+func (recipeDB *RecipeDB) RebuildRelated() (count int, err error) {
+	tx, err := recipeDB.DB.Beginx()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// nothing may change the recipes while they are compared
+	if _, err = tx.Exec(`LOCK TABLE recipes IN SHARE MODE`); err != nil {
+		return
+	}
+	var recipes []*Recipe
+	if err = tx.Select(&recipes, `SELECT `+relatedColumns+` FROM recipes`); err != nil {
+		return
+	}
+	related := BuildRelated(recipes)
+
+	if _, err = tx.Exec(`DELETE FROM related_recipes`); err != nil {
+		return
+	}
+	stmt, err := tx.Prepare(pq.CopyIn("related_recipes", "recipe_id", "related_id", "score"))
+	if err != nil {
+		return
+	}
+	for id, scores := range related {
+		for _, score := range scores {
+			if _, err = stmt.Exec(id, score.ID, score.Score); err != nil {
+				stmt.Close()
+				return
+			}
+		}
+	}
+	// an Exec without arguments ends the copy
+	if _, err = stmt.Exec(); err != nil {
+		stmt.Close()
+		return
+	}
+	if err = stmt.Close(); err != nil {
+		return
+	}
+	err = tx.Commit()
+	return len(related), err
+}
+
+// RelatedRecipe is a recipe related to another, as listed on its page.
+type RelatedRecipe struct {
+	ID          int     `json:"id"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Cuisine     int     `json:"cuisine"`
+	Mealtype    int     `json:"mealtype"`
+	Season      int     `json:"season"`
+	Score       float64 `json:"score"`
+}
+
+// RelatedRecipes is the JSON of a recipe's related recipes.
+type RelatedRecipes struct {
+	Recipe  int             `json:"recipe"`
+	Related []RelatedRecipe `json:"related"`
+}
+
+// GetRelated gets the recipes related to the recipe with id, most
+// related first.
+func (recipeDB *RecipeDB) GetRelated(id int) (related []RelatedRecipe, err error) {
+	related = []RelatedRecipe{}
+	err = recipeDB.DB.Select(&related, `SELECT r.id, r.name, r.description, r.cuisine, `+
+		`r.mealtype, r.season, x.score FROM related_recipes x `+
+		`JOIN recipes r ON r.id=x.related_id WHERE x.recipe_id=$1 `+
+		`ORDER BY x.score DESC, r.id`, id)
+	return
+}
+
+// RecipeRelated renders the recipes related to a recipe as JSON.
+func (c *RBController) RecipeRelated(w http.ResponseWriter, r *http.Request) (err error) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	if _, err = c.GetRecipe(id); err == sql.ErrNoRows {
+		if moved, err := c.redirectMerged(w, r, id); moved || err != nil {
+			return err
+		}
+		c.RenderError(w, http.StatusNotFound, "no recipe has id "+strconv.Itoa(id))
+		return nil
+	} else if err != nil {
+		return
+	}
+	related, err := c.GetRelated(id)
+	if err == nil {
+		c.JSON(w, http.StatusOK, RelatedRecipes{Recipe: id, Related: related})
+	}
+	return
+}
+
+// RelatedCommand runs `recipebox-server related`, which finds the
+// related recipes of every recipe again. It returns the exit status.
+func RelatedCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("related", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: recipebox-server related\n\n"+
+			"Finds the related recipes of every recipe again, e.g. after an import.\n")
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+	count, err := ConnectToDB().RebuildRelated()
+	if err != nil {
+		fmt.Fprintf(stderr, "related: %s\n", err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "%d recipes have related recipes.\n", count)
+	return 0
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestBuildRelated tests that recipes are related by their ingredients,
+// cuisine, meals and seasons, and that recipes sharing nothing aren't.
+func TestBuildRelated(t *testing.T) {
+	recipes := []*Recipe{
+		{ID: 1, Name: "Mafe", Cuisine: 3, Mealtype: 4, Season: 4,
+			Ingredientlist: "chicken; peanut butter; onions; tomatoes"},
+		{ID: 2, Name: "Groundnut soup", Cuisine: 3, Mealtype: 6, Season: 4,
+			Ingredientlist: "2 cups peanut butter; chicken, in pieces; onion; pepper"},
+		{ID: 3, Name: "Jollof rice", Cuisine: 3, Mealtype: 2, Season: 2,
+			Ingredientlist: "rice; tomatoes; onions"},
+		{ID: 4, Name: "Pancakes", Cuisine: 1, Mealtype: 1, Season: 1,
+			Ingredientlist: "flour; milk; eggs"},
+		{ID: 5, Name: "Crepes", Cuisine: 2, Mealtype: 1, Season: 1,
+			Ingredientlist: "flour; milk; eggs; butter"},
+	}
+	related := BuildRelated(recipes)
+	ids := func(id int) []int {
+		list := []int{}
+		for _, score := range related[id] {
+			list = append(list, score.ID)
+		}
+		return list
+	}
+	for id, expected := range map[int][]int{1: {2, 3}, 3: {1, 2}, 4: {5}, 5: {4}} {
+		if !reflect.DeepEqual(ids(id), expected) {
+			t.Errorf("BuildRelated() related recipe %d to %v, expected %v", id, ids(id), expected)
+		}
+	}
+	for id, scores := range related {
+		for _, score := range scores {
+			if score.Score < relatedMinScore || score.Score > 1 {
+				t.Errorf("BuildRelated() scored recipes %d and %d %v", id, score.ID, score.Score)
+			}
+		}
+	}
+}
+
+// TestRelatedCandidates tests that the recipes read when a recipe is
+// saved include every recipe sharing an ingredient with it, as LIKE
+// would find them in their folded ingredient lists.
+func TestRelatedCandidates(t *testing.T) {
+	saved := newRelatedPrint(&Recipe{ID: 9, Cuisine: 3,
+		Ingredientlist: "2 strawberries; peanut butter, smooth; tomato; Tomatoes"})
+	query, args := relatedCandidates(saved)
+	if !strings.Contains(query, "id<>$1 AND (cuisine=$2 OR ") ||
+		!strings.HasSuffix(query, "LIKE ANY (ARRAY[$3,$4,$5]))") {
+		t.Errorf("relatedCandidates() = %s", query)
+	}
+	expected := []interface{}{9, 3, "%strawberr%", "%peanut%", "%tomato%"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("relatedCandidates() args = %v, expected %v", args, expected)
+	}
+	for _, list := range []string{"Strawberries, hulled", "1 strawberry", "crunchy PEANUT butter",
+		"3 tomatoes", "tomate"} {
+		key := ingredientKey(list)
+		shares := false
+		for _, have := range saved.ingredients {
+			shares = shares || have == key
+		}
+		found := false
+		for _, pattern := range args[2:] {
+			found = found || strings.Contains(foldText(list), strings.Trim(pattern.(string), "%"))
+		}
+		if shares && !found {
+			t.Errorf("relatedCandidates() misses a recipe with %q", list)
+		}
+	}
+
+	query, args = relatedCandidates(newRelatedPrint(&Recipe{ID: 9, Cuisine: 3}))
+	if strings.Contains(query, "LIKE") || len(args) != 2 {
+		t.Errorf("relatedCandidates() without ingredients = %s %v", query, args)
+	}
+}
+
+// TestBuildRelatedLimit tests that only the most related recipes are
+// kept, and that the index finds every recipe that comparing all would.
+func TestBuildRelatedLimit(t *testing.T) {
+	recipes := []*Recipe{}
+	for i := 1; i <= 20; i++ {
+		ingredients := []string{"rice"}
+		for j := 0; j < i%5; j++ {
+			ingredients = append(ingredients, "spice "+string(rune('a'+j)))
+		}
+		recipes = append(recipes, &Recipe{ID: i, Cuisine: i % 3, Mealtype: i % 8,
+			Season: i % 16, Ingredientlist: strings.Join(ingredients, "; ")})
+	}
+	related := BuildRelated(recipes)
+	for _, recipe := range recipes {
+		expected := []RelatedScore{}
+		for _, other := range recipes {
+			if other == recipe {
+				continue
+			}
+			score := relatedScore(newRelatedPrint(recipe), newRelatedPrint(other))
+			if score >= relatedMinScore {
+				expected = append(expected, RelatedScore{other.ID, score})
+			}
+		}
+		sortRelated(expected)
+		if len(expected) > relatedLimit {
+			expected = expected[:relatedLimit]
+		}
+		if len(expected) == 0 {
+			expected = nil
+		}
+		if !reflect.DeepEqual(related[recipe.ID], expected) {
+			t.Errorf("BuildRelated() related recipe %d to %v, expected %v", recipe.ID,
+				related[recipe.ID], expected)
+		}
+	}
+}
+
+// TestRecipePageRelated tests that a recipe's page links its related
+// recipes.
+func TestRecipePageRelated(t *testing.T) {
+	c := &RBController{Render: NewRenderer(), RecipeDB: nil}
+	w := httptest.NewRecorder()
+	c.HTML(w, http.StatusOK, "recipes/recipe", &recipePage{Recipe: &Recipe{ID: 1, Name: "Mafe"},
+		Related: []RelatedRecipe{{ID: 2, Name: "Groundnut soup", Description: "Peanut soup"}}})
+	page := w.Body.String()
+	if !strings.Contains(page, "Related recipes") ||
+		!strings.Contains(page, `<a href="/recipes/2/">Groundnut soup</a>: Peanut soup`) {
+		t.Errorf("recipes/recipe rendered:\n%s", page)
+	}
+}
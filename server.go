@@ -9,7 +9,11 @@ import (
 	"github.com/lib/pq"
 	"github.com/unrolled/render"
 	"html/template"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
 )
 
 // GetPort retrieves the port number set in the PORT environment variable.
@@ -24,6 +28,41 @@ func GetPort() string {
 	return ":" + port
 }
 
+// GetBaseURL retrieves the site's scheme and host, such as
+// https://recipes.example.org, from the BASE_URL environment variable.
+// If BASE_URL does not exist, GetBaseURL will return localhost on PORT.
+func GetBaseURL() string {
+	baseURL := strings.TrimSuffix(os.Getenv("BASE_URL"), "/")
+	if baseURL == "" {
+		baseURL = "http://localhost" + GetPort()
+		fmt.Println("[recipebox] No BASE_URL environment variable detected. Using",
+			baseURL)
+	}
+	if u, err := url.Parse(baseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+		u.Host == "" || u.Path != "" {
+		panic("[recipebox] BASE_URL must be a scheme and host, like https://recipes.example.org")
+	}
+	return baseURL
+}
+
+// ServeGRPC serves the gRPC service on the port in the GRPC_PORT
+// environment variable, in the background. Without GRPC_PORT, gRPC is off.
+func ServeGRPC(c *RBController) {
+	port := os.Getenv("GRPC_PORT")
+	if port == "" {
+		return
+	}
+	// gRPC needs HTTP/2, which without TLS is only spoken when asked for
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{Addr: ":" + port, Handler: c.GRPCHandler(),
+		Protocols: protocols}
+	go func() {
+		fmt.Println("[recipebox] serving gRPC on port", port)
+		panic(server.ListenAndServe())
+	}()
+}
+
 // ConnectToDB connects to a postgres database.
 // The database path should be stored in the DATABASE_URL environment var
 func ConnectToDB() (recipedb *RecipeDB) {
@@ -54,47 +93,302 @@ func ConnectToDB() (recipedb *RecipeDB) {
 	return
 }
 
-func main() {
-	// Connect to a database, get a *RecipeDB object
-	recipedb := ConnectToDB()
+// GetSessions sets up cookie sessions. Cookies are signed with the
+// SESSION_SECRET environment variable, and session values are kept in
+// the store named by SESSION_STORE: "memory" (the default) or "postgres".
+// Set SESSION_SECURE=1 when serving over HTTPS.
+func GetSessions(recipedb *RecipeDB) *Sessions {
+	secret := os.Getenv("SESSION_SECRET")
+	if secret == "" {
+		var err error
+		if secret, err = randomToken(32); err != nil {
+			panic(fmt.Sprintf("[recipebox] Unable to make a session secret.  Error %v",
+				err.Error()))
+		}
+		fmt.Println("[recipebox] No SESSION_SECRET environment variable detected.",
+			"Sessions will not survive a restart.")
+	}
 
-	// Some helper functions for our renderer
-	recipesHelper := template.FuncMap{
-		"ParseIngredients": ParseIngredients,
-		"ParseMeal":        ParseMealtype,
-		"ParseSeason":      ParseSeason,
+	var store SessionStore
+	switch os.Getenv("SESSION_STORE") {
+	case "postgres":
+		store = &PostgresSessionStore{DB: recipedb.DB}
+	case "", "memory":
+		store = NewMemorySessionStore()
+	default:
+		panic("[recipebox] SESSION_STORE must be memory or postgres. Please see README.")
 	}
 
-	// Set up renderer.  Default template is templates/layout.tmpl
-	renderer := render.New(render.Options{
+	sessions := NewSessions(store, []byte(secret))
+	sessions.Secure = os.Getenv("SESSION_SECURE") == "1"
+	return sessions
+}
+
+// rateLimitGroups are the route groups with rate limits, and their
+// default limits.
+var rateLimitGroups = map[string]string{
+	"search":   "30/m",
+	"api":      "120/m",
+	"login":    "10/m,5",
+	"cookbook": "20/h",
+}
+
+// GetRateLimiter sets up per-client rate limits. Each group's limit may
+// be changed with a RATE_LIMIT_<GROUP> environment variable such as
+// RATE_LIMIT_SEARCH=60/m, or turned off with RATE_LIMIT_SEARCH=off.
+// RATE_LIMIT_STORE chooses where buckets are kept, "memory" (the
+// default) or "postgres".
+func GetRateLimiter(recipedb *RecipeDB) *RateLimiter {
+	limiter := &RateLimiter{Groups: make(map[string]RateLimit)}
+	for group, spec := range rateLimitGroups {
+		if env := os.Getenv("RATE_LIMIT_" + strings.ToUpper(group)); env != "" {
+			spec = env
+		}
+		if spec == "off" {
+			continue
+		}
+		limit, err := ParseRateLimit(spec)
+		if err != nil {
+			panic(fmt.Sprintf("[recipebox] Bad rate limit for %v.  Error %v",
+				group, err.Error()))
+		}
+		limiter.Groups[group] = limit
+	}
+
+	switch os.Getenv("RATE_LIMIT_STORE") {
+	case "postgres":
+		limiter.Store = &PostgresRateStore{DB: recipedb.DB}
+	case "", "memory":
+		limiter.Store = NewMemoryRateStore()
+	default:
+		panic("[recipebox] RATE_LIMIT_STORE must be memory or postgres. Please see README.")
+	}
+	return limiter
+}
+
+// Some helper functions for our renderer
+var recipesHelper = template.FuncMap{
+	"ParseIngredients": ParseIngredients,
+	"ParseMeal":        ParseMealtype,
+	"ParseSeason":      ParseSeason,
+	"PageHead":         PageHead,
+}
+
+// PageHead returns the extra head tags of a page whose binding has a
+// Head method, as recipe pages do.
+func PageHead(binding interface{}) template.HTML {
+	if page, ok := binding.(interface {
+		Head() template.HTML
+	}); ok {
+		return page.Head()
+	}
+	return ""
+}
+
+// NewRenderer sets up the renderer used by the controller.
+// Default template is templates/layout.tmpl
+func NewRenderer() *render.Render {
+	return render.New(render.Options{
 		Layout: "layout",
 		Funcs: []template.FuncMap{
 			recipesHelper,
 		},
 	})
+}
 
-	// Set up the controller. The controller is responsible for
-	// rendering, database queries, and handling requests
-	c := &RBController{Render: renderer, RecipeDB: recipedb}
+// APIRoute is a route of the JSON API, with an action for each method
+// it allows. Every APIRoute is described in webroot/api/openapi.json.
+type APIRoute struct {
+	Path    string
+	Actions map[string]Action
+}
+
+// apiMethods is the order methods are registered and listed in.
+var apiMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
 
-	// Set up the router and associate routes with the controller
+// register adds the route to a router. GET actions also answer HEAD,
+// and other methods get a 405.
+func (route APIRoute) register(c *RBController, router *mux.Router) {
+	allowed := []string{}
+	for _, method := range apiMethods {
+		a, ok := route.Actions[method]
+		if !ok {
+			continue
+		}
+		methods := []string{method}
+		if method == "GET" {
+			methods = append(methods, "HEAD")
+		}
+		allowed = append(allowed, methods...)
+		router.HandleFunc(route.Path, c.APIAction(a)).Methods(methods...)
+	}
+	router.HandleFunc(route.Path,
+		c.APIAction(c.MethodNotAllowed(strings.Join(allowed, ", "))))
+}
+
+// APIRoutes lists the routes of the JSON API.
+func (c *RBController) APIRoutes() []APIRoute {
+	return []APIRoute{
+		{"/recipes/jsonsearch/", map[string]Action{
+			"GET":  c.Throttle("search", c.RecipeJSONAdvanced),
+			"POST": c.Throttle("search", c.RecipeJSONAdvanced),
+		}},
+		{"/recipes/{id:[0-9]+}/json/", map[string]Action{
+			"GET": c.Throttle("api", c.RecipeJSON),
+		}},
+		{"/recipes/{id:[0-9]+}/jsonld/", map[string]Action{
+			"GET": c.Throttle("api", c.RecipeJSONLD),
+		}},
+		{"/recipes/{id:[0-9]+}/related/", map[string]Action{
+			"GET": c.Throttle("api", c.RecipeRelated),
+		}},
+		{"/api/v1/recipes", map[string]Action{
+			"GET": c.Throttle("api", c.APIRecipes),
+			"POST": c.Throttle("api", c.Require(RoleContributor,
+				c.CheckCSRF(c.APICreateRecipe))),
+		}},
+		{"/api/v1/recipes/pantry", map[string]Action{
+			"GET": c.Throttle("search", c.PantryJSON),
+		}},
+		{"/api/v1/recipes/import", map[string]Action{
+			"POST": c.Throttle("api", c.Require(RoleContributor,
+				c.CheckCSRF(c.APIImportRecipe))),
+		}},
+		{"/api/v1/recipes/{id:[0-9]+}", map[string]Action{
+			"GET": c.Throttle("api", c.APIRecipe),
+			"PUT": c.Throttle("api", c.Require(RoleContributor,
+				c.CheckCSRF(c.APIReplaceRecipe))),
+			"PATCH": c.Throttle("api", c.Require(RoleContributor,
+				c.CheckCSRF(c.APIPatchRecipe))),
+			"DELETE": c.Throttle("api", c.Require(RoleContributor,
+				c.CheckCSRF(c.APIDeleteRecipe))),
+		}},
+		{"/graphql", map[string]Action{
+			"GET":  c.Throttle("api", c.GraphQL),
+			"POST": c.Throttle("api", c.GraphQL),
+		}},
+		{"/stats/", map[string]Action{
+			"GET": c.Throttle("api", c.StatsJSON),
+		}},
+		{"/admin/audit/export/", map[string]Action{
+			"GET": c.Throttle("api", c.Require(RoleAdmin, c.AdminAuditExport)),
+		}},
+	}
+}
+
+// PageRoute is a route of the HTML pages and the downloads that aren't
+// JSON, which is only ever answered by an APIRoute. With no Methods it
+// answers any method.
+type PageRoute struct {
+	Path    string
+	Methods []string
+	Action  Action
+}
+
+// PageRoutes lists the routes of everything but the JSON API, in the
+// order they are matched.
+func (c *RBController) PageRoutes() []PageRoute {
+	post := []string{"POST"}
+	return []PageRoute{
+		{"/recipes/{id:[0-9]+}/edit/", nil, c.Require(RoleContributor, c.EditRecipe)},
+		{"/recipes/{id:[0-9]+}/save/", post,
+			c.Require(RoleContributor, c.CheckCSRF(c.SaveRecipe))},
+		{"/recipes/{id:[0-9]+}/", nil, c.Recipe},
+		{"/recipes/{id:[0-9]+}/pdf/", nil, c.Throttle("api", c.RecipePDF)},
+		{"/recipes/{id:[0-9]+}/{format:md|txt}/", nil, c.Throttle("api", c.RecipeExport)},
+		{"/recipes/epub/", nil, c.Throttle("search", c.RecipesEPUBExport)},
+		{"/recipes/pantry/", nil, c.Throttle("search", c.Pantry)},
+		{"/recipes/new/save/", post,
+			c.Require(RoleContributor, c.CheckCSRF(c.SaveRecipe))},
+		{"/recipes/new/", nil, c.Require(RoleContributor, c.NewRecipe)},
+		{"/recipes/import/preview/", post,
+			c.Require(RoleContributor, c.CheckCSRF(c.PreviewImport))},
+		{"/recipes/import/save/", post,
+			c.Require(RoleContributor, c.CheckCSRF(c.SaveImport))},
+		{"/recipes/import/", nil, c.Require(RoleContributor, c.ImportRecipesForm)},
+		{"/recipes/", nil, c.Throttle("search", c.Recipes)},
+		{"/cookbooks/new/", post,
+			c.Require(RoleViewer, c.CheckCSRF(c.Throttle("cookbook", c.NewCookbook)))},
+		{"/cookbooks/{id:[A-Za-z0-9_-]+}/pdf/", nil, c.CookbookPDF},
+		{"/cookbooks/{id:[A-Za-z0-9_-]+}/", nil, c.Cookbook},
+		{"/admin/users/{id:[0-9]+}/role/", post,
+			c.Require(RoleAdmin, c.CheckCSRF(c.SaveUserRole))},
+		{"/admin/users/", nil, c.Require(RoleAdmin, c.AdminUsers)},
+		{"/admin/audit/", nil, c.Require(RoleAdmin, c.AdminAudit)},
+		{"/admin/duplicates/merge/", post,
+			c.Require(RoleEditor, c.CheckCSRF(c.MergeRecipes))},
+		{"/admin/duplicates/", nil, c.Require(RoleEditor, c.AdminDuplicates)},
+		{"/account/tokens/{id:[0-9]+}/revoke/", post,
+			c.Require(RoleViewer, c.CheckCSRF(c.RevokeAPIToken))},
+		{"/account/tokens/new/", post,
+			c.Require(RoleViewer, c.CheckCSRF(c.SaveAPIToken))},
+		{"/account/tokens/", nil, c.Require(RoleViewer, c.APITokens)},
+		{"/register/save/", post,
+			c.Throttle("login", c.CheckCSRF(c.SaveRegistration))},
+		{"/register/", nil, c.Register},
+		{"/login/save/", post, c.Throttle("login", c.CheckCSRF(c.SaveLogin))},
+		{"/login/", nil, c.Login},
+		{"/logout/", post, c.CheckCSRF(c.Logout)},
+		{"/about/", nil, c.About},
+		{"/contact/", nil, c.Contact},
+		{"/index/", nil, c.Home},
+		{"/", nil, c.Home},
+		{"/{path:.+}", nil, c.Static},
+	}
+}
+
+// Router sets up the router and associates routes with the controller.
+// The JSON API comes first, and anything unrouted is served from webroot,
+// including the API's description at /api/openapi.json.
+func (c *RBController) Router() *mux.Router {
 	router := mux.NewRouter()
-	router.HandleFunc("/recipes/jsonsearch/", c.Action(c.RecipeJSONAdvanced))
-	router.HandleFunc("/recipes/{id:[0-9]+}/json/", c.Action(c.RecipeJSON))
-	router.HandleFunc("/recipes/{id:[0-9]+}/edit/", c.Action(c.EditRecipe))
-	router.HandleFunc("/recipes/{id:[0-9]+}/save/", c.Action(c.SaveRecipe))
-	router.HandleFunc("/recipes/{id:[0-9]+}/", c.Action(c.Recipe))
-	router.HandleFunc("/recipes/new/save/", c.Action(c.SaveRecipe))
-	router.HandleFunc("/recipes/new/", c.Action(c.NewRecipe))
-	router.HandleFunc("/about/", c.Action(c.About))
-	router.HandleFunc("/contact/", c.Action(c.Contact))
-	router.HandleFunc("/index/", c.Action(c.Home))
-	router.HandleFunc("/", c.Action(c.Home))
-	router.HandleFunc("/{path:.+}", c.Action(c.Static))
+	for _, route := range c.APIRoutes() {
+		route.register(c, router)
+	}
+	for _, route := range c.PageRoutes() {
+		r := router.HandleFunc(route.Path, c.Action(route.Action))
+		if route.Methods != nil {
+			r.Methods(route.Methods...)
+		}
+	}
+	return router
+}
+
+// commands are the commands recipebox-server runs instead of serving,
+// given as its first argument. Each returns the exit status.
+var commands = map[string]func(args []string, stdout, stderr io.Writer) int{
+	"import":  ImportCommand,
+	"export":  ExportCommand,
+	"restore": RestoreCommand,
+	"related": RelatedCommand,
+}
+
+func main() {
+	// commands such as `recipebox-server import` run and exit
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
+	// Connect to a database, get a *RecipeDB object
+	recipedb := ConnectToDB()
+
+	// Set up renderer.  Default template is templates/layout.tmpl
+	renderer := NewRenderer()
+
+	// Set up the controller. The controller is responsible for
+	// rendering, database queries, and handling requests
+	c := &RBController{Render: renderer, RecipeDB: recipedb,
+		Sessions: GetSessions(recipedb), Limiter: GetRateLimiter(recipedb),
+		Stats: NewStatsCache(recipedb), Cookbooks: NewCookbookQueue(recipedb, 2),
+		TrustProxy: os.Getenv("TRUST_PROXY") == "1", BaseURL: GetBaseURL()}
 
 	// Setting up middleware (server, logging layer)
 	n := negroni.Classic()
-	n.UseHandler(router)
+	n.UseHandler(c.Router())
+
+	ServeGRPC(c)
 
 	// Run on specified port
 	n.Run(GetPort())
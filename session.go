@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/context"
+	"github.com/jmoiron/sqlx"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SessionCookie is the name of the cookie holding the signed session id.
+const SessionCookie = "recipebox_session"
+
+var errNoSessions = errors.New("sessions are not enabled")
+
+// Session holds per-visitor state between requests. Only the session id
+// is sent to the browser; the values live in a SessionStore.
+type Session struct {
+	ID     string
+	Values map[string]string
+}
+
+// SessionStore keeps session values on the server, keyed by session id.
+// Load returns nil values, and no error, for unknown or expired sessions.
+type SessionStore interface {
+	Load(id string) (values map[string]string, err error)
+	Save(id string, values map[string]string, expires time.Time) error
+	Delete(id string) error
+}
+
+// Sessions issues signed session cookies and keeps their values in Store.
+type Sessions struct {
+	Store  SessionStore
+	Secret []byte
+	MaxAge time.Duration
+	Secure bool
+}
+
+// NewSessions makes a session manager with a thirty day lifetime.
+func NewSessions(store SessionStore, secret []byte) *Sessions {
+	return &Sessions{Store: store, Secret: secret, MaxAge: 30 * 24 * time.Hour}
+}
+
+// randomToken returns n random bytes encoded for use in URLs and cookies.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// sign returns the signed form of a session id, id.signature
+func (s *Sessions) sign(id string) string {
+	mac := hmac.New(sha256.New, s.Secret)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks a signed session id and returns the id if it is valid.
+func (s *Sessions) verify(signed string) (id string, ok bool) {
+	i := strings.LastIndex(signed, ".")
+	if i < 0 {
+		return "", false
+	}
+	id = signed[:i]
+	return id, hmac.Equal([]byte(signed), []byte(s.sign(id)))
+}
+
+// New makes an empty session with a fresh id. It is not stored until
+// Save is called.
+func (s *Sessions) New() (*Session, error) {
+	id, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{ID: id, Values: make(map[string]string)}, nil
+}
+
+// Get returns the session belonging to a request, or nil if the request
+// has no valid session cookie.
+func (s *Sessions) Get(r *http.Request) (*Session, error) {
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return nil, nil
+	}
+	id, ok := s.verify(cookie.Value)
+	if !ok {
+		return nil, nil
+	}
+	values, err := s.Store.Load(id)
+	if err != nil || values == nil {
+		return nil, err
+	}
+	return &Session{ID: id, Values: values}, nil
+}
+
+// Save stores the session and sends its cookie. Call it before the
+// response body is written.
+func (s *Sessions) Save(w http.ResponseWriter, session *Session) error {
+	expires := time.Now().Add(s.MaxAge)
+	if err := s.Store.Save(session.ID, session.Values, expires); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    s.sign(session.ID),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   s.Secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// Renew moves a session's values to a fresh id, so that an id seen
+// before logging in can't be used afterwards.
+func (s *Sessions) Renew(w http.ResponseWriter, session *Session) error {
+	if err := s.Store.Delete(session.ID); err != nil {
+		return err
+	}
+	fresh, err := s.New()
+	if err != nil {
+		return err
+	}
+	session.ID = fresh.ID
+	return s.Save(w, session)
+}
+
+// Destroy deletes the session and clears its cookie.
+func (s *Sessions) Destroy(w http.ResponseWriter, session *Session) error {
+	if err := s.Store.Delete(session.ID); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.Secure,
+	})
+	return nil
+}
+
+// Session returns the request's session, starting a new one if the
+// request doesn't have one yet. Call it before the response body is
+// written.
+func (c *RBController) Session(w http.ResponseWriter, r *http.Request) (*Session, error) {
+	if c.Sessions == nil {
+		return nil, errNoSessions
+	}
+	session, err := c.existingSession(r)
+	if err != nil || session != nil {
+		return session, err
+	}
+	if session, err = c.Sessions.New(); err != nil {
+		return nil, err
+	}
+	if err = c.Sessions.Save(w, session); err != nil {
+		return nil, err
+	}
+	context.Set(r, sessionKey, session)
+	return session, nil
+}
+
+// existingSession returns the request's session, or nil if it has none.
+func (c *RBController) existingSession(r *http.Request) (*Session, error) {
+	if c.Sessions == nil {
+		return nil, nil
+	}
+	if cached, ok := context.GetOk(r, sessionKey); ok {
+		return cached.(*Session), nil
+	}
+	session, err := c.Sessions.Get(r)
+	if err == nil && session != nil {
+		context.Set(r, sessionKey, session)
+	}
+	return session, err
+}
+
+// --------------------------------------------
+//                SESSION STORES
+// --------------------------------------------
+
+// MemorySessionStore keeps sessions in memory. Sessions are lost when the
+// server restarts and aren't shared between server instances.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]memorySession
+	swept    time.Time
+	now      func() time.Time
+}
+
+type memorySession struct {
+	values  map[string]string
+	expires time.Time
+}
+
+// NewMemorySessionStore makes an empty MemorySessionStore.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]memorySession), now: time.Now}
+}
+
+// Load implements SessionStore.
+func (store *MemorySessionStore) Load(id string) (map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	session, ok := store.sessions[id]
+	if !ok {
+		return nil, nil
+	}
+	if store.now().After(session.expires) {
+		delete(store.sessions, id)
+		return nil, nil
+	}
+	values := make(map[string]string, len(session.values))
+	for k, v := range session.values {
+		values[k] = v
+	}
+	return values, nil
+}
+
+// Save implements SessionStore.
+func (store *MemorySessionStore) Save(id string, values map[string]string,
+	expires time.Time) error {
+	copied := make(map[string]string, len(values))
+	for k, v := range values {
+		copied[k] = v
+	}
+	store.mu.Lock()
+	store.sweep(store.now())
+	store.sessions[id] = memorySession{values: copied, expires: expires}
+	store.mu.Unlock()
+	return nil
+}
+
+// sweep drops expired sessions, about once a minute, so that sessions
+// started by clients that never come back don't pile up.
+func (store *MemorySessionStore) sweep(now time.Time) {
+	if now.Sub(store.swept) < time.Minute {
+		return
+	}
+	for id, session := range store.sessions {
+		if now.After(session.expires) {
+			delete(store.sessions, id)
+		}
+	}
+	store.swept = now
+}
+
+// Delete implements SessionStore.
+func (store *MemorySessionStore) Delete(id string) error {
+	store.mu.Lock()
+	delete(store.sessions, id)
+	store.mu.Unlock()
+	return nil
+}
+
+// PostgresSessionStore keeps sessions in the sessions table, so they
+// survive restarts and are shared by every server instance.
+type PostgresSessionStore struct {
+	DB *sqlx.DB
+
+	mu    sync.Mutex
+	swept time.Time
+}
+
+// Load implements SessionStore.
+func (store *PostgresSessionStore) Load(id string) (map[string]string, error) {
+	var data string
+	err := store.DB.QueryRowx(
+		"SELECT data FROM sessions WHERE id=$1 AND expires > now()", id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	err = json.Unmarshal([]byte(data), &values)
+	return values, err
+}
+
+// Save implements SessionStore.
+func (store *PostgresSessionStore) Save(id string, values map[string]string,
+	expires time.Time) error {
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	upsert := `INSERT INTO sessions (id, data, expires) VALUES ($1,$2,$3) ` +
+		`ON CONFLICT (id) DO UPDATE SET data=$2, expires=$3`
+	if _, err = store.DB.Exec(upsert, id, string(data), expires); err != nil {
+		return err
+	}
+	return store.sweep()
+}
+
+// sweep deletes expired sessions, about every ten minutes, so the table
+// doesn't grow without bound.
+func (store *PostgresSessionStore) sweep() error {
+	store.mu.Lock()
+	due := time.Since(store.swept) > 10*time.Minute
+	if due {
+		store.swept = time.Now()
+	}
+	store.mu.Unlock()
+	if !due {
+		return nil
+	}
+	_, err := store.DB.Exec("DELETE FROM sessions WHERE expires < now()")
+	return err
+}
+
+// Delete implements SessionStore.
+func (store *PostgresSessionStore) Delete(id string) error {
+	_, err := store.DB.Exec("DELETE FROM sessions WHERE id=$1", id)
+	return err
+}
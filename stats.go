@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Stats are aggregate numbers about the recipe box, shown on the home
+// page and at /stats/.
+type Stats struct {
+	Recipes    int            `json:"recipes"`
+	Volunteers int            `json:"volunteers"`
+	Countries  int            `json:"countries"`
+	Years      int            `json:"years"`
+	ByCuisine  map[int]int    `json:"by_cuisine"`
+	ByCountry  map[string]int `json:"by_country"`
+	BySeason   map[string]int `json:"by_season"`
+	Updated    time.Time      `json:"updated"`
+}
+
+// StatsCache keeps the most recent Stats, recomputing them when they are
+// older than TTL or after Invalidate is called.
+type StatsCache struct {
+	RecipeDB *RecipeDB
+	TTL      time.Duration
+
+	mu    sync.Mutex
+	stats *Stats
+}
+
+// NewStatsCache makes a StatsCache which refreshes every ten minutes.
+func NewStatsCache(recipeDB *RecipeDB) *StatsCache {
+	return &StatsCache{RecipeDB: recipeDB, TTL: 10 * time.Minute}
+}
+
+// Get returns the cached stats, recomputing them if need be.
+func (cache *StatsCache) Get() (*Stats, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.stats != nil && time.Since(cache.stats.Updated) < cache.TTL {
+		return cache.stats, nil
+	}
+	stats, err := cache.RecipeDB.GetStats()
+	if err != nil {
+		return nil, err
+	}
+	cache.stats = stats
+	return stats, nil
+}
+
+// Invalidate throws away the cached stats, so the next Get recomputes
+// them. Call it after changing recipes.
+func (cache *StatsCache) Invalidate() {
+	if cache == nil {
+		return
+	}
+	cache.mu.Lock()
+	cache.stats = nil
+	cache.mu.Unlock()
+}
+
+// formatCount formats n with commas between thousands, e.g. 200,000.
+func formatCount(n int) string {
+	if n < 0 {
+		return "-" + formatCount(-n)
+	}
+	s := strconv.Itoa(n)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Role is a user's permission level. Roles are ordered, so a user
+// holding a role may do everything the roles below it may do.
+type Role int
+
+// The roles, from least to most privileged.
+const (
+	RoleViewer Role = iota + 1
+	RoleContributor
+	RoleEditor
+	RoleModerator
+	RoleAdmin
+)
+
+// DefaultRole is the role given to newly registered users.
+const DefaultRole = RoleContributor
+
+// constants in map form
+var (
+	Roles = map[Role]string{
+		RoleViewer:      "Viewer",
+		RoleContributor: "Contributor",
+		RoleEditor:      "Editor",
+		RoleModerator:   "Moderator",
+		RoleAdmin:       "Admin",
+	}
+	RolesToInt = map[string]Role{
+		"Viewer":      RoleViewer,
+		"Contributor": RoleContributor,
+		"Editor":      RoleEditor,
+		"Moderator":   RoleModerator,
+		"Admin":       RoleAdmin,
+	}
+)
+
+// String returns the display name of a role.
+func (role Role) String() string {
+	if name, ok := Roles[role]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+// Includes reports whether a user holding role may act as required.
+func (role Role) Includes(required Role) bool {
+	return role >= required
+}
+
+// User represents a registered user.
+type User struct {
+	ID       int       `json:"id"`
+	Email    string    `json:"email"`
+	Name     string    `json:"name"`
+	Password string    `json:"-"`
+	Role     Role      `json:"role"`
+	Created  time.Time `json:"created"`
+}
+
+// CanEdit reports whether the user may edit the given recipe.
+// Editors and above may edit any recipe; contributors only their own.
+func (user *User) CanEdit(recipe *Recipe) bool {
+	if user == nil {
+		return false
+	}
+	if user.Role.Includes(RoleEditor) {
+		return true
+	}
+	return user.Role.Includes(RoleContributor) && recipe.Owner == user.ID
+}
+
+// password hashing parameters
+const (
+	passwordScheme     = "pbkdf2-sha256"
+	passwordIterations = 100000
+	passwordSaltLen    = 16
+	passwordKeyLen     = 32
+)
+
+var errBadPasswordHash = errors.New("malformed password hash")
+
+// HashPassword returns a salted hash of password suitable for storage.
+// The result has the form scheme$iterations$salt$key.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations,
+		passwordKeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", passwordScheme, passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPassword reports whether password matches a hash produced
+// by HashPassword.
+func CheckPassword(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return false, errBadPasswordHash
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false, errBadPasswordHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false, errBadPasswordHash
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false, errBadPasswordHash
+	}
+	got, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
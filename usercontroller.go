@@ -0,0 +1,310 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// minPasswordLen is the shortest password accepted at registration.
+const minPasswordLen = 8
+
+// AdminUsers lists every user along with a form to change their role.
+func (c *RBController) AdminUsers(w http.ResponseWriter, r *http.Request) (err error) {
+	users, err := c.GetUsers()
+	if err != nil {
+		return
+	}
+	current, err := c.CurrentUser(r)
+	if err != nil {
+		return
+	}
+	data := struct {
+		Users   []*User
+		Current *User
+		Roles   map[Role]string
+	}{
+		users,
+		current,
+		Roles,
+	}
+	c.HTML(w, http.StatusOK, "admin/users", data)
+	return nil
+}
+
+// APITokens lists the user's API tokens along with a form to create
+// new ones.
+func (c *RBController) APITokens(w http.ResponseWriter, r *http.Request) (err error) {
+	return c.renderAPITokens(w, r, http.StatusOK, "", "")
+}
+
+// renderAPITokens renders the token management page. secret is shown
+// once, right after a token is created.
+func (c *RBController) renderAPITokens(w http.ResponseWriter, r *http.Request,
+	status int, secret, msg string) (err error) {
+	user, err := c.CurrentUser(r)
+	if err != nil {
+		return
+	}
+	tokens, err := c.GetAPITokens(user.ID)
+	if err != nil {
+		return
+	}
+	data := struct {
+		Tokens []*APIToken
+		Secret string
+		Error  string
+	}{
+		tokens,
+		secret,
+		msg,
+	}
+	c.HTML(w, status, "users/tokens", data)
+	return nil
+}
+
+// SaveAPIToken takes a POST request from the /account/tokens/ form and
+// creates a new token. The token itself is shown once and never stored.
+func (c *RBController) SaveAPIToken(w http.ResponseWriter, r *http.Request) (err error) {
+	if !c.sessionOnly(w, r) {
+		return nil
+	}
+	user, err := c.CurrentUser(r)
+	if err != nil {
+		return
+	}
+
+	name := strings.TrimSpace(r.PostFormValue(`name`))
+	scope := r.PostFormValue(`scope`)
+	if name == "" || (scope != ScopeRead && scope != ScopeWrite) {
+		return c.renderAPITokens(w, r, http.StatusBadRequest, "",
+			"Please name your token and choose read or write access.")
+	}
+
+	secret, err := NewAPITokenSecret()
+	if err != nil {
+		return
+	}
+	token := APIToken{UserID: user.ID, Name: name, Scope: scope,
+		Hash: HashAPIToken(secret)}
+	if _, err = c.NewAPIToken(&token); err != nil {
+		return
+	}
+	return c.renderAPITokens(w, r, http.StatusCreated, secret, "")
+}
+
+// RevokeAPIToken takes a POST request from the /account/tokens/ page
+// and deletes one of the user's tokens.
+func (c *RBController) RevokeAPIToken(w http.ResponseWriter, r *http.Request) (err error) {
+	if !c.sessionOnly(w, r) {
+		return nil
+	}
+	user, err := c.CurrentUser(r)
+	if err != nil {
+		return
+	}
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	found, err := c.DeleteAPIToken(id, user.ID)
+	if err != nil {
+		return
+	} else if !found {
+		c.RenderError(w, 404, "Sorry, that token wasn't found")
+		return nil
+	}
+	http.Redirect(w, r, "/account/tokens/", http.StatusFound)
+	return nil
+}
+
+// sessionOnly turns away requests made with an API token, so that a
+// leaked token can't be used to mint or revoke others. It reports
+// whether the request may go ahead.
+func (c *RBController) sessionOnly(w http.ResponseWriter, r *http.Request) bool {
+	if token, _ := c.CurrentToken(r); token != nil {
+		c.RenderError(w, http.StatusForbidden,
+			"Sorry, API tokens can only be managed after logging in.")
+		return false
+	}
+	return true
+}
+
+// Login serves the login form, or a logout button to users who are
+// already logged in.
+func (c *RBController) Login(w http.ResponseWriter, r *http.Request) (err error) {
+	user, err := c.CurrentUser(r)
+	if err != nil {
+		return
+	}
+	c.renderLogin(w, http.StatusOK, user, r.FormValue(`next`), "", "")
+	return nil
+}
+
+// renderLogin renders the login form with an optional error.
+func (c *RBController) renderLogin(w http.ResponseWriter, status int,
+	user *User, next, email, msg string) {
+	data := struct {
+		User  *User
+		Next  string
+		Email string
+		Error string
+	}{
+		user,
+		next,
+		email,
+		msg,
+	}
+	c.HTML(w, status, "users/login", data)
+}
+
+// SaveLogin takes a POST request from the /login/ form and logs the
+// user in to their session.
+func (c *RBController) SaveLogin(w http.ResponseWriter, r *http.Request) (err error) {
+	email := strings.TrimSpace(r.PostFormValue(`email`))
+	next := r.PostFormValue(`next`)
+
+	user, err := c.checkLogin(email, r.PostFormValue(`password`))
+	if err != nil {
+		return
+	}
+	if user == nil {
+		c.renderLogin(w, http.StatusUnauthorized, nil, next, email,
+			"Sorry, that email and password don't match.")
+		return nil
+	}
+
+	// start over with a fresh session id and CSRF token
+	session, err := c.Session(w, r)
+	if err != nil {
+		return
+	}
+	session.Values[sessionUserKey] = strconv.Itoa(user.ID)
+	delete(session.Values, csrfKey)
+	if err = c.Sessions.Renew(w, session); err != nil {
+		return
+	}
+
+	http.Redirect(w, r, localRedirect(next), http.StatusFound)
+	return nil
+}
+
+// localRedirect is next if it is a path on this site, or else "/".
+// Browsers read a backslash as a slash and drop tabs and newlines, so
+// "/\host" and "/\t/host" leave the site just as "//host" does.
+func localRedirect(next string) string {
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || !strings.HasPrefix(next, "/") ||
+		strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") ||
+		strings.ContainsAny(next, "\t\r\n") {
+		return "/"
+	}
+	return next
+}
+
+// Logout takes a POST request and ends the user's session.
+func (c *RBController) Logout(w http.ResponseWriter, r *http.Request) (err error) {
+	session, err := c.existingSession(r)
+	if err != nil {
+		return
+	}
+	if session != nil {
+		if err = c.Sessions.Destroy(w, session); err != nil {
+			return
+		}
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
+}
+
+// Register serves the registration form.
+func (c *RBController) Register(w http.ResponseWriter, r *http.Request) (err error) {
+	c.renderRegister(w, http.StatusOK, "", "", "")
+	return nil
+}
+
+// renderRegister renders the registration form with an optional error.
+func (c *RBController) renderRegister(w http.ResponseWriter, status int,
+	email, name, msg string) {
+	data := map[string]string{
+		"email":     email,
+		"name":      name,
+		"error_msg": msg,
+	}
+	c.HTML(w, status, "users/register", data)
+}
+
+// SaveRegistration takes a POST request from the /register/ form and
+// creates a new user with the default role.
+func (c *RBController) SaveRegistration(w http.ResponseWriter, r *http.Request) (err error) {
+	email := strings.TrimSpace(r.PostFormValue(`email`))
+	name := strings.TrimSpace(r.PostFormValue(`name`))
+	password := r.PostFormValue(`password`)
+
+	if !strings.Contains(email, "@") || name == "" {
+		c.renderRegister(w, http.StatusBadRequest, email, name,
+			"Please enter your name and a valid email address.")
+		return nil
+	}
+	if len(password) < minPasswordLen {
+		c.renderRegister(w, http.StatusBadRequest, email, name,
+			"Passwords must be at least "+strconv.Itoa(minPasswordLen)+
+				" characters long.")
+		return nil
+	}
+
+	_, err = c.GetUserByEmail(email)
+	if err == nil {
+		c.renderRegister(w, http.StatusConflict, email, name,
+			"An account with that email address already exists.")
+		return nil
+	} else if err != sql.ErrNoRows {
+		return
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return
+	}
+	user := User{Email: email, Name: name, Password: hash, Role: DefaultRole}
+	if _, err = c.RecipeDB.NewUser(&user); err == nil {
+		http.Redirect(w, r, "/login/", http.StatusFound)
+	}
+	return
+}
+
+// SaveUserRole takes a POST request from the /admin/users/ page and
+// changes a user's role.
+func (c *RBController) SaveUserRole(w http.ResponseWriter, r *http.Request) (err error) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+	role, ok := RolesToInt[r.PostFormValue(`role`)]
+	if !ok {
+		c.RenderError(w, http.StatusBadRequest, "Sorry, that role doesn't exist.")
+		return nil
+	}
+
+	// admins may not change their own role, so there is always one left
+	current, err := c.CurrentUser(r)
+	if err != nil {
+		return
+	}
+	if current.ID == id {
+		c.RenderError(w, http.StatusBadRequest,
+			"Sorry, you can't change your own role.")
+		return nil
+	}
+
+	_, err = c.GetUser(id)
+	if err == sql.ErrNoRows {
+		c.RenderError(w, 404, "Sorry, that user wasn't found")
+		return nil
+	} else if err != nil {
+		return
+	}
+
+	if err = c.UpdateUserRole(id, role, c.actor(r, current)); err == nil {
+		http.Redirect(w, r, "/admin/users/", http.StatusFound)
+	}
+	return
+}
@@ -0,0 +1,112 @@
+package main
+
+// GetUser gets a User based on its id.
+func (recipeDB *RecipeDB) GetUser(id int) (user *User, err error) {
+	row := recipeDB.DB.QueryRowx("SELECT * FROM users WHERE id=$1", id)
+	user = new(User)
+	err = row.StructScan(user)
+	return
+}
+
+// GetUserByEmail gets a User based on its email address.
+// Emails are compared case-insensitively.
+func (recipeDB *RecipeDB) GetUserByEmail(email string) (user *User, err error) {
+	row := recipeDB.DB.QueryRowx(
+		"SELECT * FROM users WHERE lower(email)=lower($1)", email)
+	user = new(User)
+	err = row.StructScan(user)
+	return
+}
+
+// GetUsers gets every user, ordered by email.
+func (recipeDB *RecipeDB) GetUsers() (users []*User, err error) {
+	err = recipeDB.DB.Select(&users, "SELECT * FROM users ORDER BY email")
+	return
+}
+
+// NewUser inserts a new user into the database. user.Password must
+// already be hashed with HashPassword.
+func (recipeDB *RecipeDB) NewUser(user *User) (newID int, err error) {
+	insert := `INSERT INTO users (email, name, password, role) ` +
+		`VALUES ($1,$2,$3,$4) RETURNING id`
+	err = recipeDB.DB.QueryRowx(insert, user.Email, user.Name,
+		user.Password, user.Role).Scan(&newID)
+	return
+}
+
+// UpdateUserRole changes the role of the user with the given id.
+// The change is recorded in the audit log as made by actor.
+func (recipeDB *RecipeDB) UpdateUserRole(id int, role Role, actor Actor) (err error) {
+	tx, err := recipeDB.DB.Beginx()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var before Role
+	err = tx.QueryRowx("SELECT role FROM users WHERE id=$1 FOR UPDATE", id).
+		Scan(&before)
+	if err != nil {
+		return
+	}
+	if _, err = tx.Exec("UPDATE users SET role=$2 WHERE id=$1", id, role); err != nil {
+		return
+	}
+	err = insertAudit(tx, &AuditEntry{Actor: actor.UserID,
+		ActorName: actor.Name, Action: AuditUserRole, Target: userTarget(id),
+		Before: "role: " + before.String(), After: "role: " + role.String(),
+		IP: actor.IP})
+	if err != nil {
+		return
+	}
+	return tx.Commit()
+}
+
+// GetAPITokens gets every token belonging to a user, newest first.
+func (recipeDB *RecipeDB) GetAPITokens(userID int) (tokens []*APIToken, err error) {
+	err = recipeDB.DB.Select(&tokens,
+		"SELECT * FROM api_tokens WHERE user_id=$1 ORDER BY created DESC", userID)
+	return
+}
+
+// GetAPITokenByHash gets a token based on its hash.
+func (recipeDB *RecipeDB) GetAPITokenByHash(hash string) (token *APIToken, err error) {
+	row := recipeDB.DB.QueryRowx("SELECT * FROM api_tokens WHERE hash=$1", hash)
+	token = new(APIToken)
+	err = row.StructScan(token)
+	return
+}
+
+// NewAPIToken inserts a new token into the database.
+func (recipeDB *RecipeDB) NewAPIToken(token *APIToken) (newID int, err error) {
+	insert := `INSERT INTO api_tokens (user_id, name, scope, hash) ` +
+		`VALUES ($1,$2,$3,$4) RETURNING id`
+	err = recipeDB.DB.QueryRowx(insert, token.UserID, token.Name, token.Scope,
+		token.Hash).Scan(&newID)
+	return
+}
+
+// TouchAPIToken records that a token was just used. To save writes, the
+// timestamp is only updated about once a minute.
+func (recipeDB *RecipeDB) TouchAPIToken(id int) (err error) {
+	update := `UPDATE api_tokens SET last_used=now() WHERE id=$1 AND ` +
+		`(last_used IS NULL OR last_used < now() - interval '1 minute')`
+	_, err = recipeDB.DB.Exec(update, id)
+	return
+}
+
+// DeleteAPIToken revokes one of a user's tokens. It reports whether the
+// user had such a token.
+func (recipeDB *RecipeDB) DeleteAPIToken(id, userID int) (found bool, err error) {
+	result, err := recipeDB.DB.Exec(
+		"DELETE FROM api_tokens WHERE id=$1 AND user_id=$2", id, userID)
+	if err != nil {
+		return
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}